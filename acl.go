@@ -0,0 +1,63 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/acl"
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"fmt"
+)
+
+// Access lists of config parsed, binds and dashboard share them by name
+var acls = make(map[string]*acl.List)
+var aclsMut mutex.Mutex
+
+// Parse access lists of config and use them, binds which use changed lists
+// are opened again by caller
+func loadAcls(cfg *config.Config) error {
+
+	parsed := make(map[string]*acl.List, len(cfg.Acls))
+
+	for name, list := range cfg.Acls {
+		var err error
+
+		if parsed[name], err = acl.Parse(list); err != nil {
+			return fmt.Errorf("failed to parse acl %s: %w", name, err)
+		}
+	}
+
+	aclsMut.Lock()
+	acls = parsed
+	aclsMut.Unlock()
+
+	return nil
+}
+
+// Access list by name, nil allows everything
+func getAcl(name string) *acl.List {
+	if name == "" {
+		return nil
+	}
+
+	aclsMut.Lock()
+	defer aclsMut.Unlock()
+
+	return acls[name]
+}
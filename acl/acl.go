@@ -0,0 +1,156 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package acl allows or denies addresses by CIDR rules
+package acl
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+const ALLOW = "allow"
+const DENY = "deny"
+
+// Rule allows or denies network, single address is a network of its own
+type Rule struct {
+	Action string `json:"action"`
+	Cidr   string `json:"cidr"`
+}
+
+// Rules are checked in order, the first matching one decides.
+// Addresses which match none get the default action, allow when it is empty.
+type Config struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Parsed rules of config
+type List struct {
+	allowByDefault bool
+	rules          []rule
+}
+
+type rule struct {
+	allow   bool
+	network *net.IPNet
+}
+
+func parseAction(action string) (bool, error) {
+	switch action {
+	case ALLOW:
+		return true, nil
+	case DENY:
+		return false, nil
+	}
+
+	return false, errors.New("invalid acl action " + action + " (should be allow or deny)")
+}
+
+func parseNetwork(cidr string) (*net.IPNet, error) {
+
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, errors.New("invalid acl address " + cidr)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.New("invalid acl CIDR " + cidr)
+	}
+
+	return network, nil
+}
+
+func Parse(config Config) (*List, error) {
+
+	list := &List{allowByDefault: true}
+
+	if config.Default != "" {
+		allow, err := parseAction(config.Default)
+		if err != nil {
+			return nil, err
+		}
+		list.allowByDefault = allow
+	}
+
+	for _, r := range config.Rules {
+
+		allow, err := parseAction(r.Action)
+		if err != nil {
+			return nil, err
+		}
+
+		network, err := parseNetwork(r.Cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		list.rules = append(list.rules, rule{allow: allow, network: network})
+	}
+
+	return list, nil
+}
+
+// Address is allowed, nil list allows everything
+func (l *List) Allows(ip net.IP) bool {
+
+	if l == nil {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, r := range l.rules {
+		if r.network.Contains(ip) {
+			return r.allow
+		}
+	}
+
+	return l.allowByDefault
+}
+
+// Address of connection is allowed, addr is host:port or a bare host
+func (l *List) AllowsAddr(addr string) bool {
+
+	if l == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	// Zone of IPv6 link local address isn't part of it
+	host, _, _ = strings.Cut(host, "%")
+
+	return l.Allows(net.ParseIP(host))
+}
@@ -0,0 +1,167 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{"empty", Config{}, ""},
+		{"default deny", Config{Default: DENY}, ""},
+		{"invalid default", Config{Default: "block"}, "invalid acl action block"},
+		{"ipv4 address", Config{Rules: []Rule{{ALLOW, "10.0.0.1"}}}, ""},
+		{"ipv6 address", Config{Rules: []Rule{{ALLOW, "2001:db8::1"}}}, ""},
+		{"ipv4 cidr", Config{Rules: []Rule{{ALLOW, "10.0.0.0/8"}}}, ""},
+		{"ipv6 cidr", Config{Rules: []Rule{{DENY, "2001:db8::/32"}}}, ""},
+		{"invalid action", Config{Rules: []Rule{{"permit", "10.0.0.1"}}}, "invalid acl action permit"},
+		{"invalid address", Config{Rules: []Rule{{ALLOW, "10.0.0.256"}}}, "invalid acl address"},
+		{"hostname", Config{Rules: []Rule{{ALLOW, "pool.example.com"}}}, "invalid acl address"},
+		{"invalid ipv4 prefix", Config{Rules: []Rule{{ALLOW, "10.0.0.0/33"}}}, "invalid acl CIDR"},
+		{"invalid ipv6 prefix", Config{Rules: []Rule{{ALLOW, "2001:db8::/129"}}}, "invalid acl CIDR"},
+		{"empty cidr", Config{Rules: []Rule{{ALLOW, ""}}}, "invalid acl address"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.config)
+
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error is %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+
+	config := Config{
+		Default: DENY,
+		Rules: []Rule{
+			{DENY, "10.0.0.13"},
+			{ALLOW, "10.0.0.0/8"},
+			{ALLOW, "192.168.1.7"},
+			{DENY, "2001:db8:bad::/48"},
+			{ALLOW, "2001:db8::/32"},
+			{ALLOW, "fe80::1"},
+		},
+	}
+
+	list, err := Parse(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"10.0.0.13", false},
+		{"10.0.0.14", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:192.168.1.7", true},
+		{"2001:db8::1", true},
+		{"2001:db8:bad::1", false},
+		{"2001:db9::1", false},
+		{"fe80::1", true},
+		{"fe80::2", false},
+		{"::1", false},
+	}
+
+	for _, test := range tests {
+		if list.Allows(net.ParseIP(test.ip)) != test.allowed {
+			t.Errorf("%s: allowed is %v", test.ip, !test.allowed)
+		}
+	}
+}
+
+func TestAllowsDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    *List
+		ip      net.IP
+		allowed bool
+	}{
+		{"nil list", nil, net.ParseIP("10.0.0.1"), true},
+		{"nil list without address", nil, nil, true},
+		{"allow by default", mustParse(t, Config{}), net.ParseIP("10.0.0.1"), true},
+		{"deny by default", mustParse(t, Config{Default: DENY}), net.ParseIP("10.0.0.1"), false},
+		{"no address", mustParse(t, Config{}), nil, false},
+	}
+
+	for _, test := range tests {
+		if test.list.Allows(test.ip) != test.allowed {
+			t.Errorf("%s: allowed is %v", test.name, !test.allowed)
+		}
+	}
+}
+
+func TestAllowsAddr(t *testing.T) {
+
+	list := mustParse(t, Config{
+		Default: DENY,
+		Rules: []Rule{
+			{ALLOW, "10.0.0.0/8"},
+			{ALLOW, "2001:db8::/32"},
+			{ALLOW, "fe80::/10"},
+		},
+	})
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.0.0.1:3333", true},
+		{"10.0.0.1", true},
+		{"11.0.0.1:3333", false},
+		{"[2001:db8::1]:3333", true},
+		{"2001:db8::1", true},
+		{"[2001:db9::1]:3333", false},
+		{"[fe80::1%eth0]:3333", true},
+		{"fe80::1%eth0", true},
+		{"pool.example.com:3333", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if list.AllowsAddr(test.addr) != test.allowed {
+			t.Errorf("%s: allowed is %v", test.addr, !test.allowed)
+		}
+	}
+}
+
+func mustParse(t *testing.T, config Config) *List {
+	list, err := Parse(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
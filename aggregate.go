@@ -0,0 +1,393 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stratum/rpc"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Aggregation mode lets many miners share one pool session.
+// Proxy subscribes and authorizes to the pool by itself, then every miner gets
+// extranonce1 of the pool followed by its own prefix taken from extranonce2.
+// Submits are rewritten back into the extranonce space of the pool.
+
+// Number of miners which can share one upstream
+func aggregateCapacity() uint64 {
+
+	size := config.Get().Aggregate.ExtraNonceSize
+
+	// Prefix of 8 bytes has more slots than miners can ever connect, shift would overflow
+	if size >= 8 {
+		return math.MaxUint64
+	}
+
+	return uint64(1) << (8 * size)
+}
+
+// Find shared upstream of pool which still has free extranonce prefix
+func findSharedUpstream(poolIndex uint64) *Upstream {
+
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	for _, us := range Upstreams {
+
+		if !us.Aggregated || us.Primary != poolIndex {
+			continue
+		}
+
+		us.mutex.Lock()
+		isFull := uint64(len(us.slots)) >= aggregateCapacity()
+		us.mutex.Unlock()
+
+		if !isFull {
+			return us
+		}
+	}
+
+	return nil
+}
+
+// Open new shared upstream, proxy subscribes and authorizes on behalf of miners
+func newSharedUpstream(poolIndex uint64) (*Upstream, error) {
+
+	us, err := newUpstream(poolIndex, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = us.subscribe()
+
+	if err != nil {
+		CloseUpstream(us.ID)
+		return nil, err
+	}
+
+	return us, nil
+}
+
+// Give miner a free extranonce prefix of upstream
+func (us *Upstream) attach(conn *stratumserver.Connection) bool {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	return us.attachLocked(conn)
+}
+
+// Give miner a free extranonce prefix of upstream, upstream must be locked
+func (us *Upstream) attachLocked(conn *stratumserver.Connection) bool {
+
+	for slot := uint64(0); slot < aggregateCapacity(); slot++ {
+
+		if _, used := us.slots[slot]; used {
+			continue
+		}
+
+		us.slots[slot] = conn.Id
+		us.servers[conn.Id] = conn
+
+		conn.ExtraNoncePrefix = fmt.Sprintf("%0*x", config.Get().Aggregate.ExtraNonceSize*2, slot)
+		conn.ExtraNonce1 = us.ExtraNonce1 + conn.ExtraNoncePrefix
+		conn.ExtraNonce2Size = us.ExtraNonce2Size - config.Get().Aggregate.ExtraNonceSize
+		conn.Upstream = us.ID
+		conn.PoolId = us.PoolId
+
+		return true
+	}
+
+	return false
+}
+
+// Shared upstream of pool which is ready for miners, new upstream is opened when all are full
+func readySharedUpstream(poolIndex uint64) (*Upstream, error) {
+
+	us := findSharedUpstream(poolIndex)
+
+	if us == nil {
+		var err error
+		us, err = newSharedUpstream(poolIndex)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case <-us.ready:
+	case <-time.After(config.UPSTREAM_READY_TIMEOUT_SECONDS * time.Second):
+		return nil, errors.New("timeout while waiting shared upstream")
+	}
+
+	if us.readyErr != nil {
+		return nil, us.readyErr
+	}
+
+	return us, nil
+}
+
+// Attach miner to shared upstream of its pool, new upstream is opened when all are full
+func attachAggregated(conn *stratumserver.Connection) error {
+
+	poolIndex := minerPool(conn)
+
+	for {
+		us, err := readySharedUpstream(poolIndex)
+
+		if err != nil {
+			return err
+		}
+
+		if us.attach(conn) {
+			venuslog.Warn("Miner attached to shared upstream", us.ID, conn.ExtraNoncePrefix)
+			makeReport()
+			return nil
+		}
+	}
+}
+
+// Answer mining.subscribe of miner with extranonce of shared upstream
+func SubscribeAggregated(conn *stratumserver.Connection, data []byte) {
+
+	req := template.StratumMsg{}
+	errJson := rpc.ReadJSON(&req, data)
+
+	if errJson != nil {
+		venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
+		return
+	}
+
+	if conn.Upstream == 0 {
+		err := attachAggregated(conn)
+
+		if err != nil {
+			venuslog.Warn("Error while attaching miner to shared upstream:", err)
+			conn.Send(template.StratumMsgResponse{
+				ID:    req.ID,
+				Error: template.NewError(20, "Pool is not available"),
+			})
+			conn.Close()
+			return
+		}
+	}
+
+	subscriptionId := fmt.Sprintf("%016x", conn.Id)
+
+	err := conn.Send(template.StratumMsgResponse{
+		ID: req.ID,
+		Result: []any{
+			[][]string{
+				{"mining.set_difficulty", subscriptionId},
+				{"mining.notify", subscriptionId},
+			},
+			conn.ExtraNonce1,
+			conn.ExtraNonce2Size,
+		},
+	})
+
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+	}
+}
+
+// Answer mining.authorize of miner, pool is already authorized by proxy
+func AuthorizeAggregated(conn *stratumserver.Connection, data []byte) {
+
+	authorizemsg := template.AuthorizeMsg{}
+	errJson := rpc.ReadJSON(&authorizemsg, data)
+
+	if errJson != nil || len(authorizemsg.Params) == 0 {
+		venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
+		return
+	}
+
+	us := getUpstream(conn.Upstream)
+
+	if us == nil {
+		conn.Send(template.StratumMsgResponse{
+			ID:    authorizemsg.ID,
+			Error: template.NewError(25, "Not subscribed"),
+		})
+		return
+	}
+
+	password := ""
+	if len(authorizemsg.Params) > 1 {
+		password = authorizemsg.Params[1]
+	}
+
+	conn.WorkerID = authorizemsg.Params[0]
+
+	if err := checkAuthorize(conn, conn.WorkerID, password); err != nil {
+		refuseAuthorize(conn, authorizemsg.ID, conn.WorkerID, err)
+		return
+	}
+
+	err := conn.Send(template.StratumMsgResponse{
+		ID:     authorizemsg.ID,
+		Result: true,
+	})
+
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+		return
+	}
+
+	us.authorizeWorker(conn)
+
+	// Give the latest work of pool to miner, later work comes by broadcasting
+	us.mutex.Lock()
+
+	conn.Authorized = true
+
+	difficulty := 0.0
+	lastDifficulty := us.lastDifficulty
+	lastNotify := us.lastNotify
+
+	if config.Get().Vardiff.Enabled {
+		difficulty = us.startVardiff(conn)
+		lastDifficulty = nil
+	} else {
+		conn.Difficulty = us.Difficulty
+	}
+
+	us.mutex.Unlock()
+
+	if difficulty > 0 {
+		sendDifficulty(conn, difficulty)
+	}
+
+	if lastDifficulty != nil {
+		conn.SendBytes(lastDifficulty)
+	}
+
+	if lastNotify != nil {
+		conn.SendBytes(lastNotify)
+	}
+}
+
+// Answer request of miner to shared upstream, session with pool belongs to proxy,
+// so standard methods are answered by proxy itself
+func forwardAggregated(us *Upstream, conn *stratumserver.Connection, req template.StratumMsg, data []byte) error {
+
+	switch req.Method {
+	case "mining.extranonce.subscribe":
+
+		conn.ExtranonceSubscribed = true
+
+		return conn.Send(template.StratumMsgResponse{
+			ID:     req.ID,
+			Result: true,
+		})
+
+	case "mining.configure":
+
+		SendConfigure(conn, data)
+		return nil
+
+	case "mining.suggest_difficulty", "mining.suggest_target":
+
+		// Difficulty of shared session is set by pool, vardiff gives miners their own
+		return conn.Send(template.StratumMsgResponse{
+			ID:     req.ID,
+			Result: true,
+		})
+
+	default:
+
+		return conn.Send(template.StratumMsgResponse{
+			ID:    req.ID,
+			Error: template.NewError(20, "Method not supported by proxy"),
+		})
+	}
+}
+
+// Handle msg which pool sent to shared upstream
+func handleAggregatedNotification(us *Upstream, req template.StratumMsg, msg []byte) {
+
+	switch req.Method {
+	case "mining.set_extranonce":
+
+		extranoncemsg := template.NotifyMsg{}
+		errJson := rpc.ReadJSON(&extranoncemsg, msg)
+
+		if errJson != nil || len(extranoncemsg.Params) < 2 {
+			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+			return
+		}
+
+		extraNonce1, ok1 := extranoncemsg.Params[0].(string)
+		extraNonce2Size, ok2 := extranoncemsg.Params[1].(float64)
+
+		if !ok1 || !ok2 || us.updateExtranonce(extraNonce1, int(extraNonce2Size)) != nil {
+			venuslog.Warn("Pool sent extranonce which can't be shared, closing upstream", us.ID)
+			CloseUpstream(us.ID)
+			return
+		}
+
+	case "client.reconnect":
+
+		venuslog.Warn("Pool asked reconnecting, closing shared upstream", us.ID)
+		CloseUpstream(us.ID)
+
+	case "client.get_version":
+
+		data, _ := json.Marshal(template.StratumMsgResponse{
+			ID:     req.ID,
+			Result: config.USERAGENT,
+		})
+		us.poolClient().SendData(data)
+
+	default:
+
+		// Request of pool is answered by the first miner which answers it
+		if req.ID != 0 {
+			us.mutex.Lock()
+			us.poolRequests[req.ID] = true
+			us.mutex.Unlock()
+		}
+
+		us.broadcast(msg)
+	}
+}
+
+// Forward response of miner to request of pool, the other miners' responses are dropped
+func forwardAggregatedResponse(us *Upstream, req template.StratumMsg, data []byte) error {
+
+	us.mutex.Lock()
+	isWaiting := us.poolRequests[req.ID]
+	delete(us.poolRequests, req.ID)
+	us.mutex.Unlock()
+
+	if !isWaiting {
+		return nil
+	}
+
+	return us.poolClient().SendData(data)
+}
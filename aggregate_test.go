@@ -0,0 +1,270 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"encoding/json"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Shared upstream with extranonce2 of 8 bytes, its first miner is attached and authorized
+func aggregatedUpstream(t *testing.T, extraNonceSize int) (*Upstream, *stratumserver.Connection, chan string, chan string) {
+
+	us, conn, pool, miner := shareUpstream(t, false)
+
+	config.Update(func(cfg *config.Config) {
+		cfg.ValidateShares = false
+		cfg.Aggregate.Enabled = true
+		cfg.Aggregate.ExtraNonceSize = extraNonceSize
+	})
+
+	us.Aggregated = true
+	us.slots = make(map[uint64]uint64)
+	us.poolRequests = make(map[uint64]bool)
+	us.servers = make(map[uint64]*stratumserver.Connection)
+	us.ExtraNonce1 = "aabbccdd"
+	us.ExtraNonce2Size = 8
+
+	if !us.attach(conn) {
+		t.Fatal("miner wasn't attached")
+	}
+	conn.Authorized = true
+
+	return us, conn, pool, miner
+}
+
+// Another miner attached to shared upstream, and its end of pipe
+func attachMiner(t *testing.T, us *Upstream, id uint64) (*stratumserver.Connection, chan string) {
+
+	miner, minerEnd := net.Pipe()
+	t.Cleanup(func() { miner.Close() })
+
+	conn := &stratumserver.Connection{
+		Conn:    &sv2PipeConn{Conn: miner, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}},
+		Id:      id,
+		Rejects: make(map[string]uint64),
+	}
+
+	if !us.attach(conn) {
+		t.Fatalf("miner %d wasn't attached", id)
+	}
+	conn.Authorized = true
+
+	return conn, pipeLines(minerEnd)
+}
+
+func TestAggregateCapacity(t *testing.T) {
+
+	cfg := config.Get()
+	t.Cleanup(func() { config.Set(cfg) })
+
+	tests := []struct {
+		size     int
+		capacity uint64
+	}{
+		{1, 256},
+		{2, 65536},
+		{4, 1 << 32},
+		{7, 1 << 56},
+		{8, math.MaxUint64},
+		{16, math.MaxUint64},
+	}
+
+	for _, test := range tests {
+
+		next := &config.Config{}
+		next.Aggregate.ExtraNonceSize = test.size
+		config.Set(next)
+
+		if capacity := aggregateCapacity(); capacity != test.capacity {
+			t.Errorf("capacity of %d bytes is %d, expected %d", test.size, capacity, test.capacity)
+		}
+	}
+}
+
+// Upstream is full when every prefix is taken, prefix of detached miner is given again
+func TestAttachFull(t *testing.T) {
+
+	us, _, _, _ := aggregatedUpstream(t, 1)
+
+	for id := uint64(2); id <= 256; id++ {
+		if !us.attachLocked(&stratumserver.Connection{Id: id}) {
+			t.Fatalf("miner %d wasn't attached", id)
+		}
+	}
+
+	if us.attach(&stratumserver.Connection{Id: 257}) {
+		t.Fatal("miner attached to full upstream")
+	}
+
+	delete(us.slots, 7)
+
+	conn := &stratumserver.Connection{Id: 258}
+	if !us.attach(conn) || conn.ExtraNoncePrefix != "07" {
+		t.Fatalf("miner got prefix %q after one was freed, expected 07", conn.ExtraNoncePrefix)
+	}
+}
+
+// Miners get extranonce1 of pool with their own prefix, shares are sent in extranonce space of pool
+func TestAggregateSplitExtranonce(t *testing.T) {
+
+	tests := []struct {
+		size        int
+		extraNonce1 string
+		extraNonce2 string
+		submitted   string
+	}{
+		{1, "aabbccdd01", "11223344556677", "0111223344556677"},
+		{2, "aabbccdd0001", "112233445566", "0001112233445566"},
+		{4, "aabbccdd00000001", "11223344", "0000000111223344"},
+	}
+
+	for _, test := range tests {
+
+		us, _, pool, _ := aggregatedUpstream(t, test.size)
+		conn, miner := attachMiner(t, us, 2)
+
+		if conn.ExtraNonce1 != test.extraNonce1 || conn.ExtraNonce2Size != 8-test.size {
+			t.Fatalf("prefix of %d bytes: miner got extranonce1 %s with extranonce2 of %d bytes", test.size, conn.ExtraNonce1, conn.ExtraNonce2Size)
+		}
+
+		params := []string{"rig2", "1f", test.extraNonce2, "504e86b9", "00000000"}
+
+		submit, code := submitShare(t, us, conn, pool, miner, params)
+
+		request := template.SubmitMsg{}
+		json.Unmarshal([]byte(submit), &request)
+
+		if code != 0 || len(request.Params) < 3 || request.Params[2] != test.submitted {
+			t.Fatalf("prefix of %d bytes: pool got %s, expected extranonce2 %s", test.size, submit, test.submitted)
+		}
+	}
+}
+
+// Proxy answers standard methods of miners of shared upstream itself
+func TestForwardAggregated(t *testing.T) {
+
+	tests := []struct {
+		method string
+		params string
+		result string
+		code   int
+	}{
+		{"mining.extranonce.subscribe", `[]`, `true`, 0},
+		{"mining.suggest_difficulty", `[1024]`, `true`, 0},
+		{"mining.suggest_target", `["00000000ffff0000000000000000000000000000000000000000000000000000"]`, `true`, 0},
+		{"mining.configure", `[["version-rolling"], {"version-rolling.mask": "ffffffff"}]`, `{"version-rolling":true,"version-rolling.mask":"1fffe000"}`, 0},
+		{"mining.get_transactions", `["1f"]`, `null`, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+
+			us, conn, pool, miner := aggregatedUpstream(t, 1)
+
+			us.ID = 1000
+			us.VersionMask = 0x1fffe000
+			us.configured = make(chan struct{})
+			close(us.configured)
+			conn.Upstream = us.ID
+
+			UpstreamsMut.Lock()
+			Upstreams[us.ID] = us
+			UpstreamsMut.Unlock()
+			t.Cleanup(func() {
+				UpstreamsMut.Lock()
+				delete(Upstreams, us.ID)
+				UpstreamsMut.Unlock()
+			})
+
+			go us.forward(conn, []byte(`{"id":3,"method":"`+test.method+`","params":`+test.params+`}`))
+
+			select {
+			case line := <-miner:
+				resp := struct {
+					ID     uint64          `json:"id"`
+					Result json.RawMessage `json:"result"`
+					Error  any             `json:"error"`
+				}{}
+				json.Unmarshal([]byte(line), &resp)
+				code, _ := template.ParseError(resp.Error)
+
+				if resp.ID != 3 || string(resp.Result) != test.result || code != test.code {
+					t.Fatalf("miner got %s", line)
+				}
+
+			case line := <-pool:
+				t.Fatalf("pool got %s", line)
+
+			case <-time.After(5 * time.Second):
+				t.Fatal("miner didn't get answer")
+			}
+		})
+	}
+}
+
+// Request of pool goes to every miner, the first answer goes back to pool
+func TestAggregatedPoolRequest(t *testing.T) {
+
+	us, conn, pool, miner := aggregatedUpstream(t, 1)
+	second, secondMiner := attachMiner(t, us, 2)
+
+	request := []byte(`{"id":5,"method":"client.show_message","params":["maintenance"]}`)
+	handleAggregatedNotification(us, template.StratumMsg{ID: 5, Method: "client.show_message"}, request)
+
+	for _, lines := range []chan string{miner, secondMiner} {
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, "maintenance") {
+				t.Fatalf("miner got %s", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("miner didn't get request of pool")
+		}
+	}
+
+	// Both miners answer, then one answers request which pool didn't send
+	go func() {
+		us.forward(conn, []byte(`{"id":5,"result":true,"error":null}`))
+		us.forward(second, []byte(`{"id":5,"result":true,"error":null}`))
+		us.forward(second, []byte(`{"id":6,"result":true,"error":null}`))
+	}()
+
+	select {
+	case line := <-pool:
+		if !strings.Contains(line, `"id":5`) {
+			t.Fatalf("pool got %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("answer of miner didn't reach pool")
+	}
+
+	select {
+	case line := <-pool:
+		t.Fatalf("pool got another answer %s", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
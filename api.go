@@ -0,0 +1,687 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/acl"
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	"btcminerproxy/openapi"
+	"btcminerproxy/routing"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Management API. Handlers are registered with types of their request and response
+// bodies, OpenAPI document of API is made from them. Changes of config are validated
+// and applied like reloaded config, then saved as a revision.
+
+const API_PREFIX = "/api/v1"
+
+// Error of request, it is sent as {"error": {...}} with its HTTP status
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, args ...any) error {
+	return &apiError{Status: http.StatusBadRequest, Code: "invalid_request", Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return &apiError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...any) error {
+	return &apiError{Status: http.StatusConflict, Code: "conflict", Message: fmt.Sprintf(format, args...)}
+}
+
+func apiFail(c *gin.Context, err error) {
+
+	var failure *apiError
+	if !errors.As(err, &failure) {
+		failure = &apiError{Status: http.StatusInternalServerError, Code: "internal", Message: err.Error()}
+
+		if errors.Is(err, errInvalidConfig) {
+			failure = &apiError{Status: http.StatusBadRequest, Code: "invalid_config", Message: err.Error()}
+		}
+	}
+
+	c.AbortWithStatusJSON(failure.Status, gin.H{
+		"error": failure,
+	})
+}
+
+func apiOk(c *gin.Context, status int, data any) {
+	c.JSON(status, gin.H{
+		"data": data,
+	})
+}
+
+// Decode JSON body, unknown fields are refused so misspelled ones aren't ignored
+func bindBody(c *gin.Context, body any) error {
+
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(body); err != nil {
+		return badRequest("invalid body: %s", err)
+	}
+
+	return nil
+}
+
+// Decode JSON body onto value, fields which body doesn't have keep their values
+func mergeBody(data []byte, body any) error {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(body); err != nil {
+		return badRequest("invalid body: %s", err)
+	}
+
+	return nil
+}
+
+type poolResponse struct {
+	Index   int  `json:"index"`
+	Current bool `json:"current"`
+	config.PoolInfo
+}
+
+type minerRequest struct {
+	PoolUrl string `json:"pool_url"`
+}
+
+type minerResponse struct {
+	IP      string `json:"ip"`
+	PoolUrl string `json:"pool_url"`
+
+	// pool which miner goes back to after its schedule
+	ReturnPoolUrl string `json:"return_pool_url,omitempty"`
+
+	Connections int `json:"connections"`
+}
+
+type routesBody struct {
+	Rules  []routing.Rule      `json:"rules"`
+	Groups map[string][]string `json:"groups"`
+}
+
+type banRequest struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+
+	// seconds, duration of config when it is zero
+	Duration uint32 `json:"duration"`
+}
+
+func (r *banRequest) Validate() error {
+
+	if net.ParseIP(r.IP) == nil {
+		return badRequest("invalid ip %q", r.IP)
+	}
+
+	if r.Duration == 0 && config.Get().Bans.Duration == 0 {
+		return badRequest("duration is required, config has none")
+	}
+
+	return nil
+}
+
+type api struct {
+	router *gin.RouterGroup
+	doc    *openapi.Document
+}
+
+// Register handler of operation which needs role and describe it, request and response
+// are values of types of their bodies or nil
+func (a *api) handle(method string, path string, role string, summary string, status int, request any, response any, handler gin.HandlerFunc) {
+	a.router.Handle(method, path, handler)
+	routeRoles[method+" "+API_PREFIX+path] = role
+
+	op := a.doc.Add(method, API_PREFIX+path, summary, status, request, response)
+	op.Role = role
+}
+
+func registerApi(r *gin.Engine) {
+
+	a := &api{
+		router: r.Group(API_PREFIX),
+		doc:    openapi.New("BtcMinerProxy", config.VERSION.ToString(), apiError{}),
+	}
+
+	a.doc.AddSecurity("basic", "basic")
+	a.doc.AddSecurity("token", "bearer")
+
+	a.poolRoutes()
+	a.minerRoutes()
+	a.routingRoutes()
+	a.aclRoutes()
+	a.banRoutes()
+
+	a.handle("GET", "/openapi.json", auth.VIEWER, "OpenAPI document of API", http.StatusOK, nil, nil, func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.doc)
+	})
+
+	// Other paths keep plain 404 of dashboard
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, API_PREFIX+"/") {
+			apiFail(c, notFound("%s %s is not found", c.Request.Method, c.Request.URL.Path))
+		}
+	})
+}
+
+// Pools with their index, pool index of config is the current one
+func listPools(withSecrets bool) []poolResponse {
+
+	configured := config.Get().Pools
+	if !withSecrets {
+		configured = redactedPools(configured)
+	}
+
+	pools := make([]poolResponse, 0, len(configured))
+	for idx, pool := range configured {
+		pools = append(pools, poolResponse{
+			Index:    idx,
+			Current:  uint64(idx) == config.Get().PoolIndex,
+			PoolInfo: pool,
+		})
+	}
+
+	return pools
+}
+
+// Add pool to config, returns its index
+func addPool(cfg *config.Config, pool config.PoolInfo) (int, error) {
+
+	if findPool(cfg.Pools, pool.Url) >= 0 {
+		return -1, conflict("pool %s exists", pool.Url)
+	}
+
+	cfg.Pools = append(cfg.Pools, pool)
+
+	return len(cfg.Pools) - 1, nil
+}
+
+// Remove pool from config, miners assigned to it get a pool again when they connect
+func removePool(cfg *config.Config, url string) (config.PoolInfo, error) {
+
+	index := findPool(cfg.Pools, url)
+	if index < 0 {
+		return config.PoolInfo{}, notFound("pool %s is not found", url)
+	}
+
+	deleted := cfg.Pools[index]
+	cfg.Pools = append(cfg.Pools[:index], cfg.Pools[index+1:]...)
+
+	if cfg.PoolIndex == uint64(index) {
+		cfg.PoolIndex = 0
+	} else if cfg.PoolIndex > uint64(index) {
+		cfg.PoolIndex--
+	}
+
+	miners := make([]config.MinerInfo, 0, len(cfg.Miners))
+	for _, miner := range cfg.Miners {
+		if miner.PoolUrl != url {
+			miners = append(miners, miner)
+		}
+	}
+	cfg.Miners = miners
+
+	return deleted, nil
+}
+
+func findPool(pools []config.PoolInfo, url string) int {
+	for idx, pool := range pools {
+		if pool.Url == url {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+func (a *api) poolRoutes() {
+
+	a.handle("GET", "/pools", auth.VIEWER, "List pools, passwords are redacted for users which aren't admin", http.StatusOK, nil, []poolResponse{}, func(c *gin.Context) {
+		apiOk(c, http.StatusOK, listPools(isAdmin(c)))
+	})
+
+	a.handle("GET", "/pools/:url", auth.VIEWER, "Get pool", http.StatusOK, nil, poolResponse{}, func(c *gin.Context) {
+
+		for _, pool := range listPools(isAdmin(c)) {
+			if pool.Url == c.Param("url") {
+				apiOk(c, http.StatusOK, pool)
+				return
+			}
+		}
+
+		apiFail(c, notFound("pool %s is not found", c.Param("url")))
+	})
+
+	a.handle("POST", "/pools", auth.ADMIN, "Add pool", http.StatusCreated, config.PoolInfo{}, poolResponse{}, func(c *gin.Context) {
+
+		pool := config.PoolInfo{}
+		if err := bindBody(c, &pool); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		index := -1
+		err := changeConfig(changedBy(c), "added pool "+pool.Url, func(cfg *config.Config) (err error) {
+			index, err = addPool(cfg, pool)
+			return err
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusCreated, poolResponse{Index: index, PoolInfo: pool})
+	})
+
+	a.handle("PUT", "/pools/:url", auth.ADMIN, "Change fields of pool which body has, miners on it connect again when its connection changes", http.StatusOK, config.PoolInfo{}, poolResponse{}, func(c *gin.Context) {
+
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			apiFail(c, badRequest("invalid body: %s", err))
+			return
+		}
+
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(data, &fields); err != nil {
+			apiFail(c, badRequest("invalid body: %s", err))
+			return
+		}
+
+		url := c.Param("url")
+		index := -1
+		var pool config.PoolInfo
+
+		err = changeConfig(changedBy(c), "changed pool "+url, func(cfg *config.Config) error {
+
+			if index = findPool(cfg.Pools, url); index < 0 {
+				return notFound("pool %s is not found", url)
+			}
+
+			// Workers of body replace the old ones, map of running config isn't changed
+			pool = cfg.Pools[index]
+			if _, ok := fields["workers"]; ok {
+				pool.Workers = nil
+			}
+
+			if err := mergeBody(data, &pool); err != nil {
+				return err
+			}
+
+			if pool.Url != url {
+				return badRequest("url of pool can't be changed, add a new pool instead")
+			}
+
+			cfg.Pools[index] = pool
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, poolResponse{Index: index, Current: uint64(index) == config.Get().PoolIndex, PoolInfo: pool})
+	})
+
+	a.handle("DELETE", "/pools/:url", auth.ADMIN, "Delete pool, its miners connect again", http.StatusOK, nil, config.PoolInfo{}, func(c *gin.Context) {
+
+		url := c.Param("url")
+		var deleted config.PoolInfo
+
+		err := changeConfig(changedBy(c), "deleted pool "+url, func(cfg *config.Config) (err error) {
+			deleted, err = removePool(cfg, url)
+			return err
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, deleted)
+	})
+}
+
+// Miners by IP with pools assigned to them and their connections
+func listMiners() []minerResponse {
+
+	srv.ConnsMut.Lock()
+	connections := make(map[string]int, len(srv.Connections))
+	for _, conn := range srv.Connections {
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		connections[ip]++
+	}
+	srv.ConnsMut.Unlock()
+
+	minersMut.Lock()
+	defer minersMut.Unlock()
+
+	miners := make([]minerResponse, 0, len(config.Get().Miners))
+	for _, miner := range config.Get().Miners {
+		miners = append(miners, minerResponse{
+			IP:            miner.IP,
+			PoolUrl:       miner.PoolUrl,
+			ReturnPoolUrl: scheduledMiners[miner.IP],
+			Connections:   connections[miner.IP],
+		})
+	}
+
+	return miners
+}
+
+func (a *api) minerRoutes() {
+
+	a.handle("GET", "/miners", auth.VIEWER, "List miners by IP with their pools", http.StatusOK, nil, []minerResponse{}, func(c *gin.Context) {
+		apiOk(c, http.StatusOK, listMiners())
+	})
+
+	a.handle("PUT", "/miners/:ip", auth.ADMIN, "Assign miners of IP to pool, connected ones are switched to it", http.StatusOK, minerRequest{}, minerResponse{}, func(c *gin.Context) {
+
+		request := minerRequest{}
+		if err := bindBody(c, &request); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		miner := config.MinerInfo{IP: c.Param("ip"), PoolUrl: request.PoolUrl}
+
+		err := changeConfig(changedBy(c), "set pool of miner "+miner.IP+" to "+miner.PoolUrl, func(cfg *config.Config) error {
+
+			if net.ParseIP(miner.IP) == nil {
+				return badRequest("invalid ip %q", miner.IP)
+			}
+
+			if findPool(cfg.Pools, miner.PoolUrl) < 0 {
+				return badRequest("pool %s is not found", miner.PoolUrl)
+			}
+
+			for idx := range cfg.Miners {
+				if cfg.Miners[idx].IP == miner.IP {
+					cfg.Miners[idx].PoolUrl = miner.PoolUrl
+					return nil
+				}
+			}
+
+			cfg.Miners = append(cfg.Miners, miner)
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		for _, listed := range listMiners() {
+			if listed.IP == miner.IP {
+				apiOk(c, http.StatusOK, listed)
+				return
+			}
+		}
+
+		apiFail(c, notFound("miner %s is not found", miner.IP))
+	})
+
+	a.handle("DELETE", "/miners/:ip", auth.ADMIN, "Forget pool of miners of IP and disconnect them", http.StatusOK, nil, minerResponse{}, func(c *gin.Context) {
+
+		ip := c.Param("ip")
+		var deleted config.MinerInfo
+
+		err := changeConfig(changedBy(c), "deleted miner "+ip, func(cfg *config.Config) error {
+			for idx, miner := range cfg.Miners {
+				if miner.IP == ip {
+					deleted = miner
+					cfg.Miners = append(cfg.Miners[:idx], cfg.Miners[idx+1:]...)
+					return nil
+				}
+			}
+
+			return notFound("miner %s is not found", ip)
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		disconnectMiner(ip)
+
+		apiOk(c, http.StatusOK, minerResponse{IP: deleted.IP, PoolUrl: deleted.PoolUrl})
+	})
+}
+
+func (a *api) routingRoutes() {
+
+	a.handle("GET", "/routes", auth.VIEWER, "List routing rules and pool groups", http.StatusOK, nil, routesBody{}, func(c *gin.Context) {
+		rules, groups := getRoutes()
+		apiOk(c, http.StatusOK, routesBody{Rules: rules, Groups: groups})
+	})
+
+	a.handle("PUT", "/routes", auth.ADMIN, "Replace routing rules and pool groups", http.StatusOK, routesBody{}, routesBody{}, func(c *gin.Context) {
+
+		body := routesBody{}
+		if err := bindBody(c, &body); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		err := changeConfig(changedBy(c), fmt.Sprintf("set %d routing rules", len(body.Rules)), func(cfg *config.Config) error {
+			cfg.Routes = body.Rules
+			cfg.PoolGroups = body.Groups
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, body)
+	})
+
+	a.handle("POST", "/routes", auth.ADMIN, "Add routing rule after the others", http.StatusCreated, routing.Rule{}, routing.Rule{}, func(c *gin.Context) {
+
+		rule := routing.Rule{}
+		if err := bindBody(c, &rule); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		err := changeConfig(changedBy(c), "added routing rule "+rule.Name, func(cfg *config.Config) error {
+			for _, existing := range cfg.Routes {
+				if existing.Name == rule.Name {
+					return conflict("routing rule %s exists", rule.Name)
+				}
+			}
+
+			cfg.Routes = append(cfg.Routes, rule)
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusCreated, rule)
+	})
+
+	a.handle("DELETE", "/routes/:name", auth.ADMIN, "Delete routing rule", http.StatusOK, nil, routing.Rule{}, func(c *gin.Context) {
+
+		name := c.Param("name")
+		var deleted routing.Rule
+
+		err := changeConfig(changedBy(c), "deleted routing rule "+name, func(cfg *config.Config) error {
+			for idx, rule := range cfg.Routes {
+				if rule.Name == name {
+					deleted = rule
+					cfg.Routes = append(cfg.Routes[:idx], cfg.Routes[idx+1:]...)
+					return nil
+				}
+			}
+
+			return notFound("routing rule %s is not found", name)
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, deleted)
+	})
+}
+
+func (a *api) aclRoutes() {
+
+	a.handle("GET", "/acls", auth.VIEWER, "List access lists by name", http.StatusOK, nil, map[string]acl.Config{}, func(c *gin.Context) {
+
+		configMut.Lock()
+		acls := config.Get().Acls
+		configMut.Unlock()
+
+		apiOk(c, http.StatusOK, acls)
+	})
+
+	a.handle("PUT", "/acls/:name", auth.ADMIN, "Create or replace access list, binds using it are opened again", http.StatusOK, acl.Config{}, acl.Config{}, func(c *gin.Context) {
+
+		list := acl.Config{}
+		if err := bindBody(c, &list); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		name := c.Param("name")
+		err := changeConfig(changedBy(c), "set acl "+name, func(cfg *config.Config) error {
+			if cfg.Acls == nil {
+				cfg.Acls = make(map[string]acl.Config)
+			}
+
+			cfg.Acls[name] = list
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, list)
+	})
+
+	a.handle("DELETE", "/acls/:name", auth.ADMIN, "Delete access list which isn't used", http.StatusOK, nil, acl.Config{}, func(c *gin.Context) {
+
+		name := c.Param("name")
+		var deleted acl.Config
+
+		err := changeConfig(changedBy(c), "deleted acl "+name, func(cfg *config.Config) error {
+			list, ok := cfg.Acls[name]
+			if !ok {
+				return notFound("acl %s is not found", name)
+			}
+
+			deleted = list
+			delete(cfg.Acls, name)
+			return nil
+		})
+
+		if err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		apiOk(c, http.StatusOK, deleted)
+	})
+}
+
+func (a *api) banRoutes() {
+
+	a.handle("GET", "/bans", auth.VIEWER, "List bans in force", http.StatusOK, nil, []Ban{}, func(c *gin.Context) {
+		apiOk(c, http.StatusOK, getBans())
+	})
+
+	a.handle("POST", "/bans", auth.OPERATOR, "Ban IP and disconnect its miners", http.StatusCreated, banRequest{}, Ban{}, func(c *gin.Context) {
+
+		request := banRequest{}
+		if err := bindBody(c, &request); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		if err := request.Validate(); err != nil {
+			apiFail(c, err)
+			return
+		}
+
+		duration := time.Duration(request.Duration) * time.Second
+		if request.Duration == 0 {
+			duration = time.Duration(config.Get().Bans.Duration) * time.Second
+		}
+
+		reason := request.Reason
+		if reason == "" {
+			reason = "banned by " + changedBy(c)
+		}
+
+		banIpFor(request.IP, reason, duration)
+
+		for _, ban := range getBans() {
+			if ban.IP == request.IP {
+				apiOk(c, http.StatusCreated, ban)
+				return
+			}
+		}
+
+		apiFail(c, notFound("ban of %s is not found", request.IP))
+	})
+
+	a.handle("DELETE", "/bans/:ip", auth.OPERATOR, "Lift ban of IP", http.StatusOK, nil, Ban{}, func(c *gin.Context) {
+
+		ban := delBan(c.Param("ip"))
+		if ban == nil || time.Now().After(ban.Expires) {
+			apiFail(c, notFound("ban of %s is not found", c.Param("ip")))
+			return
+		}
+
+		apiOk(c, http.StatusOK, ban)
+	})
+}
@@ -0,0 +1,104 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Envelope of API answers
+type apiAnswer struct {
+	Data  json.RawMessage `json:"data"`
+	Error *apiError       `json:"error"`
+}
+
+// Requests made one after another on config of revisionConfig, changes are kept for the next ones
+func TestApiResources(t *testing.T) {
+
+	handler := apiConfig(t)
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		// Pools
+		{"GET", "/api/v1/pools", "", http.StatusOK, ""},
+		{"GET", "/api/v1/pools/pool-a:3333", "", http.StatusOK, ""},
+		{"GET", "/api/v1/pools/pool-c:3333", "", http.StatusNotFound, "not_found"},
+		{"POST", "/api/v1/pools", `{"url": "pool-c:3333", "user": "pooluser"}`, http.StatusCreated, ""},
+		{"POST", "/api/v1/pools", `{"url": "pool-c:3333", "user": "pooluser"}`, http.StatusConflict, "conflict"},
+		{"POST", "/api/v1/pools", `{"url": "pool-d:3333", "protocol": "stratum3"}`, http.StatusBadRequest, "invalid_config"},
+		{"POST", "/api/v1/pools", `{"url": "pool-d:3333", "usr": "pooluser"}`, http.StatusBadRequest, "invalid_request"},
+
+		// Miners
+		{"PUT", "/api/v1/miners/10.0.0.5", `{"pool_url": "pool-c:3333"}`, http.StatusOK, ""},
+		{"PUT", "/api/v1/miners/10.0.0.5", `{"pool_url": "pool-x:3333"}`, http.StatusBadRequest, "invalid_request"},
+		{"PUT", "/api/v1/miners/miner", `{"pool_url": "pool-c:3333"}`, http.StatusBadRequest, "invalid_request"},
+		{"GET", "/api/v1/miners", "", http.StatusOK, ""},
+
+		// Routing rules use pools which exist
+		{"POST", "/api/v1/routes", `{"name": "nh", "worker_prefix": "nh.", "pool": "pool-c:3333"}`, http.StatusCreated, ""},
+		{"POST", "/api/v1/routes", `{"name": "nh", "worker_prefix": "nh.", "pool": "pool-c:3333"}`, http.StatusConflict, "conflict"},
+		{"POST", "/api/v1/routes", `{"name": "x", "pool": "pool-x:3333"}`, http.StatusBadRequest, "invalid_config"},
+		{"DELETE", "/api/v1/routes/nh", "", http.StatusOK, ""},
+		{"DELETE", "/api/v1/routes/nh", "", http.StatusNotFound, "not_found"},
+
+		// Bans
+		{"POST", "/api/v1/bans", `{"ip": "10.0.0.9", "duration": 60}`, http.StatusCreated, ""},
+		{"POST", "/api/v1/bans", `{"ip": "host", "duration": 60}`, http.StatusBadRequest, "invalid_request"},
+		{"GET", "/api/v1/bans", "", http.StatusOK, ""},
+		{"DELETE", "/api/v1/bans/10.0.0.9", "", http.StatusOK, ""},
+		{"DELETE", "/api/v1/bans/10.0.0.9", "", http.StatusNotFound, "not_found"},
+
+		// Deleted pool takes its miners with it
+		{"DELETE", "/api/v1/pools/pool-c:3333", "", http.StatusOK, ""},
+		{"DELETE", "/api/v1/miners/10.0.0.5", "", http.StatusNotFound, "not_found"},
+
+		{"GET", "/api/v1/unknown", "", http.StatusNotFound, "not_found"},
+	}
+
+	for idx, step := range steps {
+
+		res := apiRequest(handler, step.method, step.path, "token", step.body)
+
+		answer := apiAnswer{}
+		if err := json.Unmarshal(res.Body.Bytes(), &answer); err != nil {
+			t.Fatalf("step %d: %s %s answered %s", idx, step.method, step.path, res.Body.String())
+		}
+
+		code := ""
+		if answer.Error != nil {
+			code = answer.Error.Code
+		}
+
+		if res.Code != step.status || code != step.code || (code == "") == (answer.Data == nil) {
+			t.Fatalf("step %d: %s %s answered %d %s, expected %d %q", idx, step.method, step.path, res.Code, res.Body.String(), step.status, step.code)
+		}
+	}
+
+	if len(config.Get().Pools) != 2 || len(config.Get().Miners) != 1 || len(config.Get().Routes) != 0 {
+		t.Fatalf("config has pools %+v, miners %+v and routes %+v", config.Get().Pools, config.Get().Miners, config.Get().Routes)
+	}
+}
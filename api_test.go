@@ -0,0 +1,144 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Config of revisionConfig with dashboard authentication by admin and viewer tokens
+func apiConfig(t *testing.T) http.Handler {
+
+	useTestRedis(t)
+	revisionConfig(t)
+
+	viewerHash := sha256.Sum256([]byte("viewer"))
+
+	config.Update(func(cfg *config.Config) {
+		cfg.Dashboard.Auth.Enabled = true
+		cfg.Dashboard.Auth.Tokens = append(cfg.Dashboard.Auth.Tokens, auth.Token{Name: "grafana", Hash: hex.EncodeToString(viewerHash[:]), Role: auth.VIEWER})
+	})
+
+	return dashboardHandler()
+}
+
+func apiRequest(handler http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	return res
+}
+
+func TestApiRoles(t *testing.T) {
+
+	handler := apiConfig(t)
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"GET", "/api/v1/openapi.json", "", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/openapi.json", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/openapi.json", "viewer", "", http.StatusOK},
+		{"GET", "/api/v1/pools", "viewer", "", http.StatusOK},
+		{"PUT", "/api/v1/pools/pool-a:3333", "viewer", `{"weight": 3}`, http.StatusForbidden},
+		{"POST", "/api/v1/bans", "viewer", `{"ip": "10.0.0.9", "duration": 60}`, http.StatusForbidden},
+		{"DELETE", "/api/v1/pools/pool-b:3333", "viewer", "", http.StatusForbidden},
+		{"PUT", "/api/v1/pools/pool-a:3333", "token", `{"weight": 3}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if res := apiRequest(handler, test.method, test.path, test.token, test.body); res.Code != test.status {
+			t.Errorf("%s %s with token %q: status %d, expected %d: %s", test.method, test.path, test.token, res.Code, test.status, res.Body.String())
+		}
+	}
+}
+
+// Operations are described in OpenAPI document with roles they need
+func TestApiDocument(t *testing.T) {
+
+	handler := apiConfig(t)
+
+	res := apiRequest(handler, "GET", "/api/v1/openapi.json", "viewer", "")
+
+	for _, path := range []string{`"/api/v1/openapi.json"`, `"/api/v1/pools/{url}"`} {
+		if !strings.Contains(res.Body.String(), path) {
+			t.Errorf("document doesn't describe %s", path)
+		}
+	}
+}
+
+// Fields which body of PUT doesn't have keep their values
+func TestApiChangePool(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		pool    string
+		weight  float64
+		pass    string
+		workers int
+	}{
+		{"weight only", `{"weight": 3}`, http.StatusOK, "pool-a:3333", 3, "poolsecret", 1},
+		{"password", `{"pass": "other"}`, http.StatusOK, "pool-a:3333", 0, "other", 1},
+		{"workers replaced", `{"workers": {}}`, http.StatusOK, "pool-a:3333", 0, "poolsecret", 0},
+		{"same url", `{"url": "pool-a:3333", "weight": 2}`, http.StatusOK, "pool-a:3333", 2, "poolsecret", 1},
+		{"other url", `{"url": "pool-c:3333"}`, http.StatusBadRequest, "pool-a:3333", 0, "poolsecret", 1},
+		{"unknown field", `{"password": "other"}`, http.StatusBadRequest, "pool-a:3333", 0, "poolsecret", 1},
+		{"invalid body", `{"weight": `, http.StatusBadRequest, "pool-a:3333", 0, "poolsecret", 1},
+		{"unknown pool", `{"weight": 3}`, http.StatusNotFound, "pool-c:3333", 0, "poolsecret", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			handler := apiConfig(t)
+			config.Update(func(cfg *config.Config) {
+				cfg.Pools[0].Workers = map[string]string{"rig1": "pooluser.rig1"}
+			})
+
+			res := apiRequest(handler, "PUT", "/api/v1/pools/"+test.pool, "token", test.body)
+			if res.Code != test.status {
+				t.Fatalf("status %d, expected %d: %s", res.Code, test.status, res.Body.String())
+			}
+
+			pool := config.Get().Pool(0)
+			if pool.Url != "pool-a:3333" || pool.User != "pooluser" || pool.Pass != test.pass || pool.Weight != test.weight || len(pool.Workers) != test.workers {
+				t.Fatalf("pool is %+v", pool)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"errors"
+	"net"
+)
+
+// Miners authorize with worker name of a user and its password when authorization
+// is enabled, and only from whitelisted IPs in whitelist only mode. Miners of users
+// limited to some pools are moved to them after authorizing and stay on them.
+
+// Check IP and credentials of miner authorizing as worker
+func checkAuthorize(conn *stratumserver.Connection, worker string, password string) error {
+
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+	if config.Get().Auth.WhitelistOnly && !checkWhiteList(ip) {
+		return errors.New("IP is not whitelisted")
+	}
+
+	if !config.Get().Auth.Enabled {
+		return nil
+	}
+
+	user := auth.Find(config.Get().Auth.Users, worker)
+
+	if user == nil {
+		return errors.New("unknown user")
+	}
+
+	if !user.CheckPassword(password) {
+		return errors.New("wrong password")
+	}
+
+	return nil
+}
+
+// Answer mining.authorize with false, IP is banned after too many failures
+func refuseAuthorize(conn *stratumserver.Connection, id uint64, worker string, reason error) {
+
+	venuslog.Warn("Refused authorization of", worker, "from", conn.Conn.RemoteAddr(), reason)
+
+	err := conn.Send(template.StratumMsgResponse{
+		ID:     id,
+		Result: false,
+		Error:  template.NewError(24, "Unauthorized worker"),
+	})
+
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+	}
+
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+	recordAuthFailure(ip)
+}
+
+// User of authorized miner may mine on pool
+func allowedPool(conn *stratumserver.Connection, poolIndex uint64) bool {
+
+	if !config.Get().Auth.Enabled {
+		return true
+	}
+
+	user := auth.Find(config.Get().Auth.Users, conn.WorkerID)
+
+	return user == nil || user.AllowsPool(config.Get().Pool(poolIndex).Url)
+}
+
+// Pool for miner of user limited to some pools, the current one when it is allowed,
+// otherwise the first healthy pool of user
+func userPool(conn *stratumserver.Connection, current uint64) (uint64, bool) {
+
+	if !config.Get().Auth.Enabled {
+		return 0, false
+	}
+
+	user := auth.Find(config.Get().Auth.Users, conn.WorkerID)
+
+	if user == nil || len(user.Pools) == 0 {
+		return 0, false
+	}
+
+	if user.AllowsPool(config.Get().Pool(current).Url) {
+		return current, true
+	}
+
+	return healthyPool(user.Pools)
+}
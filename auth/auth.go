@@ -0,0 +1,88 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package auth checks credentials which miners authorize with, and users of dashboard
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User of proxy, password is kept as bcrypt hash.
+// Pools limit where miners of user may mine, empty allows every pool.
+type User struct {
+	Name         string   `json:"user"`
+	PasswordHash string   `json:"password_hash"`
+	Pools        []string `json:"pools,omitempty"`
+}
+
+func (u *User) Validate() error {
+
+	if u.Name == "" {
+		return errors.New("user has no name")
+	}
+
+	if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+		return errors.New("invalid bcrypt password hash of user " + u.Name)
+	}
+
+	return nil
+}
+
+// Password matches hash of user
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// User may mine on pool
+func (u *User) AllowsPool(url string) bool {
+
+	if len(u.Pools) == 0 {
+		return true
+	}
+
+	for _, pool := range u.Pools {
+		if pool == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// User of worker name, the whole name or the part before its first dot
+func Find(users []User, worker string) *User {
+
+	account, _, _ := strings.Cut(worker, ".")
+
+	var found *User
+	for idx := range users {
+		if users[idx].Name == worker {
+			return &users[idx]
+		}
+
+		if found == nil && users[idx].Name == account {
+			found = &users[idx]
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,133 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of dashboard users, every role may do what the roles before it may
+const VIEWER = "viewer"
+const OPERATOR = "operator"
+const ADMIN = "admin"
+
+var roles = []string{VIEWER, OPERATOR, ADMIN}
+
+func roleLevel(role string) int {
+	for level, name := range roles {
+		if name == role {
+			return level
+		}
+	}
+
+	return -1
+}
+
+func ValidateRole(role string) error {
+	if roleLevel(role) < 0 {
+		return errors.New("invalid role " + role + " (should be viewer, operator or admin)")
+	}
+
+	return nil
+}
+
+// Role may do what required role may
+func RoleAllows(role string, required string) bool {
+	return roleLevel(role) >= 0 && roleLevel(role) >= roleLevel(required)
+}
+
+// User of dashboard logging in with password, it is kept as bcrypt hash
+type Account struct {
+	Name         string `json:"user"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+}
+
+func (a *Account) Validate() error {
+
+	if a.Name == "" {
+		return errors.New("dashboard user has no name")
+	}
+
+	if _, err := bcrypt.Cost([]byte(a.PasswordHash)); err != nil {
+		return errors.New("invalid bcrypt password hash of dashboard user " + a.Name)
+	}
+
+	return ValidateRole(a.Role)
+}
+
+func (a *Account) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
+}
+
+// API token of dashboard, it is kept as SHA-256 hash in hex
+type Token struct {
+	Name string `json:"name"`
+	Hash string `json:"token_hash"`
+	Role string `json:"role"`
+}
+
+func (t *Token) Validate() error {
+
+	if t.Name == "" {
+		return errors.New("dashboard token has no name")
+	}
+
+	if hash, err := hex.DecodeString(t.Hash); err != nil || len(hash) != sha256.Size {
+		return errors.New("invalid SHA-256 hash of dashboard token " + t.Name)
+	}
+
+	return ValidateRole(t.Role)
+}
+
+func (t *Token) Check(token string) bool {
+
+	hash := sha256.Sum256([]byte(token))
+	expected, _ := hex.DecodeString(t.Hash)
+
+	return subtle.ConstantTimeCompare(hash[:], expected) == 1
+}
+
+func FindAccount(accounts []Account, name string) *Account {
+	for idx := range accounts {
+		if accounts[idx].Name == name {
+			return &accounts[idx]
+		}
+	}
+
+	return nil
+}
+
+// Token matching secret, every token is checked
+func FindToken(tokens []Token, secret string) *Token {
+
+	var found *Token
+	for idx := range tokens {
+		if tokens[idx].Check(secret) && found == nil {
+			found = &tokens[idx]
+		}
+	}
+
+	return found
+}
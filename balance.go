@@ -0,0 +1,369 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/venuslog"
+	"math"
+	"net"
+	"time"
+)
+
+// Balancing gives every pool the share of total hashrate set by its weight.
+// New miners are assigned to the pool which is furthest below its share, and
+// miners are moved periodically from pools above their share to pools below
+// without disconnecting them, like with setPool.
+// Miners which can't be split finely enough, like a farm behind one IP which
+// shares one upstream, are time-sliced: pool which got less than its share of
+// the recent work is given more than its share of hashrate until it catches up.
+
+// Miners connected from one IP, they are always assigned to the same pool
+type minerGroup struct {
+	ip        string
+	poolIndex uint64
+	hashrate  float64
+	conns     []*stratumserver.Connection
+}
+
+// Work which every pool got from balanced miners recently, in hashrate times seconds
+// minersMut must be locked
+var balanceWork []float64
+var balanceWorkAt time.Time
+
+// Part of total hashrate which pool should get
+func weightShare(poolIndex uint64) float64 {
+
+	totalWeight := 0.0
+	for _, pool := range config.Get().Pools {
+		totalWeight += pool.Weight
+	}
+
+	if totalWeight <= 0 {
+		return 0
+	}
+
+	return config.Get().Pool(poolIndex).Weight / totalWeight
+}
+
+// Pool can get more miners, pools which failed recently are skipped
+func isBalanceTarget(poolIndex uint64) bool {
+	if config.Get().Pool(poolIndex).Weight <= 0 {
+		return false
+	}
+
+	return !config.Get().Failover.Enabled || !isPoolDown(poolIndex)
+}
+
+// Connected miners grouped by IP, with the pool they are assigned to and their hashrate.
+// IP which didn't get shares accepted yet counts as one average IP, its other
+// connections may be idle, so they don't add more.
+// minersMut must be locked
+func assignedGroups() []*minerGroup {
+
+	assigned := make(map[string]uint64, len(config.Get().Miners))
+	for _, miner := range config.Get().Miners {
+		for idx, pool := range config.Get().Pools {
+			if pool.Url == miner.PoolUrl {
+				assigned[miner.IP] = uint64(idx)
+				break
+			}
+		}
+	}
+
+	srv.ConnsMut.Lock()
+	conns := make([]*stratumserver.Connection, len(srv.Connections))
+	copy(conns, srv.Connections)
+	srv.ConnsMut.Unlock()
+
+	byIp := make(map[string]*minerGroup)
+	groups := make([]*minerGroup, 0)
+
+	for _, conn := range conns {
+
+		// Pool of routed miners is chosen by their rule
+		if conn.Route != "" {
+			continue
+		}
+
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+		// Miners on pool of schedule stay there
+		poolIndex, ok := assigned[ip]
+		if _, isScheduled := scheduledMiners[ip]; !ok || isScheduled {
+			continue
+		}
+
+		group := byIp[ip]
+		if group == nil {
+			group = &minerGroup{ip: ip, poolIndex: poolIndex}
+			byIp[ip] = group
+			groups = append(groups, group)
+		}
+
+		group.conns = append(group.conns, conn)
+		group.hashrate += conn.Hashrate.Hashrate(config.BALANCE_WINDOW_MINUTES * time.Minute)
+	}
+
+	countUnmeasured(groups)
+
+	return groups
+}
+
+// Groups without hashrate get the average hashrate of measured groups
+func countUnmeasured(groups []*minerGroup) {
+
+	measuredHashrate := 0.0
+	measured := 0
+
+	for _, group := range groups {
+		if group.hashrate > 0 {
+			measuredHashrate += group.hashrate
+			measured++
+		}
+	}
+
+	average := 1.0
+	if measured > 0 {
+		average = measuredHashrate / float64(measured)
+	}
+
+	for _, group := range groups {
+		if group.hashrate <= 0 {
+			group.hashrate = average
+		}
+	}
+}
+
+// Hashrate assigned to every pool, and the total
+func poolLoads(groups []*minerGroup) ([]float64, float64) {
+
+	loads := make([]float64, len(config.Get().Pools))
+	total := 0.0
+
+	for _, group := range groups {
+		if group.poolIndex < uint64(len(loads)) {
+			loads[group.poolIndex] += group.hashrate
+		}
+		total += group.hashrate
+	}
+
+	return loads, total
+}
+
+// Pool for miner from new IP, the one which is furthest below its share
+// minersMut must be locked
+func balancedPool() uint64 {
+
+	groups := assignedGroups()
+	loads, total := poolLoads(groups)
+
+	// New miner is expected to be like the others
+	expected := 1.0
+	if len(groups) > 0 {
+		expected = total / float64(len(groups))
+	}
+	total += expected
+
+	best := config.Get().PoolIndex
+	bestDeficit := math.Inf(-1)
+
+	for idx := range config.Get().Pools {
+
+		poolIndex := uint64(idx)
+		if !isBalanceTarget(poolIndex) {
+			continue
+		}
+
+		deficit := total*weightShare(poolIndex) - loads[idx]
+		if deficit > bestDeficit {
+			best = poolIndex
+			bestDeficit = deficit
+		}
+	}
+
+	return best
+}
+
+// Hashrate which every pool should get until the next balancing, so that its
+// recent work gets to its share. History is cleared when pools changed, one can't
+// get miners or balancing didn't run for a while, old work is forgotten proportionally.
+// minersMut must be locked
+func balanceTargets(groups []*minerGroup) []float64 {
+
+	loads, total := poolLoads(groups)
+	interval := float64(config.Get().Balance.Interval)
+	now := time.Now()
+
+	isStale := len(balanceWork) != len(loads) || now.Sub(balanceWorkAt).Seconds() > 2*interval
+	for idx := range loads {
+		if !isBalanceTarget(uint64(idx)) {
+			isStale = true
+		}
+	}
+
+	if isStale {
+		balanceWork = make([]float64, len(loads))
+	} else {
+		elapsed := now.Sub(balanceWorkAt).Seconds()
+		for idx, load := range loads {
+			balanceWork[idx] += load * elapsed
+		}
+	}
+	balanceWorkAt = now
+
+	work := 0.0
+	for _, poolWork := range balanceWork {
+		work += poolWork
+	}
+
+	if limit := total * interval * config.BALANCE_HISTORY_INTERVALS; work > limit {
+		for idx := range balanceWork {
+			balanceWork[idx] *= limit / work
+		}
+		work = limit
+	}
+
+	targets := make([]float64, len(loads))
+	for idx := range targets {
+		if interval > 0 {
+			targets[idx] = ((work+total*interval)*weightShare(uint64(idx)) - balanceWork[idx]) / interval
+		} else {
+			targets[idx] = total * weightShare(uint64(idx))
+		}
+	}
+
+	return targets
+}
+
+// Move miners from pools above their target to pools below it,
+// until every pool is within tolerance or no move gets closer
+func planBalance(groups []*minerGroup, targets []float64) []*minerGroup {
+
+	loads, total := poolLoads(groups)
+	moved := make([]*minerGroup, 0)
+
+	if total <= 0 {
+		return moved
+	}
+
+	for range groups {
+
+		var over, under uint64
+		maxExcess, maxDeficit := 0.0, 0.0
+
+		for idx := range config.Get().Pools {
+
+			poolIndex := uint64(idx)
+			diff := loads[idx] - targets[idx]
+
+			if diff > maxExcess {
+				over = poolIndex
+				maxExcess = diff
+			}
+
+			if -diff > maxDeficit && isBalanceTarget(poolIndex) {
+				under = poolIndex
+				maxDeficit = -diff
+			}
+		}
+
+		if maxExcess == 0 || maxDeficit == 0 {
+			break
+		}
+
+		if math.Max(maxExcess, maxDeficit)/total*100 <= config.Get().Balance.Tolerance {
+			break
+		}
+
+		// Miner which brings both pools closest to their share, moving more
+		// than twice of the gap would leave the pools further apart
+		gap := math.Min(maxExcess, maxDeficit)
+
+		var best *minerGroup
+		for _, group := range groups {
+
+			if group.poolIndex != over || group.hashrate >= 2*gap {
+				continue
+			}
+
+			if best == nil || math.Abs(gap-group.hashrate) < math.Abs(gap-best.hashrate) {
+				best = group
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		loads[over] -= best.hashrate
+		loads[under] += best.hashrate
+		best.poolIndex = under
+
+		moved = append(moved, best)
+	}
+
+	return moved
+}
+
+// Move miners so that pools get closer to their weights
+func rebalance() {
+
+	minersMut.Lock()
+
+	groups := assignedGroups()
+	moved := planBalance(groups, balanceTargets(groups))
+
+	config.Update(func(cfg *config.Config) {
+		for _, group := range moved {
+			for idx, miner := range cfg.Miners {
+				if miner.IP == group.ip {
+					venuslog.Info("Balancing moves miner", group.ip, "from", miner.PoolUrl, "to", cfg.Pool(group.poolIndex).Url)
+					cfg.Miners[idx].PoolUrl = cfg.Pool(group.poolIndex).Url
+					configChanged("balancing moved miner " + group.ip + " to " + cfg.Pool(group.poolIndex).Url)
+				}
+			}
+		}
+	})
+
+	minersMut.Unlock()
+
+	for _, group := range moved {
+		for _, conn := range group.conns {
+			moveMiner(conn, group.poolIndex)
+		}
+	}
+}
+
+// Balancing pools periodically while it is enabled, config can be reloaded
+func watchBalance() {
+	for {
+		if !config.Get().Balance.Enabled {
+			time.Sleep(config.CONFIG_WATCH_SECONDS * time.Second)
+			continue
+		}
+
+		time.Sleep(time.Duration(config.Get().Balance.Interval) * time.Second)
+
+		if config.Get().Balance.Enabled {
+			rebalance()
+		}
+	}
+}
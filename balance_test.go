@@ -0,0 +1,140 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"math"
+	"testing"
+	"time"
+)
+
+// Config with pools of weights, restored after test
+func balanceConfig(t *testing.T, weights ...float64) {
+
+	cfg := config.Get()
+	work, workAt := balanceWork, balanceWorkAt
+
+	t.Cleanup(func() {
+		config.Set(cfg)
+		balanceWork, balanceWorkAt = work, workAt
+	})
+
+	next := &config.Config{}
+	for idx, weight := range weights {
+		next.Pools = append(next.Pools, config.PoolInfo{Url: string(rune('a'+idx)) + ":3333", Weight: weight})
+	}
+	next.Balance.Enabled = true
+	next.Balance.Interval = 60
+	next.Balance.Tolerance = 5
+	config.Set(next)
+
+	balanceWork = nil
+}
+
+func TestCountUnmeasured(t *testing.T) {
+	tests := []struct {
+		name      string
+		hashrates []float64
+		expected  []float64
+	}{
+		{"all measured", []float64{100, 300}, []float64{100, 300}},
+		{"new ip counts as average ip", []float64{100, 300, 0}, []float64{100, 300, 200}},
+		{"nothing measured", []float64{0, 0}, []float64{1, 1}},
+	}
+
+	for _, test := range tests {
+
+		groups := make([]*minerGroup, len(test.hashrates))
+		for idx, hashrate := range test.hashrates {
+			groups[idx] = &minerGroup{hashrate: hashrate}
+		}
+
+		countUnmeasured(groups)
+
+		for idx, group := range groups {
+			if group.hashrate != test.expected[idx] {
+				t.Errorf("%s: group %d has hashrate %v, expected %v", test.name, idx, group.hashrate, test.expected[idx])
+			}
+		}
+	}
+}
+
+// Groups fine enough are split by weights right away
+func TestPlanBalance(t *testing.T) {
+
+	balanceConfig(t, 70, 30)
+
+	groups := make([]*minerGroup, 10)
+	for idx := range groups {
+		groups[idx] = &minerGroup{hashrate: 100}
+	}
+
+	moved := planBalance(groups, balanceTargets(groups))
+
+	if len(moved) != 3 {
+		t.Fatalf("moved %d groups, expected 3", len(moved))
+	}
+	for _, group := range moved {
+		if group.poolIndex != 1 {
+			t.Fatalf("group moved to pool %d", group.poolIndex)
+		}
+	}
+}
+
+// Farm behind one IP is time-sliced between pools by weights
+func TestPlanBalanceTimeSlicing(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		weights []float64
+	}{
+		{"70/30", []float64{70, 30}},
+		{"50/50", []float64{50, 50}},
+		{"70/20/10", []float64{70, 20, 10}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			balanceConfig(t, test.weights...)
+
+			group := &minerGroup{hashrate: 100}
+			groups := []*minerGroup{group}
+			intervals := make([]float64, len(test.weights))
+
+			for round := 0; round < 200; round++ {
+
+				// Balancing ran an interval ago
+				if round > 0 {
+					balanceWorkAt = time.Now().Add(-time.Duration(config.Get().Balance.Interval) * time.Second)
+				}
+
+				planBalance(groups, balanceTargets(groups))
+				intervals[group.poolIndex]++
+			}
+
+			for idx, weight := range test.weights {
+				if share := intervals[idx] / 200 * 100; math.Abs(share-weight) > 5 {
+					t.Errorf("pool %d got %v%% of time, expected %v%%", idx, share, weight)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/venuslog"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// IPs of miners which send too many invalid shares or malformed messages, connect too
+// often or fail to authorize are banned for a while. Bans are kept in redis, so they
+// last over restarts, and expire by themselves.
+
+type Ban struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+var bans = make(map[string]*Ban)
+var bansMut mutex.Mutex
+
+// What IP did since start of its windows
+type offense struct {
+	since        time.Time
+	malformed    uint64
+	authFailures uint64
+
+	connectionsSince time.Time
+	connections      uint64
+}
+
+var offenses = make(map[string]*offense)
+var offensesMut mutex.Mutex
+
+// Load bans of the previous run from redis
+func loadBans() {
+
+	bansResult, err := db.Get("bans").Result()
+
+	if err != nil {
+		venuslog.Warn("error while reading bans", err)
+		return
+	}
+
+	bansMut.Lock()
+	json.Unmarshal([]byte(bansResult), &bans)
+	bansMut.Unlock()
+
+	saveBans()
+}
+
+// Store bans which didn't expire in redis, bansMut must not be locked
+func saveBans() {
+
+	bansMut.Lock()
+	for ip, ban := range bans {
+		if time.Now().After(ban.Expires) {
+			delete(bans, ip)
+		}
+	}
+	bansstr, _ := json.Marshal(bans)
+	bansMut.Unlock()
+
+	db.Set("bans", string(bansstr), 0)
+}
+
+func isBanned(ip string) bool {
+
+	bansMut.Lock()
+	defer bansMut.Unlock()
+
+	ban := bans[ip]
+
+	return ban != nil && time.Now().Before(ban.Expires)
+}
+
+// Ban IP for duration of config and close connections of its miners
+func banIp(ip string, reason string) {
+	banIpFor(ip, reason, time.Duration(config.Get().Bans.Duration)*time.Second)
+}
+
+// Ban IP for duration, ban in force which lasts longer is kept
+func banIpFor(ip string, reason string, duration time.Duration) {
+
+	expires := time.Now().Add(duration)
+
+	bansMut.Lock()
+	if ban := bans[ip]; ban != nil && ban.Expires.After(expires) {
+		bansMut.Unlock()
+		return
+	}
+	bans[ip] = &Ban{IP: ip, Reason: reason, Expires: expires}
+	bansMut.Unlock()
+
+	venuslog.Warn("Banned", ip, "until", expires.Format(time.RFC3339), reason)
+
+	saveBans()
+
+	srv.ConnsMut.Lock()
+	for _, conn := range srv.Connections {
+		host, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		if host == ip {
+			conn.Close()
+		}
+	}
+	srv.ConnsMut.Unlock()
+}
+
+// Lift ban of IP, the lifted ban is returned when there was one
+func delBan(ip string) *Ban {
+
+	bansMut.Lock()
+	ban := bans[ip]
+	delete(bans, ip)
+	bansMut.Unlock()
+
+	saveBans()
+
+	return ban
+}
+
+// Bans in force, the earliest expiring first
+func getBans() []Ban {
+
+	bansMut.Lock()
+	list := make([]Ban, 0, len(bans))
+	for _, ban := range bans {
+		if time.Now().Before(ban.Expires) {
+			list = append(list, *ban)
+		}
+	}
+	bansMut.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Expires.Before(list[j].Expires)
+	})
+
+	return list
+}
+
+// Offenses of IP in the current windows, offensesMut must be locked
+func offenseOf(ip string) *offense {
+
+	now := time.Now()
+
+	o := offenses[ip]
+	if o == nil {
+		o = &offense{since: now, connectionsSince: now}
+		offenses[ip] = o
+	}
+
+	if now.Sub(o.since) > config.BAN_WINDOW_MINUTES*time.Minute {
+		o.since = now
+		o.malformed = 0
+		o.authFailures = 0
+	}
+
+	if now.Sub(o.connectionsSince) > time.Minute {
+		o.connectionsSince = now
+		o.connections = 0
+	}
+
+	return o
+}
+
+// Count new connection of IP, it is banned when it connects too often
+func recordConnection(ip string) bool {
+
+	if !config.Get().Bans.Enabled || config.Get().Bans.ConnectionsPerMinute == 0 {
+		return false
+	}
+
+	offensesMut.Lock()
+	o := offenseOf(ip)
+	o.connections++
+	isFlooding := o.connections > config.Get().Bans.ConnectionsPerMinute
+	offensesMut.Unlock()
+
+	if isFlooding {
+		banIp(ip, fmt.Sprintf("more than %d connections per minute", config.Get().Bans.ConnectionsPerMinute))
+	}
+
+	return isFlooding
+}
+
+// Count message of miner which isn't valid JSON
+func recordMalformed(ip string) {
+
+	if !config.Get().Bans.Enabled || config.Get().Bans.MalformedMessages == 0 {
+		return
+	}
+
+	offensesMut.Lock()
+	o := offenseOf(ip)
+	o.malformed++
+	isAbusive := o.malformed >= config.Get().Bans.MalformedMessages
+	offensesMut.Unlock()
+
+	if isAbusive {
+		banIp(ip, fmt.Sprintf("%d malformed messages", config.Get().Bans.MalformedMessages))
+	}
+}
+
+// Count refused authorization of miner
+func recordAuthFailure(ip string) {
+
+	if !config.Get().Bans.Enabled || config.Get().Bans.FailedAuthorizations == 0 {
+		return
+	}
+
+	offensesMut.Lock()
+	o := offenseOf(ip)
+	o.authFailures++
+	isAbusive := o.authFailures >= config.Get().Bans.FailedAuthorizations
+	offensesMut.Unlock()
+
+	if isAbusive {
+		banIp(ip, fmt.Sprintf("%d failed authorizations", config.Get().Bans.FailedAuthorizations))
+	}
+}
+
+// Ban miner whose shares are mostly invalid, upstream of miner is locked
+func checkInvalidShares(conn *stratumserver.Connection) {
+
+	if !config.Get().Bans.Enabled || config.Get().Bans.InvalidSharePercent == 0 {
+		return
+	}
+
+	total := conn.Shares.Accepted + conn.Shares.Invalid
+	if total == 0 || total < config.Get().Bans.MinShares {
+		return
+	}
+
+	percent := float64(conn.Shares.Invalid) / float64(total) * 100
+	if percent < config.Get().Bans.InvalidSharePercent {
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+	go banIp(ip, fmt.Sprintf("%.0f%% invalid shares", percent))
+}
+
+// Forget offenses and bans which expired
+func watchBans() {
+	for {
+		time.Sleep(time.Minute)
+
+		offensesMut.Lock()
+		for ip, o := range offenses {
+			if time.Since(o.since) > config.BAN_WINDOW_MINUTES*time.Minute && time.Since(o.connectionsSince) > time.Minute {
+				delete(offenses, ip)
+			}
+		}
+		offensesMut.Unlock()
+
+		saveBans()
+	}
+}
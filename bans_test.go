@@ -0,0 +1,205 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"net"
+	"testing"
+	"time"
+)
+
+// Bans enabled with thresholds, bans and offenses are cleared and restored after test
+func bansConfig(t *testing.T) *testRedis {
+
+	redis := useTestRedis(t)
+
+	cfg := config.Get()
+	bansMut.Lock()
+	previousBans := bans
+	bans = make(map[string]*Ban)
+	bansMut.Unlock()
+	offensesMut.Lock()
+	previousOffenses := offenses
+	offenses = make(map[string]*offense)
+	offensesMut.Unlock()
+
+	t.Cleanup(func() {
+		config.Set(cfg)
+		bansMut.Lock()
+		bans = previousBans
+		bansMut.Unlock()
+		offensesMut.Lock()
+		offenses = previousOffenses
+		offensesMut.Unlock()
+	})
+
+	next := &config.Config{}
+	next.Bans.Enabled = true
+	next.Bans.Duration = 600
+	next.Bans.InvalidSharePercent = 50
+	next.Bans.MinShares = 10
+	next.Bans.MalformedMessages = 3
+	next.Bans.ConnectionsPerMinute = 5
+	next.Bans.FailedAuthorizations = 2
+	config.Set(next)
+
+	return redis
+}
+
+func TestRecordOffenses(t *testing.T) {
+
+	connect := func(ip string) { recordConnection(ip) }
+
+	tests := []struct {
+		name     string
+		record   func(ip string)
+		count    int
+		isBanned bool
+	}{
+		{"connections below limit", connect, 5, false},
+		{"connection flood", connect, 6, true},
+		{"malformed messages below limit", recordMalformed, 2, false},
+		{"malformed messages", recordMalformed, 3, true},
+		{"failed authorization", recordAuthFailure, 1, false},
+		{"failed authorizations", recordAuthFailure, 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			bansConfig(t)
+
+			for i := 0; i < test.count; i++ {
+				test.record("10.0.0.1")
+			}
+
+			if isBanned("10.0.0.1") != test.isBanned {
+				t.Fatalf("banned is %v after %d offenses", !test.isBanned, test.count)
+			}
+
+			// Offenses are counted by IP
+			if isBanned("10.0.0.2") {
+				t.Fatal("other IP is banned")
+			}
+		})
+	}
+}
+
+func TestRecordOffensesDisabled(t *testing.T) {
+
+	bansConfig(t)
+	config.Update(func(cfg *config.Config) {
+		cfg.Bans.Enabled = false
+	})
+
+	for i := 0; i < 10; i++ {
+		recordConnection("10.0.0.1")
+		recordMalformed("10.0.0.1")
+		recordAuthFailure("10.0.0.1")
+	}
+
+	if isBanned("10.0.0.1") {
+		t.Fatal("IP is banned while bans are disabled")
+	}
+}
+
+func TestCheckInvalidShares(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		accepted uint64
+		invalid  uint64
+		isBanned bool
+	}{
+		{"too few shares", 0, 9, false},
+		{"mostly valid", 8, 2, false},
+		{"half invalid", 5, 5, true},
+		{"mostly invalid", 2, 18, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			bansConfig(t)
+
+			conn := &stratumserver.Connection{Conn: &sv2PipeConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}}}
+			conn.Shares.Accepted = test.accepted
+			conn.Shares.Invalid = test.invalid
+
+			checkInvalidShares(conn)
+
+			// Ban is made in background
+			deadline := time.Now().Add(time.Second)
+			for !isBanned("10.0.0.1") && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if isBanned("10.0.0.1") != test.isBanned {
+				t.Fatalf("banned is %v with %d accepted and %d invalid shares", !test.isBanned, test.accepted, test.invalid)
+			}
+		})
+	}
+}
+
+// Bans expire by themselves, a longer ban in force isn't shortened
+func TestBanExpires(t *testing.T) {
+
+	bansConfig(t)
+
+	banIpFor("10.0.0.1", "test", time.Hour)
+	banIpFor("10.0.0.1", "shorter", time.Minute)
+	banIpFor("10.0.0.2", "test", time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if !isBanned("10.0.0.1") || isBanned("10.0.0.2") {
+		t.Fatal("ban didn't expire or expired too early")
+	}
+
+	list := getBans()
+	if len(list) != 1 || list[0].Reason != "test" || time.Until(list[0].Expires) < 59*time.Minute {
+		t.Fatalf("bans in force are %+v", list)
+	}
+
+	if ban := delBan("10.0.0.1"); ban == nil || isBanned("10.0.0.1") {
+		t.Fatal("ban wasn't lifted")
+	}
+}
+
+// Bans are kept in redis over restarts
+func TestLoadBans(t *testing.T) {
+
+	bansConfig(t)
+
+	banIp("10.0.0.1", "test")
+	banIpFor("10.0.0.2", "test", time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	bansMut.Lock()
+	bans = make(map[string]*Ban)
+	bansMut.Unlock()
+
+	loadBans()
+
+	if !isBanned("10.0.0.1") || len(getBans()) != 1 {
+		t.Fatalf("bans after restart are %+v", getBans())
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/acl"
+	"btcminerproxy/config"
+	"btcminerproxy/venuslog"
+	"net"
+	"reflect"
+	"strconv"
+)
+
+// Listeners of binds, keyed by address. Listener is opened again when its bind or
+// access list changes, connections accepted by it stay.
+
+type bindListener struct {
+	bind     config.BindInfo
+	acl      acl.Config
+	listener net.Listener
+}
+
+// Changed at start and by reload, configMut is locked while reloading
+var listeners = make(map[string]*bindListener)
+
+func bindAddr(bind config.BindInfo) string {
+	return net.JoinHostPort(bind.Host, strconv.FormatUint(uint64(bind.Port), 10))
+}
+
+// Open listener of bind and accept miners on it
+func startBind(bind config.BindInfo) error {
+
+	var listener net.Listener
+	var err error
+
+	if bind.Protocol == config.PROTOCOL_V2 {
+		if sv2Authority == nil {
+			initSv2()
+		}
+		listener, err = net.Listen("tcp", bindAddr(bind))
+	} else {
+		listener, err = srv.Listen(bind.Port, bind.Host, bind.Tls)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	listeners[bindAddr(bind)] = &bindListener{
+		bind:     bind,
+		acl:      config.Get().Acls[bind.Acl],
+		listener: listener,
+	}
+
+	list := getAcl(bind.Acl)
+	if bind.Protocol == config.PROTOCOL_V2 {
+		go ServeSv2(listener, list)
+	} else {
+		go srv.Serve(listener, list)
+	}
+
+	return nil
+}
+
+// Open listeners of all binds
+func startBinds() {
+	for _, bind := range config.Get().Bind {
+		if err := startBind(bind); err != nil {
+			venuslog.Fatal(err)
+		}
+	}
+}
+
+// Close listeners of binds which are gone or changed and open the new ones,
+// Running config has binds and access lists of new config already
+func reloadBinds() {
+
+	kept := make(map[string]bool, len(config.Get().Bind))
+
+	for _, bind := range config.Get().Bind {
+		current, ok := listeners[bindAddr(bind)]
+		if ok && current.bind == bind && reflect.DeepEqual(current.acl, config.Get().Acls[bind.Acl]) {
+			kept[bindAddr(bind)] = true
+		}
+	}
+
+	for addr, current := range listeners {
+		if !kept[addr] {
+			current.listener.Close()
+			delete(listeners, addr)
+		}
+	}
+
+	for _, bind := range config.Get().Bind {
+		if kept[bindAddr(bind)] {
+			continue
+		}
+
+		if err := startBind(bind); err != nil {
+			venuslog.Warn("Failed to listen on", bindAddr(bind), err)
+		}
+	}
+}
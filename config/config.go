@@ -18,8 +18,56 @@
 
 package config
 
+// Config of proxy, changes made at runtime are written back to it
+const CONFIG_FILE = "./config.json"
+
+// Revisions of config kept for rollback
+const CONFIG_REVISIONS = 50
+
+// Interval of saving config changed by proxy itself, like miners assigned to pools
+const CONFIG_SAVE_SECONDS = 10
+
+// Interval of checking config file for changes, it is reloaded when it changes
+const CONFIG_WATCH_SECONDS = 2
+
 const WRITE_TIMEOUT_SECONDS = 30
 const READ_TIMEOUT_SECONDS = 6000
 const MAX_REQUEST_SIZE = 50000
 
 const HASHRATE_AVG_MINUTES = 30
+
+// Waiting time for a shared upstream to be subscribed and authorized
+const UPSTREAM_READY_TIMEOUT_SECONDS = 30
+
+// Waiting time for pool to answer submits of upstream which lost its miners
+const DRAIN_TIMEOUT_SECONDS = 10
+
+// Waiting time for pool to answer mining.configure of proxy
+const CONFIGURE_TIMEOUT_SECONDS = 5
+
+// Minimal extranonce2 size left to miners on a shared upstream
+const MIN_EXTRANONCE2_SIZE = 2
+
+// Miner which can't change extranonce waits this long for pool with its extranonce1 after failover
+const EXTRANONCE_HOLD_SECONDS = 600
+
+// Difficulty of stratum session until pool sends mining.set_difficulty
+const DEFAULT_DIFFICULTY = 1
+
+// Jobs of pool kept for checking shares of miners
+const MAX_JOBS = 16
+
+// Window of miner hashrate which pool weights are balanced on
+const BALANCE_WINDOW_MINUTES = 15
+
+// Balancing intervals of work which time-slicing of miners catches up on
+const BALANCE_HISTORY_INTERVALS = 20
+
+// Interval of applying pool schedule to miners
+const SCHEDULE_CHECK_SECONDS = 15
+
+// Window of counting malformed messages and failed authorizations of IP for bans
+const BAN_WINDOW_MINUTES = 10
+
+// Passwords of dashboard users are checked again after this, bcrypt is too slow for every request
+const DASHBOARD_LOGIN_MINUTES = 5
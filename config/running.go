@@ -0,0 +1,73 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"btcminerproxy/mutex"
+	"sync/atomic"
+)
+
+// Running config is published as a whole and never changed in place, so readers
+// get a consistent snapshot without locking while reload, api or balancing replace it
+
+var running atomic.Pointer[Config]
+
+// Changes of running config are applied one after another
+var updateMut mutex.Mutex
+
+func init() {
+	running.Store(&Config{})
+}
+
+// Snapshot of running config, it must not be changed
+func Get() *Config {
+	return running.Load()
+}
+
+// Publish config as the running one, it must not be changed afterwards
+func Set(cfg *Config) {
+	updateMut.Lock()
+	defer updateMut.Unlock()
+
+	running.Store(cfg)
+}
+
+// Change copy of running config and publish it. Miners and pools of the copy may be
+// changed in place, other slices must be replaced.
+func Update(change func(cfg *Config)) {
+	updateMut.Lock()
+	defer updateMut.Unlock()
+
+	next := *running.Load()
+	next.Miners = append([]MinerInfo(nil), next.Miners...)
+	next.Pools = append([]PoolInfo(nil), next.Pools...)
+
+	change(&next)
+
+	running.Store(&next)
+}
+
+// Pool of index, pool which was removed in meantime is empty
+func (c *Config) Pool(index uint64) PoolInfo {
+	if index >= uint64(len(c.Pools)) {
+		return PoolInfo{}
+	}
+
+	return c.Pools[index]
+}
@@ -19,12 +19,20 @@
 package config
 
 import (
+	"btcminerproxy/acl"
+	"btcminerproxy/auth"
+	"btcminerproxy/profit"
+	"btcminerproxy/routing"
+	"btcminerproxy/schedule"
+	"btcminerproxy/workername"
 	"encoding/hex"
 	"errors"
 	"net"
 )
 
-var CFG Config
+// Stratum protocols of bind
+const PROTOCOL_V1 = "v1"
+const PROTOCOL_V2 = "v2"
 
 type PoolInfo struct {
 	Name           string `json:"name"`
@@ -33,6 +41,16 @@ type PoolInfo struct {
 	TlsFingerprint string `json:"fingerprint"`
 	User           string `json:"user"`
 	Pass           string `json:"pass"`
+	Protocol       string `json:"protocol"`
+	AuthorityKey   string `json:"authority_key"`
+
+	// share of total hashrate given to pool when balancing
+	Weight float64 `json:"weight"`
+
+	// worker name of miners on pool, by miner worker name or IP, then by template.
+	// User of pool is used for all when both are empty.
+	Workers        map[string]string `json:"workers"`
+	WorkerTemplate string            `json:"worker_template"`
 }
 
 type MinerInfo struct {
@@ -40,18 +58,98 @@ type MinerInfo struct {
 	PoolUrl string `json:"poolUrl"`
 }
 
+type BindInfo struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Tls      bool   `json:"tls"`
+	Protocol string `json:"protocol"`
+	Acl      string `json:"acl"`
+}
+
 type Config struct {
 	Pools []PoolInfo `json:"pools"`
-	Bind  []struct {
-		Host string `json:"host"`
-		Port uint16 `json:"port"`
-		Tls  bool   `json:"tls"`
-	} `json:"bind"`
-	Miners    []MinerInfo `json:"miner"`
+	Bind  []BindInfo `json:"bind"`
+	// access lists by name, used by binds and dashboard
+	Acls map[string]acl.Config `json:"acls"`
+	// limits of accepting miner connections, zero is unlimited
+	Limits struct {
+		MaxConnections      uint64  `json:"max_connections"`
+		MaxConnectionsPerIp uint64  `json:"max_connections_per_ip"`
+		AcceptRate          float64 `json:"accept_rate"`
+		AcceptBurst         uint64  `json:"accept_burst"`
+	} `json:"limits"`
+	Miners     []MinerInfo         `json:"miner"`
+	Routes     []routing.Rule      `json:"routes"`
+	PoolGroups map[string][]string `json:"pool_groups"`
+	Auth       struct {
+		// miners authorize with credentials of users
+		Enabled bool        `json:"enabled"`
+		Users   []auth.User `json:"users"`
+
+		// only miners from whitelisted IPs may authorize
+		WhitelistOnly bool `json:"whitelist_only"`
+	} `json:"auth"`
+	Bans struct {
+		Enabled  bool   `json:"enabled"`
+		Duration uint32 `json:"duration"`
+
+		// thresholds of banning, zero disables the check
+		InvalidSharePercent  float64 `json:"invalid_share_percent"`
+		MinShares            uint64  `json:"min_shares"`
+		MalformedMessages    uint64  `json:"malformed_messages"`
+		ConnectionsPerMinute uint64  `json:"connections_per_minute"`
+		FailedAuthorizations uint64  `json:"failed_authorizations"`
+	} `json:"bans"`
+	Aggregate struct {
+		Enabled        bool `json:"enabled"`
+		ExtraNonceSize int  `json:"extranonce_size"`
+	} `json:"aggregate"`
+	Failover struct {
+		Enabled       bool   `json:"enabled"`
+		Timeout       uint16 `json:"timeout"`
+		MaxTimeouts   int    `json:"max_timeouts"`
+		RetryInterval uint16 `json:"retry_interval"`
+	} `json:"failover"`
+	Vardiff struct {
+		Enabled         bool    `json:"enabled"`
+		StartDifficulty float64 `json:"start_difficulty"`
+		MinDifficulty   float64 `json:"min_difficulty"`
+		MaxDifficulty   float64 `json:"max_difficulty"`
+		TargetTime      float64 `json:"target_time"`
+		RetargetTime    uint16  `json:"retarget_time"`
+		VariancePercent float64 `json:"variance_percent"`
+	} `json:"vardiff"`
+	Balance struct {
+		Enabled   bool    `json:"enabled"`
+		Interval  uint16  `json:"interval"`
+		Tolerance float64 `json:"tolerance_percent"`
+	} `json:"balance"`
+	Profit struct {
+		Enabled    bool    `json:"enabled"`
+		Provider   string  `json:"provider"`
+		Source     string  `json:"source"`
+		Interval   uint16  `json:"interval"`
+		Hysteresis float64 `json:"hysteresis_percent"`
+		MinDwell   uint16  `json:"min_dwell"`
+	} `json:"profit"`
+	Schedule []schedule.Rule `json:"schedule"`
+	Sv2      struct {
+		AuthoritySecretKey  string `json:"authority_secret_key"`
+		CertificateValidity uint32 `json:"certificate_validity"`
+	} `json:"sv2"`
 	Dashboard struct {
 		Enabled bool   `json:"enabled"`
 		Port    uint16 `json:"port"`
 		Host    string `json:"host"`
+		Acl     string `json:"acl"`
+		// served with certificate of stratum TLS binds
+		Tls  bool `json:"tls"`
+		Auth struct {
+			// users log in with password or API token, their role decides what they may do
+			Enabled bool           `json:"enabled"`
+			Users   []auth.Account `json:"users"`
+			Tokens  []auth.Token   `json:"tokens"`
+		} `json:"auth"`
 	} `json:"dashboard"`
 	PrintInterval  uint16 `json:"print_interval"`
 	Interactive    bool   `json:"interactive"`
@@ -61,6 +159,7 @@ type Config struct {
 	Title          bool   `json:"title"`
 	Verbose        bool   `json:"verbose"`
 	PoolIndex      uint64 `json:"pool_index"`
+	ValidateShares bool   `json:"validate_shares"`
 }
 
 const DefaultConfig = `{
@@ -90,10 +189,77 @@ const DefaultConfig = `{
 			"tls": true
 		}
 	],
+	"acls": {},
+	"limits": {
+		"max_connections": 0,
+		"max_connections_per_ip": 0,
+		"accept_rate": 100,
+		"accept_burst": 200
+	},
+	"routes": [],
+	"pool_groups": {},
+	"auth": {
+		"enabled": false,
+		"users": [],
+		"whitelist_only": false
+	},
+	"bans": {
+		"enabled": false,
+		"duration": 3600,
+		"invalid_share_percent": 50,
+		"min_shares": 20,
+		"malformed_messages": 10,
+		"connections_per_minute": 60,
+		"failed_authorizations": 5
+	},
+	"aggregate": {
+		"enabled": false,
+		"extranonce_size": 1
+	},
+	"failover": {
+		"enabled": false,
+		"timeout": 30,
+		"max_timeouts": 3,
+		"retry_interval": 60
+	},
+	"vardiff": {
+		"enabled": false,
+		"start_difficulty": 16384,
+		"min_difficulty": 1024,
+		"max_difficulty": 16777216,
+		"target_time": 10,
+		"retarget_time": 60,
+		"variance_percent": 30
+	},
+	"balance": {
+		"enabled": false,
+		"interval": 60,
+		"tolerance_percent": 5
+	},
+	"profit": {
+		"enabled": false,
+		"provider": "file",
+		"source": "profit.json",
+		"interval": 300,
+		"hysteresis_percent": 5,
+		"min_dwell": 1800
+	},
+	"schedule": [],
+	"validate_shares": true,
+	"sv2": {
+		"authority_secret_key": "",
+		"certificate_validity": 3600
+	},
 	"dashboard": {
 		"enabled": false,
 		"port": 1315,
-		"host": "0.0.0.0"
+		"host": "0.0.0.0",
+		"tls": false,
+		"auth": {
+			"enabled": false,
+			"users": [],
+			"tokens": []
+		}
 	},
 	"print_interval": 60,
 	"interactive": true,
@@ -121,19 +287,151 @@ func (c *Config) Validate() error {
 				return errors.New("invalid SHA-256 TLS fingerprint")
 			}
 		}
-
+		if v.Protocol != "" && v.Protocol != PROTOCOL_V1 && v.Protocol != PROTOCOL_V2 {
+			return errors.New("invalid pool protocol (should be v1 or v2)")
+		}
+		if v.Protocol == PROTOCOL_V2 {
+			if v.Tls {
+				return errors.New("stratum v2 pool is encrypted by itself and can't use tls")
+			}
+			if key, err := hex.DecodeString(v.AuthorityKey); err != nil || len(key) != 32 {
+				return errors.New("invalid authority key of stratum v2 pool (should be 32 bytes hex)")
+			}
+		}
+		if v.Weight < 0 {
+			return errors.New("invalid pool weight")
+		}
+		if err := workername.Validate(v.WorkerTemplate); err != nil {
+			return err
+		}
+		for _, name := range v.Workers {
+			if err := workername.Validate(name); err != nil {
+				return err
+			}
+		}
 	}
 
 	if len(c.Bind) == 0 {
 		return errors.New("bind is empty")
 	}
+	isV2 := false
 	for _, v := range c.Bind {
+		isV2 = isV2 || v.Protocol == PROTOCOL_V2
 		if len(v.Host) == 0 || net.ParseIP(v.Host) == nil {
 			return errors.New("invalid bind host")
 		}
 		if v.Port == 0 {
 			return errors.New("invalid bind port")
 		}
+		if v.Protocol != "" && v.Protocol != PROTOCOL_V1 && v.Protocol != PROTOCOL_V2 {
+			return errors.New("invalid bind protocol (should be v1 or v2)")
+		}
+		if v.Protocol == PROTOCOL_V2 && v.Tls {
+			return errors.New("stratum v2 bind is encrypted by itself and can't use tls")
+		}
+	}
+	if isV2 {
+		if c.Sv2.AuthoritySecretKey != "" {
+			if key, err := hex.DecodeString(c.Sv2.AuthoritySecretKey); err != nil || len(key) != 32 {
+				return errors.New("invalid sv2 authority secret key (should be 32 bytes hex)")
+			}
+		}
+		if c.Sv2.CertificateValidity == 0 {
+			return errors.New("invalid sv2 certificate validity")
+		}
+	}
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+	if err := c.validateUsers(); err != nil {
+		return err
+	}
+	if err := c.validateDashboard(); err != nil {
+		return err
+	}
+	if err := c.validateAcls(); err != nil {
+		return err
+	}
+	if c.Limits.AcceptRate < 0 {
+		return errors.New("invalid accept rate")
+	}
+	if c.Bans.Enabled {
+		if c.Bans.Duration == 0 {
+			return errors.New("invalid ban duration")
+		}
+		if c.Bans.InvalidSharePercent < 0 || c.Bans.InvalidSharePercent > 100 {
+			return errors.New("invalid share percent of bans should be between 0 and 100")
+		}
+	}
+	if c.Aggregate.Enabled {
+		if c.Aggregate.ExtraNonceSize < 1 || c.Aggregate.ExtraNonceSize > 4 {
+			return errors.New("invalid aggregate extranonce size (should be between 1 and 4)")
+		}
+	}
+	if c.Failover.Enabled {
+		if c.Failover.Timeout == 0 {
+			return errors.New("invalid failover timeout")
+		}
+		if c.Failover.MaxTimeouts < 1 {
+			return errors.New("invalid failover max timeouts")
+		}
+		if c.Failover.RetryInterval == 0 {
+			return errors.New("invalid failover retry interval")
+		}
+	}
+	if c.Balance.Enabled {
+		totalWeight := 0.0
+		for _, v := range c.Pools {
+			totalWeight += v.Weight
+		}
+		if totalWeight <= 0 {
+			return errors.New("no pool has weight for balancing")
+		}
+		if c.Balance.Interval == 0 {
+			return errors.New("invalid balance interval")
+		}
+		if c.Balance.Tolerance < 0 || c.Balance.Tolerance >= 100 {
+			return errors.New("invalid balance tolerance (should be between 0 and 100)")
+		}
+	}
+	if c.Profit.Enabled {
+		if c.Balance.Enabled {
+			return errors.New("profit switching and balancing can't be enabled together")
+		}
+		if _, err := profit.New(c.Profit.Provider, c.Profit.Source); err != nil {
+			return err
+		}
+		if c.Profit.Interval == 0 {
+			return errors.New("invalid profit interval")
+		}
+		if c.Profit.Hysteresis < 0 {
+			return errors.New("invalid profit hysteresis")
+		}
+	}
+	for _, rule := range c.Schedule {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if !c.isPool(rule.Pool) {
+			return errors.New("schedule rule " + rule.Name + " uses unknown pool " + rule.Pool)
+		}
+	}
+	if c.Vardiff.Enabled {
+		if c.Vardiff.MinDifficulty <= 0 || c.Vardiff.MaxDifficulty < c.Vardiff.MinDifficulty {
+			return errors.New("invalid vardiff difficulty range")
+		}
+		if c.Vardiff.StartDifficulty < c.Vardiff.MinDifficulty || c.Vardiff.StartDifficulty > c.Vardiff.MaxDifficulty {
+			return errors.New("invalid vardiff start difficulty (should be between min and max difficulty)")
+		}
+		if c.Vardiff.TargetTime <= 0 {
+			return errors.New("invalid vardiff target time")
+		}
+		if c.Vardiff.RetargetTime == 0 {
+			return errors.New("invalid vardiff retarget time")
+		}
+		if c.Vardiff.VariancePercent < 0 || c.Vardiff.VariancePercent >= 100 {
+			return errors.New("invalid vardiff variance (should be between 0 and 100)")
+		}
 	}
 	if c.PrintInterval == 0 {
 		return errors.New("invalid print interval")
@@ -143,3 +441,104 @@ func (c *Config) Validate() error {
 	}
 	return nil
 }
+
+func (c *Config) isPool(url string) bool {
+	for _, v := range c.Pools {
+		if v.Url == url {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateRoutes() error {
+	for name, urls := range c.PoolGroups {
+		if len(urls) == 0 {
+			return errors.New("pool group " + name + " is empty")
+		}
+		for _, url := range urls {
+			if !c.isPool(url) {
+				return errors.New("pool group " + name + " uses unknown pool " + url)
+			}
+		}
+	}
+	// Rules are validated in place, they keep what they compiled for matching
+	for idx := range c.Routes {
+		rule := &c.Routes[idx]
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if rule.Pool != "" && !c.isPool(rule.Pool) {
+			return errors.New("routing rule " + rule.Name + " uses unknown pool " + rule.Pool)
+		}
+		if _, ok := c.PoolGroups[rule.Group]; rule.Group != "" && !ok {
+			return errors.New("routing rule " + rule.Name + " uses unknown pool group " + rule.Group)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateUsers() error {
+	names := make(map[string]bool, len(c.Auth.Users))
+	for _, user := range c.Auth.Users {
+		if err := user.Validate(); err != nil {
+			return err
+		}
+		if names[user.Name] {
+			return errors.New("user " + user.Name + " is defined twice")
+		}
+		names[user.Name] = true
+		for _, url := range user.Pools {
+			if !c.isPool(url) {
+				return errors.New("user " + user.Name + " uses unknown pool " + url)
+			}
+		}
+	}
+	if c.Auth.Enabled && len(c.Auth.Users) == 0 {
+		return errors.New("authorization is enabled without users")
+	}
+	return nil
+}
+
+func (c *Config) validateDashboard() error {
+	names := make(map[string]bool, len(c.Dashboard.Auth.Users)+len(c.Dashboard.Auth.Tokens))
+	for _, user := range c.Dashboard.Auth.Users {
+		if err := user.Validate(); err != nil {
+			return err
+		}
+		if names[user.Name] {
+			return errors.New("dashboard user " + user.Name + " is defined twice")
+		}
+		names[user.Name] = true
+	}
+	for _, token := range c.Dashboard.Auth.Tokens {
+		if err := token.Validate(); err != nil {
+			return err
+		}
+		if names[token.Name] {
+			return errors.New("dashboard token " + token.Name + " has name of another user or token")
+		}
+		names[token.Name] = true
+	}
+	if c.Dashboard.Auth.Enabled && len(names) == 0 {
+		return errors.New("dashboard authentication is enabled without users or tokens")
+	}
+	return nil
+}
+
+func (c *Config) validateAcls() error {
+	for name, list := range c.Acls {
+		if _, err := acl.Parse(list); err != nil {
+			return errors.New("acl " + name + ": " + err.Error())
+		}
+	}
+	for _, v := range c.Bind {
+		if _, ok := c.Acls[v.Acl]; v.Acl != "" && !ok {
+			return errors.New("bind uses unknown acl " + v.Acl)
+		}
+	}
+	if _, ok := c.Acls[c.Dashboard.Acl]; c.Dashboard.Acl != "" && !ok {
+		return errors.New("dashboard uses unknown acl " + c.Dashboard.Acl)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/venuslog"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Changes of config made at runtime are written back to config file atomically.
+// Every change is kept in redis as a revision with the whole config and who made
+// it, so config can be rolled back. Changes made by proxy itself, like miners
+// assigned to pools, are saved together periodically, and before config is changed
+// by someone else, so every revision holds only changes of whom it is credited to.
+// Revisions are kept without secrets, rollback takes them from running config.
+
+type ConfigRevision struct {
+	Revision int64           `json:"revision"`
+	Time     string          `json:"time"`
+	Who      string          `json:"who"`
+	Change   string          `json:"change"`
+	Config   json.RawMessage `json:"config,omitempty"`
+}
+
+var configMut mutex.Mutex
+
+// Changes made by proxy which weren't saved yet
+var pendingChanges = make([]string, 0)
+var pendingMut mutex.Mutex
+
+// Config as it is now, miners and routes are locked while it is copied.
+// Miners moved by schedule are saved with the pool they go back to.
+// configMut must be locked
+func savedConfig() config.Config {
+
+	minersMut.Lock()
+	routesMut.Lock()
+	defer routesMut.Unlock()
+	defer minersMut.Unlock()
+
+	cfg := *config.Get()
+	cfg.Miners = append([]config.MinerInfo(nil), cfg.Miners...)
+	keepRestartSettings(&cfg)
+
+	for idx, miner := range cfg.Miners {
+		if returnPool, isScheduled := scheduledMiners[miner.IP]; isScheduled {
+			cfg.Miners[idx].PoolUrl = returnPool
+		}
+	}
+
+	return cfg
+}
+
+// Config as it is written to file, configMut must be locked
+func marshalConfig() ([]byte, error) {
+	return json.MarshalIndent(savedConfig(), "", "\t")
+}
+
+// Save changes made by proxy, they are written to file together
+func saveConfig() error {
+
+	configMut.Lock()
+	defer configMut.Unlock()
+
+	change := takePendingChanges()
+	if change == "" {
+		return nil
+	}
+
+	return writeConfig("proxy", change)
+}
+
+// Apply change made by someone else than proxy, write config to file and keep it
+// as revision of who made it. Changes made by proxy before are kept first as its own
+// revision, so revisions stay in order.
+func saveChange(who string, change string, apply func() error) error {
+
+	configMut.Lock()
+	defer configMut.Unlock()
+
+	if pending := takePendingChanges(); pending != "" {
+		addRevision("proxy", pending, savedConfig())
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	return writeConfig(who, change)
+}
+
+// Write config to file and keep it as a new revision, configMut must be locked
+func writeConfig(who string, change string) error {
+
+	cfg := savedConfig()
+
+	data, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	err = config.WriteFileAtomic(config.CONFIG_FILE, data)
+	if err != nil {
+		venuslog.Warn("Failed to write config", err)
+		return err
+	}
+
+	rememberConfigFile(data)
+
+	return addRevision(who, change, cfg)
+}
+
+// Keep config without secrets as revision in redis, configMut must be locked
+func addRevision(who string, change string, cfg config.Config) error {
+
+	data, err := json.MarshalIndent(redactedConfig(cfg), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	revision, err := db.Incr("config_revision").Result()
+	if err != nil {
+		venuslog.Warn("Failed to keep config revision", err)
+		return err
+	}
+
+	record, _ := json.Marshal(ConfigRevision{
+		Revision: revision,
+		Time:     time.Now().Format(time.RFC3339),
+		Who:      who,
+		Change:   change,
+		Config:   data,
+	})
+
+	db.LPush("config_revisions", string(record))
+	db.LTrim("config_revisions", 0, config.CONFIG_REVISIONS-1)
+
+	venuslog.Info("Config revision", revision, "by", who+":", change)
+
+	return nil
+}
+
+// Loaded config is the first revision when there is none
+func initConfigRevisions() {
+
+	count, err := db.LLen("config_revisions").Result()
+	if err != nil || count > 0 {
+		return
+	}
+
+	configMut.Lock()
+	defer configMut.Unlock()
+
+	addRevision("proxy", "loaded "+config.CONFIG_FILE, savedConfig())
+}
+
+// Kept revisions, the latest first, with or without their config
+func getRevisions(withConfig bool) ([]ConfigRevision, error) {
+
+	records, err := db.LRange("config_revisions", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]ConfigRevision, 0, len(records))
+	for _, record := range records {
+
+		revision := ConfigRevision{}
+		if json.Unmarshal([]byte(record), &revision) != nil {
+			continue
+		}
+
+		if !withConfig {
+			revision.Config = nil
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// Go back to config of revision, it is applied like reloaded config file
+func rollbackConfig(revision int64, who string) error {
+
+	revisions, err := getRevisions(true)
+	if err != nil {
+		return err
+	}
+
+	var found *ConfigRevision
+	for idx := range revisions {
+		if revisions[idx].Revision == revision {
+			found = &revisions[idx]
+			break
+		}
+	}
+
+	if found == nil {
+		return fmt.Errorf("revision %d is not kept", revision)
+	}
+
+	candidate := config.Config{}
+	if err := json.Unmarshal(found.Config, &candidate); err != nil {
+		return err
+	}
+
+	return saveChange(who, fmt.Sprintf("rollback to revision %d", revision), func() error {
+
+		if err := restoreSecrets(&candidate, savedConfig()); err != nil {
+			return err
+		}
+
+		if err := candidate.Validate(); err != nil {
+			return errors.New("config of revision is invalid: " + err.Error())
+		}
+
+		return applyConfig(&candidate)
+	})
+}
+
+// Secrets which revision was kept without are taken from running config by url or name
+func restoreSecrets(cfg *config.Config, running config.Config) error {
+
+	for idx := range cfg.Pools {
+		pool := &cfg.Pools[idx]
+		if pool.Pass != REDACTED {
+			continue
+		}
+		for _, runningPool := range running.Pools {
+			if runningPool.Url == pool.Url {
+				pool.Pass = runningPool.Pass
+			}
+		}
+		if pool.Pass == REDACTED {
+			return errors.New("password of pool " + pool.Url + " is not kept, it was deleted since revision")
+		}
+	}
+
+	for idx := range cfg.Auth.Users {
+		user := &cfg.Auth.Users[idx]
+		for _, runningUser := range running.Auth.Users {
+			if runningUser.Name == user.Name && user.PasswordHash == REDACTED {
+				user.PasswordHash = runningUser.PasswordHash
+			}
+		}
+		if user.PasswordHash == REDACTED {
+			return errors.New("password of user " + user.Name + " is not kept, it was deleted since revision")
+		}
+	}
+
+	for idx := range cfg.Dashboard.Auth.Users {
+		account := &cfg.Dashboard.Auth.Users[idx]
+		for _, runningAccount := range running.Dashboard.Auth.Users {
+			if runningAccount.Name == account.Name && account.PasswordHash == REDACTED {
+				account.PasswordHash = runningAccount.PasswordHash
+			}
+		}
+		if account.PasswordHash == REDACTED {
+			return errors.New("password of dashboard user " + account.Name + " is not kept, it was deleted since revision")
+		}
+	}
+
+	for idx := range cfg.Dashboard.Auth.Tokens {
+		token := &cfg.Dashboard.Auth.Tokens[idx]
+		for _, runningToken := range running.Dashboard.Auth.Tokens {
+			if runningToken.Name == token.Name && token.Hash == REDACTED {
+				token.Hash = runningToken.Hash
+			}
+		}
+		if token.Hash == REDACTED {
+			return errors.New("dashboard token " + token.Name + " is not kept, it was deleted since revision")
+		}
+	}
+
+	// Authority key needs restart, it is the one of config file
+	if cfg.Sv2.AuthoritySecretKey == REDACTED {
+		cfg.Sv2.AuthoritySecretKey = running.Sv2.AuthoritySecretKey
+	}
+
+	return nil
+}
+
+// Config which failed validation
+var errInvalidConfig = errors.New("invalid config")
+
+// Change running config, changed copy is validated, applied like reloaded config and saved
+func changeConfig(who string, change string, edit func(cfg *config.Config) error) error {
+	return saveChange(who, change, func() error {
+		return editConfig(edit)
+	})
+}
+
+// Edit copy of running config and apply it, configMut must be locked
+func editConfig(edit func(cfg *config.Config) error) error {
+
+	data, err := marshalConfig()
+	if err != nil {
+		return err
+	}
+
+	candidate := config.Config{}
+	if err := json.Unmarshal(data, &candidate); err != nil {
+		return err
+	}
+
+	if err := edit(&candidate); err != nil {
+		return err
+	}
+
+	if err := candidate.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidConfig, err)
+	}
+
+	return applyConfig(&candidate)
+}
+
+// Remember change made by proxy, it is saved with others later
+func configChanged(change string) {
+	pendingMut.Lock()
+	pendingChanges = append(pendingChanges, change)
+	pendingMut.Unlock()
+}
+
+// Changes made by proxy which weren't saved yet, described together
+func takePendingChanges() string {
+
+	pendingMut.Lock()
+	changes := pendingChanges
+	pendingChanges = make([]string, 0)
+	pendingMut.Unlock()
+
+	if len(changes) > 3 {
+		return fmt.Sprintf("%s and %d more", strings.Join(changes[:3], ", "), len(changes)-3)
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// Save changes made by proxy periodically
+func watchConfigChanges() {
+	for {
+		time.Sleep(config.CONFIG_SAVE_SECONDS * time.Second)
+
+		pendingMut.Lock()
+		pending := len(pendingChanges)
+		pendingMut.Unlock()
+
+		if pending > 0 {
+			saveConfig()
+		}
+	}
+}
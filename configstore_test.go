@@ -0,0 +1,212 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config with secrets, saved to config file in temporary directory, restored after test
+func revisionConfig(t *testing.T) []string {
+
+	cfg := config.Get()
+	restart := restartConfig
+	wd, _ := os.Getwd()
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		config.Set(cfg)
+		restartConfig = restart
+		takePendingChanges()
+	})
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenHash := sha256.Sum256([]byte("token"))
+
+	next := &config.Config{}
+	if err := json.Unmarshal([]byte(config.DefaultConfig), next); err != nil {
+		t.Fatal(err)
+	}
+	next.Bind = []config.BindInfo{testBind(t)}
+	next.Pools = []config.PoolInfo{
+		{Url: "pool-a:3333", User: "pooluser", Pass: "poolsecret"},
+		{Url: "pool-b:3333", User: "pooluser", Pass: "poolsecret"},
+	}
+	next.Miners = []config.MinerInfo{{IP: "10.0.0.1", PoolUrl: "pool-a:3333"}}
+	next.Auth.Users = []auth.User{{Name: "alice", PasswordHash: string(passwordHash)}}
+	next.Dashboard.Auth.Tokens = []auth.Token{{Name: "ci", Hash: hex.EncodeToString(tokenHash[:]), Role: auth.ADMIN}}
+	config.Set(next)
+
+	return []string{"poolsecret", string(passwordHash), hex.EncodeToString(tokenHash[:])}
+}
+
+// Bind which is listening already, reload keeps it
+func testBind(t *testing.T) config.BindInfo {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bind := config.BindInfo{Host: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+	listeners[bindAddr(bind)] = &bindListener{bind: bind, listener: listener}
+
+	t.Cleanup(func() {
+		delete(listeners, bindAddr(bind))
+		listener.Close()
+	})
+
+	return bind
+}
+
+// Change made by proxy and change made by user are kept as their own revisions
+func TestSaveChange(t *testing.T) {
+
+	redis := useTestRedis(t)
+	secrets := revisionConfig(t)
+
+	config.Update(func(cfg *config.Config) {
+		cfg.Miners[0].PoolUrl = "pool-b:3333"
+	})
+	configChanged("moved miner 10.0.0.1 to pool-b:3333")
+
+	err := changeConfig("alice@127.0.0.1", "changed weight of pool-a:3333", func(cfg *config.Config) error {
+		cfg.Pools[0].Weight = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := getRevisions(true)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions %+v, error %v", revisions, err)
+	}
+
+	tests := []struct {
+		who     string
+		change  string
+		weight  float64
+		poolUrl string
+	}{
+		{"alice@127.0.0.1", "changed weight of pool-a:3333", 2, "pool-b:3333"},
+		{"proxy", "moved miner 10.0.0.1 to pool-b:3333", 0, "pool-b:3333"},
+	}
+
+	for idx, test := range tests {
+
+		revision := revisions[idx]
+		saved := config.Config{}
+		json.Unmarshal(revision.Config, &saved)
+
+		if revision.Who != test.who || revision.Change != test.change {
+			t.Errorf("revision %d is %q by %s, expected %q by %s", idx, revision.Change, revision.Who, test.change, test.who)
+		}
+		if saved.Pools[0].Weight != test.weight || saved.Miners[0].PoolUrl != test.poolUrl {
+			t.Errorf("revision %d by %s keeps weight %v and miner on %s", idx, revision.Who, saved.Pools[0].Weight, saved.Miners[0].PoolUrl)
+		}
+	}
+
+	// Secrets stay in config file only
+	for _, record := range redis.lists["config_revisions"] {
+		for _, secret := range secrets {
+			if strings.Contains(record, secret) {
+				t.Fatalf("revision keeps secret %s", secret)
+			}
+		}
+	}
+
+	file, _ := os.ReadFile(config.CONFIG_FILE)
+	for _, secret := range secrets {
+		if !strings.Contains(string(file), secret) {
+			t.Fatalf("config file lost secret %s", secret)
+		}
+	}
+}
+
+// Rollback takes secrets which revision was kept without from running config
+func TestRollbackSecrets(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		edit  func(cfg *config.Config)
+		error string
+	}{
+		{"secrets kept", func(cfg *config.Config) {}, ""},
+		{"pool deleted", func(cfg *config.Config) { cfg.Pools = cfg.Pools[1:] }, "password of pool pool-a:3333 is not kept"},
+		{"user deleted", func(cfg *config.Config) { cfg.Auth.Users = nil }, "password of user alice is not kept"},
+		{"token deleted", func(cfg *config.Config) { cfg.Dashboard.Auth.Tokens = nil }, "dashboard token ci is not kept"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			useTestRedis(t)
+			secrets := revisionConfig(t)
+
+			config.Update(func(cfg *config.Config) {
+				cfg.Miners = nil
+			})
+			initConfigRevisions()
+
+			err := changeConfig("alice@127.0.0.1", test.name, func(cfg *config.Config) error {
+				test.edit(cfg)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = rollbackConfig(1, "bob@127.0.0.1")
+
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("rollback returned %v, expected %q", err, test.error)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := config.Get()
+			if cfg.Pools[0].Pass != secrets[0] || cfg.Auth.Users[0].PasswordHash != secrets[1] || cfg.Dashboard.Auth.Tokens[0].Hash != secrets[2] {
+				t.Fatalf("secrets after rollback: %+v %+v %+v", cfg.Pools[0], cfg.Auth.Users[0], cfg.Dashboard.Auth.Tokens[0])
+			}
+		})
+	}
+}
@@ -3,10 +3,18 @@ package main
 import (
 	"btcminerproxy/config"
 	"btcminerproxy/dash"
+	"btcminerproxy/metrics"
+	"btcminerproxy/mutex"
+	"btcminerproxy/routing"
+	stratumserver "btcminerproxy/stratum/server"
 	"btcminerproxy/venuslog"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math"
+	"net"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -31,10 +39,86 @@ func timeSince(epoch int64) string {
 	}
 }
 
+// Server of dashboard, it is started again when reloaded config changes its address or TLS
+var dashboard *http.Server
+var dashboardMut mutex.Mutex
+
 func StartDashboard() {
+	serveDashboard(dashboardHandler())
+}
+
+func dashboardAddr() string {
+	return net.JoinHostPort(config.Get().Dashboard.Host, strconv.FormatUint(uint64(config.Get().Dashboard.Port), 10))
+}
+
+// Serve dashboard on address of config until it is stopped
+func serveDashboard(handler http.Handler) {
+
+	server := &http.Server{Addr: dashboardAddr(), Handler: handler}
+
+	if config.Get().Dashboard.Tls {
+		cert, err := stratumserver.LoadCertificate()
+		if err != nil {
+			venuslog.Warn("Dashboard stopped, no TLS certificate:", err)
+			return
+		}
+
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	dashboardMut.Lock()
+	dashboard = server
+	dashboardMut.Unlock()
+
+	venuslog.Info("Dashboard listening on", server.Addr)
+
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		venuslog.Warn("Dashboard stopped:", err)
+	}
+}
+
+// Move dashboard to address or TLS setting of reloaded config, access list and users
+// are checked on every request. Requests in progress, like the one which changed config,
+// are finished first.
+func reloadDashboard() {
+
+	dashboardMut.Lock()
+	server := dashboard
+	dashboardMut.Unlock()
+
+	if server == nil || (server.Addr == dashboardAddr() && (server.TLSConfig != nil) == config.Get().Dashboard.Tls) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		server.Shutdown(ctx)
+		serveDashboard(server.Handler)
+	}()
+}
+
+func dashboardHandler() http.Handler {
 
 	r := gin.Default()
 
+	// Address of client is taken from socket, forwarded headers could be forged
+	r.Use(func(c *gin.Context) {
+		if !getAcl(config.Get().Dashboard.Acl).AllowsAddr(c.Request.RemoteAddr) {
+			dashboardFail(c, 403, "forbidden", "address is denied by acl")
+		}
+	})
+
+	r.Use(dashboardAuth)
+
 	r.GET("/", func(c *gin.Context) {
 		c.Data(200, "text/html", dash.MainPage)
 	})
@@ -43,11 +127,18 @@ func StartDashboard() {
 		getStats()
 		c.JSON(200, gin.H{
 			"hr":        avgHashrate,
+			"hashrate":  globalHashrate.Hashrates(),
+			"pools":     poolHashrateReport(),
 			"miners":    numMiners,
 			"upstreams": numUpstreams,
+			"rejected":  srv.RejectedConnections(),
 		})
 	})
 
+	r.GET("/metrics", func(c *gin.Context) {
+		c.Data(200, metrics.CONTENT_TYPE, metricsReport())
+	})
+
 	r.GET("/hr_chart", func(c *gin.Context) {
 		c.JSON(200, hrChart)
 	})
@@ -61,7 +152,7 @@ func StartDashboard() {
 
 		for _, v := range hrChart {
 			cd.Labels = append(cd.Labels, timeSince(v.Time))
-			cd.Data = append(cd.Data, math.Round(v.Hr/10)/100)
+			cd.Data = append(cd.Data, math.Round(v.Hr/1e10)/100)
 			cd.Miners = append(cd.Miners, v.Miners)
 		}
 
@@ -69,7 +160,11 @@ func StartDashboard() {
 	})
 
 	r.GET("/configuration", func(c *gin.Context) {
-		c.JSON(200, config.CFG)
+		if isAdmin(c) {
+			c.JSON(200, config.Get())
+		} else {
+			c.JSON(200, redactedConfig(*config.Get()))
+		}
 	})
 
 	r.GET("/disconnect", func(c *gin.Context) {
@@ -137,11 +232,32 @@ func StartDashboard() {
 		})
 	})
 
+	r.GET("/bans", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"list": getBans(),
+		})
+	})
+
+	r.GET("/delBan", func(c *gin.Context) {
+		remoteAddr := c.Query("addr")
+
+		delBan(remoteAddr)
+
+		c.JSON(200, gin.H{
+			"result": "ok",
+		})
+	})
+
 	r.GET("/getPoolList", func(c *gin.Context) {
 
+		pools := config.Get().Pools
+		if !isAdmin(c) {
+			pools = redactedPools(pools)
+		}
+
 		c.JSON(200, gin.H{
-			"list":       config.CFG.Pools,
-			"currentIdx": config.CFG.PoolIndex,
+			"list":       pools,
+			"currentIdx": config.Get().PoolIndex,
 		})
 	})
 
@@ -150,8 +266,17 @@ func StartDashboard() {
 		poolUrlStr := c.Query("pool")
 		minerIpStr := c.Query("miner")
 
+		result := ""
+		saveChange(changedBy(c), "set pool of miner "+minerIpStr+" to "+poolUrlStr, func() error {
+			var ok bool
+			if result, ok = setPool(poolUrlStr, minerIpStr); !ok {
+				return errors.New(result)
+			}
+			return nil
+		})
+
 		c.JSON(200, gin.H{
-			"list": setPool(poolUrlStr, minerIpStr),
+			"list": result,
 		})
 	})
 
@@ -162,6 +287,86 @@ func StartDashboard() {
 		})
 	})
 
+	r.GET("/routes", func(c *gin.Context) {
+
+		routes, groups := getRoutes()
+
+		c.JSON(200, gin.H{
+			"list":   routes,
+			"groups": groups,
+		})
+	})
+
+	// Routing rules are replaced by the JSON array of body
+	r.POST("/routes", func(c *gin.Context) {
+
+		routes := make([]routing.Rule, 0)
+
+		if err := c.ShouldBindJSON(&routes); err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err := saveChange(changedBy(c), fmt.Sprintf("set %d routing rules", len(routes)), func() error {
+			return setRoutes(routes)
+		})
+
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"list": routes,
+		})
+	})
+
+	r.GET("/config/revisions", func(c *gin.Context) {
+
+		revisions, err := getRevisions(false)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"list": revisions,
+		})
+	})
+
+	r.GET("/config/rollback", func(c *gin.Context) {
+
+		revision, err := strconv.ParseInt(c.Query("revision"), 10, 64)
+
+		if err == nil {
+			err = rollbackConfig(revision, changedBy(c))
+		}
+
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"result": "ok",
+		})
+	})
+
+	r.GET("/schedule", func(c *gin.Context) {
+
+		c.JSON(200, gin.H{
+			"list": scheduleReport(),
+		})
+	})
+
 	r.GET("/addPool", func(c *gin.Context) {
 
 		// {
@@ -177,12 +382,6 @@ func StartDashboard() {
 		poolUser := c.Query("user")
 		poolPass := c.Query("pass")
 
-		venuslog.Warn("poolUrl", poolName)
-		venuslog.Warn("poolUrl", poolUrl)
-		venuslog.Warn("poolTls", poolTls)
-		venuslog.Warn("poolUser", poolUser)
-		venuslog.Warn("poolPass", poolPass)
-
 		newPool := config.PoolInfo{
 			Name:           poolName,
 			Url:            poolUrl,
@@ -192,52 +391,41 @@ func StartDashboard() {
 			Pass:           poolPass,
 		}
 
-		config.CFG.Pools = append(config.CFG.Pools, newPool)
+		err := changeConfig(changedBy(c), "added pool "+poolUrl, func(cfg *config.Config) error {
+			_, err := addPool(cfg, newPool)
+			return err
+		})
 
-		str, _ := json.Marshal(config.CFG.Pools)
-		venuslog.Warn("newPool", string(str))
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
 
 		c.JSON(200, gin.H{
-			"list": config.CFG.Pools,
+			"list": config.Get().Pools,
 		})
 	})
 
 	r.GET("/delPool", func(c *gin.Context) {
 
 		poolUrl := c.Query("url")
-		var poolIndex uint64
-
-		poolIndex = 10000
-
-		venuslog.Warn("poolUrl", poolUrl)
-
-		if config.CFG.Pools[config.CFG.PoolIndex].Url == poolUrl {
-			closeAllUpstream()
-			poolIndex = config.CFG.PoolIndex
-		} else {
 
-			for i, pool := range config.CFG.Pools {
-				if pool.Url == poolUrl {
-					poolIndex = uint64(i)
-					break
-				}
-			}
-		}
+		err := changeConfig(changedBy(c), "deleted pool "+poolUrl, func(cfg *config.Config) error {
+			_, err := removePool(cfg, poolUrl)
+			return err
+		})
 
-		if poolIndex == 10000 {
-			c.JSON(200, gin.H{
-				"list": "There is no Pool with that url",
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
 			})
 			return
 		}
 
-		config.CFG.Pools = append(config.CFG.Pools[:poolIndex], config.CFG.Pools[poolIndex+1:]...)
-
-		str, _ := json.Marshal(config.CFG.Pools)
-		venuslog.Warn("newPool", string(str))
-
 		c.JSON(200, gin.H{
-			"list": config.CFG.Pools,
+			"list": config.Get().Pools,
 		})
 	})
 
@@ -261,5 +449,7 @@ func StartDashboard() {
 		}
 	})
 
-	r.Run(fmt.Sprintf("%s:%d", config.CFG.Dashboard.Host, config.CFG.Dashboard.Port))
+	registerApi(r)
+
+	return r
 }
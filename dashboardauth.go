@@ -0,0 +1,231 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"crypto/sha256"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dashboard users log in with HTTP basic authentication or with API token as bearer.
+// Reading needs viewer role, disconnecting and banning miners operator and changing
+// pools and config admin. Secrets of config are redacted for users which aren't admin.
+
+const REDACTED = "<redacted>"
+
+// Roles needed by routes which don't follow their method, keyed by method and path
+var routeRoles = map[string]string{
+	"GET /disconnect":      auth.OPERATOR,
+	"GET /addWhite":        auth.OPERATOR,
+	"GET /delWhite":        auth.OPERATOR,
+	"GET /addBlack":        auth.OPERATOR,
+	"GET /delBlack":        auth.OPERATOR,
+	"GET /delBan":          auth.OPERATOR,
+	"GET /setPool":         auth.ADMIN,
+	"GET /addPool":         auth.ADMIN,
+	"GET /delPool":         auth.ADMIN,
+	"GET /config/rollback": auth.ADMIN,
+}
+
+// Passwords which matched, keyed by hash of user, password and its bcrypt hash
+var logins = make(map[[32]byte]time.Time)
+var loginsMut mutex.Mutex
+
+// Role needed by route, reading needs viewer and changing admin unless route says otherwise
+func requiredRole(c *gin.Context) string {
+
+	if role, ok := routeRoles[c.Request.Method+" "+c.FullPath()]; ok {
+		return role
+	}
+
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return auth.VIEWER
+	}
+
+	return auth.ADMIN
+}
+
+// Password of user matches, matches are remembered for a while
+func checkLogin(account *auth.Account, password string) bool {
+
+	key := sha256.Sum256([]byte(account.Name + "\x00" + password + "\x00" + account.PasswordHash))
+
+	loginsMut.Lock()
+	expires, ok := logins[key]
+	loginsMut.Unlock()
+
+	if ok && time.Now().Before(expires) {
+		return true
+	}
+
+	if !account.CheckPassword(password) {
+		return false
+	}
+
+	loginsMut.Lock()
+	for other, otherExpires := range logins {
+		if time.Now().After(otherExpires) {
+			delete(logins, other)
+		}
+	}
+	logins[key] = time.Now().Add(config.DASHBOARD_LOGIN_MINUTES * time.Minute)
+	loginsMut.Unlock()
+
+	return true
+}
+
+// Name and role of user who sent request, ok is false when credentials are missing or wrong
+func authenticate(c *gin.Context) (name string, role string, ok bool) {
+
+	users := config.Get().Dashboard.Auth.Users
+	tokens := config.Get().Dashboard.Auth.Tokens
+
+	if secret, isBearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); isBearer {
+
+		token := auth.FindToken(tokens, secret)
+		if token == nil {
+			return "", "", false
+		}
+
+		return token.Name, token.Role, true
+	}
+
+	name, password, isBasic := c.Request.BasicAuth()
+	if !isBasic {
+		return "", "", false
+	}
+
+	account := auth.FindAccount(users, name)
+	if account == nil || !checkLogin(account, password) {
+		return "", "", false
+	}
+
+	return account.Name, account.Role, true
+}
+
+// Refuse request, API gets its error envelope
+func dashboardFail(c *gin.Context, status int, code string, message string) {
+
+	if strings.HasPrefix(c.Request.URL.Path, API_PREFIX+"/") {
+		apiFail(c, &apiError{Status: status, Code: code, Message: message})
+		return
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": code,
+	})
+}
+
+// Authenticate user of request and check its role, everybody is admin when authentication is disabled
+func dashboardAuth(c *gin.Context) {
+
+	if !config.Get().Dashboard.Auth.Enabled {
+		c.Set("role", auth.ADMIN)
+		return
+	}
+
+	name, role, ok := authenticate(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="BtcMinerProxy"`)
+		dashboardFail(c, http.StatusUnauthorized, "unauthorized", "authentication is required")
+		return
+	}
+
+	c.Set("user", name)
+	c.Set("role", role)
+
+	if required := requiredRole(c); !auth.RoleAllows(role, required) {
+		dashboardFail(c, http.StatusForbidden, "forbidden", "role "+required+" is required")
+	}
+}
+
+func isAdmin(c *gin.Context) bool {
+	return c.GetString("role") == auth.ADMIN
+}
+
+// Who made change of config, user when dashboard has authentication and address of client
+func changedBy(c *gin.Context) string {
+
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+
+	if user := c.GetString("user"); user != "" {
+		return user + "@" + host
+	}
+
+	return host
+}
+
+// Pools without passwords
+func redactedPools(pools []config.PoolInfo) []config.PoolInfo {
+
+	redacted := make([]config.PoolInfo, len(pools))
+	copy(redacted, pools)
+
+	for idx := range redacted {
+		if redacted[idx].Pass != "" {
+			redacted[idx].Pass = REDACTED
+		}
+	}
+
+	return redacted
+}
+
+// Config without passwords, password hashes, tokens and keys
+func redactedConfig(cfg config.Config) config.Config {
+
+	cfg.Pools = redactedPools(cfg.Pools)
+
+	users := make([]auth.User, len(cfg.Auth.Users))
+	for idx, user := range cfg.Auth.Users {
+		user.PasswordHash = REDACTED
+		users[idx] = user
+	}
+	cfg.Auth.Users = users
+
+	accounts := make([]auth.Account, len(cfg.Dashboard.Auth.Users))
+	for idx, account := range cfg.Dashboard.Auth.Users {
+		account.PasswordHash = REDACTED
+		accounts[idx] = account
+	}
+	cfg.Dashboard.Auth.Users = accounts
+
+	tokens := make([]auth.Token, len(cfg.Dashboard.Auth.Tokens))
+	for idx, token := range cfg.Dashboard.Auth.Tokens {
+		token.Hash = REDACTED
+		tokens[idx] = token
+	}
+	cfg.Dashboard.Auth.Tokens = tokens
+
+	if cfg.Sv2.AuthoritySecretKey != "" {
+		cfg.Sv2.AuthoritySecretKey = REDACTED
+	}
+
+	return cfg
+}
@@ -0,0 +1,150 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Dashboard of apiConfig with operator who logs in with password
+func operatorDashboard(t *testing.T) (http.Handler, []string) {
+
+	handler := apiConfig(t)
+	secrets := []string{"poolsecret"}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("operatorsecret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Update(func(cfg *config.Config) {
+		cfg.Dashboard.Auth.Users = []auth.Account{{Name: "bob", PasswordHash: string(passwordHash), Role: auth.OPERATOR}}
+		for _, token := range cfg.Dashboard.Auth.Tokens {
+			secrets = append(secrets, token.Hash)
+		}
+	})
+
+	return handler, append(secrets, string(passwordHash))
+}
+
+func basicRequest(handler http.Handler, method string, path string, user string, password string, body string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(user, password)
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	return res
+}
+
+func TestDashboardRoles(t *testing.T) {
+
+	handler, _ := operatorDashboard(t)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		password string
+		body     string
+		status   int
+	}{
+		{"wrong password", "GET", "/configuration", "wrong", "", http.StatusUnauthorized},
+		{"operator reads", "GET", "/configuration", "operatorsecret", "", http.StatusOK},
+		{"operator reads api", "GET", "/api/v1/bans", "operatorsecret", "", http.StatusOK},
+		{"operator bans", "POST", "/api/v1/bans", "operatorsecret", `{"ip": "10.0.0.9", "duration": 60}`, http.StatusCreated},
+		{"operator lifts ban", "GET", "/delBan?ip=10.0.0.9", "operatorsecret", "", http.StatusOK},
+		{"operator can't change pools", "GET", "/setPool?miner=10.0.0.1&pool=pool-b:3333", "operatorsecret", "", http.StatusForbidden},
+		{"operator can't change pools in api", "PUT", "/api/v1/pools/pool-a:3333", "operatorsecret", `{"weight": 1}`, http.StatusForbidden},
+		{"operator can't roll back config", "GET", "/config/rollback?id=1", "operatorsecret", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+
+		res := basicRequest(handler, test.method, test.path, "bob", test.password, test.body)
+		if res.Code != test.status {
+			t.Errorf("%s: status %d, expected %d: %s", test.name, res.Code, test.status, res.Body.String())
+		}
+	}
+
+	res := apiRequest(handler, "GET", "/configuration", "", "")
+	if res.Code != http.StatusUnauthorized || !strings.HasPrefix(res.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("request without credentials got %d, header %q", res.Code, res.Header().Get("WWW-Authenticate"))
+	}
+}
+
+// Only admin reads secrets of config, everybody is admin while authentication is disabled
+func TestDashboardRedaction(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		isEnabled bool
+		token     string
+		password  string
+		isSecret  bool
+	}{
+		{"viewer token", true, "viewer", "", false},
+		{"operator", true, "", "operatorsecret", false},
+		{"admin token", true, "token", "", true},
+		{"authentication disabled", false, "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			handler, secrets := operatorDashboard(t)
+			config.Update(func(cfg *config.Config) {
+				cfg.Dashboard.Auth.Enabled = test.isEnabled
+			})
+
+			for _, path := range []string{"/configuration", "/api/v1/pools"} {
+
+				res := apiRequest(handler, "GET", path, test.token, "")
+				if test.password != "" {
+					res = basicRequest(handler, "GET", path, "bob", test.password, "")
+				}
+
+				if res.Code != http.StatusOK {
+					t.Fatalf("%s: status %d", path, res.Code)
+				}
+
+				if strings.Contains(res.Body.String(), "poolsecret") != test.isSecret {
+					t.Fatalf("%s: password of pool shown is %v", path, !test.isSecret)
+				}
+
+				// Hashes are redacted too
+				if !test.isSecret {
+					for _, secret := range secrets {
+						if strings.Contains(res.Body.String(), secret) {
+							t.Fatalf("%s shows %s", path, secret)
+						}
+					}
+				}
+			}
+		})
+	}
+}
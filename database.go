@@ -20,10 +20,12 @@ package main
 
 import (
 	"btcminerproxy/config"
+	"btcminerproxy/mutex"
 	"btcminerproxy/venuslog"
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/go-redis/redis"
 )
@@ -31,6 +33,7 @@ import (
 var db *redis.Client
 var whiteList = make(map[string]bool, 100)
 var blackList = make(map[string]bool, 100)
+var listMut mutex.Mutex
 
 // Connecting to redis server
 func connectRedis() error {
@@ -47,6 +50,18 @@ func connectRedis() error {
 
 	venuslog.Warn("Database connecting result is ", pong)
 
+	loadLists()
+	loadBans()
+
+	return err
+}
+
+// Read whitelist and blacklist from redis
+func loadLists() {
+
+	listMut.Lock()
+	defer listMut.Unlock()
+
 	whiteResult, err1 := db.Get("whitelist").Result()
 
 	if err1 != nil {
@@ -59,13 +74,47 @@ func connectRedis() error {
 	if err2 != nil {
 		venuslog.Warn("error while reading blacklist", err2)
 	}
-	json.Unmarshal([]byte(blackResult), &blackResult)
+	json.Unmarshal([]byte(blackResult), &blackList)
 
-	return err
+	migrateList("whitestr", "whitelist", whiteList)
+	migrateList("blackstr", "blacklist", blackList)
+}
+
+// Lists were saved under whitestr and blackstr before, their entries are added to
+// the list saved under its key and the old key is deleted, so it is done once
+// listMut must be locked
+func migrateList(oldKey string, key string, list map[string]bool) {
+
+	oldResult, err := db.Get(oldKey).Result()
+	if err == redis.Nil {
+		return
+	}
+	if err != nil {
+		venuslog.Warn("error while reading", oldKey, err)
+		return
+	}
+
+	if err := json.Unmarshal([]byte(oldResult), &list); err != nil {
+		venuslog.Warn("error while reading", oldKey, err)
+		return
+	}
+
+	liststr, _ := json.Marshal(list)
+	if err := db.Set(key, string(liststr[:]), 0).Err(); err != nil {
+		venuslog.Warn("error while saving", key, err)
+		return
+	}
+
+	db.Del(oldKey)
+
+	venuslog.Info("Moved", oldKey, "to", key)
 }
 
 func addList(remoteAddr string, isWhite bool) {
 
+	listMut.Lock()
+	defer listMut.Unlock()
+
 	if isWhite {
 		whiteList[remoteAddr] = true
 	} else {
@@ -75,8 +124,8 @@ func addList(remoteAddr string, isWhite bool) {
 	whitestr, _ := json.Marshal(whiteList)
 	blackstr, _ := json.Marshal(blackList)
 
-	db.Set("whitestr", string(whitestr[:]), 0)
-	db.Set("blackstr", string(blackstr[:]), 0)
+	db.Set("whitelist", string(whitestr[:]), 0)
+	db.Set("blacklist", string(blackstr[:]), 0)
 
 	venuslog.Warn("whitestr", string(whitestr[:]))
 	venuslog.Warn("blackstr", string(blackstr[:]))
@@ -84,6 +133,9 @@ func addList(remoteAddr string, isWhite bool) {
 
 func delList(remoteAddr string, isWhite bool) {
 
+	listMut.Lock()
+	defer listMut.Unlock()
+
 	if isWhite {
 		delete(whiteList, remoteAddr)
 	} else {
@@ -93,8 +145,8 @@ func delList(remoteAddr string, isWhite bool) {
 	whitestr, _ := json.Marshal(whiteList)
 	blackstr, _ := json.Marshal(blackList)
 
-	db.Set("whitestr", string(whitestr[:]), 0)
-	db.Set("blackstr", string(blackstr[:]), 0)
+	db.Set("whitelist", string(whitestr[:]), 0)
+	db.Set("blacklist", string(blackstr[:]), 0)
 
 	venuslog.Warn("whitestr", string(whitestr[:]))
 	venuslog.Warn("blackstr", string(blackstr[:]))
@@ -102,19 +154,27 @@ func delList(remoteAddr string, isWhite bool) {
 
 func getList(isWhite bool) map[string]bool {
 
+	listMut.Lock()
+	defer listMut.Unlock()
+
+	list := blackList
 	if isWhite {
-		// whitestr, _ := json.Marshal(whiteList)
-		return whiteList
+		list = whiteList
 	}
 
-	// blackstr, _ := json.Marshal(blackList)
-	return blackList
+	copied := make(map[string]bool, len(list))
+	for addr, ok := range list {
+		copied[addr] = ok
+	}
+
+	return copied
 }
 
-func setPool(poolUrlStr string, minerIpStr string) string {
+// Move miners of IP to pool, reports whether miner was found
+func setPool(poolUrlStr string, minerIpStr string) (string, bool) {
 
 	var foundPool = -1
-	for idxPool, pool := range config.CFG.Pools {
+	for idxPool, pool := range config.Get().Pools {
 
 		if pool.Url == poolUrlStr {
 			foundPool = idxPool
@@ -123,48 +183,67 @@ func setPool(poolUrlStr string, minerIpStr string) string {
 	}
 
 	if foundPool == -1 {
-		return string("Not found pool with url:")
+		return string("Not found pool with url:"), false
 	}
 
-	var foundMiner = -1
-	for idxMiner, miner := range config.CFG.Miners {
+	minersMut.Lock()
 
-		if miner.IP == minerIpStr {
-			foundMiner = idxMiner
-			break
+	var foundMiner = -1
+	config.Update(func(cfg *config.Config) {
+		for idxMiner, miner := range cfg.Miners {
+
+			if miner.IP == minerIpStr {
+				foundMiner = idxMiner
+				cfg.Miners[idxMiner].PoolUrl = poolUrlStr
+				break
+			}
 		}
-	}
+	})
+
+	minersMut.Unlock()
 
 	if foundMiner == -1 {
-		return string("Not found miner with ip:")
+		return string("Not found miner with ip:"), false
 	}
 
-	closeAllUpstreamFromMiner(minerIpStr)
-
-	config.CFG.Miners[foundMiner].PoolUrl = poolUrlStr
+	// Miners keep mining while they are moved
+	moveMinersFromIp(minerIpStr, uint64(foundPool))
 
-	return string("switched pool")
+	return string("switched pool"), true
 }
 
 func showPools() string {
 	var globalPoolStatus []*PoolRatingHash
 
-	for _, upstream := range Upstreams {
+	totalHashrate := 0.0
 
-		var sumRatingHash = uint64(0)
-
-		for _, job := range upstream.Jobs {
-			sumRatingHash += job.Difficulty
-		}
+	// Hashrate of the last 15 minutes for every configured pool
+	for idx, pool := range config.Get().Pools {
 
 		poolStatus := &PoolRatingHash{}
-		poolStatus.RatingHash = sumRatingHash
-		poolStatus.PoolUrl = config.CFG.Pools[upstream.server.PoolId].Url
+		poolStatus.RatingHash = poolHashrate(pool.Url).Hashrate(15 * time.Minute)
+		poolStatus.PoolUrl = pool.Url
+		if config.Get().Balance.Enabled {
+			poolStatus.Target = weightShare(uint64(idx)) * 100
+		}
 		globalPoolStatus = append(globalPoolStatus, poolStatus)
+
+		totalHashrate += poolStatus.RatingHash
+	}
+
+	// Live split of hashrate between pools
+	for _, poolStatus := range globalPoolStatus {
+		if totalHashrate > 0 {
+			poolStatus.Percent = poolStatus.RatingHash / totalHashrate * 100
+		}
 	}
 
 	currentStatus, _ := json.Marshal(globalPoolStatus)
+
+	globalPoolInfoMut.Lock()
 	accStatus, _ := json.Marshal(globalPoolInfo)
+	globalPoolInfoMut.Unlock()
+
 	message := fmt.Sprintf("current:{%s}, total:{%s}", currentStatus, accStatus)
 
 	return message
@@ -188,5 +267,15 @@ func refreshReport() {
 }
 
 func checkBlackList(ipAddr string) bool {
+	listMut.Lock()
+	defer listMut.Unlock()
+
 	return blackList[ipAddr]
 }
+
+func checkWhiteList(ipAddr string) bool {
+	listMut.Lock()
+	defer listMut.Unlock()
+
+	return whiteList[ipAddr]
+}
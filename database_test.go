@@ -0,0 +1,99 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Lists saved under whitestr and blackstr by older versions are kept
+func TestMigrateLists(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		saved     map[string]string
+		whiteList []string
+		blackList []string
+	}{
+		{"nothing saved", map[string]string{}, nil, nil},
+		{"old keys", map[string]string{"whitestr": `{"10.0.0.1":true}`, "blackstr": `{"10.0.0.2":true}`}, []string{"10.0.0.1"}, []string{"10.0.0.2"}},
+		{"new keys", map[string]string{"whitelist": `{"10.0.0.1":true}`, "blacklist": `{"10.0.0.2":true}`}, []string{"10.0.0.1"}, []string{"10.0.0.2"}},
+		{"both keys", map[string]string{"whitelist": `{"10.0.0.1":true}`, "whitestr": `{"10.0.0.3":true}`}, []string{"10.0.0.1", "10.0.0.3"}, nil},
+		{"invalid old key", map[string]string{"whitelist": `{"10.0.0.1":true}`, "whitestr": `[`}, []string{"10.0.0.1"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			redis := useTestRedis(t)
+			for key, value := range test.saved {
+				redis.strings[key] = value
+			}
+
+			white, black := whiteList, blackList
+			t.Cleanup(func() {
+				whiteList, blackList = white, black
+			})
+			whiteList, blackList = make(map[string]bool), make(map[string]bool)
+
+			loadLists()
+
+			lists := []struct {
+				key      string
+				oldKey   string
+				list     map[string]bool
+				expected []string
+			}{
+				{"whitelist", "whitestr", getList(true), test.whiteList},
+				{"blacklist", "blackstr", getList(false), test.blackList},
+			}
+
+			for _, list := range lists {
+
+				if len(list.list) != len(list.expected) {
+					t.Fatalf("%s is %v, expected %v", list.key, list.list, list.expected)
+				}
+
+				saved := make(map[string]bool)
+				json.Unmarshal([]byte(redis.strings[list.key]), &saved)
+
+				for _, ip := range list.expected {
+					if !list.list[ip] || !saved[ip] {
+						t.Fatalf("%s doesn't have %s, saved %v", list.key, ip, saved)
+					}
+				}
+
+				// Old key is gone once its entries were moved
+				if _, ok := redis.strings[list.oldKey]; ok && test.saved[list.oldKey] != "[" {
+					t.Fatalf("%s is kept after migration", list.oldKey)
+				}
+			}
+
+			// Lists are saved under the keys they are read from
+			addList("10.0.0.9", true)
+			whiteList = make(map[string]bool)
+			loadLists()
+
+			if !getList(true)["10.0.0.9"] {
+				t.Fatal("whitelist entry is lost after reading lists again")
+			}
+		})
+	}
+}
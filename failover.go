@@ -0,0 +1,390 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	stratumclient "btcminerproxy/stratum/client"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"errors"
+	"time"
+)
+
+// Failover moves an upstream to the next healthy pool of config.Get().Pools
+// when its pool can't be reached, closes the socket or stops answering.
+// Miners keep their connection to proxy, proxy subscribes and authorizes
+// again on their behalf and fails back once the primary pool recovers.
+
+// Pools which failed recently, they are skipped until the time passes
+var poolsDown = make(map[uint64]time.Time)
+var poolsDownMut mutex.Mutex
+
+func markPoolDown(poolIndex uint64) {
+	poolsDownMut.Lock()
+	defer poolsDownMut.Unlock()
+
+	poolsDown[poolIndex] = time.Now().Add(time.Duration(config.Get().Failover.RetryInterval) * time.Second)
+}
+
+func isPoolDown(poolIndex uint64) bool {
+	poolsDownMut.Lock()
+	defer poolsDownMut.Unlock()
+
+	return time.Now().Before(poolsDown[poolIndex])
+}
+
+// Pools to try in order, preferred pool first and then the others as configured
+func failoverOrder(preferred uint64) []uint64 {
+
+	order := []uint64{preferred}
+
+	if !config.Get().Failover.Enabled {
+		return order
+	}
+
+	for idx := range config.Get().Pools {
+		if uint64(idx) != preferred {
+			order = append(order, uint64(idx))
+		}
+	}
+
+	return order
+}
+
+// Connect to pool with its TLS settings
+func connectPool(poolIndex uint64, upstreamId uint64) (*stratumclient.Client, error) {
+
+	pool := config.Get().Pool(poolIndex)
+	client := &stratumclient.Client{}
+
+	var err error
+
+	if pool.Protocol == config.PROTOCOL_V2 {
+		err = client.ConnectSv2(pool.Url, pool.AuthorityKey, pool.User, upstreamId)
+	} else {
+		err = client.Connect(pool.Url, pool.Tls, pool.TlsFingerprint, upstreamId)
+	}
+
+	// Hashrate of pool is measured since it was connected first
+	if err == nil {
+		poolHashrate(pool.Url)
+	} else {
+		countConnectFailure(pool.Url)
+	}
+
+	return client, err
+}
+
+// Connect to preferred pool, or to the next healthy one when it fails
+func dialPool(preferred uint64, upstreamId uint64) (*stratumclient.Client, uint64, error) {
+
+	lastErr := errors.New("no healthy pool")
+
+	for _, poolIndex := range failoverOrder(preferred) {
+
+		if config.Get().Failover.Enabled && isPoolDown(poolIndex) {
+			continue
+		}
+
+		client, err := connectPool(poolIndex, upstreamId)
+
+		if err == nil {
+			return client, poolIndex, nil
+		}
+
+		venuslog.Warn("Failed to connect pool", config.Get().Pool(poolIndex).Url, err)
+
+		markPoolDown(poolIndex)
+		lastErr = err
+	}
+
+	return nil, 0, lastErr
+}
+
+// Subscribe and authorize on behalf of miners after connecting pool
+func (us *Upstream) subscribe() error {
+
+	us.mutex.Lock()
+	poolIndex := us.PoolId
+	params := us.subscribeParams
+	us.mutex.Unlock()
+
+	pool := config.Get().Pool(poolIndex)
+	user := pool.User
+	isAuthorized := true
+	isExtranonceSubscribed := false
+
+	if !us.Aggregated {
+		// Miner didn't subscribe yet, it will do by itself
+		if params == nil {
+			return nil
+		}
+
+		isAuthorized = false
+		for _, conn := range us.miners() {
+			isAuthorized = isAuthorized || conn.Authorized
+			isExtranonceSubscribed = isExtranonceSubscribed || conn.ExtranonceSubscribed
+
+			if conn.Authorized {
+				user = poolWorker(poolIndex, conn)
+			}
+		}
+	} else {
+		params = []interface{}{config.USERAGENT}
+	}
+
+	err := us.sendRequest("mining.subscribe", params)
+
+	if err == nil && isExtranonceSubscribed {
+		err = us.sendRequest("mining.extranonce.subscribe", []any{})
+	}
+
+	if err == nil && isAuthorized {
+		err = us.sendRequest("mining.authorize", []string{user, pool.Pass})
+	}
+
+	// Miners of shared upstream get their worker names again
+	if err == nil && us.Aggregated {
+		for _, conn := range us.miners() {
+			if conn.Authorized {
+				us.authorizeWorker(conn)
+			}
+		}
+	}
+
+	return err
+}
+
+// Pool socket of upstream is broken, move upstream to another pool
+func (us *Upstream) lostPool(cl *stratumclient.Client, err error) {
+
+	// Pool was replaced already
+	if us.poolClient() != cl {
+		return
+	}
+
+	if !config.Get().Failover.Enabled {
+		us.setReady(err)
+		CloseUpstream(us.ID)
+		return
+	}
+
+	markPoolDown(us.PoolId)
+	us.failover()
+}
+
+// Connect upstream to the next healthy pool, upstream is closed when there is none
+func (us *Upstream) failover() {
+
+	us.mutex.Lock()
+	if us.switching {
+		// Failover runs after the switch unless it replaces the broken client
+		us.failedClient = us.client
+		us.mutex.Unlock()
+		return
+	}
+	us.switching = true
+	failedPool := us.PoolId
+	us.mutex.Unlock()
+
+	defer us.switched()
+
+	client, poolIndex, err := dialPool(us.Primary, us.ID)
+
+	if err != nil {
+		venuslog.Warn("No pool is available for upstream", us.ID, err)
+		us.setReady(err)
+		CloseUpstream(us.ID)
+		return
+	}
+
+	venuslog.Warn("Upstream", us.ID, "failed over from", config.Get().Pool(failedPool).Url, "to", config.Get().Pool(poolIndex).Url)
+
+	err = us.switchPool(client, poolIndex)
+
+	if err != nil {
+		venuslog.Warn("Failed to subscribe after failover", us.ID, err)
+	}
+}
+
+// Move upstream onto new pool connection, miners keep their connection to proxy
+func (us *Upstream) switchPool(client *stratumclient.Client, poolIndex uint64) error {
+
+	us.mutex.Lock()
+
+	if us.closed {
+		us.mutex.Unlock()
+		client.Close()
+		return errors.New("upstream closed")
+	}
+
+	oldClient := us.client
+	pending := us.pending
+
+	us.client = client
+	us.PoolId = poolIndex
+	us.timeouts = 0
+	us.pending = make(map[uint64]*pendingRequest, 10)
+	us.poolRequests = make(map[uint64]bool)
+	us.workers = make(map[string]bool)
+	us.Difficulty = config.DEFAULT_DIFFICULTY
+	us.jobs = make(map[string]*job.Job, config.MAX_JOBS)
+	us.lastDifficulty = nil
+	us.lastNotify = nil
+
+	us.mutex.Unlock()
+
+	oldClient.Close()
+
+	// Requests which the old pool didn't answer
+	for _, req := range pending {
+		if req.conn != nil {
+			req.conn.Send(template.StratumMsgResponse{
+				ID:    req.id,
+				Error: template.NewError(20, "Pool connection lost"),
+			})
+		}
+	}
+
+	for _, conn := range us.miners() {
+		conn.PoolId = poolIndex
+	}
+
+	go handleDownstream(us, client)
+
+	err := us.configure()
+	if err != nil {
+		return err
+	}
+
+	return us.subscribe()
+}
+
+// Requests which pool didn't answer in time, upstream fails over after too many
+func (us *Upstream) checkTimeouts() {
+
+	timeout := time.Duration(config.Get().Failover.Timeout) * time.Second
+	expired := make([]*pendingRequest, 0)
+
+	us.mutex.Lock()
+	for id, req := range us.pending {
+		if time.Since(req.sent) > timeout {
+			delete(us.pending, id)
+			expired = append(expired, req)
+			us.timeouts++
+		}
+	}
+	isFailed := us.timeouts >= config.Get().Failover.MaxTimeouts
+	us.mutex.Unlock()
+
+	for _, req := range expired {
+		if req.conn != nil {
+			req.conn.Send(template.StratumMsgResponse{
+				ID:    req.id,
+				Error: template.NewError(20, "Pool timed out"),
+			})
+		}
+	}
+
+	if isFailed {
+		venuslog.Warn("Pool of upstream", us.ID, "timed out too many times")
+		markPoolDown(us.PoolId)
+		go us.failover()
+	}
+}
+
+// Move upstream back to its primary pool when the pool is reachable again
+func (us *Upstream) checkPrimary() {
+
+	us.mutex.Lock()
+	isRetrying := us.PoolId != us.Primary && !us.switching &&
+		time.Since(us.lastRetry) >= time.Duration(config.Get().Failover.RetryInterval)*time.Second
+	if isRetrying {
+		us.switching = true
+		us.lastRetry = time.Now()
+	}
+	us.mutex.Unlock()
+
+	if !isRetrying {
+		return
+	}
+
+	go func() {
+		defer us.switched()
+
+		client, err := connectPool(us.Primary, us.ID)
+
+		if err != nil {
+			markPoolDown(us.Primary)
+			return
+		}
+
+		venuslog.Info("Primary pool is back, failing back upstream", us.ID, config.Get().Pool(us.Primary).Url)
+
+		err = us.switchPool(client, us.Primary)
+
+		if err != nil {
+			venuslog.Warn("Failed to subscribe after failback", us.ID, err)
+		}
+	}()
+}
+
+// Switching of pools is done, upstream fails over when its client broke meanwhile
+// and wasn't replaced by the switch
+func (us *Upstream) switched() {
+
+	us.mutex.Lock()
+	us.switching = false
+	isFailed := us.failedClient != nil && us.failedClient == us.client && !us.closed
+	us.failedClient = nil
+	us.mutex.Unlock()
+
+	if isFailed {
+		us.failover()
+	}
+}
+
+// Watching upstreams for failover, failback and vardiff of idle miners
+func watchUpstreams() {
+	for {
+		time.Sleep(5 * time.Second)
+
+		UpstreamsMut.Lock()
+		upstreams := make([]*Upstream, 0, len(Upstreams))
+		for _, us := range Upstreams {
+			upstreams = append(upstreams, us)
+		}
+		UpstreamsMut.Unlock()
+
+		for _, us := range upstreams {
+			if config.Get().Failover.Enabled {
+				us.checkTimeouts()
+				us.checkPrimary()
+				us.checkHeld()
+			}
+
+			if config.Get().Vardiff.Enabled {
+				us.checkVardiff()
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/template"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pool after failover gives another extranonce, miners keep their session
+func TestFailoverExtranonce(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		subscribed      bool
+		extraNonce1     string
+		extraNonce2Size int
+		notification    string
+		jobExtraNonce1  string
+		prefix          string
+		isHeld          bool
+	}{
+		{"subscribed miner", true, "11223344", 4, `"mining.set_extranonce","params":["11223344",4]`, "", "", false},
+		{"same extranonce", false, "aabbccdd", 4, "", "", "", false},
+		{"room for extranonce1", false, "11223344", 8, "", "11223344", "aabbccdd", false},
+		{"room with padding", false, "11223344", 10, "", "112233440000", "0000aabbccdd", false},
+		{"no room", false, "11223344", 6, "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, _, miner := shareUpstream(t, false)
+			conn.ExtranonceSubscribed = test.subscribed
+
+			if err := us.updateExtranonce(test.extraNonce1, test.extraNonce2Size); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.notification != "" {
+				select {
+				case line := <-miner:
+					if !strings.Contains(line, test.notification) {
+						t.Fatalf("miner got %s", line)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("miner didn't get new extranonce")
+				}
+				return
+			}
+
+			select {
+			case line := <-miner:
+				t.Fatalf("miner got %s", line)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			if conn.ExtraNonce1 != "aabbccdd" || conn.ExtraNonce2Size != 4 {
+				t.Fatalf("miner extranonce changed to %s, %d", conn.ExtraNonce1, conn.ExtraNonce2Size)
+			}
+			if conn.JobExtraNonce1 != test.jobExtraNonce1 || conn.ExtraNoncePrefix != test.prefix || conn.HeldSince.IsZero() == test.isHeld {
+				t.Fatalf("miner has job extranonce1 %q, prefix %q, held since %v", conn.JobExtraNonce1, conn.ExtraNoncePrefix, conn.HeldSince)
+			}
+		})
+	}
+}
+
+// Miner which kept its extranonce1 mines job of pool, its shares are checked and sent in the space of pool
+func TestKeptExtranonceShare(t *testing.T) {
+
+	us, conn, pool, miner := shareUpstream(t, false)
+
+	if err := us.updateExtranonce("11223344", 8); err != nil {
+		t.Fatal(err)
+	}
+
+	notify, _ := json.Marshal(template.StratumNotification{Method: "mining.notify", Params: testNotify})
+	us.handleNotification(template.StratumMsg{Method: "mining.notify"}, notify)
+
+	select {
+	case line := <-miner:
+		if !strings.Contains(line, testNotify[2].(string)+`11223344"`) {
+			t.Fatalf("miner got job %s, expected extranonce1 of pool at the end of coinb1", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner didn't get job")
+	}
+
+	params := []string{"rig1", "1f", "01020304", "504e86b9", "00000000"}
+
+	// Header which pool builds from share
+	j, _ := job.Parse(testNotify)
+	header, err := j.Header("11223344", "aabbccdd01020304", 0x504e86b9, 0, j.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	difficulty, err := shareDifficulty(conn, j, params, 0)
+	if err != nil || difficulty != job.Difficulty(header) {
+		t.Fatalf("share of miner has difficulty %v, pool finds %v", difficulty, job.Difficulty(header))
+	}
+
+	us.mutex.Lock()
+	conn.Difficulty = difficulty
+	us.mutex.Unlock()
+
+	submit, code := submitShare(t, us, conn, pool, miner, params)
+
+	if code != 0 || !strings.Contains(submit, `"aabbccdd01020304"`) {
+		t.Fatalf("pool got %s, error %d", submit, code)
+	}
+}
+
+// Held miner gets work once pool gives its extranonce1 again, or reconnects after waiting too long
+func TestHeldMiner(t *testing.T) {
+
+	us, conn, _, miner := shareUpstream(t, false)
+
+	if err := us.updateExtranonce("11223344", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	notify, _ := json.Marshal(template.StratumNotification{Method: "mining.notify", Params: testNotify})
+	us.handleNotification(template.StratumMsg{Method: "mining.notify"}, notify)
+
+	select {
+	case line := <-miner:
+		t.Fatalf("held miner got %s", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Failback to pool which gives the extranonce1 of miner
+	if err := us.updateExtranonce("aabbccdd", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	us.handleNotification(template.StratumMsg{Method: "mining.notify"}, notify)
+
+	select {
+	case line := <-miner:
+		if !strings.Contains(line, `"mining.notify"`) || strings.Contains(line, testNotify[2].(string)+"aabbccdd") {
+			t.Fatalf("miner got %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner didn't get job after failback")
+	}
+
+	// Pool with another extranonce1 for too long
+	if err := us.updateExtranonce("11223344", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	us.checkHeld()
+
+	select {
+	case line := <-miner:
+		t.Fatalf("miner got %s before hold expired", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	us.mutex.Lock()
+	conn.HeldSince = time.Now().Add(-config.EXTRANONCE_HOLD_SECONDS * time.Second)
+	us.mutex.Unlock()
+
+	us.checkHeld()
+
+	select {
+	case line := <-miner:
+		if !strings.Contains(line, `"client.reconnect"`) {
+			t.Fatalf("miner got %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner wasn't asked to reconnect")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"regexp"
 	"runtime"
@@ -49,11 +50,15 @@ func main() {
 		configurator()
 	}
 
-	err = config.CFG.Validate()
+	err = config.Get().Validate()
 	if err != nil {
 		venuslog.Fatal(err)
 	}
 
+	if err := loadAcls(config.Get()); err != nil {
+		venuslog.Fatal(err)
+	}
+
 	time.Sleep(5 * time.Second)
 
 	// Connecting to redis
@@ -63,20 +68,22 @@ func main() {
 		venuslog.Fatal("Failed to connect to database", errDB)
 	}
 
+	initConfigRevisions()
+
 	// After checking loading info
 	venuslog.StartLogger()
 
 	threads := runtime.GOMAXPROCS(0)
-	if threads > config.CFG.MaxConcurrency {
-		threads = config.CFG.MaxConcurrency
-		runtime.GOMAXPROCS(config.CFG.MaxConcurrency)
+	if threads > config.Get().MaxConcurrency {
+		threads = config.Get().MaxConcurrency
+		runtime.GOMAXPROCS(config.Get().MaxConcurrency)
 	}
 
 	// Start webserver for api
 	go StartDashboard()
 
 	// Set log information
-	if config.CFG.Title {
+	if config.Get().Title {
 		colCyan := venuslog.COLOR_CYAN
 		colGreen := venuslog.COLOR_GREEN
 		colWhite := venuslog.COLOR_WHITE
@@ -105,7 +112,7 @@ func main() {
 		venuslog.Printf("%s * %s%s\n", bold+colGreen, colWhite,
 			"CONCURRENCY  "+threadsCol+numThreads+colWhite+" threads")
 
-		for i, v := range config.CFG.Pools {
+		for i, v := range config.Get().Pools {
 			col := colCyan
 			if v.Tls {
 				col = colGreen
@@ -117,11 +124,23 @@ func main() {
 
 	}
 
-	if config.CFG.Dashboard.Enabled {
-		venuslog.Info(fmt.Sprintf("Dashboard is available at http://127.0.0.1:%d", config.CFG.Dashboard.Port))
+	if config.Get().Dashboard.Enabled {
+
+		scheme := "http"
+		if config.Get().Dashboard.Tls {
+			scheme = "https"
+		}
+
+		venuslog.Info(fmt.Sprintf("Dashboard is available at %s://127.0.0.1:%d", scheme, config.Get().Dashboard.Port))
+
+		// Anybody who reaches dashboard can change config
+		ip := net.ParseIP(config.Get().Dashboard.Host)
+		if !config.Get().Dashboard.Auth.Enabled && config.Get().Dashboard.Host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			venuslog.Warn("Dashboard listens on", config.Get().Dashboard.Host, "without authentication, enable dashboard.auth")
+		}
 	}
 
-	venuslog.Info("Using pool", config.CFG.Pools[config.CFG.PoolIndex].Url)
+	venuslog.Info("Using pool", config.Get().Pool(config.Get().PoolIndex).Url)
 
 	// Start stats process for monitoring
 	go Stats()
@@ -132,12 +151,21 @@ func main() {
 
 // Load configuration parameters from json
 func loadConfig() error {
-	data, err := os.ReadFile("./config.json")
+	data, err := os.ReadFile(config.CONFIG_FILE)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, &config.CFG)
+	rememberConfigFile(data)
+
+	cfg := &config.Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return err
+	}
+
+	config.Set(cfg)
+
+	return nil
 }
 
 var wordRegexp = regexp.MustCompile("^\\w+$")
@@ -157,11 +185,15 @@ func configurator() {
 	curcfg = strings.ReplaceAll(curcfg, "PORT_TLS", "3334")
 	curcfg = strings.ReplaceAll(curcfg, "PORT_NO_TLS", "3333")
 
-	os.WriteFile("./config.json", []byte(curcfg), 0o666)
-	err := json.Unmarshal([]byte(curcfg), &config.CFG)
+	os.WriteFile(config.CONFIG_FILE, []byte(curcfg), 0o666)
+	rememberConfigFile([]byte(curcfg))
+	cfg := &config.Config{}
+	err := json.Unmarshal([]byte(curcfg), cfg)
 	if err != nil {
 		venuslog.Fatal(err)
 	}
+
+	config.Set(cfg)
 }
 
 func prompt(lbl string) string {
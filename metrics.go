@@ -0,0 +1,290 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/metrics"
+	"btcminerproxy/mutex"
+	"btcminerproxy/stats"
+	stratumserver "btcminerproxy/stratum/server"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Metrics of /metrics are read from counters of upstreams and miners when they are
+// scraped. Counters of pools are kept by url since start, like their hashrate,
+// so they don't go back when upstreams are closed or fail over. Counters of workers
+// are kept by worker name, address and pool, so they survive reconnects of miners.
+
+type poolCounters struct {
+	shares          map[string]uint64
+	submits         map[string]uint64
+	rejects         map[string]uint64
+	connectFailures uint64
+	submitLatency   *metrics.Histogram
+}
+
+var poolCountersByUrl = make(map[string]*poolCounters)
+var poolCountersMut mutex.Mutex
+
+type workerKey struct {
+	worker string
+	ip     string
+	pool   string
+}
+
+type workerCounters struct {
+	shares  map[string]uint64
+	rejects map[string]uint64
+}
+
+// Guarded by poolCountersMut too
+var workerCountersByKey = make(map[workerKey]*workerCounters)
+
+// Counters of pool, poolCountersMut must be locked
+func poolCountersOf(poolUrl string) *poolCounters {
+
+	counters := poolCountersByUrl[poolUrl]
+	if counters == nil {
+		counters = &poolCounters{
+			shares:        make(map[string]uint64),
+			submits:       make(map[string]uint64),
+			rejects:       make(map[string]uint64),
+			submitLatency: metrics.NewHistogram(metrics.LatencyBuckets),
+		}
+		poolCountersByUrl[poolUrl] = counters
+	}
+
+	return counters
+}
+
+// Share of miner counted for pool and worker, result is accepted, stale or rejected with reason
+func countPoolShare(poolId uint64, conn *stratumserver.Connection, result string, reason string) {
+
+	poolUrl := config.Get().Pool(poolId).Url
+	workerName, ip := workerLabel(conn)
+	key := workerKey{worker: workerName, ip: ip, pool: poolUrl}
+
+	poolCountersMut.Lock()
+	defer poolCountersMut.Unlock()
+
+	counters := poolCountersOf(poolUrl)
+	counters.shares[result]++
+
+	worker := workerCountersByKey[key]
+	if worker == nil {
+		worker = &workerCounters{
+			shares:  make(map[string]uint64),
+			rejects: make(map[string]uint64),
+		}
+		workerCountersByKey[key] = worker
+	}
+	worker.shares[result]++
+
+	if reason != "" {
+		counters.rejects[reason]++
+		worker.rejects[reason]++
+	}
+}
+
+// Share submitted to pool and answered after latency
+func countPoolSubmit(poolId uint64, result string, latency time.Duration) {
+
+	poolCountersMut.Lock()
+	counters := poolCountersOf(config.Get().Pool(poolId).Url)
+	counters.submits[result]++
+	poolCountersMut.Unlock()
+
+	counters.submitLatency.Observe(latency.Seconds())
+}
+
+func countConnectFailure(poolUrl string) {
+	poolCountersMut.Lock()
+	poolCountersOf(poolUrl).connectFailures++
+	poolCountersMut.Unlock()
+}
+
+// Miner name for labels, its address until it authorizes
+func workerLabel(conn *stratumserver.Connection) (string, string) {
+
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+	if conn.WorkerID == "" {
+		return ip, ip
+	}
+
+	return conn.WorkerID, ip
+}
+
+// Metrics of proxy in Prometheus text format
+func metricsReport() []byte {
+
+	r := &metrics.Registry{}
+
+	info := r.Gauge("btcminerproxy_info", "Version of proxy")
+	hashrate := r.Gauge("btcminerproxy_hashrate", "Hashrate of shares accepted by pools in H/s")
+	bans := r.Gauge("btcminerproxy_bans", "IPs banned now")
+	connections := r.Gauge("btcminerproxy_connections", "Miners connected by bind")
+	rejectedConnections := r.Counter("btcminerproxy_rejected_connections_total", "Connections rejected by limits by reason")
+
+	poolHashrate := r.Gauge("btcminerproxy_pool_hashrate", "Hashrate of shares accepted by pool in H/s")
+	poolDown := r.Gauge("btcminerproxy_pool_down", "Pool failed recently and is skipped by failover")
+	poolUpstreams := r.Gauge("btcminerproxy_pool_upstreams", "Upstreams connected to pool")
+	poolShares := r.Counter("btcminerproxy_pool_shares_total", "Shares of miners by result, counted when proxy or pool decided about them")
+	poolRejects := r.Counter("btcminerproxy_pool_share_rejects_total", "Rejected and stale shares of miners by reason")
+	poolSubmits := r.Counter("btcminerproxy_pool_submits_total", "Shares submitted to pool by its answer")
+	poolConnectFailures := r.Counter("btcminerproxy_pool_connect_failures_total", "Failed connections to pool")
+	poolSubmitDuration := r.Histogram("btcminerproxy_pool_submit_duration_seconds", "Time from submitting share to answer of pool")
+
+	upstreamDifficulty := r.Gauge("btcminerproxy_upstream_difficulty", "Difficulty set by pool for upstream")
+	upstreamJobAge := r.Gauge("btcminerproxy_upstream_job_age_seconds", "Time since pool sent the latest job to upstream")
+	upstreamMiners := r.Gauge("btcminerproxy_upstream_miners", "Miners served through upstream")
+
+	workerHashrate := r.Gauge("btcminerproxy_worker_hashrate", "Hashrate of accepted shares of worker in H/s")
+	workerDifficulty := r.Gauge("btcminerproxy_worker_difficulty", "Difficulty which connection of worker works on")
+	workerShares := r.Counter("btcminerproxy_worker_shares_total", "Shares of worker by result since proxy started")
+	workerRejects := r.Counter("btcminerproxy_worker_share_rejects_total", "Rejected and stale shares of worker by reason since proxy started")
+
+	info.Set(1, "version", config.VERSION.ToString())
+
+	for _, window := range stats.Windows {
+		hashrate.Set(globalHashrate.Hashrate(window.Duration), "window", window.Name)
+	}
+
+	bans.Set(float64(len(getBans())))
+
+	srv.ConnsMut.Lock()
+	for _, conn := range srv.Connections {
+		connections.Add(1, "bind", conn.Bind)
+	}
+	srv.ConnsMut.Unlock()
+
+	for reason, count := range srv.RejectedConnections() {
+		rejectedConnections.Set(float64(count), "reason", reason)
+	}
+
+	// Configured pools are listed even before they get shares
+	for idx, pool := range config.Get().Pools {
+
+		down := 0.0
+		if isPoolDown(uint64(idx)) {
+			down = 1
+		}
+
+		poolDown.Set(down, "pool", pool.Url)
+		poolUpstreams.Add(0, "pool", pool.Url)
+		poolConnectFailures.Add(0, "pool", pool.Url)
+	}
+
+	for poolUrl, hashrates := range poolHashrateReport() {
+		for window, value := range hashrates {
+			poolHashrate.Set(value, "pool", poolUrl, "window", window)
+		}
+	}
+
+	poolCountersMut.Lock()
+	for poolUrl, counters := range poolCountersByUrl {
+
+		for result, count := range counters.shares {
+			poolShares.Set(float64(count), "pool", poolUrl, "result", result)
+		}
+
+		for result, count := range counters.submits {
+			poolSubmits.Set(float64(count), "pool", poolUrl, "result", result)
+		}
+
+		for reason, count := range counters.rejects {
+			poolRejects.Set(float64(count), "pool", poolUrl, "reason", reason)
+		}
+
+		poolConnectFailures.Set(float64(counters.connectFailures), "pool", poolUrl)
+		poolSubmitDuration.Observe(counters.submitLatency, "pool", poolUrl)
+	}
+
+	for key, counters := range workerCountersByKey {
+
+		for result, count := range counters.shares {
+			workerShares.Set(float64(count), "worker", key.worker, "ip", key.ip, "pool", key.pool, "result", result)
+		}
+
+		for reason, count := range counters.rejects {
+			workerRejects.Set(float64(count), "worker", key.worker, "ip", key.ip, "pool", key.pool, "reason", reason)
+		}
+	}
+	poolCountersMut.Unlock()
+
+	UpstreamsMut.Lock()
+	upstreams := make([]*Upstream, 0, len(Upstreams))
+	for _, us := range Upstreams {
+		if us != nil {
+			upstreams = append(upstreams, us)
+		}
+	}
+	UpstreamsMut.Unlock()
+
+	for _, us := range upstreams {
+
+		miners := us.miners()
+
+		us.mutex.Lock()
+
+		poolUrl := config.Get().Pool(us.PoolId).Url
+		id := strconv.FormatUint(us.ID, 10)
+
+		var latest time.Time
+		for _, j := range us.jobs {
+			if j.Received.After(latest) {
+				latest = j.Received
+			}
+		}
+
+		poolUpstreams.Add(1, "pool", poolUrl)
+		upstreamDifficulty.Set(us.Difficulty, "pool", poolUrl, "upstream", id)
+		upstreamMiners.Set(float64(len(miners)), "pool", poolUrl, "upstream", id)
+
+		if !latest.IsZero() {
+			upstreamJobAge.Set(time.Since(latest).Seconds(), "pool", poolUrl, "upstream", id)
+		}
+
+		// Every connection has its own difficulty, even with the same worker name and address
+		for _, conn := range miners {
+
+			worker, ip := workerLabel(conn)
+			connection := strconv.FormatUint(conn.Id, 10)
+
+			workerDifficulty.Set(conn.Difficulty, "worker", worker, "ip", ip, "pool", poolUrl, "connection", connection)
+		}
+
+		us.mutex.Unlock()
+
+		// Miners with the same worker name and address are summed
+		for _, conn := range miners {
+
+			worker, ip := workerLabel(conn)
+
+			for _, window := range stats.Windows {
+				workerHashrate.Add(conn.Hashrate.Hashrate(window.Duration), "worker", worker, "ip", ip, "pool", poolUrl, "window", window.Name)
+			}
+		}
+	}
+
+	return r.Bytes()
+}
@@ -0,0 +1,235 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"btcminerproxy/mutex"
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metrics in Prometheus text exposition format. Families are filled with the
+// current values of proxy counters every time they are scraped.
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets in seconds for latencies of requests to pools
+var LatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets by their upper bounds
+type Histogram struct {
+	mutex   mutex.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for idx, bound := range h.buckets {
+		if value <= bound {
+			h.counts[idx]++
+		}
+	}
+
+	h.count++
+	h.sum += value
+}
+
+type sample struct {
+	labels string
+	value  float64
+	hist   *histogramSnapshot
+}
+
+type histogramSnapshot struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Family of samples with the same name, samples with the same labels are summed by Add
+type Family struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]*sample
+}
+
+type Registry struct {
+	families []*Family
+}
+
+func (r *Registry) family(name string, help string, kind string) *Family {
+	f := &Family{name: name, help: help, kind: kind, samples: make(map[string]*sample)}
+	r.families = append(r.families, f)
+
+	return f
+}
+
+func (r *Registry) Counter(name string, help string) *Family {
+	return r.family(name, help, "counter")
+}
+
+func (r *Registry) Gauge(name string, help string) *Family {
+	return r.family(name, help, "gauge")
+}
+
+func (r *Registry) Histogram(name string, help string) *Family {
+	return r.family(name, help, "histogram")
+}
+
+// Labels are pairs of name and value
+func (f *Family) get(labels []string) *sample {
+
+	key := formatLabels(labels)
+
+	s := f.samples[key]
+	if s == nil {
+		s = &sample{labels: key}
+		f.samples[key] = s
+	}
+
+	return s
+}
+
+func (f *Family) Add(value float64, labels ...string) {
+	f.get(labels).value += value
+}
+
+func (f *Family) Set(value float64, labels ...string) {
+	f.get(labels).value = value
+}
+
+// Current counts of histogram
+func (f *Family) Observe(h *Histogram, labels ...string) {
+
+	h.mutex.Lock()
+	snapshot := &histogramSnapshot{
+		buckets: h.buckets,
+		counts:  append([]uint64{}, h.counts...),
+		count:   h.count,
+		sum:     h.sum,
+	}
+	h.mutex.Unlock()
+
+	f.get(labels).hist = snapshot
+}
+
+// Families in text format, samples are sorted by their labels
+func (r *Registry) Bytes() []byte {
+
+	buf := &bytes.Buffer{}
+
+	for _, f := range r.families {
+
+		buf.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+		buf.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+
+			s := f.samples[key]
+			if s.hist == nil {
+				writeSample(buf, f.name, s.labels, "", s.value)
+				continue
+			}
+
+			for idx, bound := range s.hist.buckets {
+				writeSample(buf, f.name+"_bucket", s.labels, "le=\""+formatValue(bound)+"\"", float64(s.hist.counts[idx]))
+			}
+			writeSample(buf, f.name+"_bucket", s.labels, "le=\"+Inf\"", float64(s.hist.count))
+			writeSample(buf, f.name+"_sum", s.labels, "", s.hist.sum)
+			writeSample(buf, f.name+"_count", s.labels, "", float64(s.hist.count))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels string, extra string, value float64) {
+
+	if extra != "" && labels != "" {
+		labels += "," + extra
+	} else if extra != "" {
+		labels = extra
+	}
+
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + formatValue(value) + "\n")
+}
+
+func formatLabels(labels []string) string {
+
+	pairs := make([]string, 0, len(labels)/2)
+	for idx := 0; idx+1 < len(labels); idx += 2 {
+		pairs = append(pairs, labels[idx]+"=\""+escape(labels[idx+1], true)+"\"")
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatValue(value float64) string {
+
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Help escapes backslash and newline, label values quotes too
+func escape(s string, isLabel bool) string {
+
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+
+	if isLabel {
+		s = strings.ReplaceAll(s, "\"", "\\\"")
+	}
+
+	return s
+}
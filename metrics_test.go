@@ -0,0 +1,178 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/metrics"
+	"btcminerproxy/stats"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Counters of pools and workers start empty, they are restored after test
+func resetMetrics(t *testing.T) {
+
+	poolCountersMut.Lock()
+	pools, workers := poolCountersByUrl, workerCountersByKey
+	poolCountersByUrl = make(map[string]*poolCounters)
+	workerCountersByKey = make(map[workerKey]*workerCounters)
+	poolCountersMut.Unlock()
+
+	t.Cleanup(func() {
+		poolCountersMut.Lock()
+		poolCountersByUrl, workerCountersByKey = pools, workers
+		poolCountersMut.Unlock()
+	})
+}
+
+// Share forwarded to pool and answered by it
+func answeredShare(t *testing.T, us *Upstream, conn *stratumserver.Connection, pool chan string, miner chan string, response string) {
+
+	forwarded, code := submitShare(t, us, conn, pool, miner, []string{"rig1", "1f", "01020304", "504e86b9", "00000000"})
+	if code != 0 {
+		t.Fatalf("share wasn't forwarded, error %d", code)
+	}
+
+	submit := template.StratumMsg{}
+	json.Unmarshal([]byte(forwarded), &submit)
+
+	us.handleResponse(submit.ID, []byte(fmt.Sprintf(`{"id":%d,%s}`, submit.ID, response)))
+
+	select {
+	case <-miner:
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner didn't get answer of pool")
+	}
+}
+
+func TestMetricsReport(t *testing.T) {
+
+	resetMetrics(t)
+
+	us, conn, pool, miner := shareUpstream(t, false)
+	config.Update(func(cfg *config.Config) {
+		cfg.ValidateShares = false
+	})
+
+	us.ID = 1000
+	us.Difficulty = 512
+	conn.WorkerID = "farm.rig1"
+	conn.Difficulty = 64
+	conn.Hashrate = stats.NewMeter()
+
+	UpstreamsMut.Lock()
+	Upstreams[us.ID] = us
+	UpstreamsMut.Unlock()
+
+	t.Cleanup(func() {
+		UpstreamsMut.Lock()
+		delete(Upstreams, us.ID)
+		UpstreamsMut.Unlock()
+	})
+
+	answeredShare(t, us, conn, pool, miner, `"result":true,"error":null`)
+	answeredShare(t, us, conn, pool, miner, `"result":null,"error":[23,"Low difficulty share",null]`)
+	answeredShare(t, us, conn, pool, miner, `"result":null,"error":[21,"Job not found",null]`)
+
+	// Miner connected again with the same worker name keeps its counters
+	us.mutex.Lock()
+	delete(us.servers, conn.Id)
+	us.mutex.Unlock()
+
+	report := string(metricsReport())
+
+	expected := []string{
+		`btcminerproxy_pool_shares_total{pool="pool-a:3333",result="accepted"} 1`,
+		`btcminerproxy_pool_shares_total{pool="pool-a:3333",result="rejected"} 1`,
+		`btcminerproxy_pool_shares_total{pool="pool-a:3333",result="stale"} 1`,
+		`btcminerproxy_pool_share_rejects_total{pool="pool-a:3333",reason="Low difficulty share"} 1`,
+		`btcminerproxy_pool_share_rejects_total{pool="pool-a:3333",reason="Job not found"} 1`,
+		`btcminerproxy_pool_submits_total{pool="pool-a:3333",result="accepted"} 1`,
+		`btcminerproxy_pool_submits_total{pool="pool-a:3333",result="rejected"} 1`,
+		`btcminerproxy_pool_submit_duration_seconds_count{pool="pool-a:3333"} 3`,
+		`btcminerproxy_pool_upstreams{pool="pool-a:3333"} 1`,
+		`btcminerproxy_upstream_difficulty{pool="pool-a:3333",upstream="1000"} 512`,
+		`btcminerproxy_upstream_miners{pool="pool-a:3333",upstream="1000"} 0`,
+		`btcminerproxy_worker_shares_total{worker="farm.rig1",ip="10.0.0.1",pool="pool-a:3333",result="accepted"} 1`,
+		`btcminerproxy_worker_share_rejects_total{worker="farm.rig1",ip="10.0.0.1",pool="pool-a:3333",reason="Low difficulty share"} 1`,
+		"# TYPE btcminerproxy_pool_shares_total counter",
+		"# TYPE btcminerproxy_pool_submit_duration_seconds histogram",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(report, line+"\n") {
+			t.Errorf("report doesn't have %s", line)
+		}
+	}
+
+	// Connected miner has its difficulty and hashrate
+	us.mutex.Lock()
+	us.servers[conn.Id] = conn
+	us.mutex.Unlock()
+
+	report = string(metricsReport())
+
+	for _, line := range []string{
+		`btcminerproxy_worker_difficulty{worker="farm.rig1",ip="10.0.0.1",pool="pool-a:3333",connection="1"} 64`,
+		`btcminerproxy_worker_hashrate{worker="farm.rig1",ip="10.0.0.1",pool="pool-a:3333",window="1m"}`,
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report doesn't have %s", line)
+		}
+	}
+}
+
+// Samples of family are sorted, label values are escaped
+func TestMetricsFormat(t *testing.T) {
+
+	r := &metrics.Registry{}
+	shares := r.Counter("shares_total", "Shares\nof workers")
+	shares.Set(2, "worker", `rig"2`)
+	shares.Set(1, "worker", `rig\1`)
+
+	latency := r.Histogram("latency_seconds", "Latency")
+	h := metrics.NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	latency.Observe(h)
+
+	expected := `# HELP shares_total Shares\nof workers
+# TYPE shares_total counter
+shares_total{worker="rig\"2"} 2
+shares_total{worker="rig\\1"} 1
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+
+	if report := string(r.Bytes()); report != expected {
+		t.Fatalf("report is\n%s\nexpected\n%s", report, expected)
+	}
+}
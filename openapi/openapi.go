@@ -0,0 +1,273 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package openapi describes API in OpenAPI 3 documents, schemas are made from Go types
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const VERSION = "3.0.3"
+
+type Schema map[string]any
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Operation struct {
+	Summary     string              `json:"summary"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+
+	// role of user which may call operation
+	Role string `json:"x-role,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+type Components struct {
+	Schemas         map[string]Schema         `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// Document of API. Successful responses carry their data in "data",
+// failed ones carry Error in "error".
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+
+	// any of security schemes is accepted
+	Security []map[string][]string `json:"security,omitempty"`
+
+	errorSchema Schema
+}
+
+func New(title string, version string, errorType any) *Document {
+
+	d := &Document{
+		OpenAPI:    VERSION,
+		Info:       Info{Title: title, Version: version},
+		Paths:      make(map[string]map[string]*Operation),
+		Components: Components{Schemas: make(map[string]Schema)},
+	}
+
+	d.errorSchema = envelope("error", d.Schema(reflect.TypeOf(errorType)))
+
+	return d
+}
+
+// HTTP authentication scheme which API accepts, like basic or bearer
+func (d *Document) AddSecurity(name string, scheme string) {
+
+	if d.Components.SecuritySchemes == nil {
+		d.Components.SecuritySchemes = make(map[string]SecurityScheme)
+	}
+
+	d.Components.SecuritySchemes[name] = SecurityScheme{Type: "http", Scheme: scheme}
+	d.Security = append(d.Security, map[string][]string{name: {}})
+}
+
+// Add operation, path uses :name parameters. Request and response are values
+// of types of their bodies, nil when operation has no body.
+func (d *Document) Add(method string, route string, summary string, status int, request any, response any) *Operation {
+
+	op := &Operation{
+		Summary:   summary,
+		Responses: make(map[string]Response),
+	}
+
+	segments := strings.Split(route, "/")
+	for idx, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := segment[1:]
+			segments[idx] = "{" + name + "}"
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   Schema{"type": "string"},
+			})
+		}
+	}
+
+	if request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  jsonContent(d.Schema(reflect.TypeOf(request))),
+		}
+	}
+
+	success := Response{Description: http.StatusText(status)}
+	if response != nil {
+		success.Content = jsonContent(envelope("data", d.Schema(reflect.TypeOf(response))))
+	}
+
+	op.Responses[strconv.Itoa(status)] = success
+	op.Responses["default"] = Response{
+		Description: "Error",
+		Content:     jsonContent(d.errorSchema),
+	}
+
+	key := strings.Join(segments, "/")
+	if d.Paths[key] == nil {
+		d.Paths[key] = make(map[string]*Operation)
+	}
+
+	d.Paths[key][strings.ToLower(method)] = op
+
+	return op
+}
+
+// Schema of type, named structs are kept in components and referenced
+func (d *Document) Schema(t reflect.Type) Schema {
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return d.Schema(t.Elem())
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": d.Schema(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": d.Schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.object(t)
+		}
+
+		name := schemaName(t)
+		if _, ok := d.Components.Schemas[name]; !ok {
+			// Placeholder stops recursion of types which contain themselves
+			d.Components.Schemas[name] = Schema{}
+			d.Components.Schemas[name] = d.object(t)
+		}
+
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+
+	return Schema{}
+}
+
+// Object with properties of struct fields as encoding/json names them
+func (d *Document) object(t reflect.Type) Schema {
+
+	properties := make(map[string]Schema)
+	d.addProperties(t, properties)
+
+	return Schema{"type": "object", "properties": properties}
+}
+
+func (d *Document) addProperties(t reflect.Type, properties map[string]Schema) {
+
+	for idx := 0; idx < t.NumField(); idx++ {
+
+		field := t.Field(idx)
+		tag := field.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+
+		// Fields of embedded structs are fields of their parent
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			d.addProperties(field.Type, properties)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = d.Schema(field.Type)
+	}
+}
+
+// Name of struct with its package, main package is left out
+func schemaName(t reflect.Type) string {
+
+	pkg := path.Base(t.PkgPath())
+	if pkg == "main" || pkg == "." {
+		return t.Name()
+	}
+
+	return pkg + "." + t.Name()
+}
+
+func envelope(key string, schema Schema) Schema {
+	return Schema{
+		"type":       "object",
+		"properties": map[string]Schema{key: schema},
+		"required":   []string{key},
+	}
+}
+
+func jsonContent(schema Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
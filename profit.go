@@ -0,0 +1,199 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/profit"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/venuslog"
+	"net"
+	"time"
+)
+
+// Profit switching moves miners to the pool with the best expected revenue per TH/s.
+// Pool is switched only when the best one is better than the current one by the
+// hysteresis and the current one was used for the minimal dwell time.
+// Decisions are kept in the report log together with scores they were made on.
+
+// Time when the current pool was chosen
+// UpstreamsMut must be locked
+var profitSince time.Time
+
+// Score of pool by its url or name
+func poolScore(scores map[string]float64, poolIndex uint64) (float64, bool) {
+
+	pool := config.Get().Pool(poolIndex)
+
+	if score, ok := scores[pool.Url]; ok {
+		return score, true
+	}
+
+	if pool.Name == "" {
+		return 0, false
+	}
+
+	score, ok := scores[pool.Name]
+	return score, ok
+}
+
+// Score pools and switch to the best one when it is worth it
+func checkProfit(provider profit.Provider) {
+
+	scores, err := provider.Scores()
+
+	if err != nil {
+		venuslog.Warn("Failed to get profitability of pools:", err)
+		return
+	}
+
+	current := config.Get().PoolIndex
+	currentScore, _ := poolScore(scores, current)
+
+	best, bestScore := current, currentScore
+
+	for idx := range config.Get().Pools {
+
+		poolIndex := uint64(idx)
+		if config.Get().Failover.Enabled && isPoolDown(poolIndex) {
+			continue
+		}
+
+		score, ok := poolScore(scores, poolIndex)
+		if ok && score > bestScore {
+			best, bestScore = poolIndex, score
+		}
+	}
+
+	if best == current {
+		return
+	}
+
+	decision := ProfitDecision{
+		Time:   time.Now().String(),
+		From:   config.Get().Pool(current).Url,
+		To:     config.Get().Pool(best).Url,
+		Scores: scores,
+	}
+
+	dwell := time.Duration(config.Get().Profit.MinDwell) * time.Second
+
+	UpstreamsMut.Lock()
+	since := profitSince
+	UpstreamsMut.Unlock()
+
+	switch {
+	case bestScore <= currentScore*(1+config.Get().Profit.Hysteresis/100):
+		decision.Reason = "gain is below hysteresis"
+	case time.Since(since) < dwell:
+		decision.Reason = "minimal dwell time didn't pass"
+	default:
+		decision.Reason = "better pool"
+		decision.Switched = true
+	}
+
+	recordProfitDecision(decision)
+
+	if decision.Switched {
+		venuslog.Info("Profit switching from", decision.From, "to", decision.To)
+		switchProfitPool(best)
+	}
+}
+
+// Add decision to the report which is logged next
+func recordProfitDecision(decision ProfitDecision) {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	globalReport.Profit = append(globalReport.Profit, decision)
+}
+
+// Make pool the default one and move miners to it, miners on pool of schedule stay
+func switchProfitPool(poolIndex uint64) {
+
+	poolUrl := config.Get().Pool(poolIndex).Url
+	moved := make(map[string]bool)
+
+	minersMut.Lock()
+	config.Update(func(cfg *config.Config) {
+		cfg.PoolIndex = poolIndex
+		for idx, miner := range cfg.Miners {
+
+			if _, isScheduled := scheduledMiners[miner.IP]; isScheduled || miner.PoolUrl == poolUrl {
+				continue
+			}
+
+			cfg.Miners[idx].PoolUrl = poolUrl
+			moved[miner.IP] = true
+		}
+	})
+	minersMut.Unlock()
+
+	configChanged("profit switching moved miners to " + poolUrl)
+
+	UpstreamsMut.Lock()
+	profitSince = time.Now()
+	UpstreamsMut.Unlock()
+
+	srv.ConnsMut.Lock()
+	conns := make([]*stratumserver.Connection, 0, len(srv.Connections))
+	for _, conn := range srv.Connections {
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		if moved[ip] && conn.Route == "" {
+			conns = append(conns, conn)
+		}
+	}
+	srv.ConnsMut.Unlock()
+
+	for _, conn := range conns {
+		moveMiner(conn, poolIndex)
+	}
+}
+
+// Scoring pools periodically while it is enabled, provider is made again when
+// reloaded config changes it
+func watchProfit() {
+
+	var provider profit.Provider
+	var kind, source string
+
+	for {
+		if !config.Get().Profit.Enabled {
+			time.Sleep(config.CONFIG_WATCH_SECONDS * time.Second)
+			continue
+		}
+
+		if provider == nil || kind != config.Get().Profit.Provider || source != config.Get().Profit.Source {
+
+			var err error
+			kind, source = config.Get().Profit.Provider, config.Get().Profit.Source
+			provider, err = profit.New(kind, source)
+
+			if err != nil {
+				venuslog.Warn("Profit switching is disabled:", err)
+				time.Sleep(time.Duration(config.Get().Profit.Interval) * time.Second)
+				continue
+			}
+		}
+
+		checkProfit(provider)
+
+		time.Sleep(time.Duration(config.Get().Profit.Interval) * time.Second)
+	}
+}
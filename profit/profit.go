@@ -0,0 +1,143 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package profit gives expected revenue of pools from a pluggable source
+package profit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Kinds of provider
+const PROVIDER_FILE = "file"
+const PROVIDER_HTTP = "http"
+const PROVIDER_SCRIPT = "script"
+
+// Waiting time for HTTP endpoint or script to give scores
+const PROVIDER_TIMEOUT = 10 * time.Second
+
+// Largest document of scores which is read
+const MAX_SCORES_SIZE = 1 << 20
+
+// Provider gives expected revenue per TH/s of pools, keyed by url or name of pool.
+// Scores are a JSON object like {"stratum.braiins.com:3333": 0.071}.
+type Provider interface {
+	Scores() (map[string]float64, error)
+}
+
+// Scores read from local file, it can be updated by anything else
+type FileProvider struct {
+	Path string
+}
+
+// Scores fetched from HTTP endpoint with GET
+type HTTPProvider struct {
+	Url    string
+	client http.Client
+}
+
+// Scores printed by command to standard output
+type ScriptProvider struct {
+	Command string
+}
+
+// Provider of kind reading from source, which is path, url or command
+func New(kind string, source string) (Provider, error) {
+
+	if source == "" {
+		return nil, errors.New("profit provider has no source")
+	}
+
+	switch kind {
+	case PROVIDER_FILE:
+		return &FileProvider{Path: source}, nil
+	case PROVIDER_HTTP:
+		return &HTTPProvider{Url: source, client: http.Client{Timeout: PROVIDER_TIMEOUT}}, nil
+	case PROVIDER_SCRIPT:
+		return &ScriptProvider{Command: source}, nil
+	}
+
+	return nil, errors.New("invalid profit provider " + kind + " (should be file, http or script)")
+}
+
+func parseScores(data []byte) (map[string]float64, error) {
+
+	scores := make(map[string]float64)
+
+	if err := json.Unmarshal(data, &scores); err != nil {
+		return nil, errors.New("invalid scores: " + err.Error())
+	}
+
+	return scores, nil
+}
+
+func (p *FileProvider) Scores() (map[string]float64, error) {
+
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseScores(data)
+}
+
+func (p *HTTPProvider) Scores() (map[string]float64, error) {
+
+	resp, err := p.client.Get(p.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("profit endpoint answered " + resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_SCORES_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseScores(data)
+}
+
+func (p *ScriptProvider) Scores() (map[string]float64, error) {
+
+	args := strings.Fields(p.Command)
+	if len(args) == 0 {
+		return nil, errors.New("profit script is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PROVIDER_TIMEOUT)
+	defer cancel()
+
+	data, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, errors.New("profit script failed: " + err.Error())
+	}
+
+	return parseScores(data)
+}
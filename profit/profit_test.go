@@ -0,0 +1,197 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package profit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		kind     string
+		source   string
+		provider Provider
+		err      string
+	}{
+		{PROVIDER_FILE, "scores.json", &FileProvider{}, ""},
+		{PROVIDER_HTTP, "http://127.0.0.1/scores", &HTTPProvider{}, ""},
+		{PROVIDER_SCRIPT, "./scores.sh", &ScriptProvider{}, ""},
+		{PROVIDER_FILE, "", nil, "no source"},
+		{"ftp", "scores.json", nil, "invalid profit provider"},
+	}
+
+	for _, test := range tests {
+		provider, err := New(test.kind, test.source)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("provider %s of %q: error is %v, expected %q", test.kind, test.source, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("provider %s of %q: %v", test.kind, test.source, err)
+			continue
+		}
+		if reflect.TypeOf(provider) != reflect.TypeOf(test.provider) {
+			t.Errorf("provider %s of %q is %T", test.kind, test.source, provider)
+		}
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		scores  map[string]float64
+		isError bool
+	}{
+		{"scores", `{"stratum.braiins.com:3333": 0.071, "viabtc": 0.069}`,
+			map[string]float64{"stratum.braiins.com:3333": 0.071, "viabtc": 0.069}, false},
+		{"empty object", `{}`, map[string]float64{}, false},
+		{"invalid json", `{"viabtc": `, nil, true},
+		{"score isn't number", `{"viabtc": "high"}`, nil, true},
+		{"missing file", "", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			path := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_")+".json")
+
+			if test.content != "" {
+				if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			provider, _ := New(PROVIDER_FILE, path)
+			scores, err := provider.Scores()
+
+			if test.isError {
+				if err == nil {
+					t.Fatalf("expected error, got scores %v", scores)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scores, test.scores) {
+				t.Fatalf("scores are %v, expected %v", scores, test.scores)
+			}
+		})
+	}
+}
+
+func TestFileProviderUpdated(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "scores.json")
+	provider := &FileProvider{Path: path}
+
+	// File is read again every time, anything can update it meanwhile
+	for _, score := range []float64{0.07, 0.08} {
+
+		if err := os.WriteFile(path, []byte(`{"pool": `+strconv.FormatFloat(score, 'f', -1, 64)+`}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		scores, err := provider.Scores()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scores["pool"] != score {
+			t.Fatalf("score is %v, expected %v", scores["pool"], score)
+		}
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		scores  map[string]float64
+		isError bool
+	}{
+		{"scores", http.StatusOK, `{"stratum.braiins.com:3333": 0.071}`,
+			map[string]float64{"stratum.braiins.com:3333": 0.071}, false},
+		{"server error", http.StatusInternalServerError, `{"stratum.braiins.com:3333": 0.071}`, nil, true},
+		{"not found", http.StatusNotFound, "", nil, true},
+		{"invalid json", http.StatusOK, `<html>`, nil, true},
+		{"too large", http.StatusOK, `{"pool": 0.07, "padding": "` + strings.Repeat("x", MAX_SCORES_SIZE) + `"}`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					t.Errorf("scores fetched with %s", r.Method)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			provider, _ := New(PROVIDER_HTTP, server.URL)
+			scores, err := provider.Scores()
+
+			if test.isError {
+				if err == nil {
+					t.Fatalf("expected error, got scores %v", scores)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scores, test.scores) {
+				t.Fatalf("scores are %v, expected %v", scores, test.scores)
+			}
+		})
+	}
+}
+
+func TestHTTPProviderUnreachable(t *testing.T) {
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	provider, _ := New(PROVIDER_HTTP, url)
+
+	if scores, err := provider.Scores(); err == nil {
+		t.Fatalf("expected error, got scores %v", scores)
+	}
+}
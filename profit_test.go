@@ -0,0 +1,242 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Provider giving scores set by test
+type testProvider struct {
+	scores map[string]float64
+	err    error
+}
+
+func (p *testProvider) Scores() (map[string]float64, error) {
+	return p.scores, p.err
+}
+
+// Config with two pools and miners on the first one, restored after test
+func profitConfig(t *testing.T) {
+
+	cfg := config.Get()
+
+	UpstreamsMut.Lock()
+	since := profitSince
+	report := globalReport
+	UpstreamsMut.Unlock()
+
+	t.Cleanup(func() {
+		config.Set(cfg)
+		UpstreamsMut.Lock()
+		profitSince = since
+		globalReport = report
+		UpstreamsMut.Unlock()
+		takePendingChanges()
+	})
+
+	next := &config.Config{}
+	next.Pools = []config.PoolInfo{
+		{Url: "pool-a:3333", Name: "a"},
+		{Url: "pool-b:3333", Name: "b"},
+	}
+	next.Miners = []config.MinerInfo{
+		{IP: "10.0.0.1", PoolUrl: "pool-a:3333"},
+		{IP: "10.0.0.2", PoolUrl: "pool-a:3333"},
+	}
+	next.Profit.Enabled = true
+	next.Profit.Hysteresis = 5
+	next.Profit.MinDwell = 600
+	config.Set(next)
+
+	UpstreamsMut.Lock()
+	globalReport = &Report{}
+	UpstreamsMut.Unlock()
+}
+
+// Time when the current pool was chosen is set like by switching
+func setProfitSince(since time.Time) {
+	UpstreamsMut.Lock()
+	profitSince = since
+	UpstreamsMut.Unlock()
+}
+
+// Decisions in the report which is logged next
+func profitDecisions() []ProfitDecision {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	return append([]ProfitDecision{}, globalReport.Profit...)
+}
+
+func TestCheckProfit(t *testing.T) {
+
+	longAgo := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		scores   map[string]float64
+		since    time.Time
+		poolUrl  string
+		switched bool
+		reason   string
+	}{
+		{"current pool is the best", map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 0.9}, longAgo, "pool-a:3333", false, ""},
+		{"gain below hysteresis", map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 1.04}, longAgo, "pool-a:3333", false, "gain is below hysteresis"},
+		{"gain equal to hysteresis", map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 1.05}, longAgo, "pool-a:3333", false, "gain is below hysteresis"},
+		{"dwell time didn't pass", map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 1.2}, time.Now().Add(-time.Minute), "pool-a:3333", false, "minimal dwell time didn't pass"},
+		{"better pool", map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 1.2}, longAgo, "pool-b:3333", true, "better pool"},
+		{"pool scored by name", map[string]float64{"a": 1.0, "b": 1.2}, longAgo, "pool-b:3333", true, "better pool"},
+		{"current pool without score", map[string]float64{"pool-b:3333": 0.1}, longAgo, "pool-b:3333", true, "better pool"},
+		{"no scores", map[string]float64{}, longAgo, "pool-a:3333", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			profitConfig(t)
+			setProfitSince(test.since)
+
+			checkProfit(&testProvider{scores: test.scores})
+
+			if poolUrl := config.Get().Pool(config.Get().PoolIndex).Url; poolUrl != test.poolUrl {
+				t.Fatalf("pool is %s, expected %s", poolUrl, test.poolUrl)
+			}
+			for _, miner := range config.Get().Miners {
+				if miner.PoolUrl != test.poolUrl {
+					t.Fatalf("miner %s is on %s, expected %s", miner.IP, miner.PoolUrl, test.poolUrl)
+				}
+			}
+
+			decisions := profitDecisions()
+
+			if test.reason == "" {
+				if len(decisions) != 0 {
+					t.Fatalf("unexpected decision %+v", decisions)
+				}
+				return
+			}
+
+			if len(decisions) != 1 {
+				t.Fatalf("expected one decision, got %+v", decisions)
+			}
+
+			decision := decisions[0]
+			if decision.Switched != test.switched || decision.Reason != test.reason {
+				t.Fatalf("decision is %+v, expected switched %v because %s", decision, test.switched, test.reason)
+			}
+		})
+	}
+}
+
+func TestCheckProfitProviderError(t *testing.T) {
+
+	profitConfig(t)
+
+	checkProfit(&testProvider{err: errors.New("unreachable")})
+
+	if decisions := profitDecisions(); config.Get().PoolIndex != 0 || len(decisions) != 0 {
+		t.Fatalf("pool changed to %d with decisions %+v when provider failed", config.Get().PoolIndex, decisions)
+	}
+}
+
+// Scores going up and down around each other don't move miners back and forth
+func TestCheckProfitFlapping(t *testing.T) {
+
+	profitConfig(t)
+	setProfitSince(time.Now().Add(-time.Hour))
+
+	steps := []struct {
+		scoreA  float64
+		scoreB  float64
+		poolUrl string
+	}{
+		// Scores which differ less than hysteresis
+		{1.00, 1.03, "pool-a:3333"},
+		{1.03, 1.00, "pool-a:3333"},
+		{1.00, 1.04, "pool-a:3333"},
+
+		// Pool b gets better, then a recovers before dwell time passed
+		{1.00, 1.20, "pool-b:3333"},
+		{1.30, 1.00, "pool-b:3333"},
+		{1.00, 1.20, "pool-b:3333"},
+		{1.30, 1.00, "pool-b:3333"},
+	}
+
+	for idx, step := range steps {
+
+		checkProfit(&testProvider{scores: map[string]float64{"pool-a:3333": step.scoreA, "pool-b:3333": step.scoreB}})
+
+		if poolUrl := config.Get().Pool(config.Get().PoolIndex).Url; poolUrl != step.poolUrl {
+			t.Fatalf("step %d: pool is %s, expected %s", idx, poolUrl, step.poolUrl)
+		}
+	}
+
+	switches := 0
+	for _, decision := range profitDecisions() {
+		if decision.Switched {
+			switches++
+		}
+	}
+
+	if switches != 1 {
+		t.Fatalf("pool switched %d times, expected once", switches)
+	}
+
+	// Pool a is worth it again once dwell time passed
+	setProfitSince(time.Now().Add(-time.Hour))
+
+	checkProfit(&testProvider{scores: map[string]float64{"pool-a:3333": 1.30, "pool-b:3333": 1.00}})
+
+	if config.Get().PoolIndex != 0 {
+		t.Fatalf("pool is %s after dwell time, expected pool-a:3333", config.Get().Pool(config.Get().PoolIndex).Url)
+	}
+}
+
+// Decisions and dwell time are shared with report logging, run with -race
+func TestCheckProfitConcurrent(t *testing.T) {
+
+	profitConfig(t)
+	setProfitSince(time.Now().Add(-time.Hour))
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+
+		// Report is replaced like by makeReport
+		for i := 0; i < 100; i++ {
+			UpstreamsMut.Lock()
+			globalReport = &Report{Profit: globalReport.Profit}
+			UpstreamsMut.Unlock()
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		checkProfit(&testProvider{scores: map[string]float64{"pool-a:3333": 1.0, "pool-b:3333": 1.2}})
+	}
+
+	<-done
+
+	if len(profitDecisions()) == 0 {
+		t.Fatal("no decision was recorded")
+	}
+}
@@ -25,17 +25,24 @@ import (
 	"btcminerproxy/stratum/template"
 	"btcminerproxy/venuslog"
 	"encoding/json"
-	"io"
-	"strconv"
-	"strings"
+	"net"
 	"time"
 )
 
-var srv = stratumserver.Server{}
+// Channel is made here, listeners and stratum V2 sessions are started concurrently
+var srv = stratumserver.Server{NewConnections: make(chan *stratumserver.Connection, 1)}
 
 // Main process of proxy, starting proxy depends config proxy
 // in terms of port and monitoring incoming connection from miner
 func StartProxy() {
+	go watchUpstreams()
+	go watchBans()
+	go watchConfigChanges()
+
+	go watchBalance()
+	go watchProfit()
+	go watchSchedule()
+
 	go func() {
 		for {
 			newConn := <-srv.NewConnections
@@ -43,18 +50,18 @@ func StartProxy() {
 		}
 	}()
 
-	for i, v := range config.CFG.Bind {
-		if i != len(config.CFG.Bind)-1 {
-			go srv.Start(v.Port, v.Host, v.Tls)
-		} else {
-			srv.Start(v.Port, v.Host, v.Tls)
-		}
-	}
+	startBinds()
+
+	go watchConfigFile()
+
+	select {}
 }
 
-func updatePoolRatedHash(conn *stratumserver.Connection, jobId uint64) {
+// Add difficulty of accepted share to the total of pool
+func updatePoolRatedHash(poolUrl string, difficulty float64) {
 
-	poolUrl := config.CFG.Pools[conn.PoolId].Url
+	globalPoolInfoMut.Lock()
+	defer globalPoolInfoMut.Unlock()
 
 	for idx, pool := range globalPoolInfo {
 
@@ -62,10 +69,7 @@ func updatePoolRatedHash(conn *stratumserver.Connection, jobId uint64) {
 			continue
 		}
 
-		globalPoolInfo[idx].RatedHash += Upstreams[conn.Upstream].Jobs[jobId].Difficulty
-		Upstreams[conn.Upstream].Jobs[jobId].Status = 0
-
-		delete(Upstreams[conn.Upstream].Jobs, jobId)
+		globalPoolInfo[idx].RatedHash += difficulty
 		return
 	}
 
@@ -73,7 +77,7 @@ func updatePoolRatedHash(conn *stratumserver.Connection, jobId uint64) {
 
 	newPoolInfo := &PoolRatedHash{}
 	newPoolInfo.PoolUrl = poolUrl
-	newPoolInfo.RatedHash = 0
+	newPoolInfo.RatedHash = difficulty
 	newPoolInfo.Timestamp = t.String()
 
 	globalPoolInfo = append(globalPoolInfo, newPoolInfo)
@@ -85,16 +89,21 @@ func HandleConnection(conn *stratumserver.Connection) {
 
 	buf := make([]byte, config.MAX_REQUEST_SIZE)
 	bufLen := 0
-	conn.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
 
-	ipAddr := strings.Split(conn.Conn.RemoteAddr().String(), ":")
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
 
-	result := checkBlackList(ipAddr[0])
+	result := checkBlackList(ip)
 
-	venuslog.Info("This miner address", ipAddr[0])
+	venuslog.Info("This miner address", ip)
 
 	if result == true {
-		venuslog.Info("This address is in blocklist", ipAddr[0])
+		venuslog.Info("This address is in blocklist", ip)
+		Kick(conn.Id)
+		return
+	}
+
+	if isBanned(ip) || recordConnection(ip) {
+		venuslog.Info("This address is banned", ip)
 		Kick(conn.Id)
 		return
 	}
@@ -102,11 +111,12 @@ func HandleConnection(conn *stratumserver.Connection) {
 	for {
 
 		// Read data from socket and parsing stratum msg one by one
+		conn.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
 		req := template.StratumMsg{}
 		msg, msgLen, readLen, err := template.ReadLineFromSocket(conn.Conn, buf, bufLen)
 
 		if err != nil || msgLen == 0 {
-			if err == io.EOF {
+			if err == nil {
 				continue
 			}
 			venuslog.Warn("Read Data failed in proxy from miner:", err)
@@ -124,6 +134,7 @@ func HandleConnection(conn *stratumserver.Connection) {
 
 		if errJson != nil {
 			venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
+			recordMalformed(ip)
 			Kick(conn.Id)
 			return
 		}
@@ -138,18 +149,33 @@ func HandleConnection(conn *stratumserver.Connection) {
 		case "mining.authorize":
 			venuslog.Warn("Stratum proxy received authorize from miner :", conn.Conn.RemoteAddr())
 
+			if config.Get().Aggregate.Enabled {
+				AuthorizeAggregated(conn, msg)
+				rerouteMiner(conn)
+				break
+			}
+
 			authorizemsg := template.AuthorizeMsg{}
 			errJson := rpc.ReadJSON(&authorizemsg, msg)
 
-			if errJson != nil {
+			if errJson != nil || len(authorizemsg.Params) == 0 {
 				venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
 				return
 			}
 
+			password := ""
+			if len(authorizemsg.Params) > 1 {
+				password = authorizemsg.Params[1]
+			}
+
 			conn.WorkerID = authorizemsg.Params[0]
 
-			authorizemsg.Params[0] = config.CFG.Pools[conn.PoolId].User
-			authorizemsg.Params[1] = config.CFG.Pools[conn.PoolId].Pass
+			if err := checkAuthorize(conn, conn.WorkerID, password); err != nil {
+				refuseAuthorize(conn, authorizemsg.ID, conn.WorkerID, err)
+				break
+			}
+
+			authorizemsg.Params = []string{poolWorker(conn.PoolId, conn), config.Get().Pool(conn.PoolId).Pass}
 
 			newmsg, err := json.Marshal(authorizemsg)
 			if err != nil {
@@ -163,26 +189,9 @@ func HandleConnection(conn *stratumserver.Connection) {
 			venuslog.Warn("Stratum proxy received configure from miner :", conn.Conn.RemoteAddr())
 			SendConfigure(conn, msg)
 
-		case "mining.submits":
-			submitmsg := template.SubmitMsg{}
-			errJson := rpc.ReadJSON(&submitmsg, msg)
-
-			if errJson != nil {
-				venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
-				return
-			}
-
-			jobId, errUintJob := strconv.ParseUint(submitmsg.Params[1], 10, 0)
-
-			if errUintJob != nil {
-				venuslog.Warn("ReadJSON failed in proxy from miner:", submitmsg.Params[1], errUintJob)
-				return
-			}
-
-			updatePoolRatedHash(conn, jobId)
-
-			conn.Submits.Accepted++
-			Upstreams[conn.Upstream].Submits.Accepted++
+		case "mining.submit":
+			// Share is counted when pool answers the submit
+			SendData(conn, msg)
 
 		default:
 			venuslog.Warn("Stratum proxy received data from miner :", conn.Conn.RemoteAddr())
@@ -206,9 +215,8 @@ func Kick(id uint64) {
 
 			if Upstreams[v.Upstream] != nil {
 				// remove client from upstream
-
 				// If upstream is empty, close it
-				Upstreams[v.Upstream].Close()
+				Upstreams[v.Upstream].detach(v)
 			}
 
 			UpstreamsMut.Unlock()
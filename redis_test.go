@@ -0,0 +1,216 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis server keeping strings and lists in memory, with commands used by proxy
+type testRedis struct {
+	mutex   sync.Mutex
+	strings map[string]string
+	lists   map[string][]string
+}
+
+// Connect db to a new test redis server, the previous one is restored after test
+func useTestRedis(t *testing.T) *testRedis {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testRedis{strings: make(map[string]string), lists: make(map[string][]string)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	previous := db
+	db = redis.NewClient(&redis.Options{Addr: listener.Addr().String()})
+
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+		listener.Close()
+	})
+
+	return server
+}
+
+func (r *testRedis) serve(conn net.Conn) {
+
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		r.mutex.Lock()
+		reply := r.command(args)
+		r.mutex.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for idx := range args {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		args[idx] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+// Range of list by redis indexes, negative ones count from the end
+func listRange(list []string, start int, stop int) []string {
+
+	if start < 0 {
+		start += len(list)
+	}
+	if stop < 0 {
+		stop += len(list)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+
+	return list[start : stop+1]
+}
+
+func (r *testRedis) command(args []string) string {
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+
+	case "GET":
+		value, ok := r.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+
+	case "SET":
+		r.strings[args[1]] = args[2]
+		return "+OK\r\n"
+
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := r.strings[key]; ok {
+				deleted++
+			}
+			delete(r.strings, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+
+	case "INCR":
+		value, _ := strconv.Atoi(r.strings[args[1]])
+		r.strings[args[1]] = strconv.Itoa(value + 1)
+		return fmt.Sprintf(":%d\r\n", value+1)
+
+	case "LPUSH":
+		for _, value := range args[2:] {
+			r.lists[args[1]] = append([]string{value}, r.lists[args[1]]...)
+		}
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+
+	case "LLEN":
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+
+	case "LTRIM", "LRANGE":
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		values := listRange(r.lists[args[1]], start, stop)
+
+		if strings.ToUpper(args[0]) == "LTRIM" {
+			r.lists[args[1]] = append([]string{}, values...)
+			return "+OK\r\n"
+		}
+
+		reply := fmt.Sprintf("*%d\r\n", len(values))
+		for _, value := range values {
+			reply += bulk(value)
+		}
+		return reply
+	}
+
+	return "-ERR unknown command " + args[0] + "\r\n"
+}
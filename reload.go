@@ -0,0 +1,299 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/venuslog"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// Config file is reloaded when it changes or proxy gets SIGHUP. New config is validated
+// and applied while proxy runs, an invalid one is rejected and the running config stays.
+// Miners are touched only when their pool changed: miners of pools which are gone or
+// connect differently reconnect, miners assigned to another pool are switched to it.
+// Aggregation, stratum V2 and concurrency settings take effect after restart.
+
+// Digest of config file as proxy loaded or wrote it last, configMut must be locked
+var configDigest [32]byte
+
+// Settings which take effect after restart, as they are in config file.
+// They are written back to config instead of the running ones, configMut must be locked.
+var restartConfig *config.Config
+
+// Remember config file which proxy loaded or wrote, it isn't reloaded
+func rememberConfigFile(data []byte) {
+	configDigest = sha256.Sum256(data)
+}
+
+// Settings of config file which need restart, instead of running ones
+func keepRestartSettings(cfg *config.Config) {
+	if restartConfig == nil {
+		return
+	}
+
+	cfg.Aggregate = restartConfig.Aggregate
+	cfg.Sv2 = restartConfig.Sv2
+	cfg.MaxConcurrency = restartConfig.MaxConcurrency
+}
+
+// Read config file again and apply it, file which didn't change is skipped unless forced
+func reloadConfig(who string, force bool) error {
+
+	configMut.Lock()
+	defer configMut.Unlock()
+
+	data, err := os.ReadFile(config.CONFIG_FILE)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	if digest == configDigest && !force {
+		return nil
+	}
+
+	// Invalid file is reported once, not on every check
+	configDigest = digest
+
+	candidate := config.Config{}
+	if err := json.Unmarshal(data, &candidate); err != nil {
+		return errors.New("config file is invalid, running config is kept: " + err.Error())
+	}
+
+	if err := candidate.Validate(); err != nil {
+		return errors.New("config file is invalid, running config is kept: " + err.Error())
+	}
+
+	// Changes made by proxy are kept as its revision, config file replaces them
+	if pending := takePendingChanges(); pending != "" {
+		addRevision("proxy", pending, savedConfig())
+	}
+
+	if err := applyConfig(&candidate); err != nil {
+		return err
+	}
+
+	venuslog.Info("Config reloaded by", who)
+
+	return addRevision(who, "reloaded "+config.CONFIG_FILE, savedConfig())
+}
+
+// Apply validated config to running proxy, configMut must be locked
+func applyConfig(candidate *config.Config) error {
+
+	if err := loadAcls(candidate); err != nil {
+		return err
+	}
+
+	running := config.Get()
+
+	if candidate.Aggregate != running.Aggregate || candidate.Sv2 != running.Sv2 || candidate.MaxConcurrency != running.MaxConcurrency {
+		venuslog.Warn("Aggregation, stratum V2 and concurrency settings take effect after restart")
+	}
+
+	restartConfig = &config.Config{
+		Aggregate:      candidate.Aggregate,
+		Sv2:            candidate.Sv2,
+		MaxConcurrency: candidate.MaxConcurrency,
+	}
+
+	next := *candidate
+	next.Aggregate = running.Aggregate
+	next.Sv2 = running.Sv2
+	next.MaxConcurrency = running.MaxConcurrency
+
+	// Miners and routes don't change while new config is published
+	minersMut.Lock()
+	routesMut.Lock()
+
+	moves := minerMoves(next.Miners)
+	routesChanged := !reflect.DeepEqual(config.Get().Routes, next.Routes) || !reflect.DeepEqual(config.Get().PoolGroups, next.PoolGroups)
+
+	applyPools(&next)
+
+	routesMut.Unlock()
+	minersMut.Unlock()
+
+	reloadBinds()
+	reloadDashboard()
+
+	for ip, url := range moves {
+		for idx, pool := range next.Pools {
+			if pool.Url == url {
+				venuslog.Info("Changed config moves miner", ip, "to", url)
+				moveMinersFromIp(ip, uint64(idx))
+			}
+		}
+	}
+
+	if routesChanged {
+		rerouteMiners()
+	}
+
+	return nil
+}
+
+// Pool connects the same way, only name and weight differ
+func samePoolConnection(a config.PoolInfo, b config.PoolInfo) bool {
+	a.Name, a.Weight = b.Name, b.Weight
+	return reflect.DeepEqual(a, b)
+}
+
+// Publish new config. Upstreams of pools which are gone or connect differently are
+// closed before and upstreams of pools which are kept get their new indexes together
+// with it, so pool index of upstream and its miners always belongs to running config.
+// minersMut and routesMut must be locked
+func applyPools(next *config.Config) {
+
+	remap := make(map[uint64]uint64, len(next.Pools))
+	for oldIdx, old := range config.Get().Pools {
+		for newIdx, pool := range next.Pools {
+			if samePoolConnection(old, pool) {
+				remap[uint64(oldIdx)] = uint64(newIdx)
+				break
+			}
+		}
+	}
+
+	UpstreamsMut.Lock()
+
+	kept := make([]*Upstream, 0, len(Upstreams))
+	closing := make([]*Upstream, 0)
+
+	for _, us := range Upstreams {
+
+		us.mutex.Lock()
+		_, isPrimaryKept := remap[us.Primary]
+		_, isCurrentKept := remap[us.PoolId]
+		us.mutex.Unlock()
+
+		if isPrimaryKept && isCurrentKept {
+			kept = append(kept, us)
+		} else {
+			closing = append(closing, us)
+		}
+	}
+
+	for _, us := range closing {
+		venuslog.Info("Pool of upstream", us.ID, "changed, its miners connect again")
+		us.Close()
+	}
+
+	// Nobody holds two upstreams at once, so all of them can be locked here
+	for _, us := range kept {
+		us.mutex.Lock()
+	}
+
+	for _, us := range kept {
+		us.Primary = remap[us.Primary]
+		us.PoolId = remap[us.PoolId]
+		for _, conn := range us.servers {
+			conn.PoolId = us.PoolId
+		}
+	}
+
+	config.Set(next)
+
+	for _, us := range kept {
+		us.mutex.Unlock()
+	}
+
+	UpstreamsMut.Unlock()
+
+	poolsDownMut.Lock()
+	down := make(map[uint64]time.Time, len(poolsDown))
+	for oldIdx, until := range poolsDown {
+		if newIdx, ok := remap[oldIdx]; ok {
+			down[newIdx] = until
+		}
+	}
+	poolsDown = down
+	poolsDownMut.Unlock()
+
+	for ip, hint := range routeHints {
+		if newIdx, ok := remap[hint.poolIndex]; ok {
+			hint.poolIndex = newIdx
+			routeHints[ip] = hint
+		} else {
+			delete(routeHints, ip)
+		}
+	}
+}
+
+// Miners whose pool changed in new config, by IP. Miners moved by schedule stay on
+// pool of schedule and go back to pool of new config after it.
+// minersMut must be locked
+func minerMoves(miners []config.MinerInfo) map[string]string {
+
+	previous := make(map[string]string, len(config.Get().Miners))
+	for _, miner := range config.Get().Miners {
+		previous[miner.IP] = miner.PoolUrl
+	}
+
+	moves := make(map[string]string)
+	for idx, miner := range miners {
+
+		current, ok := previous[miner.IP]
+		if !ok {
+			continue
+		}
+
+		if _, isScheduled := scheduledMiners[miner.IP]; isScheduled {
+			scheduledMiners[miner.IP] = miner.PoolUrl
+			miners[idx].PoolUrl = current
+			continue
+		}
+
+		if current != miner.PoolUrl {
+			moves[miner.IP] = miner.PoolUrl
+		}
+	}
+
+	return moves
+}
+
+// Reload config when file changes or proxy gets SIGHUP
+func watchConfigFile() {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for {
+		var err error
+
+		select {
+		case <-hangup:
+			err = reloadConfig("SIGHUP", true)
+		case <-time.After(config.CONFIG_WATCH_SECONDS * time.Second):
+			err = reloadConfig("config file", false)
+		}
+
+		if err != nil {
+			venuslog.Warn("Failed to reload config:", err)
+		}
+	}
+}
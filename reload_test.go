@@ -0,0 +1,138 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumclient "btcminerproxy/stratum/client"
+	stratumserver "btcminerproxy/stratum/server"
+	"net"
+	"testing"
+)
+
+// Upstream connected to pool of index with one miner, restored upstreams after test
+func testUpstream(t *testing.T, id uint64, poolIndex uint64) (*Upstream, *stratumserver.Connection) {
+
+	pool, _ := net.Pipe()
+	miner, _ := net.Pipe()
+
+	conn := &stratumserver.Connection{Conn: miner, Id: id, PoolId: poolIndex}
+
+	us := &Upstream{
+		ID:      id,
+		PoolId:  poolIndex,
+		Primary: poolIndex,
+		client:  &stratumclient.Client{Conn: pool},
+		servers: map[uint64]*stratumserver.Connection{conn.Id: conn},
+		ready:   make(chan struct{}),
+	}
+
+	UpstreamsMut.Lock()
+	Upstreams[id] = us
+	UpstreamsMut.Unlock()
+
+	t.Cleanup(func() {
+		UpstreamsMut.Lock()
+		delete(Upstreams, id)
+		UpstreamsMut.Unlock()
+	})
+
+	return us, conn
+}
+
+func TestApplyConfigPools(t *testing.T) {
+
+	cfg := config.Get()
+	t.Cleanup(func() { config.Set(cfg) })
+
+	config.Set(&config.Config{
+		Pools: []config.PoolInfo{
+			{Url: "pool-a:3333", User: "a"},
+			{Url: "pool-b:3333", User: "b"},
+			{Url: "pool-c:3333", User: "c"},
+		},
+	})
+
+	usB, _ := testUpstream(t, 1001, 1)
+	usC, connC := testUpstream(t, 1002, 2)
+
+	// Pool b is removed, the others are reordered
+	candidate := &config.Config{
+		Pools: []config.PoolInfo{
+			{Url: "pool-c:3333", User: "c", Name: "renamed"},
+			{Url: "pool-a:3333", User: "a"},
+		},
+	}
+
+	// Upstream always sees its own pool, never index of one config with pools of the other
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			usC.mutex.Lock()
+			url := config.Get().Pool(usC.PoolId).Url
+			usC.mutex.Unlock()
+
+			if url != "pool-c:3333" {
+				t.Errorf("upstream of pool c sees pool %q", url)
+				return
+			}
+		}
+	}()
+
+	configMut.Lock()
+	err := applyConfig(candidate)
+	configMut.Unlock()
+
+	close(stop)
+	<-done
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UpstreamsMut.Lock()
+	_, isOpen := Upstreams[usB.ID]
+	UpstreamsMut.Unlock()
+
+	if isOpen || !usB.closed {
+		t.Fatal("upstream of removed pool is open")
+	}
+
+	if usC.PoolId != 0 || usC.Primary != 0 || connC.PoolId != 0 {
+		t.Fatalf("upstream of pool c is on pool %d, primary %d, miner on %d, expected 0", usC.PoolId, usC.Primary, connC.PoolId)
+	}
+
+	if pool := config.Get().Pool(usC.PoolId); pool.Name != "renamed" {
+		t.Fatalf("pool of upstream is %+v, expected renamed pool c", pool)
+	}
+
+	// Index of removed pool doesn't panic
+	if pool := config.Get().Pool(2); pool.Url != "" {
+		t.Fatalf("removed pool is %+v", pool)
+	}
+}
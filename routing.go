@@ -0,0 +1,254 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/routing"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/venuslog"
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// Routing rules choose pool of miners by worker name, bind port, network or TLS
+// server name. Rules are tried in order, miners which match none get their pool
+// by IP like before. Worker name is known only after mining.authorize, so miners
+// matching a worker rule are switched to its pool once they authorized. Miners
+// which have to reconnect for it get the pool by their IP when they come back.
+// Routed miners are left alone by balancing, profit switching and schedules.
+
+var routesMut mutex.Mutex
+
+// Pools of rules for miners which reconnect after rerouting, keyed by IP
+var routeHints = make(map[string]routeHint)
+
+type routeHint struct {
+	poolIndex uint64
+	rule      string
+}
+
+// What proxy knows about miner for matching rules
+func routedMiner(conn *stratumserver.Connection) routing.Miner {
+
+	miner := routing.Miner{Worker: conn.WorkerID}
+
+	if _, port, err := net.SplitHostPort(conn.Conn.LocalAddr().String()); err == nil {
+		bindPort, _ := strconv.ParseUint(port, 10, 16)
+		miner.Port = uint16(bindPort)
+	}
+
+	if host, _, err := net.SplitHostPort(conn.Conn.RemoteAddr().String()); err == nil {
+		miner.IP = net.ParseIP(host)
+	}
+
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		miner.Sni = tlsConn.ConnectionState().ServerName
+	}
+
+	return miner
+}
+
+// Pool of rule, the first healthy one of its group
+func rulePool(rule routing.Rule) (uint64, bool) {
+
+	if rule.Group != "" {
+		return healthyPool(config.Get().PoolGroups[rule.Group])
+	}
+
+	return healthyPool([]string{rule.Pool})
+}
+
+// The first pool of urls which is not down
+func healthyPool(urls []string) (uint64, bool) {
+
+	found := false
+	var first uint64
+
+	for _, url := range urls {
+		for idx, pool := range config.Get().Pools {
+
+			if pool.Url != url {
+				continue
+			}
+
+			if !config.Get().Failover.Enabled || !isPoolDown(uint64(idx)) {
+				return uint64(idx), true
+			}
+
+			if !found {
+				found = true
+				first = uint64(idx)
+			}
+		}
+	}
+
+	// Every pool is down, failover takes care of it
+	return first, found
+}
+
+// Pool of the first rule matching miner
+func routePool(conn *stratumserver.Connection) (uint64, string, bool) {
+
+	miner := routedMiner(conn)
+
+	routesMut.Lock()
+	defer routesMut.Unlock()
+
+	for _, rule := range config.Get().Routes {
+
+		if !rule.Match(miner) {
+			continue
+		}
+
+		if poolIndex, ok := rulePool(rule); ok {
+			return poolIndex, rule.Name, true
+		}
+	}
+
+	return 0, "", false
+}
+
+// Pool for miner which is subscribing, by rules and then by its IP
+func minerPool(conn *stratumserver.Connection) uint64 {
+
+	if poolIndex, rule, ok := routePool(conn); ok {
+		conn.Route = rule
+		return poolIndex
+	}
+
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+	routesMut.Lock()
+	hint, isHinted := routeHints[ip]
+	delete(routeHints, ip)
+	routesMut.Unlock()
+
+	if isHinted {
+		conn.Route = hint.rule
+		conn.Rerouted = true
+		return hint.poolIndex
+	}
+
+	_, poolIndex := findPoolUrl(ip)
+
+	return poolIndex
+}
+
+// Move authorized miner to pool of rule which matches its worker, or to pool allowed to its user
+func rerouteMiner(conn *stratumserver.Connection) {
+
+	if !conn.Authorized {
+		return
+	}
+
+	us := getUpstream(conn.Upstream)
+	if us == nil {
+		return
+	}
+
+	us.mutex.Lock()
+	current := us.Primary
+	us.mutex.Unlock()
+
+	// Pools of user go before rules
+	poolIndex, rule, ok := routePool(conn)
+	if !ok || !allowedPool(conn, poolIndex) {
+		rule = ""
+		poolIndex, ok = userPool(conn, current)
+	}
+
+	if !ok {
+		return
+	}
+
+	isSamePool := current == poolIndex
+
+	conn.Route = rule
+
+	if isSamePool {
+		return
+	}
+
+	// Miners of one IP can match different pools, the one which reconnected stays
+	if conn.Rerouted {
+		venuslog.Warn("Routing rule", rule, "doesn't match pool of reconnected miner", conn.WorkerID)
+		return
+	}
+
+	if !conn.ExtranonceSubscribed {
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+		routesMut.Lock()
+		routeHints[ip] = routeHint{poolIndex: poolIndex, rule: rule}
+		routesMut.Unlock()
+	}
+
+	if rule == "" {
+		venuslog.Info("Pools of user move miner", conn.WorkerID, "to", config.Get().Pool(poolIndex).Url)
+	} else {
+		venuslog.Info("Routing rule", rule, "moves miner", conn.WorkerID, "to", config.Get().Pool(poolIndex).Url)
+	}
+
+	moveMiner(conn, poolIndex)
+}
+
+// Replace routing rules, connected miners are moved to pools of rules matching them
+func setRoutes(routes []routing.Rule) error {
+
+	candidate := *config.Get()
+	candidate.Routes = routes
+
+	if err := candidate.Validate(); err != nil {
+		return err
+	}
+
+	routesMut.Lock()
+	config.Update(func(cfg *config.Config) {
+		cfg.Routes = routes
+	})
+	routesMut.Unlock()
+
+	rerouteMiners()
+
+	return nil
+}
+
+// Move connected miners to pools of rules matching them
+func rerouteMiners() {
+
+	srv.ConnsMut.Lock()
+	conns := make([]*stratumserver.Connection, len(srv.Connections))
+	copy(conns, srv.Connections)
+	srv.ConnsMut.Unlock()
+
+	for _, conn := range conns {
+		rerouteMiner(conn)
+	}
+}
+
+// Routing rules and pool groups
+func getRoutes() ([]routing.Rule, map[string][]string) {
+	routesMut.Lock()
+	defer routesMut.Unlock()
+
+	return config.Get().Routes, config.Get().PoolGroups
+}
@@ -0,0 +1,140 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package routing matches miners to rules which choose their pool
+package routing
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Rule matches miners by every condition which is set, rule without conditions matches all.
+// Pool is chosen by url, or from group of pools.
+type Rule struct {
+	Name string `json:"name"`
+
+	// worker name of mining.authorize, exactly, by prefix or by regular expression
+	Worker       string `json:"worker,omitempty"`
+	WorkerPrefix string `json:"worker_prefix,omitempty"`
+	WorkerRegex  string `json:"worker_regex,omitempty"`
+
+	// port of bind which miner connected to, network of miner and TLS server name it asked for
+	Port uint16 `json:"port,omitempty"`
+	Cidr string `json:"cidr,omitempty"`
+	Sni  string `json:"sni,omitempty"`
+
+	Pool  string `json:"pool,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// WorkerRegex and Cidr parsed by Validate
+	workerRegex *regexp.Regexp
+	cidr        *net.IPNet
+	isValidated bool
+}
+
+// What is known about miner, worker is empty until it authorized
+type Miner struct {
+	Worker string
+	Port   uint16
+	IP     net.IP
+	Sni    string
+}
+
+// Check rule and compile its worker regex and network for matching
+func (r *Rule) Validate() error {
+
+	r.workerRegex = nil
+	r.cidr = nil
+	r.isValidated = false
+
+	if r.Name == "" {
+		return errors.New("routing rule has no name")
+	}
+
+	if r.WorkerRegex != "" {
+		regex, err := regexp.Compile(r.WorkerRegex)
+		if err != nil {
+			return errors.New("invalid worker regex of routing rule " + r.Name)
+		}
+		r.workerRegex = regex
+	}
+
+	if r.Cidr != "" {
+		_, network, err := net.ParseCIDR(r.Cidr)
+		if err != nil {
+			return errors.New("invalid CIDR of routing rule " + r.Name)
+		}
+		r.cidr = network
+	}
+
+	if (r.Pool == "") == (r.Group == "") {
+		return errors.New("routing rule " + r.Name + " should have either pool or group")
+	}
+
+	r.isValidated = true
+
+	return nil
+}
+
+// Rule needs worker name of miner
+func (r *Rule) HasWorker() bool {
+	return r.Worker != "" || r.WorkerPrefix != "" || r.WorkerRegex != ""
+}
+
+// Miner meets every condition of rule. Rule which wasn't validated is validated
+// as a copy on every match, rules shared by readers are left as they are.
+func (r *Rule) Match(miner Miner) bool {
+
+	if !r.isValidated {
+		rule := *r
+		return rule.Validate() == nil && rule.Match(miner)
+	}
+
+	if r.HasWorker() && miner.Worker == "" {
+		return false
+	}
+
+	if r.Worker != "" && r.Worker != miner.Worker {
+		return false
+	}
+
+	if r.WorkerPrefix != "" && !strings.HasPrefix(miner.Worker, r.WorkerPrefix) {
+		return false
+	}
+
+	if r.workerRegex != nil && !r.workerRegex.MatchString(miner.Worker) {
+		return false
+	}
+
+	if r.Port != 0 && r.Port != miner.Port {
+		return false
+	}
+
+	if r.cidr != nil && (miner.IP == nil || !r.cidr.Contains(miner.IP)) {
+		return false
+	}
+
+	if r.Sni != "" && !strings.EqualFold(r.Sni, miner.Sni) {
+		return false
+	}
+
+	return true
+}
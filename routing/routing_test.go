@@ -0,0 +1,139 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package routing
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		isValid bool
+	}{
+		{"pool", Rule{Name: "a", Pool: "pool:3333"}, true},
+		{"group", Rule{Name: "a", Group: "fleet"}, true},
+		{"no name", Rule{Pool: "pool:3333"}, false},
+		{"pool and group", Rule{Name: "a", Pool: "pool:3333", Group: "fleet"}, false},
+		{"neither pool nor group", Rule{Name: "a"}, false},
+		{"regex", Rule{Name: "a", WorkerRegex: `^s19-\d+$`, Pool: "pool:3333"}, true},
+		{"invalid regex", Rule{Name: "a", WorkerRegex: `s19-(`, Pool: "pool:3333"}, false},
+		{"cidr", Rule{Name: "a", Cidr: "10.0.0.0/8", Pool: "pool:3333"}, true},
+		{"invalid cidr", Rule{Name: "a", Cidr: "10.0.0.0/33", Pool: "pool:3333"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.rule.Validate(); (err == nil) != test.isValid {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		miner   Miner
+		isMatch bool
+	}{
+		{"no conditions", Rule{}, Miner{}, true},
+		{"worker", Rule{Worker: "rig1"}, Miner{Worker: "rig1"}, true},
+		{"other worker", Rule{Worker: "rig1"}, Miner{Worker: "rig2"}, false},
+		{"worker unknown yet", Rule{WorkerPrefix: "nh."}, Miner{}, false},
+		{"worker prefix", Rule{WorkerPrefix: "nh."}, Miner{Worker: "nh.rig1"}, true},
+		{"other worker prefix", Rule{WorkerPrefix: "nh."}, Miner{Worker: "rig1"}, false},
+		{"worker regex", Rule{WorkerRegex: `^s19-\d+$`}, Miner{Worker: "s19-07"}, true},
+		{"other worker regex", Rule{WorkerRegex: `^s19-\d+$`}, Miner{Worker: "s19-x"}, false},
+		{"port", Rule{Port: 3333}, Miner{Port: 3333}, true},
+		{"other port", Rule{Port: 3333}, Miner{Port: 3334}, false},
+		{"cidr", Rule{Cidr: "10.0.0.0/8"}, Miner{IP: net.ParseIP("10.1.2.3")}, true},
+		{"other network", Rule{Cidr: "10.0.0.0/8"}, Miner{IP: net.ParseIP("192.168.1.2")}, false},
+		{"ipv6 cidr", Rule{Cidr: "2001:db8::/32"}, Miner{IP: net.ParseIP("2001:db8::1")}, true},
+		{"address unknown", Rule{Cidr: "10.0.0.0/8"}, Miner{}, false},
+		{"sni", Rule{Sni: "pool.example.com"}, Miner{Sni: "POOL.example.com"}, true},
+		{"other sni", Rule{Sni: "pool.example.com"}, Miner{Sni: "example.com"}, false},
+		{"every condition", Rule{WorkerPrefix: "nh.", Port: 3333}, Miner{Worker: "nh.rig1", Port: 3333}, true},
+		{"one condition fails", Rule{WorkerPrefix: "nh.", Port: 3333}, Miner{Worker: "nh.rig1", Port: 3334}, false},
+	}
+
+	for _, test := range tests {
+
+		rule := test.rule
+		rule.Name = test.name
+		rule.Pool = "pool:3333"
+
+		if err := rule.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if rule.Match(test.miner) != test.isMatch {
+			t.Errorf("%s: match of %+v is %v", test.name, test.miner, !test.isMatch)
+		}
+	}
+}
+
+// Rule which skipped Validate matches like a validated one, invalid rule matches nobody
+func TestMatchNotValidated(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		miner   Miner
+		isMatch bool
+	}{
+		{"regex", Rule{Name: "a", WorkerRegex: `^s19-\d+$`, Pool: "pool:3333"}, Miner{Worker: "s19-07"}, true},
+		{"other worker regex", Rule{Name: "a", WorkerRegex: `^s19-\d+$`, Pool: "pool:3333"}, Miner{Worker: "rig1"}, false},
+		{"cidr", Rule{Name: "a", Cidr: "10.0.0.0/8", Pool: "pool:3333"}, Miner{IP: net.ParseIP("10.1.2.3")}, true},
+		{"other network", Rule{Name: "a", Cidr: "10.0.0.0/8", Pool: "pool:3333"}, Miner{IP: net.ParseIP("192.168.1.2")}, false},
+		{"invalid regex", Rule{Name: "a", WorkerRegex: `s19-(`, Pool: "pool:3333"}, Miner{Worker: "s19-("}, false},
+		{"invalid cidr", Rule{Name: "a", Cidr: "10.0.0.0/33", Pool: "pool:3333"}, Miner{IP: net.ParseIP("10.1.2.3")}, false},
+		{"no pool", Rule{Name: "a"}, Miner{}, false},
+	}
+
+	for _, test := range tests {
+
+		rule := test.rule
+
+		if rule.Match(test.miner) != test.isMatch {
+			t.Errorf("%s: match of %+v is %v", test.name, test.miner, !test.isMatch)
+		}
+
+		if !reflect.DeepEqual(rule, test.rule) {
+			t.Errorf("%s: rule changed by match", test.name)
+		}
+	}
+}
+
+// Reload compares rules to find out whether they changed
+func TestValidatedRulesEqual(t *testing.T) {
+
+	rules := func() []Rule {
+		rules := []Rule{{Name: "a", WorkerRegex: `^s19-\d+$`, Pool: "pool:3333"}}
+		if err := rules[0].Validate(); err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+
+	if !reflect.DeepEqual(rules(), rules()) {
+		t.Fatal("same rules validated twice differ")
+	}
+}
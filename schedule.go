@@ -0,0 +1,165 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/venuslog"
+	"net"
+	"time"
+)
+
+// Schedule moves miners to the pool of the first rule which matches them
+// while one of its windows runs, and back to their previous pool after.
+// Miners are moved like with setPool, without disconnecting them.
+
+// Miners on pool of schedule, with pool they go back to, locked by minersMut
+var scheduledMiners = make(map[string]string)
+
+type ScheduleRuleStatus struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Active bool   `json:"active"`
+}
+
+type ScheduledMiner struct {
+	IP         string `json:"ip"`
+	Pool       string `json:"pool"`
+	ReturnPool string `json:"returnPool"`
+}
+
+type ScheduleReport struct {
+	Time   string               `json:"time"`
+	Rules  []ScheduleRuleStatus `json:"rules"`
+	Miners []ScheduledMiner     `json:"miners"`
+}
+
+// Pool of the first active rule matching miner by IP or by any of its workers
+func scheduledPool(ip string, workers []string, now time.Time) (string, bool) {
+
+	for _, rule := range config.Get().Schedule {
+
+		if !rule.IsActive(now) {
+			continue
+		}
+
+		if rule.MatchIP(ip) {
+			return rule.Pool, true
+		}
+
+		for _, worker := range workers {
+			if rule.MatchWorker(worker) {
+				return rule.Pool, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Move connected miners to pools of schedule, or back once their rule ends
+func applySchedule() {
+
+	now := time.Now()
+
+	// Workers of connected miners by IP
+	srv.ConnsMut.Lock()
+	workers := make(map[string][]string, len(srv.Connections))
+	for _, conn := range srv.Connections {
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		workers[ip] = append(workers[ip], conn.WorkerID)
+	}
+	srv.ConnsMut.Unlock()
+
+	moves := make(map[string]string)
+
+	minersMut.Lock()
+	for _, miner := range config.Get().Miners {
+
+		if _, ok := workers[miner.IP]; !ok {
+			continue
+		}
+
+		poolUrl, ok := scheduledPool(miner.IP, workers[miner.IP], now)
+
+		if ok {
+			if _, isScheduled := scheduledMiners[miner.IP]; !isScheduled {
+				scheduledMiners[miner.IP] = miner.PoolUrl
+			}
+		} else if returnPool, isScheduled := scheduledMiners[miner.IP]; isScheduled {
+			poolUrl = returnPool
+			delete(scheduledMiners, miner.IP)
+		} else {
+			continue
+		}
+
+		if poolUrl != miner.PoolUrl {
+			moves[miner.IP] = poolUrl
+		}
+	}
+	minersMut.Unlock()
+
+	for ip, poolUrl := range moves {
+		venuslog.Info("Schedule moves miner", ip, "to", poolUrl)
+		setPool(poolUrl, ip)
+	}
+}
+
+// Rules in force and miners moved by them
+func scheduleReport() ScheduleReport {
+
+	now := time.Now()
+
+	report := ScheduleReport{
+		Time:   now.String(),
+		Rules:  make([]ScheduleRuleStatus, 0, len(config.Get().Schedule)),
+		Miners: make([]ScheduledMiner, 0),
+	}
+
+	for _, rule := range config.Get().Schedule {
+		report.Rules = append(report.Rules, ScheduleRuleStatus{
+			Name:   rule.Name,
+			Pool:   rule.Pool,
+			Active: rule.IsActive(now),
+		})
+	}
+
+	minersMut.Lock()
+	for _, miner := range config.Get().Miners {
+		if returnPool, ok := scheduledMiners[miner.IP]; ok {
+			report.Miners = append(report.Miners, ScheduledMiner{
+				IP:         miner.IP,
+				Pool:       miner.PoolUrl,
+				ReturnPool: returnPool,
+			})
+		}
+	}
+	minersMut.Unlock()
+
+	return report
+}
+
+// Applying schedule periodically
+func watchSchedule() {
+	for {
+		applySchedule()
+
+		time.Sleep(config.SCHEDULE_CHECK_SECONDS * time.Second)
+	}
+}
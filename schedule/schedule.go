@@ -0,0 +1,241 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package schedule decides which pool miners use at a time of the week
+package schedule
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time window starting on days of week, it runs past midnight when to is before from
+type Window struct {
+	// day of week field of cron, e.g. "*", "1-5", "mon-fri" or "sat,sun"
+	Days string `json:"days"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Miners matching any of patterns go to pool during any of windows
+type Rule struct {
+	Name string `json:"name"`
+
+	// IP, CIDR or pattern of worker name like "rig*"
+	Miners  []string `json:"miners"`
+	Pool    string   `json:"pool"`
+	Windows []Window `json:"windows"`
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseDay(field string) (int, error) {
+	for idx, name := range dayNames {
+		if strings.EqualFold(field, name) {
+			return idx, nil
+		}
+	}
+
+	day, err := strconv.Atoi(field)
+	if err != nil || day < 0 || day > 7 {
+		return 0, errors.New("invalid day of week " + field)
+	}
+
+	// Both 0 and 7 are sunday in cron
+	return day % 7, nil
+}
+
+// Days of week selected by cron field
+func parseDays(field string) ([7]bool, error) {
+
+	days := [7]bool{}
+
+	if field == "" || field == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return days, err
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = parseDay(bounds[1])
+			if err != nil {
+				return days, err
+			}
+		}
+
+		// Ranges like fri-mon wrap over the week
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// Minutes since midnight of "HH:MM"
+func parseClock(clock string) (int, error) {
+
+	if clock == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("invalid time " + clock + " (should be HH:MM)")
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *Window) Validate() error {
+	if _, err := parseDays(w.Days); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.From); err != nil {
+		return err
+	}
+	_, err := parseClock(w.To)
+	return err
+}
+
+// Window is running at time t, equal from and to make a window of whole day
+func (w *Window) Contains(t time.Time) bool {
+
+	days, err := parseDays(w.Days)
+	if err != nil {
+		return false
+	}
+
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+
+	minute := t.Hour()*60 + t.Minute()
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+
+	if from < to {
+		return days[today] && minute >= from && minute < to
+	}
+
+	return (days[today] && minute >= from) || (days[yesterday] && minute < to)
+}
+
+func (r *Rule) Validate() error {
+
+	if len(r.Miners) == 0 {
+		return errors.New("schedule rule " + r.Name + " has no miners")
+	}
+
+	for _, pattern := range r.Miners {
+		if strings.Contains(pattern, "/") {
+			if _, _, err := net.ParseCIDR(pattern); err != nil {
+				return errors.New("invalid CIDR " + pattern + " of schedule rule " + r.Name)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid miner pattern " + pattern + " of schedule rule " + r.Name)
+		}
+	}
+
+	for _, window := range r.Windows {
+		if err := window.Validate(); err != nil {
+			return errors.New(err.Error() + " in schedule rule " + r.Name)
+		}
+	}
+
+	return nil
+}
+
+// Rule is in force at time t, rule without windows always is
+func (r *Rule) IsActive(t time.Time) bool {
+
+	if len(r.Windows) == 0 {
+		return true
+	}
+
+	for _, window := range r.Windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Miner at ip matches an IP or CIDR of rule
+func (r *Rule) MatchIP(ip string) bool {
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, pattern := range r.Miners {
+
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err == nil && network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		if other := net.ParseIP(pattern); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Worker name matches a pattern of rule
+func (r *Rule) MatchWorker(worker string) bool {
+
+	if worker == "" {
+		return false
+	}
+
+	for _, pattern := range r.Miners {
+
+		if strings.Contains(pattern, "/") || net.ParseIP(pattern) != nil {
+			continue
+		}
+
+		if matched, _ := path.Match(pattern, worker); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// Time on day of the week starting with monday 2024-01-01
+func at(weekday time.Weekday, clock string) time.Time {
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+
+	day := (int(weekday) + 6) % 7
+
+	return time.Date(2024, 1, 1+day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestWindowContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   Window
+		t        time.Time
+		contains bool
+	}{
+		// Working hours
+		{"start of window", Window{"1-5", "09:00", "17:00"}, at(time.Monday, "09:00"), true},
+		{"inside window", Window{"1-5", "09:00", "17:00"}, at(time.Wednesday, "12:30"), true},
+		{"before window", Window{"1-5", "09:00", "17:00"}, at(time.Monday, "08:59"), false},
+		{"end of window", Window{"1-5", "09:00", "17:00"}, at(time.Friday, "17:00"), false},
+		{"other day", Window{"1-5", "09:00", "17:00"}, at(time.Saturday, "12:00"), false},
+
+		// Window past midnight belongs to the day it starts
+		{"night before midnight", Window{"fri", "22:00", "06:00"}, at(time.Friday, "23:00"), true},
+		{"night after midnight", Window{"fri", "22:00", "06:00"}, at(time.Saturday, "05:59"), true},
+		{"morning after night", Window{"fri", "22:00", "06:00"}, at(time.Saturday, "06:00"), false},
+		{"evening before night", Window{"fri", "22:00", "06:00"}, at(time.Friday, "21:59"), false},
+		{"morning of starting day", Window{"fri", "22:00", "06:00"}, at(time.Friday, "03:00"), false},
+		{"night of other day", Window{"fri", "22:00", "06:00"}, at(time.Saturday, "23:00"), false},
+		{"night over week end", Window{"sat", "20:00", "02:00"}, at(time.Sunday, "01:00"), true},
+		{"night over every midnight", Window{"*", "22:00", "06:00"}, at(time.Monday, "00:00"), true},
+
+		// Whole days
+		{"whole day", Window{"sat,sun", "", ""}, at(time.Sunday, "00:00"), true},
+		{"end of whole day", Window{"sat,sun", "", ""}, at(time.Sunday, "23:59"), true},
+		{"day after whole day", Window{"sat,sun", "", ""}, at(time.Monday, "00:00"), false},
+		{"equal from and to", Window{"wed", "10:00", "10:00"}, at(time.Wednesday, "10:00"), true},
+		{"equal from and to next day", Window{"wed", "10:00", "10:00"}, at(time.Thursday, "09:59"), true},
+		{"equal from and to ended", Window{"wed", "10:00", "10:00"}, at(time.Thursday, "10:00"), false},
+		{"every day", Window{"*", "", ""}, at(time.Thursday, "15:00"), true},
+		{"days empty", Window{"", "08:00", "09:00"}, at(time.Tuesday, "08:30"), true},
+
+		// Day fields
+		{"day names", Window{"mon-fri", "", ""}, at(time.Friday, "12:00"), true},
+		{"day names upper case", Window{"MON-FRI", "", ""}, at(time.Sunday, "12:00"), false},
+		{"days over week end", Window{"fri-mon", "", ""}, at(time.Sunday, "12:00"), true},
+		{"days over week end excludes", Window{"fri-mon", "", ""}, at(time.Tuesday, "12:00"), false},
+		{"sunday is 0", Window{"0", "", ""}, at(time.Sunday, "12:00"), true},
+		{"sunday is 7", Window{"7", "", ""}, at(time.Sunday, "12:00"), true},
+		{"list of days", Window{"1,3, 5", "", ""}, at(time.Friday, "12:00"), true},
+		{"not in list", Window{"1,3,5", "", ""}, at(time.Tuesday, "12:00"), false},
+		{"invalid day", Window{"funday", "", ""}, at(time.Monday, "12:00"), false},
+	}
+
+	for _, test := range tests {
+		if test.window.Contains(test.t) != test.contains {
+			t.Errorf("%s: window %+v contains %s is %v", test.name, test.window, test.t.Format("Mon 15:04"), !test.contains)
+		}
+	}
+}
+
+func TestWindowValidate(t *testing.T) {
+	tests := []struct {
+		window  Window
+		isValid bool
+	}{
+		{Window{"*", "", ""}, true},
+		{Window{"mon-fri", "09:00", "17:00"}, true},
+		{Window{"0-7", "22:00", "06:00"}, true},
+		{Window{"8", "", ""}, false},
+		{Window{"-1", "", ""}, false},
+		{Window{"mon-", "", ""}, false},
+		{Window{"monday", "", ""}, false},
+		{Window{"*", "24:00", ""}, false},
+		{Window{"*", "", "12:60"}, false},
+		{Window{"*", "noon", ""}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.window.Validate(); (err == nil) != test.isValid {
+			t.Errorf("window %+v: validate returned %v", test.window, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/rpc"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Keep job of pool for checking shares, older jobs are dropped when pool cleans jobs
+// upstream must be locked before adding
+func (us *Upstream) addJob(j *job.Job) {
+
+	if j.CleanJobs {
+		us.jobs = make(map[string]*job.Job, config.MAX_JOBS)
+	}
+
+	us.jobs[j.ID] = j
+
+	for len(us.jobs) > config.MAX_JOBS {
+		var oldest *job.Job
+
+		for _, v := range us.jobs {
+			if oldest == nil || v.Received.Before(oldest.Received) {
+				oldest = v
+			}
+		}
+
+		delete(us.jobs, oldest.ID)
+	}
+}
+
+// Difficulty of share which miner submitted, header is rebuilt from the job of pool
+func shareDifficulty(conn *stratumserver.Connection, j *job.Job, params []string, versionMask uint32) (float64, error) {
+
+	if len(params[2]) != conn.ExtraNonce2Size*2 {
+		return 0, errors.New("invalid extranonce2 size")
+	}
+
+	nTime, err := job.ParseUint32(params[3])
+	if err != nil {
+		return 0, err
+	}
+
+	nonce, err := job.ParseUint32(params[4])
+	if err != nil {
+		return 0, err
+	}
+
+	version := j.Version
+
+	if len(params) > 5 {
+		versionBits, err := job.ParseUint32(params[5])
+		if err != nil {
+			return 0, err
+		}
+
+		version = job.RollVersion(version, versionBits, versionMask)
+	}
+
+	// Miner which kept its extranonce1 after failover mines job with extranonce1 of pool in coinb1
+	header, err := j.Header(conn.JobExtraNonce1+conn.ExtraNonce1, params[2], nTime, nonce, version)
+	if err != nil {
+		return 0, err
+	}
+
+	return job.Difficulty(header), nil
+}
+
+// Handle mining.submit of miner. Proxy checks share against job and difficulty of miner,
+// stale, duplicate and low difficulty shares never reach pool. With vardiff share is
+// forwarded only when it meets difficulty of pool too
+func (us *Upstream) submit(conn *stratumserver.Connection, req template.StratumMsg, data []byte) error {
+
+	submitmsg := template.SubmitMsg{}
+	errJson := rpc.ReadJSON(&submitmsg, data)
+
+	if errJson != nil || len(submitmsg.Params) < 5 {
+		return conn.Send(template.StratumMsgResponse{
+			ID:    req.ID,
+			Error: template.NewError(20, "Malformed submit"),
+		})
+	}
+
+	params := submitmsg.Params
+
+	us.mutex.Lock()
+	versionMask := conn.VersionMask
+	j := us.jobs[params[1]]
+	poolDifficulty := us.Difficulty
+	minerDifficulty := conn.Difficulty
+
+	// Shares of job are measured by difficulty it was sent with, miners may
+	// apply new difficulty to the job they work on already
+	if j != nil {
+		if j.Difficulty > 0 {
+			poolDifficulty = j.Difficulty
+		}
+		if difficulty := j.MinerDifficulty(conn.Id); difficulty > 0 && difficulty < minerDifficulty {
+			minerDifficulty = difficulty
+		}
+	}
+	us.mutex.Unlock()
+
+	// Miner may roll only the version bits it was given by mining.configure
+	if len(params) > 5 {
+		versionBits, err := job.ParseUint32(params[5])
+
+		if err != nil || versionBits&^versionMask != 0 {
+			return us.rejectShare(conn, req.ID, 20, "Invalid version bits")
+		}
+	}
+
+	if !config.Get().Vardiff.Enabled && !config.Get().ValidateShares {
+		return us.forwardSubmit(conn, req.ID, submitmsg, minerDifficulty, poolDifficulty)
+	}
+
+	if j == nil {
+		return us.rejectShare(conn, req.ID, 21, "Job not found")
+	}
+
+	// Pool decides about share which proxy can't check. Miners with vardiff mine such
+	// jobs at difficulty of pool, share of miner which got the job at a lower one may be
+	// below it and isn't sent to pool.
+	if !j.IsChecked() {
+		if config.Get().Vardiff.Enabled && minerDifficulty < poolDifficulty {
+			return us.rejectShare(conn, req.ID, 21, "Job can't be checked")
+		}
+		return us.forwardSubmit(conn, req.ID, submitmsg, poolDifficulty, poolDifficulty)
+	}
+
+	difficulty, err := shareDifficulty(conn, j, params, versionMask)
+
+	if err != nil {
+		venuslog.Warn("Share of", conn.WorkerID, "is malformed:", err)
+		return us.rejectShare(conn, req.ID, 20, "Malformed share")
+	}
+
+	version := ""
+	if len(params) > 5 {
+		version = params[5]
+	}
+
+	us.mutex.Lock()
+	isNew := j.AddShare(conn.ExtraNonce1 + params[2] + params[3] + params[4] + version)
+	us.mutex.Unlock()
+
+	if !isNew {
+		return us.rejectShare(conn, req.ID, 22, "Duplicate share")
+	}
+
+	if difficulty < minerDifficulty {
+		return us.rejectShare(conn, req.ID, 23, "Low difficulty share")
+	}
+
+	if !config.Get().Vardiff.Enabled {
+		return us.forwardSubmit(conn, req.ID, submitmsg, minerDifficulty, poolDifficulty)
+	}
+
+	us.mutex.Lock()
+	newDifficulty := us.vardiffShare(conn)
+	us.mutex.Unlock()
+
+	if newDifficulty > 0 {
+		sendDifficulty(conn, newDifficulty)
+	}
+
+	if difficulty >= poolDifficulty {
+		return us.forwardSubmit(conn, req.ID, submitmsg, minerDifficulty, poolDifficulty)
+	}
+
+	// Share is good for miner, but not worth sending to pool
+	us.mutex.Lock()
+	us.Shares.Accepted++
+	conn.Shares.Accepted++
+	countPoolShare(us.PoolId, conn, "accepted", "")
+	us.mutex.Unlock()
+
+	conn.Hashrate.Add(minerDifficulty)
+
+	return conn.Send(template.StratumMsgResponse{
+		ID:     req.ID,
+		Result: true,
+	})
+}
+
+// Forward share to pool, its answer is routed back to miner
+func (us *Upstream) forwardSubmit(conn *stratumserver.Connection, id uint64, submitmsg template.SubmitMsg, minerDifficulty float64, poolDifficulty float64) error {
+
+	pending := &pendingRequest{
+		conn:           conn,
+		id:             id,
+		method:         "mining.submit",
+		jobId:          submitmsg.Params[1],
+		difficulty:     minerDifficulty,
+		poolDifficulty: poolDifficulty,
+	}
+
+	submitmsg.Params[0] = us.submitWorker(conn)
+
+	// Extranonce2 in the space of pool
+	submitmsg.Params[2] = conn.ExtraNoncePrefix + submitmsg.Params[2]
+
+	submitmsg.ID = us.addPending(pending)
+
+	newmsg, err := json.Marshal(submitmsg)
+	if err != nil {
+		return err
+	}
+
+	return us.poolClient().SendData(newmsg)
+}
+
+// Reject share of miner by proxy itself
+func (us *Upstream) rejectShare(conn *stratumserver.Connection, id uint64, code int, reason string) error {
+
+	venuslog.Warn("Proxy rejected share of", conn.WorkerID, code, reason)
+
+	us.mutex.Lock()
+	if code == 21 {
+		us.Shares.Stale++
+		conn.Shares.Stale++
+		countPoolShare(us.PoolId, conn, "stale", reason)
+	} else {
+		us.Shares.Rejected++
+		conn.Shares.Invalid++
+		countPoolShare(us.PoolId, conn, "rejected", reason)
+	}
+	recordReject(conn, code, reason)
+	us.mutex.Unlock()
+
+	return conn.Send(template.StratumMsgResponse{
+		ID:    id,
+		Error: template.NewError(code, reason),
+	})
+}
+
+// Keep reason of rejected share for report, upstream must be locked
+func recordReject(conn *stratumserver.Connection, code int, reason string) {
+	conn.Rejects[reason]++
+	conn.LastError.Code = code
+	conn.LastError.Reason = reason
+	conn.LastError.Time = time.Now()
+
+	checkInvalidShares(conn)
+}
@@ -0,0 +1,189 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumclient "btcminerproxy/stratum/client"
+	"btcminerproxy/stratum/job"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Params of mining.notify with an empty merkle branch
+var testNotify = []any{
+	"1f",
+	"4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000",
+	"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff20020862062f503253482f04b8864e5008",
+	"072f736c7573682f000000000100f2052a010000001976a914d23fcdf86f7e756a64a7a9688ef9903327048ed988ac00000000",
+	[]any{},
+	"20000000",
+	"1c2ac4af",
+	"504e86b9",
+	true,
+}
+
+// Lines written to the other end of pipe
+func pipeLines(c net.Conn) chan string {
+
+	lines := make(chan string, 10)
+
+	go func() {
+		reader := bufio.NewReader(c)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	return lines
+}
+
+// Upstream which checks shares with one miner on it, pool and miner ends of their pipes
+func shareUpstream(t *testing.T, vardiff bool) (*Upstream, *stratumserver.Connection, chan string, chan string) {
+
+	cfg := config.Get()
+	t.Cleanup(func() { config.Set(cfg) })
+
+	next := &config.Config{Pools: []config.PoolInfo{{Url: "pool-a:3333", User: "pooluser"}}}
+	next.ValidateShares = true
+	next.Vardiff.Enabled = vardiff
+	config.Set(next)
+
+	pool, poolEnd := net.Pipe()
+	miner, minerEnd := net.Pipe()
+	t.Cleanup(func() {
+		pool.Close()
+		miner.Close()
+	})
+
+	conn := &stratumserver.Connection{
+		Conn:            &sv2PipeConn{Conn: miner, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}},
+		Id:              1,
+		ExtraNonce1:     "aabbccdd",
+		ExtraNonce2Size: 4,
+		Rejects:         make(map[string]uint64),
+	}
+
+	us := &Upstream{
+		client:  &stratumclient.Client{Conn: pool},
+		servers: map[uint64]*stratumserver.Connection{conn.Id: conn},
+		jobs:    make(map[string]*job.Job),
+		pending: make(map[uint64]*pendingRequest),
+		workers: make(map[string]bool),
+	}
+
+	return us, conn, pipeLines(poolEnd), pipeLines(minerEnd)
+}
+
+// Submit share of job, returns submit which pool got or error which miner got
+func submitShare(t *testing.T, us *Upstream, conn *stratumserver.Connection, pool chan string, miner chan string, params []string) (string, int) {
+
+	data, _ := json.Marshal(template.SubmitMsg{ID: 7, Method: "mining.submit", Params: params})
+
+	go us.submit(conn, template.StratumMsg{ID: 7, Method: "mining.submit"}, data)
+
+	select {
+	case line := <-pool:
+		return line, 0
+
+	case line := <-miner:
+		resp := template.StratumMsgResponse{}
+		json.Unmarshal([]byte(line), &resp)
+		code, _ := template.ParseError(resp.Error)
+		return "", code
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("share was neither forwarded nor answered")
+	}
+
+	return "", 0
+}
+
+// Shares are measured by difficulty of their own job, not by the latest one
+func TestSubmitJobDifficulty(t *testing.T) {
+
+	params := []string{"rig1", "1f", "00000000", "504e86b9", "00000000"}
+
+	tests := []struct {
+		name    string
+		job     float64
+		current float64
+		code    int
+	}{
+		{"difficulty of job met", 0.5, 0.5, 0},
+		{"difficulty raised after job", 0.5, 4, 0},
+		{"difficulty lowered after job", 4, 0.5, 0},
+		{"difficulty of job missed", 2, 2, 23},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, pool, miner := shareUpstream(t, false)
+
+			j, err := job.Parse(testNotify)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Difficulty is relative to the share, whatever its hash is
+			difficulty, err := shareDifficulty(conn, j, params, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			j.Difficulty = test.job * difficulty
+			j.SetMinerDifficulty(conn.Id, test.job*difficulty)
+			us.addJob(j)
+
+			us.Difficulty = test.current * difficulty
+			conn.Difficulty = test.current * difficulty
+
+			submit, code := submitShare(t, us, conn, pool, miner, params)
+
+			if code != test.code {
+				t.Fatalf("share answered with error %d, expected %d", code, test.code)
+			}
+
+			if test.code == 0 && !strings.Contains(submit, `"pooluser"`) {
+				t.Fatalf("pool got %s", submit)
+			}
+
+			if test.code == 0 {
+				us.mutex.Lock()
+				pending := us.pending[1]
+				us.mutex.Unlock()
+
+				if pending == nil || pending.poolDifficulty != j.Difficulty {
+					t.Fatalf("share is credited to pool with %+v, expected difficulty of job %v", pending, j.Difficulty)
+				}
+			}
+		})
+	}
+}
@@ -20,6 +20,9 @@ package main
 
 import (
 	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/stats"
+	stratumserver "btcminerproxy/stratum/server"
 	"btcminerproxy/venuslog"
 	"encoding/json"
 	"strconv"
@@ -29,15 +32,58 @@ import (
 var numMiners, numUpstreams int
 var avgHashrate float64
 
-type FoundShare struct {
-	Time time.Time
-	Diff uint64
+// Hashrate of accepted shares, for the whole proxy and per pool url
+var globalHashrate = stats.NewMeter()
+var poolHashrates = make(map[string]*stats.Meter)
+var poolHashratesMut mutex.Mutex
+
+func poolHashrate(poolUrl string) *stats.Meter {
+	poolHashratesMut.Lock()
+	defer poolHashratesMut.Unlock()
+
+	if poolHashrates[poolUrl] == nil {
+		poolHashrates[poolUrl] = stats.NewMeter()
+	}
+
+	return poolHashrates[poolUrl]
+}
+
+// Hashrates of every pool which got shares
+func poolHashrateReport() map[string]map[string]float64 {
+	poolHashratesMut.Lock()
+	meters := make(map[string]*stats.Meter, len(poolHashrates))
+	for poolUrl, meter := range poolHashrates {
+		meters[poolUrl] = meter
+	}
+	poolHashratesMut.Unlock()
+
+	report := make(map[string]map[string]float64, len(meters))
+	for poolUrl, meter := range meters {
+		report[poolUrl] = meter.Hashrates()
+	}
+
+	return report
 }
 
-var foundShares = make([]FoundShare, 10)
+// Record share accepted by pool, miner is credited with its own difficulty
+// and pool with the difficulty it set
+func recordShare(poolUrl string, conn *stratumserver.Connection, minerDifficulty float64, poolDifficulty float64) {
+
+	conn.Hashrate.Add(minerDifficulty)
+	poolHashrate(poolUrl).Add(poolDifficulty)
+	globalHashrate.Add(poolDifficulty)
+
+	updatePoolRatedHash(poolUrl, poolDifficulty)
+}
 
 func formatHashrate(f float64) string {
-	if f > 1000*1000 {
+	if f > 1000*1000*1000*1000*1000 {
+		return strconv.FormatFloat(f/1000/1000/1000/1000/1000, 'f', 1, 64) + " P"
+	} else if f > 1000*1000*1000*1000 {
+		return strconv.FormatFloat(f/1000/1000/1000/1000, 'f', 1, 64) + " T"
+	} else if f > 1000*1000*1000 {
+		return strconv.FormatFloat(f/1000/1000/1000, 'f', 1, 64) + " G"
+	} else if f > 1000*1000 {
 		return strconv.FormatFloat(f/1000/1000, 'f', 1, 64) + " M"
 	} else if f > 1000 {
 		return strconv.FormatFloat(f/1000, 'f', 1, 64) + " k"
@@ -53,22 +99,27 @@ type Hr struct {
 }
 
 type UpstreamWorker struct {
-	ID     string `json:"id"`
-	IPAddr string `json:"ip-address"`
-	Share  struct {
+	ID         string  `json:"id"`
+	IPAddr     string  `json:"ip-address"`
+	Difficulty float64 `json:"difficulty"`
+	Share      struct {
 		Accepted uint64 `json:"accepted"`
 		Rejected uint64 `json:"rejected"`
+		Stale    uint64 `json:"stale"`
 	} `json:"shares"`
 	Submit struct {
 		Accepted uint64 `json:"accepted"`
 		Rejected uint64 `json:"rejected"`
+		Stale    uint64 `json:"stale"`
 	} `json:"submits"`
 }
 
 type DownstreamWorker struct {
-	ID     string `json:"id"`
-	IPAddr string `json:"ip-address"`
-	Share  struct {
+	ID         string             `json:"id"`
+	IPAddr     string             `json:"ip-address"`
+	Difficulty float64            `json:"difficulty"`
+	Hashrate   map[string]float64 `json:"hashrate"`
+	Share      struct {
 		Accepted uint64 `json:"accepted"`
 		Stale    uint64 `json:"stale"`
 		Invalid  uint64 `json:"rejected"`
@@ -78,6 +129,14 @@ type DownstreamWorker struct {
 		Stale    uint64 `json:"stale"`
 		Invalid  uint64 `json:"rejected"`
 	} `json:"submits"`
+	Rejects   map[string]uint64 `json:"rejects"`
+	LastError *WorkerError      `json:"last-error,omitempty"`
+}
+
+type WorkerError struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+	Time   string `json:"time"`
 }
 
 type UpstreamReport struct {
@@ -98,28 +157,41 @@ type Report struct {
 		Upstreams   []UpstreamReport
 		Downstreams []DownstreamReport
 	} `json:"streams"`
+	Profit []ProfitDecision `json:"profit,omitempty"`
+}
+
+// Decision of profit switching and scores of pools it was made on
+type ProfitDecision struct {
+	Time     string             `json:"time"`
+	From     string             `json:"from"`
+	To       string             `json:"to"`
+	Switched bool               `json:"switched"`
+	Reason   string             `json:"reason"`
+	Scores   map[string]float64 `json:"scores"`
 }
 
 type PoolRatedHash struct {
-	Timestamp string `json:"timestamp"`
-	PoolUrl   string `json:"poolUrl"`
-	RatedHash uint64 `json:"ratedHash"`
+	Timestamp string  `json:"timestamp"`
+	PoolUrl   string  `json:"poolUrl"`
+	RatedHash float64 `json:"ratedHash"`
 }
 
 type PoolRatingHash struct {
-	PoolUrl    string `json:"poolUrl"`
-	RatingHash uint64 `json:"ratingHash"`
+	PoolUrl    string  `json:"poolUrl"`
+	RatingHash float64 `json:"ratingHash"`
+	Percent    float64 `json:"percent"`
+	Target     float64 `json:"targetPercent,omitempty"`
 }
 
 var globalPoolInfo []*PoolRatedHash
-var globalReport *Report
+var globalPoolInfoMut mutex.Mutex
+var globalReport = &Report{}
 var reportLog = make([]Report, 0, 100000)
 var hrChart = make([]Hr, 0, 288)
 
 func Stats() {
 
 	refreshReport()
-	globalReport = &Report{}
 
 	go func() {
 		for {
@@ -147,7 +219,7 @@ func Stats() {
 			numMiners,
 			numUpstreams,
 		)
-		time.Sleep(time.Duration(config.CFG.PrintInterval) * time.Second)
+		time.Sleep(time.Duration(config.Get().PrintInterval) * time.Second)
 	}
 }
 
@@ -168,55 +240,70 @@ func makeReport() {
 	for _, upstream := range Upstreams {
 
 		uReport := &UpstreamReport{}
-		uReport.Name = config.CFG.Pools[upstream.server.PoolId].Url
+		uReport.Name = config.Get().Pool(upstream.PoolId).Url
 		uReport.Direction = "upstream"
 		uWorker := &UpstreamWorker{}
-		uWorker.ID = config.CFG.Pools[upstream.server.PoolId].User
-		uWorker.IPAddr = upstream.client.Conn.RemoteAddr().String()
+		uWorker.ID = config.Get().Pool(upstream.PoolId).User
+		uWorker.IPAddr = upstream.poolClient().Conn.RemoteAddr().String()
 
+		upstream.mutex.Lock()
+		uWorker.Difficulty = upstream.Difficulty
 		uWorker.Share.Accepted = upstream.Shares.Accepted
 		uWorker.Share.Rejected = upstream.Shares.Rejected
+		uWorker.Share.Stale = upstream.Shares.Stale
 
 		uWorker.Submit.Accepted = upstream.Submits.Accepted
 		uWorker.Submit.Rejected = upstream.Submits.Rejected
+		uWorker.Submit.Stale = upstream.Submits.Stale
+		upstream.mutex.Unlock()
 
 		uReport.Workers = append(uReport.Workers, *uWorker)
 		globalReport.Streams.Upstreams = append(globalReport.Streams.Upstreams, *uReport)
 
-		dReport := &DownstreamReport{}
-		dReport.Name = upstream.server.Conn.RemoteAddr().String()
-		dReport.Direction = "downstream"
-		dWorker := &DownstreamWorker{}
-		dWorker.ID = upstream.server.WorkerID
-		dWorker.IPAddr = upstream.server.Conn.RemoteAddr().String()
+		for _, miner := range upstream.miners() {
+
+			dReport := &DownstreamReport{}
+			dReport.Name = miner.Conn.RemoteAddr().String()
+			dReport.Direction = "downstream"
+			dWorker := &DownstreamWorker{}
+			dWorker.ID = miner.WorkerID
+			dWorker.IPAddr = miner.Conn.RemoteAddr().String()
+			dWorker.Hashrate = miner.Hashrate.Hashrates()
+
+			upstream.mutex.Lock()
+			dWorker.Difficulty = miner.Difficulty
+			dWorker.Share.Accepted = miner.Shares.Accepted
+			dWorker.Share.Invalid = miner.Shares.Invalid
+			dWorker.Share.Stale = miner.Shares.Stale
+			dWorker.Submit.Accepted = miner.Submits.Accepted
+			dWorker.Submit.Invalid = miner.Submits.Invalid
+			dWorker.Submit.Stale = miner.Submits.Stale
+
+			dWorker.Rejects = make(map[string]uint64, len(miner.Rejects))
+			for reason, count := range miner.Rejects {
+				dWorker.Rejects[reason] = count
+			}
 
-		dWorker.Share.Accepted = upstream.server.Shares.Accepted
-		dWorker.Share.Invalid = upstream.server.Shares.Invalid
-		dWorker.Share.Stale = upstream.server.Shares.Stale
-		dWorker.Submit.Accepted = upstream.server.Submits.Accepted
-		dWorker.Submit.Invalid = upstream.server.Submits.Invalid
-		dWorker.Submit.Stale = upstream.server.Submits.Stale
+			if miner.LastError.Reason != "" {
+				dWorker.LastError = &WorkerError{
+					Code:   miner.LastError.Code,
+					Reason: miner.LastError.Reason,
+					Time:   miner.LastError.Time.String(),
+				}
+			}
+			upstream.mutex.Unlock()
 
-		dReport.Workers = append(dReport.Workers, *dWorker)
+			dReport.Workers = append(dReport.Workers, *dWorker)
 
-		globalReport.Streams.Downstreams = append(globalReport.Streams.Downstreams, *dReport)
+			globalReport.Streams.Downstreams = append(globalReport.Streams.Downstreams, *dReport)
+		}
 
 	}
 	UpstreamsMut.Unlock() //Added for report
 }
 
 func getStats() {
-	shares2 := make([]FoundShare, 0, len(foundShares))
-	var totalDiff float64
-
-	for _, v := range foundShares {
-		if time.Since(v.Time) <= config.HASHRATE_AVG_MINUTES*time.Minute {
-			shares2 = append(shares2, v)
-			totalDiff += float64(v.Diff)
-		}
-	}
-	foundShares = shares2
-	avgHashrate = totalDiff / (config.HASHRATE_AVG_MINUTES * 60)
+	avgHashrate = globalHashrate.Hashrate(config.HASHRATE_AVG_MINUTES * time.Minute)
 
 	// TODO
 
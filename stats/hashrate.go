@@ -0,0 +1,160 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stats
+
+import (
+	"btcminerproxy/mutex"
+	"time"
+)
+
+// Hashes needed on average to find a share of difficulty 1
+const HASHES_PER_DIFFICULTY = 4294967296
+
+// Windows of hashrate reported by proxy
+var Windows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+const fineBucketSeconds = 15
+const fineBuckets = 3600 / fineBucketSeconds
+const coarseBucketSeconds = 300
+const coarseBuckets = 24 * 3600 / coarseBucketSeconds
+
+// Clock of meters, tests move it
+var now = time.Now
+
+// Meter estimates hashrate from difficulty of accepted shares.
+// Shares are summed in 15 second buckets for the last hour
+// and in 5 minute buckets for the last day.
+type Meter struct {
+	mutex   mutex.Mutex
+	created time.Time
+
+	fine       [fineBuckets]float64
+	fineLast   int64
+	coarse     [coarseBuckets]float64
+	coarseLast int64
+}
+
+func NewMeter() *Meter {
+	return &Meter{created: now()}
+}
+
+// Clear buckets which passed since the last update
+func advance(buckets []float64, last *int64, current int64) {
+	if current <= *last {
+		return
+	}
+
+	if current-*last >= int64(len(buckets)) {
+		for i := range buckets {
+			buckets[i] = 0
+		}
+	} else {
+		for idx := *last + 1; idx <= current; idx++ {
+			buckets[idx%int64(len(buckets))] = 0
+		}
+	}
+
+	*last = current
+}
+
+// Sum of the last count buckets
+func sum(buckets []float64, last int64, count int64) float64 {
+	total := 0.0
+
+	for idx := last - count + 1; idx <= last; idx++ {
+		if idx >= 0 {
+			total += buckets[idx%int64(len(buckets))]
+		}
+	}
+
+	return total
+}
+
+// Record accepted share of difficulty
+func (m *Meter) Add(difficulty float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	unix := now().Unix()
+
+	advance(m.fine[:], &m.fineLast, unix/fineBucketSeconds)
+	advance(m.coarse[:], &m.coarseLast, unix/coarseBucketSeconds)
+
+	m.fine[m.fineLast%fineBuckets] += difficulty
+	m.coarse[m.coarseLast%coarseBuckets] += difficulty
+}
+
+// Hashrate in H/s over window up to 24 hours
+func (m *Meter) Hashrate(window time.Duration) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t := now()
+	unix := t.Unix()
+
+	advance(m.fine[:], &m.fineLast, unix/fineBucketSeconds)
+	advance(m.coarse[:], &m.coarseLast, unix/coarseBucketSeconds)
+
+	bucketSeconds := int64(fineBucketSeconds)
+	buckets := m.fine[:]
+	last := m.fineLast
+
+	if window > time.Hour {
+		bucketSeconds = coarseBucketSeconds
+		buckets = m.coarse[:]
+		last = m.coarseLast
+	}
+
+	count := (int64(window.Seconds()) + bucketSeconds - 1) / bucketSeconds
+	if count > int64(len(buckets)) {
+		count = int64(len(buckets))
+	}
+
+	// Current bucket is only partly elapsed
+	seconds := float64((count-1)*bucketSeconds + unix%bucketSeconds + 1)
+
+	if !m.created.IsZero() && t.Sub(m.created).Seconds() < seconds {
+		seconds = t.Sub(m.created).Seconds()
+	}
+
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return sum(buckets, last, count) * HASHES_PER_DIFFICULTY / seconds
+}
+
+// Hashrate in H/s over every window of Windows
+func (m *Meter) Hashrates() map[string]float64 {
+	hashrates := make(map[string]float64, len(Windows))
+
+	for _, window := range Windows {
+		hashrates[window.Name] = m.Hashrate(window.Duration)
+	}
+
+	return hashrates
+}
@@ -0,0 +1,154 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Start of 5 minute bucket, and so of 15 second bucket too
+var start = time.Unix(1700000100, 0)
+
+// Clock of meters stopped at time set by test
+func setClock(t *testing.T, at time.Time) {
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func equalHashrate(a float64, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestMeterDecay(t *testing.T) {
+
+	const difficulty = 1000.0
+
+	// Hashrate of the share averaged over seconds of window which passed
+	hashrate := func(seconds float64) float64 {
+		return difficulty * HASHES_PER_DIFFICULTY / seconds
+	}
+
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		window   time.Duration
+		hashrate float64
+	}{
+		{"share just found", 0, time.Minute, hashrate(46)},
+		{"share in 1m window", 30 * time.Second, time.Minute, hashrate(46)},
+		{"share at end of 1m window", 59 * time.Second, time.Minute, hashrate(60)},
+		{"share left 1m window", time.Minute, time.Minute, 0},
+		{"share in 15m window", 10 * time.Minute, 15 * time.Minute, hashrate(886)},
+		{"share left 15m window", 15 * time.Minute, 15 * time.Minute, 0},
+		{"share in 1h window", 59 * time.Minute, time.Hour, hashrate(3586)},
+		{"share left 1h window", time.Hour, time.Hour, 0},
+		{"share in 24h window", 2 * time.Hour, 24 * time.Hour, hashrate(86101)},
+		{"share at end of 24h window", 24*time.Hour - time.Second, 24 * time.Hour, hashrate(86400)},
+		{"share left 24h window", 24 * time.Hour, 24 * time.Hour, 0},
+		{"fine buckets cleared after a day", 25 * time.Hour, time.Minute, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// Meter runs for long, so whole windows are averaged
+			setClock(t, start.Add(-48*time.Hour))
+			meter := NewMeter()
+
+			setClock(t, start)
+			meter.Add(difficulty)
+
+			setClock(t, start.Add(test.elapsed))
+
+			if got := meter.Hashrate(test.window); !equalHashrate(got, test.hashrate) {
+				t.Fatalf("hashrate over %s is %v, expected %v", test.window, got, test.hashrate)
+			}
+		})
+	}
+}
+
+func TestMeterYoung(t *testing.T) {
+
+	setClock(t, start)
+	meter := NewMeter()
+	meter.Add(1)
+
+	tests := []struct {
+		elapsed time.Duration
+		seconds float64
+	}{
+		// Meter younger than window is averaged over its age, at least a second
+		{0, 1},
+		{500 * time.Millisecond, 1},
+		{10 * time.Second, 10},
+		{30 * time.Second, 30},
+		{90 * time.Second, 90},
+	}
+
+	for _, test := range tests {
+		setClock(t, start.Add(test.elapsed))
+
+		expected := HASHES_PER_DIFFICULTY / test.seconds
+		if got := meter.Hashrate(time.Hour); !equalHashrate(got, expected) {
+			t.Errorf("hashrate after %s is %v, expected %v", test.elapsed, got, expected)
+		}
+	}
+}
+
+func TestMeterSum(t *testing.T) {
+
+	setClock(t, start.Add(-48*time.Hour))
+	meter := NewMeter()
+
+	// Shares over 20 minutes, the older ones leave shorter windows first
+	for minute := 0; minute < 20; minute++ {
+		setClock(t, start.Add(time.Duration(minute)*time.Minute))
+		meter.Add(10)
+	}
+
+	setClock(t, start.Add(20*time.Minute))
+
+	tests := []struct {
+		window  time.Duration
+		shares  float64
+		seconds float64
+	}{
+		// The latest share is a minute old already
+		{time.Minute, 0, 46},
+		{15 * time.Minute, 14, 886},
+		{time.Hour, 20, 3586},
+		{24 * time.Hour, 20, 86101},
+	}
+
+	for _, test := range tests {
+
+		expected := test.shares * 10 * HASHES_PER_DIFFICULTY / test.seconds
+
+		if got := meter.Hashrate(test.window); !equalHashrate(got, expected) {
+			t.Errorf("hashrate over %s is %v, expected %v of %v shares", test.window, got, expected, test.shares)
+		}
+	}
+
+	hashrates := meter.Hashrates()
+	if len(hashrates) != len(Windows) {
+		t.Fatalf("hashrates of %d windows, expected %d", len(hashrates), len(Windows))
+	}
+}
@@ -23,7 +23,12 @@ import (
 	"btcminerproxy/config"
 	"btcminerproxy/mutex"
 	"btcminerproxy/venuslog"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -47,8 +52,9 @@ func (cl *Client) IsAlive() bool {
 	return cl.alive
 }
 
-// Connect client socket to mining pool
-func (cl *Client) Connect(destination string, upstream uint64) (err error) {
+// Connect client socket to mining pool, with TLS the certificate of pool
+// is checked against fingerprint when it is given
+func (cl *Client) Connect(destination string, isTls bool, fingerprint string, upstream uint64) (err error) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
@@ -56,7 +62,13 @@ func (cl *Client) Connect(destination string, upstream uint64) (err error) {
 
 	cl.destination = destination
 
-	cl.Conn, err = net.DialTimeout("tcp", destination, time.Second*config.WRITE_TIMEOUT_SECONDS)
+	dialer := &net.Dialer{Timeout: time.Second * config.WRITE_TIMEOUT_SECONDS}
+
+	if isTls {
+		cl.Conn, err = tls.DialWithDialer(dialer, "tcp", destination, tlsConfig(destination, fingerprint))
+	} else {
+		cl.Conn, err = dialer.Dial("tcp", destination)
+	}
 
 	if err != nil {
 		return err
@@ -68,6 +80,39 @@ func (cl *Client) Connect(destination string, upstream uint64) (err error) {
 	return nil
 }
 
+// TLS config for pool, a pinned certificate doesn't need to be signed by known authority
+func tlsConfig(destination string, fingerprint string) *tls.Config {
+
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+
+	if fingerprint == "" {
+		return &tls.Config{ServerName: host}
+	}
+
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("pool sent no TLS certificate")
+			}
+
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			poolFingerprint := hex.EncodeToString(sum[:])
+
+			if !strings.EqualFold(poolFingerprint, fingerprint) {
+				venuslog.Warn("TLS fingerprint of pool (SHA-256):", poolFingerprint)
+				return errors.New("TLS fingerprint of pool mismatch")
+			}
+
+			return nil
+		},
+	}
+}
+
 // Send subscribe through client socket to mining pool
 func (cl *Client) SendSubscribe(destination string, data []byte, upstream uint64) (err error) {
 
@@ -0,0 +1,157 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pool listening with self-signed certificate, returns its address and certificate fingerprint
+func selfSignedPool(t *testing.T) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pool"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	sum := sha256.Sum256(der)
+
+	return listener.Addr().String(), hex.EncodeToString(sum[:])
+}
+
+func TestConnectTls(t *testing.T) {
+
+	destination, fingerprint := selfSignedPool(t)
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		err         string
+	}{
+		{"fingerprint matches", fingerprint, ""},
+		{"fingerprint in upper case", strings.ToUpper(fingerprint), ""},
+		{"fingerprint mismatch", strings.Repeat("00", sha256.Size), "TLS fingerprint of pool mismatch"},
+		{"self-signed without fingerprint", "", "certificate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cl := &Client{}
+			err := cl.Connect(destination, true, test.fingerprint, 1)
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatal("connect failed:", err)
+				}
+				if !cl.IsAlive() {
+					t.Fatal("client isn't alive after connect")
+				}
+				cl.Conn.Close()
+				return
+			}
+
+			if err == nil {
+				cl.Conn.Close()
+				t.Fatal("connect succeeded, expected error with", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error is %q, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTlsConfig(t *testing.T) {
+
+	tests := []struct {
+		destination        string
+		fingerprint        string
+		serverName         string
+		insecureSkipVerify bool
+	}{
+		{"pool.example.com:3333", "", "pool.example.com", false},
+		{"pool.example.com:3333", "ab", "pool.example.com", true},
+		{"pool.example.com", "", "pool.example.com", false},
+		{"[::1]:3333", "", "::1", false},
+	}
+
+	for _, test := range tests {
+		cfg := tlsConfig(test.destination, test.fingerprint)
+
+		if cfg.ServerName != test.serverName || cfg.InsecureSkipVerify != test.insecureSkipVerify {
+			t.Errorf("config of %s with fingerprint %q has server name %q and skip verify %v",
+				test.destination, test.fingerprint, cfg.ServerName, cfg.InsecureSkipVerify)
+		}
+		if (test.fingerprint != "") != (cfg.VerifyConnection != nil) {
+			t.Errorf("config of %s with fingerprint %q doesn't pin certificate as expected", test.destination, test.fingerprint)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumclient
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/sv2"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stratum V2 pool is used through an extended channel, the channel is translated
+// into stratum V1 msgs on a pipe, so upstream reads and writes V1 as with any pool.
+
+// Extranonce rolled by proxy and its miners in the channel
+const SV2_EXTRANONCE_SIZE = 8
+
+// Hashrate told to pool when opening channel, pool adjusts target by shares
+const SV2_NOMINAL_HASHRATE = 1e12
+
+// Pipe end which tells the address of pool
+type sv2PipeConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *sv2PipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Extended channel with the pool
+type sv2Channel struct {
+	conn *sv2.Conn
+	pipe net.Conn
+	user string
+
+	// msgs of V1 side, written by one goroutine so that pipe is never written concurrently
+	out       chan any
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mutex            mutex.Mutex
+	isOpen           bool
+	channelId        uint32
+	extraNoncePrefix []byte
+	extraNonceSize   int
+	subscribeId      uint64
+	authorizeIds     []uint64
+	jobs             map[uint32]*sv2.NewExtendedMiningJob
+	prevHash         *sv2.SetNewPrevHash
+	versionRolling   bool
+	nextSequence     uint32
+	submits          map[uint32]uint64
+}
+
+// Connect to stratum V2 pool, its certificate must be signed by authority
+func (cl *Client) ConnectSv2(destination string, authorityKey string, user string, upstream uint64) (err error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	venuslog.Warn("trying to connect stratum V2 pool ", destination)
+
+	cl.destination = destination
+
+	authority, err := sv2.ParsePublicKey(authorityKey)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: time.Second * config.WRITE_TIMEOUT_SECONDS}
+
+	c, err := dialer.Dial("tcp", destination)
+	if err != nil {
+		return err
+	}
+
+	conn, err := sv2.Connect(c, authority)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	if err = setupSv2(conn, destination); err != nil {
+		conn.Close()
+		return err
+	}
+
+	local, remote := net.Pipe()
+
+	ch := &sv2Channel{
+		conn:           conn,
+		pipe:           local,
+		user:           user,
+		out:            make(chan any, config.MAX_JOBS*4),
+		done:           make(chan struct{}),
+		jobs:           make(map[uint32]*sv2.NewExtendedMiningJob),
+		versionRolling: true,
+		submits:        make(map[uint32]uint64),
+	}
+
+	go ch.writeSession()
+	go ch.readSession()
+	go ch.readPool()
+
+	cl.Conn = &sv2PipeConn{Conn: remote, remoteAddr: c.RemoteAddr()}
+	cl.upstreamId = upstream
+	cl.alive = true
+	return nil
+}
+
+// Setup mining connection with pool
+func setupSv2(conn *sv2.Conn, destination string) error {
+
+	host, portStr, _ := net.SplitHostPort(destination)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+
+	err := conn.WriteMessage(&sv2.SetupConnection{
+		Protocol:     sv2.PROTOCOL_MINING,
+		MinVersion:   2,
+		MaxVersion:   2,
+		EndpointHost: host,
+		EndpointPort: uint16(port),
+		Vendor:       config.USERAGENT,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn.Conn.SetReadDeadline(time.Now().Add(config.WRITE_TIMEOUT_SECONDS * time.Second))
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	switch m := msg.(type) {
+	case *sv2.SetupConnectionSuccess:
+		return nil
+	case *sv2.SetupConnectionError:
+		return errors.New("pool refused setup: " + m.ErrorCode)
+	}
+
+	return errors.New("pool didn't answer setup")
+}
+
+// Close channel together with V1 side
+func (ch *sv2Channel) close() {
+	ch.closeOnce.Do(func() {
+		close(ch.done)
+		ch.conn.Close()
+		ch.pipe.Close()
+	})
+}
+
+// Queue msg for V1 side
+func (ch *sv2Channel) send(msg any) {
+	select {
+	case ch.out <- msg:
+	case <-ch.done:
+	default:
+		venuslog.Warn("Stratum V2 pool sends faster than upstream reads, closing channel")
+		ch.close()
+	}
+}
+
+func (ch *sv2Channel) writeSession() {
+	for {
+		var msg any
+
+		select {
+		case msg = <-ch.out:
+		case <-ch.done:
+			return
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			panic(err)
+		}
+
+		if _, err = ch.pipe.Write(append(data, '\n')); err != nil {
+			ch.close()
+			return
+		}
+	}
+}
+
+// Translate requests of upstream into messages of channel
+func (ch *sv2Channel) readSession() {
+
+	defer ch.close()
+
+	reader := bufio.NewReaderSize(ch.pipe, config.MAX_REQUEST_SIZE)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		req := template.NotifyMsg{}
+		if err = json.Unmarshal(line, &req); err != nil {
+			venuslog.Warn("ReadJSON failed in proxy from upstream:", err)
+			continue
+		}
+
+		if err = ch.handleRequest(req, line); err != nil {
+			venuslog.Warn("Failed to write to stratum V2 pool:", err)
+			return
+		}
+	}
+}
+
+// Handle V1 request of upstream
+func (ch *sv2Channel) handleRequest(req template.NotifyMsg, data []byte) error {
+
+	switch req.Method {
+	case "mining.configure":
+		// Jobs of pool tell whether version can be rolled, the mask is BIP320
+		ch.send(template.StratumMsgResponse{
+			ID: req.ID,
+			Result: map[string]any{
+				"version-rolling":      true,
+				"version-rolling.mask": fmt.Sprintf("%08x", job.BIP320_VERSION_MASK),
+			},
+		})
+
+	case "mining.subscribe":
+		ch.mutex.Lock()
+		defer ch.mutex.Unlock()
+
+		if ch.isOpen {
+			ch.send(ch.subscribeResult(req.ID))
+			return nil
+		}
+
+		// Channel is opened for user of pool, upstream authorizes with it anyway
+		ch.subscribeId = req.ID
+
+		return ch.conn.WriteMessage(&sv2.OpenExtendedMiningChannel{
+			RequestID:         uint32(req.ID),
+			UserIdentity:      ch.user,
+			NominalHashRate:   SV2_NOMINAL_HASHRATE,
+			MaxTarget:         sv2.TargetFromDifficulty(0),
+			MinExtranonceSize: SV2_EXTRANONCE_SIZE,
+		})
+
+	case "mining.authorize":
+		ch.mutex.Lock()
+		defer ch.mutex.Unlock()
+
+		// Upstream is authorized when channel is open, after it knows extranonce
+		if !ch.isOpen {
+			ch.authorizeIds = append(ch.authorizeIds, req.ID)
+			return nil
+		}
+
+		ch.send(template.StratumMsgResponse{ID: req.ID, Result: true})
+
+	case "mining.extranonce.subscribe":
+		ch.send(template.StratumMsgResponse{ID: req.ID, Result: true})
+
+	case "mining.submit":
+		submitmsg := template.SubmitMsg{}
+		if err := json.Unmarshal(data, &submitmsg); err != nil {
+			return nil
+		}
+
+		return ch.submit(submitmsg)
+
+	default:
+		if req.Method != "" {
+			ch.send(template.StratumMsgResponse{
+				ID:    req.ID,
+				Error: template.NewError(20, "Method not supported by pool"),
+			})
+		}
+	}
+
+	return nil
+}
+
+// Result of mining.subscribe, channel must be locked
+func (ch *sv2Channel) subscribeResult(id uint64) template.StratumMsgResponse {
+
+	subscriptionId := fmt.Sprintf("%08x", ch.channelId)
+
+	return template.StratumMsgResponse{
+		ID: id,
+		Result: []any{
+			[][]string{
+				{"mining.set_difficulty", subscriptionId},
+				{"mining.notify", subscriptionId},
+			},
+			hex.EncodeToString(ch.extraNoncePrefix),
+			ch.extraNonceSize,
+		},
+	}
+}
+
+// Translate mining.submit into share of channel
+func (ch *sv2Channel) submit(submitmsg template.SubmitMsg) error {
+
+	reject := func(code int, reason string) error {
+		ch.send(template.StratumMsgResponse{ID: submitmsg.ID, Error: template.NewError(code, reason)})
+		return nil
+	}
+
+	params := submitmsg.Params
+	if len(params) < 5 {
+		return reject(20, "Malformed submit")
+	}
+
+	jobId, err1 := strconv.ParseUint(params[1], 16, 32)
+	extraNonce, err2 := hex.DecodeString(params[2])
+	nTime, err3 := job.ParseUint32(params[3])
+	nonce, err4 := job.ParseUint32(params[4])
+
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return reject(20, "Malformed submit")
+	}
+
+	ch.mutex.Lock()
+
+	j := ch.jobs[uint32(jobId)]
+	if j == nil {
+		ch.mutex.Unlock()
+		return reject(21, "Job not found")
+	}
+
+	version := j.Version
+	if len(params) > 5 {
+		versionBits, err := job.ParseUint32(params[5])
+		if err != nil {
+			ch.mutex.Unlock()
+			return reject(20, "Malformed submit")
+		}
+		version = job.RollVersion(version, versionBits, job.BIP320_VERSION_MASK)
+	}
+
+	ch.nextSequence++
+	sequence := ch.nextSequence
+	ch.submits[sequence] = submitmsg.ID
+	channelId := ch.channelId
+
+	ch.mutex.Unlock()
+
+	return ch.conn.WriteMessage(&sv2.SubmitSharesExtended{
+		SubmitSharesStandard: sv2.SubmitSharesStandard{
+			ChannelID:      channelId,
+			SequenceNumber: sequence,
+			JobID:          uint32(jobId),
+			Nonce:          nonce,
+			NTime:          nTime,
+			Version:        version,
+		},
+		Extranonce: extraNonce,
+	})
+}
+
+// Translate messages of pool into V1 msgs for upstream
+func (ch *sv2Channel) readPool() {
+
+	defer ch.close()
+
+	for {
+		ch.conn.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
+
+		frame, err := ch.conn.ReadFrame()
+		if err != nil {
+			venuslog.Warn("Read failed in proxy from stratum V2 pool:", err)
+			return
+		}
+
+		msg, err := sv2.Decode(frame)
+		if err != nil {
+			venuslog.Warn("Stratum V2 pool sent message which proxy can't handle:", err)
+			continue
+		}
+
+		if !ch.handleMessage(msg) {
+			return
+		}
+	}
+}
+
+// Handle message of pool, returns false when channel must be closed
+func (ch *sv2Channel) handleMessage(msg sv2.Message) bool {
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	switch m := msg.(type) {
+	case *sv2.OpenExtendedMiningChannelSuccess:
+		ch.isOpen = true
+		ch.channelId = m.ChannelID
+		ch.extraNoncePrefix = m.ExtranoncePrefix
+		ch.extraNonceSize = int(m.ExtranonceSize)
+
+		ch.send(ch.subscribeResult(ch.subscribeId))
+		for _, id := range ch.authorizeIds {
+			ch.send(template.StratumMsgResponse{ID: id, Result: true})
+		}
+		ch.authorizeIds = nil
+		ch.setDifficulty(m.Target)
+
+	case *sv2.OpenMiningChannelError:
+		venuslog.Warn("Stratum V2 pool refused channel:", m.ErrorCode)
+		ch.send(template.StratumMsgResponse{
+			ID:    ch.subscribeId,
+			Error: template.NewError(20, m.ErrorCode),
+		})
+		for _, id := range ch.authorizeIds {
+			ch.send(template.StratumMsgResponse{ID: id, Error: template.NewError(24, m.ErrorCode)})
+		}
+		return false
+
+	case *sv2.SetTarget:
+		ch.setDifficulty(m.MaximumTarget)
+
+	case *sv2.NewExtendedMiningJob:
+		ch.jobs[m.JobID] = m
+
+		// Job for the current block is sent at once, future job waits for its block
+		if m.MinNTime != nil && ch.prevHash != nil {
+			ch.notify(m, *m.MinNTime, false)
+		}
+
+	case *sv2.SetNewPrevHash:
+		ch.prevHash = m
+
+		// Jobs of previous block can't be mined anymore
+		for id := range ch.jobs {
+			if id != m.JobID {
+				delete(ch.jobs, id)
+			}
+		}
+
+		if j := ch.jobs[m.JobID]; j != nil {
+			ch.notify(j, m.MinNTime, true)
+		}
+
+	case *sv2.SetExtranoncePrefix:
+		ch.extraNoncePrefix = m.ExtranoncePrefix
+
+		ch.send(template.StratumNotification{
+			Method: "mining.set_extranonce",
+			Params: []any{hex.EncodeToString(m.ExtranoncePrefix), ch.extraNonceSize},
+		})
+
+	case *sv2.SubmitSharesSuccess:
+		// Success confirms every share up to the sequence number
+		for sequence, id := range ch.submits {
+			if sequence <= m.LastSequenceNumber {
+				delete(ch.submits, sequence)
+				ch.send(template.StratumMsgResponse{ID: id, Result: true})
+			}
+		}
+
+	case *sv2.SubmitSharesError:
+		id, ok := ch.submits[m.SequenceNumber]
+		delete(ch.submits, m.SequenceNumber)
+
+		if ok {
+			code, reason := sv2ShareError(m.ErrorCode)
+			ch.send(template.StratumMsgResponse{ID: id, Error: template.NewError(code, reason)})
+		}
+
+	case *sv2.CloseChannel:
+		venuslog.Warn("Stratum V2 pool closed channel:", m.ReasonCode)
+		return false
+
+	case *sv2.UpdateChannelError:
+		venuslog.Warn("Stratum V2 pool refused channel update:", m.ErrorCode)
+
+	default:
+		venuslog.Warn("Stratum V2 pool sent unexpected message", fmt.Sprintf("%02x", msg.MsgType()))
+	}
+
+	return true
+}
+
+// Error code and reason of V1 for error code of rejected V2 share
+func sv2ShareError(errorCode string) (int, string) {
+	switch errorCode {
+	case "stale-share", "invalid-job-id":
+		return 21, "Job not found"
+	case "duplicate-share":
+		return 22, "Duplicate share"
+	case "difficulty-too-low":
+		return 23, "Low difficulty share"
+	default:
+		return 20, errorCode
+	}
+}
+
+// Send target of channel as difficulty, channel must be locked
+func (ch *sv2Channel) setDifficulty(target [32]byte) {
+	ch.send(template.StratumNotification{
+		Method: "mining.set_difficulty",
+		Params: []any{sv2.DifficultyFromTarget(target)},
+	})
+}
+
+// Send job as mining.notify, channel must be locked
+func (ch *sv2Channel) notify(j *sv2.NewExtendedMiningJob, nTime uint32, cleanJobs bool) {
+
+	if j.VersionRollingAllowed != ch.versionRolling {
+		ch.versionRolling = j.VersionRollingAllowed
+
+		mask := uint32(0)
+		if ch.versionRolling {
+			mask = job.BIP320_VERSION_MASK
+		}
+
+		ch.send(template.StratumNotification{
+			Method: "mining.set_version_mask",
+			Params: []any{fmt.Sprintf("%08x", mask)},
+		})
+	}
+
+	// Stratum V1 sends prevhash with every 4 bytes swapped
+	prevHash := make([]byte, 32)
+	for idx := 0; idx < 32; idx += 4 {
+		binary.BigEndian.PutUint32(prevHash[idx:], binary.LittleEndian.Uint32(ch.prevHash.PrevHash[idx:]))
+	}
+
+	merkleBranch := make([]string, len(j.MerklePath))
+	for idx, branch := range j.MerklePath {
+		merkleBranch[idx] = hex.EncodeToString(branch[:])
+	}
+
+	ch.send(template.StratumNotification{
+		Method: "mining.notify",
+		Params: []any{
+			strconv.FormatUint(uint64(j.JobID), 16),
+			hex.EncodeToString(prevHash),
+			hex.EncodeToString(j.CoinbasePrefix),
+			hex.EncodeToString(j.CoinbaseSuffix),
+			merkleBranch,
+			fmt.Sprintf("%08x", j.Version),
+			fmt.Sprintf("%08x", ch.prevHash.NBits),
+			fmt.Sprintf("%08x", nTime),
+			cleanJobs,
+		},
+	})
+}
@@ -0,0 +1,424 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumclient
+
+import (
+	"btcminerproxy/stratum/sv2"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// V1 msg read by upstream from the channel
+type v1Msg struct {
+	ID     *uint64         `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// Pool stub, accepts one connection and answers its setup
+type stubPool struct {
+	listener net.Listener
+	conn     chan *sv2.Conn
+	setup    chan *sv2.SetupConnection
+	err      chan error
+}
+
+func newStubPool(t *testing.T, authority *btcec.PrivateKey) *stubPool {
+
+	static, _ := btcec.NewPrivateKey()
+
+	cert, err := sv2.NewCertificate(authority, static.PubKey(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	pool := &stubPool{
+		listener: listener,
+		conn:     make(chan *sv2.Conn, 1),
+		setup:    make(chan *sv2.SetupConnection, 1),
+		err:      make(chan error, 1),
+	}
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			pool.err <- err
+			return
+		}
+
+		conn, err := sv2.Accept(c, static, cert)
+		if err != nil {
+			c.Close()
+			pool.err <- err
+			return
+		}
+
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			pool.err <- err
+			return
+		}
+
+		setup, _ := msg.(*sv2.SetupConnection)
+		pool.setup <- setup
+
+		if err = conn.WriteMessage(&sv2.SetupConnectionSuccess{UsedVersion: 2}); err != nil {
+			conn.Close()
+			pool.err <- err
+			return
+		}
+
+		pool.conn <- conn
+	}()
+
+	return pool
+}
+
+// Connection accepted by pool after setup
+func (pool *stubPool) accepted(t *testing.T) *sv2.Conn {
+	select {
+	case conn := <-pool.conn:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case err := <-pool.err:
+		t.Fatal("pool:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool didn't accept connection")
+	}
+	return nil
+}
+
+// Next message sent to pool
+func readPool(t *testing.T, pool *sv2.Conn) sv2.Message {
+	t.Helper()
+
+	pool.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	msg, err := pool.ReadMessage()
+	if err != nil {
+		t.Fatal("read of pool:", err)
+	}
+	return msg
+}
+
+func writePool(t *testing.T, pool *sv2.Conn, msg sv2.Message) {
+	t.Helper()
+
+	if err := pool.WriteMessage(msg); err != nil {
+		t.Fatal("write of pool:", err)
+	}
+}
+
+// Next V1 msg read by upstream
+func readV1(t *testing.T, conn net.Conn, reader *bufio.Reader) v1Msg {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal("read of upstream:", err)
+	}
+
+	msg := v1Msg{}
+	if err = json.Unmarshal(line, &msg); err != nil {
+		t.Fatalf("upstream read %q: %v", line, err)
+	}
+	return msg
+}
+
+func writeV1(t *testing.T, conn net.Conn, line string) {
+	t.Helper()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal("write of upstream:", err)
+	}
+}
+
+func expectResponse(t *testing.T, msg v1Msg, id uint64, result string) {
+	t.Helper()
+
+	if msg.ID == nil || *msg.ID != id {
+		t.Fatalf("expected response to %d, got %+v", id, msg)
+	}
+	if !bytes.Equal(msg.Result, []byte(result)) {
+		t.Fatalf("result of %d is %s, expected %s", id, msg.Result, result)
+	}
+}
+
+func expectError(t *testing.T, msg v1Msg, id uint64, code int) {
+	t.Helper()
+
+	var stratumErr []any
+	if msg.ID == nil || *msg.ID != id || json.Unmarshal(msg.Error, &stratumErr) != nil || len(stratumErr) == 0 {
+		t.Fatalf("expected error of %d, got %+v", id, msg)
+	}
+	if stratumErr[0] != float64(code) {
+		t.Fatalf("error of %d is %v, expected code %d", id, stratumErr, code)
+	}
+}
+
+func expectNotification(t *testing.T, msg v1Msg, method string, params any) {
+	t.Helper()
+
+	if msg.Method != method {
+		t.Fatalf("expected %s, got %+v", method, msg)
+	}
+
+	expected, _ := json.Marshal(params)
+
+	var got, want any
+	json.Unmarshal(msg.Params, &got)
+	json.Unmarshal(expected, &want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("params of %s are %s, expected %s", method, msg.Params, expected)
+	}
+}
+
+func TestConnectSv2(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+	stub := newStubPool(t, authority)
+
+	cl := &Client{}
+	err := cl.ConnectSv2(stub.listener.Addr().String(), sv2.SerializePublicKey(authority.PubKey()), "pooluser", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Conn.Close()
+
+	pool := stub.accepted(t)
+
+	setup := <-stub.setup
+	if setup == nil || setup.Protocol != sv2.PROTOCOL_MINING || setup.MinVersion != 2 || setup.EndpointHost != "127.0.0.1" {
+		t.Fatalf("unexpected setup %+v", setup)
+	}
+
+	if cl.Conn.RemoteAddr().String() != stub.listener.Addr().String() {
+		t.Fatalf("remote address is %s, expected pool %s", cl.Conn.RemoteAddr(), stub.listener.Addr())
+	}
+
+	upstream := bufio.NewReader(cl.Conn)
+
+	// Channel is opened by subscribe, authorize waits for it
+	writeV1(t, cl.Conn, `{"id":1,"method":"mining.subscribe","params":["test"]}`)
+	writeV1(t, cl.Conn, `{"id":2,"method":"mining.authorize","params":["miner","x"]}`)
+
+	open, ok := readPool(t, pool).(*sv2.OpenExtendedMiningChannel)
+	if !ok {
+		t.Fatal("pool didn't get OpenExtendedMiningChannel")
+	}
+	if open.RequestID != 1 || open.UserIdentity != "pooluser" || open.MinExtranonceSize != SV2_EXTRANONCE_SIZE {
+		t.Fatalf("unexpected channel request %+v", open)
+	}
+
+	writePool(t, pool, &sv2.OpenExtendedMiningChannelSuccess{
+		RequestID:        1,
+		ChannelID:        7,
+		Target:           sv2.TargetFromDifficulty(1024),
+		ExtranonceSize:   8,
+		ExtranoncePrefix: []byte{0xca, 0xfe, 0xba, 0xbe},
+	})
+
+	expectResponse(t, readV1(t, cl.Conn, upstream), 1,
+		`[[["mining.set_difficulty","00000007"],["mining.notify","00000007"]],"cafebabe",8]`)
+
+	// Authorize is answered before difficulty, unless channel opened before it was read
+	msg, authorized := readV1(t, cl.Conn, upstream), readV1(t, cl.Conn, upstream)
+	if msg.ID != nil {
+		msg, authorized = authorized, msg
+	}
+	expectResponse(t, authorized, 2, "true")
+
+	var difficulty []float64
+	if msg.Method != "mining.set_difficulty" || json.Unmarshal(msg.Params, &difficulty) != nil ||
+		len(difficulty) != 1 || math.Abs(difficulty[0]-1024) > 1e-6 {
+		t.Fatalf("expected difficulty 1024, got %+v", msg)
+	}
+
+	// Job for next block is sent to miners with its prevhash
+	prevHash := [32]byte{}
+	for idx := range prevHash {
+		prevHash[idx] = byte(idx)
+	}
+	branch := [32]byte{0xaa}
+
+	writePool(t, pool, &sv2.NewExtendedMiningJob{
+		ChannelID:             7,
+		JobID:                 0x2a,
+		Version:               0x20000000,
+		VersionRollingAllowed: true,
+		MerklePath:            [][32]byte{branch},
+		CoinbasePrefix:        []byte{0x01, 0x02},
+		CoinbaseSuffix:        []byte{0x03, 0x04},
+	})
+	writePool(t, pool, &sv2.SetNewPrevHash{
+		ChannelID: 7,
+		JobID:     0x2a,
+		PrevHash:  prevHash,
+		MinNTime:  0x65000000,
+		NBits:     0x1703a30c,
+	})
+
+	expectNotification(t, readV1(t, cl.Conn, upstream), "mining.notify", []any{
+		"2a",
+		"03020100070605040b0a09080f0e0d0c13121110171615141b1a19181f1e1d1c",
+		"0102",
+		"0304",
+		[]string{"aa00000000000000000000000000000000000000000000000000000000000000"},
+		"20000000",
+		"1703a30c",
+		"65000000",
+		true,
+	})
+
+	// Job for the current block is sent at once and doesn't clean jobs
+	minNTime := uint32(0x65000010)
+	writePool(t, pool, &sv2.NewExtendedMiningJob{
+		ChannelID:             7,
+		JobID:                 0x2b,
+		MinNTime:              &minNTime,
+		Version:               0x20000000,
+		VersionRollingAllowed: true,
+		CoinbasePrefix:        []byte{0x05},
+		CoinbaseSuffix:        []byte{0x06},
+	})
+
+	expectNotification(t, readV1(t, cl.Conn, upstream), "mining.notify", []any{
+		"2b",
+		"03020100070605040b0a09080f0e0d0c13121110171615141b1a19181f1e1d1c",
+		"05",
+		"06",
+		[]string{},
+		"20000000",
+		"1703a30c",
+		"65000010",
+		false,
+	})
+
+	// Share with rolled version is submitted to channel and accepted
+	writeV1(t, cl.Conn, `{"id":3,"method":"mining.submit","params":["miner","2a","0000000000000001","65000001","deadbeef","00002000"]}`)
+
+	share, ok := readPool(t, pool).(*sv2.SubmitSharesExtended)
+	if !ok {
+		t.Fatal("pool didn't get SubmitSharesExtended")
+	}
+
+	expected := sv2.SubmitSharesStandard{
+		ChannelID:      7,
+		SequenceNumber: 1,
+		JobID:          0x2a,
+		Nonce:          0xdeadbeef,
+		NTime:          0x65000001,
+		Version:        0x20002000,
+	}
+	if share.SubmitSharesStandard != expected || !bytes.Equal(share.Extranonce, []byte{0, 0, 0, 0, 0, 0, 0, 1}) {
+		t.Fatalf("unexpected share %+v", share)
+	}
+
+	writePool(t, pool, &sv2.SubmitSharesSuccess{ChannelID: 7, LastSequenceNumber: 1, NewSubmitsAcceptedCount: 1})
+	expectResponse(t, readV1(t, cl.Conn, upstream), 3, "true")
+
+	// Rejected share gets error of stratum V1
+	writeV1(t, cl.Conn, `{"id":4,"method":"mining.submit","params":["miner","2b","0000000000000002","65000011","00000001"]}`)
+
+	share, ok = readPool(t, pool).(*sv2.SubmitSharesExtended)
+	if !ok || share.SequenceNumber != 2 || share.JobID != 0x2b || share.Version != 0x20000000 {
+		t.Fatalf("unexpected share %+v", share)
+	}
+
+	writePool(t, pool, &sv2.SubmitSharesError{ChannelID: 7, SequenceNumber: 2, ErrorCode: "stale-share"})
+	expectError(t, readV1(t, cl.Conn, upstream), 4, 21)
+
+	// Share of unknown job is rejected without asking pool
+	writeV1(t, cl.Conn, `{"id":5,"method":"mining.submit","params":["miner","ff","0000000000000003","65000011","00000002"]}`)
+	expectError(t, readV1(t, cl.Conn, upstream), 5, 21)
+
+	// New block drops jobs of previous one
+	writePool(t, pool, &sv2.SetNewPrevHash{ChannelID: 7, JobID: 0x2b, PrevHash: prevHash, MinNTime: 0x65000020, NBits: 0x1703a30c})
+
+	msg = readV1(t, cl.Conn, upstream)
+	if msg.Method != "mining.notify" || !bytes.HasPrefix(msg.Params, []byte(`["2b"`)) {
+		t.Fatalf("expected notify of job 2b, got %+v", msg)
+	}
+
+	writeV1(t, cl.Conn, `{"id":6,"method":"mining.submit","params":["miner","2a","0000000000000004","65000021","00000003"]}`)
+	expectError(t, readV1(t, cl.Conn, upstream), 6, 21)
+
+	// Channel closed by pool closes the V1 side
+	writePool(t, pool, &sv2.CloseChannel{ChannelID: 7, ReasonCode: "bye"})
+
+	cl.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = upstream.ReadBytes('\n'); err == nil {
+		t.Fatal("upstream side wasn't closed with channel")
+	}
+}
+
+func TestSv2ShareError(t *testing.T) {
+	tests := []struct {
+		errorCode string
+		code      int
+	}{
+		{"stale-share", 21},
+		{"invalid-job-id", 21},
+		{"duplicate-share", 22},
+		{"difficulty-too-low", 23},
+		{"invalid-channel-id", 20},
+	}
+
+	for _, test := range tests {
+		if code, _ := sv2ShareError(test.errorCode); code != test.code {
+			t.Errorf("code of %s is %d, expected %d", test.errorCode, code, test.code)
+		}
+	}
+}
+
+func TestConnectSv2WrongAuthority(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+	other, _ := btcec.NewPrivateKey()
+	stub := newStubPool(t, authority)
+
+	cl := &Client{}
+	err := cl.ConnectSv2(stub.listener.Addr().String(), sv2.SerializePublicKey(other.PubKey()), "pooluser", 1)
+	if err == nil {
+		cl.Conn.Close()
+		t.Fatal("pool certified by another authority was accepted")
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Version bits which miners may roll by BIP320
+const BIP320_VERSION_MASK = 0x1fffe000
+
+// Target of difficulty 1 share, 0x00000000ffff0000...
+var diff1Target = new(big.Int).Lsh(big.NewInt(0xffff), 208)
+
+// Job sent by pool with mining.notify
+type Job struct {
+	ID           string
+	PrevHash     []byte
+	Coinbase1    []byte
+	Coinbase2    []byte
+	MerkleBranch [][]byte
+	Version      uint32
+	NBits        uint32
+	NTime        uint32
+	CleanJobs    bool
+	Received     time.Time
+
+	// difficulty of pool when job was sent, shares of job are measured by it
+	Difficulty float64
+
+	// difficulty of every miner when it got the job, by connection id
+	minerDifficulty map[uint64]float64
+
+	// shares submitted for job, for finding duplicates
+	shares map[string]bool
+}
+
+// Job which couldn't be parsed, its shares are left to pool
+func Unchecked(id string, cleanJobs bool) *Job {
+	return &Job{ID: id, CleanJobs: cleanJobs, Received: time.Now()}
+}
+
+// Whether shares of job can be checked
+func (j *Job) IsChecked() bool {
+	return j.PrevHash != nil
+}
+
+// Remember share of job, returns false when it was submitted already
+func (j *Job) AddShare(key string) bool {
+
+	if j.shares == nil {
+		j.shares = make(map[string]bool)
+	}
+
+	if j.shares[key] {
+		return false
+	}
+
+	j.shares[key] = true
+
+	return true
+}
+
+// Remember difficulty which miner had when it got the job
+func (j *Job) SetMinerDifficulty(connId uint64, difficulty float64) {
+
+	if j.minerDifficulty == nil {
+		j.minerDifficulty = make(map[uint64]float64)
+	}
+
+	j.minerDifficulty[connId] = difficulty
+}
+
+// Difficulty which miner had when it got the job, zero when it joined later
+func (j *Job) MinerDifficulty(connId uint64) float64 {
+	return j.minerDifficulty[connId]
+}
+
+func doubleSha256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// Parse hex of big endian uint32 as stratum sends version, nbits, ntime and nonce
+func ParseUint32(str string) (uint32, error) {
+	if len(str) != 8 {
+		return 0, errors.New("invalid uint32 hex: " + str)
+	}
+
+	value, err := strconv.ParseUint(str, 16, 32)
+
+	return uint32(value), err
+}
+
+// Parse params of mining.notify
+func Parse(params []any) (*Job, error) {
+
+	if len(params) < 9 {
+		return nil, errors.New("too few params of mining.notify")
+	}
+
+	strs := make([]string, 8)
+
+	for idx := range strs {
+		if idx == 4 {
+			continue
+		}
+
+		str, ok := params[idx].(string)
+
+		if !ok {
+			return nil, errors.New("invalid param of mining.notify")
+		}
+
+		strs[idx] = str
+	}
+
+	job := &Job{ID: strs[0], Received: time.Now()}
+	job.CleanJobs, _ = params[8].(bool)
+
+	prevHash, err := hex.DecodeString(strs[1])
+	if err != nil || len(prevHash) != 32 {
+		return nil, errors.New("invalid prevhash of mining.notify")
+	}
+
+	// Stratum sends prevhash with every 4 bytes swapped
+	job.PrevHash = make([]byte, 32)
+	for idx := 0; idx < 32; idx += 4 {
+		binary.LittleEndian.PutUint32(job.PrevHash[idx:], binary.BigEndian.Uint32(prevHash[idx:]))
+	}
+
+	if job.Coinbase1, err = hex.DecodeString(strs[2]); err != nil {
+		return nil, errors.New("invalid coinbase1 of mining.notify")
+	}
+
+	if job.Coinbase2, err = hex.DecodeString(strs[3]); err != nil {
+		return nil, errors.New("invalid coinbase2 of mining.notify")
+	}
+
+	branches, ok := params[4].([]any)
+	if !ok {
+		return nil, errors.New("invalid merkle branch of mining.notify")
+	}
+
+	for _, branch := range branches {
+		str, _ := branch.(string)
+		hash, err := hex.DecodeString(str)
+
+		if err != nil || len(hash) != 32 {
+			return nil, errors.New("invalid merkle branch of mining.notify")
+		}
+
+		job.MerkleBranch = append(job.MerkleBranch, hash)
+	}
+
+	if job.Version, err = ParseUint32(strs[5]); err != nil {
+		return nil, err
+	}
+
+	if job.NBits, err = ParseUint32(strs[6]); err != nil {
+		return nil, err
+	}
+
+	if job.NTime, err = ParseUint32(strs[7]); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Build block header of share from job and submit of miner
+func (j *Job) Header(extraNonce1 string, extraNonce2 string, nTime uint32, nonce uint32, version uint32) ([]byte, error) {
+
+	coinbase, err := hex.DecodeString(extraNonce1 + extraNonce2)
+	if err != nil {
+		return nil, errors.New("invalid extranonce")
+	}
+
+	coinbase = append(append(append([]byte{}, j.Coinbase1...), coinbase...), j.Coinbase2...)
+
+	merkleRoot := doubleSha256(coinbase)
+	for _, branch := range j.MerkleBranch {
+		merkleRoot = doubleSha256(append(merkleRoot, branch...))
+	}
+
+	header := make([]byte, 80)
+	binary.LittleEndian.PutUint32(header[0:], version)
+	copy(header[4:], j.PrevHash)
+	copy(header[36:], merkleRoot)
+	binary.LittleEndian.PutUint32(header[68:], nTime)
+	binary.LittleEndian.PutUint32(header[72:], j.NBits)
+	binary.LittleEndian.PutUint32(header[76:], nonce)
+
+	return header, nil
+}
+
+// Difficulty of block header, as pools measure shares
+func Difficulty(header []byte) float64 {
+
+	hash := doubleSha256(header)
+
+	// Hash is a little endian number
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+
+	value := new(big.Int).SetBytes(hash)
+
+	if value.Sign() == 0 {
+		return 0
+	}
+
+	difficulty, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), new(big.Float).SetInt(value)).Float64()
+
+	return difficulty
+}
+
+// Version of block header with bits rolled by miner inside mask
+func RollVersion(version uint32, versionBits uint32, mask uint32) uint32 {
+	return (version &^ mask) | (versionBits & mask)
+}
@@ -0,0 +1,235 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package job
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Genesis block as a pool would send it, extranonces are cut out of its coinbase
+const (
+	genesisCoinbase1   = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d010445"
+	genesisExtraNonce1 = "54686520"
+	genesisExtraNonce2 = "54696d65"
+	genesisCoinbase2   = "732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+	genesisNTime       = 0x495fab29
+	genesisNonce       = 0x7c2bac1d
+	genesisHash        = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	genesisMerkleRoot  = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+)
+
+func genesisNotify() []any {
+	return []any{
+		"0",
+		strings.Repeat("0", 64),
+		genesisCoinbase1,
+		genesisCoinbase2,
+		[]any{},
+		"00000001",
+		"1d00ffff",
+		"495fab29",
+		true,
+	}
+}
+
+// Hash of header as block explorers show it
+func headerHash(header []byte) string {
+
+	hash := doubleSha256(header)
+
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+
+	return hex.EncodeToString(hash)
+}
+
+func reversed(str string) []byte {
+
+	data, _ := hex.DecodeString(str)
+
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+
+	return data
+}
+
+func TestGenesisHeader(t *testing.T) {
+
+	j, err := Parse(genesisNotify())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.ID != "0" || j.Version != 1 || j.NBits != 0x1d00ffff || j.NTime != genesisNTime || !j.CleanJobs || !j.IsChecked() {
+		t.Fatalf("unexpected job %+v", j)
+	}
+
+	header, err := j.Header(genesisExtraNonce1, genesisExtraNonce2, genesisNTime, genesisNonce, j.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(header[36:68], reversed(genesisMerkleRoot)) {
+		t.Fatalf("merkle root is %x", header[36:68])
+	}
+
+	if hash := headerHash(header); hash != genesisHash {
+		t.Fatalf("hash of header is %s, expected %s", hash, genesisHash)
+	}
+
+	if difficulty := Difficulty(header); math.Abs(difficulty-2536.4262984453103) > 1e-9 {
+		t.Fatalf("difficulty of header is %v", difficulty)
+	}
+}
+
+func TestRolledHeader(t *testing.T) {
+
+	j, err := Parse(genesisNotify())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := RollVersion(j.Version, 0x00002000, BIP320_VERSION_MASK)
+	if version != 0x00002001 {
+		t.Fatalf("rolled version is %08x", version)
+	}
+
+	header, err := j.Header(genesisExtraNonce1, genesisExtraNonce2, genesisNTime, genesisNonce, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(header[0:4], []byte{0x01, 0x20, 0x00, 0x00}) {
+		t.Fatalf("version of header is %x", header[0:4])
+	}
+
+	if hash := headerHash(header); hash != "4f91bc5a024ac4c27642bec359f89e737ce826eddcd55e4786a3178d41b65cc3" {
+		t.Fatalf("hash of rolled header is %s", hash)
+	}
+
+	if difficulty := Difficulty(header); math.Abs(difficulty-7.490797337925296e-10) > 1e-20 {
+		t.Fatalf("difficulty of rolled header is %v", difficulty)
+	}
+}
+
+func TestRollVersion(t *testing.T) {
+	tests := []struct {
+		version     uint32
+		versionBits uint32
+		mask        uint32
+		rolled      uint32
+	}{
+		{0x20000000, 0x00000000, BIP320_VERSION_MASK, 0x20000000},
+		{0x20000000, 0x1fffe000, BIP320_VERSION_MASK, 0x3fffe000},
+		{0x20000000, 0x00006000, 0x00002000, 0x20002000},
+		{0x20002000, 0x00000000, BIP320_VERSION_MASK, 0x20000000},
+		{0x20000000, 0xe0001fff, BIP320_VERSION_MASK, 0x20000000},
+		{0x20000000, 0x1fffe000, 0, 0x20000000},
+	}
+
+	for _, test := range tests {
+		if rolled := RollVersion(test.version, test.versionBits, test.mask); rolled != test.rolled {
+			t.Errorf("version %08x rolled by %08x in %08x is %08x, expected %08x", test.version, test.versionBits, test.mask, rolled, test.rolled)
+		}
+	}
+}
+
+// Stratum sends prevhash with every 4 bytes swapped, header has it little endian
+func TestParsePrevHash(t *testing.T) {
+
+	params := genesisNotify()
+	params[1] = "ab02cd818b9e567ee21793cddef299feb29ad444a41b85b8000008a300000000"
+
+	j, err := Parse(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := reversed("00000000000008a3a41b85b8b29ad444def299fee21793cd8b9e567eab02cd81"); !bytes.Equal(j.PrevHash, expected) {
+		t.Fatalf("prevhash is %x, expected %x", j.PrevHash, expected)
+	}
+}
+
+func TestMerkleBranch(t *testing.T) {
+
+	params := genesisNotify()
+	params[4] = []any{strings.Repeat("11", 32), strings.Repeat("22", 32)}
+
+	j, err := Parse(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := j.Header(genesisExtraNonce1, genesisExtraNonce2, genesisNTime, genesisNonce, j.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root := hex.EncodeToString(header[36:68]); root != "3cfb8a083b55b72cc284884440375206e84ffa279fc8ba1aa5415197671573c9" {
+		t.Fatalf("merkle root is %s", root)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		idx   int
+		param any
+	}{
+		{"job id not string", 0, 1},
+		{"short prevhash", 1, "00"},
+		{"prevhash not hex", 1, strings.Repeat("zz", 32)},
+		{"coinbase1 not hex", 2, "zz"},
+		{"coinbase2 not hex", 3, "zz"},
+		{"merkle branch not list", 4, "00"},
+		{"short merkle branch", 4, []any{"00"}},
+		{"short version", 5, "1"},
+		{"nbits not hex", 6, "zzzzzzzz"},
+		{"ntime not string", 7, 0x495fab29},
+	}
+
+	for _, test := range tests {
+		params := genesisNotify()
+		params[test.idx] = test.param
+
+		if _, err := Parse(params); err == nil {
+			t.Errorf("%s: job parsed", test.name)
+		}
+	}
+
+	if _, err := Parse(genesisNotify()[:8]); err == nil {
+		t.Error("job without clean jobs parsed")
+	}
+}
+
+func TestUnchecked(t *testing.T) {
+
+	j := Unchecked("1f", true)
+
+	if j.IsChecked() || j.ID != "1f" || !j.CleanJobs {
+		t.Fatalf("unexpected job %+v", j)
+	}
+}
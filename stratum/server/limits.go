@@ -0,0 +1,143 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/venuslog"
+	"math"
+	"net"
+	"time"
+)
+
+// Reasons of rejecting connection
+const REJECT_ACCEPT_RATE = "accept_rate"
+const REJECT_MAX_CONNECTIONS = "max_connections"
+const REJECT_MAX_CONNECTIONS_PER_IP = "max_connections_per_ip"
+
+// Token bucket of accepting connections, it refills by rate up to burst
+type tokenBucket struct {
+	mutex  mutex.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate float64, burst float64) bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Reason of rejecting new connection by limits, empty when it is admitted
+func (s *Server) overLimit(c net.Conn) string {
+
+	limits := config.Get().Limits
+
+	if limits.AcceptRate > 0 {
+		burst := math.Max(1, float64(limits.AcceptBurst))
+
+		if !s.acceptBucket.take(limits.AcceptRate, burst) {
+			return REJECT_ACCEPT_RATE
+		}
+	}
+
+	if limits.MaxConnections == 0 && limits.MaxConnectionsPerIp == 0 {
+		return ""
+	}
+
+	ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+
+	s.ConnsMut.Lock()
+	total := uint64(len(s.Connections))
+	fromIp := uint64(0)
+	for _, conn := range s.Connections {
+		host, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		if host == ip {
+			fromIp++
+		}
+	}
+	s.ConnsMut.Unlock()
+
+	if limits.MaxConnections > 0 && total >= limits.MaxConnections {
+		return REJECT_MAX_CONNECTIONS
+	}
+
+	if limits.MaxConnectionsPerIp > 0 && fromIp >= limits.MaxConnectionsPerIp {
+		return REJECT_MAX_CONNECTIONS_PER_IP
+	}
+
+	return ""
+}
+
+// Close new connection which is over limits, before anything is read from it
+func (s *Server) Admit(c net.Conn) bool {
+
+	reason := s.overLimit(c)
+
+	if reason == "" {
+		return true
+	}
+
+	venuslog.Warn("Connection rejected by limits:", c.RemoteAddr().String(), reason)
+
+	s.rejectedMut.Lock()
+	if s.rejected == nil {
+		s.rejected = make(map[string]uint64)
+	}
+	s.rejected[reason]++
+	s.rejectedMut.Unlock()
+
+	c.Close()
+
+	return false
+}
+
+// Connections rejected by limits since start, by reason
+func (s *Server) RejectedConnections() map[string]uint64 {
+
+	s.rejectedMut.Lock()
+	defer s.rejectedMut.Unlock()
+
+	rejected := map[string]uint64{
+		REJECT_ACCEPT_RATE:            0,
+		REJECT_MAX_CONNECTIONS:        0,
+		REJECT_MAX_CONNECTIONS_PER_IP: 0,
+	}
+	for reason, count := range s.rejected {
+		rejected[reason] = count
+	}
+
+	return rejected
+}
@@ -0,0 +1,144 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package stratumserver
+
+import (
+	"btcminerproxy/config"
+	"net"
+	"testing"
+	"time"
+)
+
+// Pipe end with address of miner
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func minerConn(t *testing.T, ip string) net.Conn {
+
+	c, other := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		other.Close()
+	})
+
+	return &addrConn{Conn: c, remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000}}
+}
+
+// Limits of config, restored after test
+func limitsConfig(t *testing.T, maxConnections uint64, maxPerIp uint64, rate float64, burst uint64) {
+
+	cfg := config.Get()
+	t.Cleanup(func() { config.Set(cfg) })
+
+	next := &config.Config{}
+	next.Limits.MaxConnections = maxConnections
+	next.Limits.MaxConnectionsPerIp = maxPerIp
+	next.Limits.AcceptRate = rate
+	next.Limits.AcceptBurst = burst
+	config.Set(next)
+}
+
+func TestAdmitConnectionLimits(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		maxConnections uint64
+		maxPerIp       uint64
+		connected      []string
+		ip             string
+		reason         string
+	}{
+		{"no limits", 0, 0, []string{"10.0.0.1", "10.0.0.1"}, "10.0.0.1", ""},
+		{"below limits", 3, 2, []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.1", ""},
+		{"too many connections", 2, 0, []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.3", REJECT_MAX_CONNECTIONS},
+		{"too many connections of ip", 0, 2, []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}, "10.0.0.1", REJECT_MAX_CONNECTIONS_PER_IP},
+		{"other ip below its limit", 0, 2, []string{"10.0.0.1", "10.0.0.1"}, "10.0.0.2", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			limitsConfig(t, test.maxConnections, test.maxPerIp, 0, 0)
+
+			s := &Server{}
+			for _, ip := range test.connected {
+				s.Connections = append(s.Connections, &Connection{Conn: minerConn(t, ip)})
+			}
+
+			c := minerConn(t, test.ip)
+			isAdmitted := s.Admit(c)
+
+			if isAdmitted != (test.reason == "") {
+				t.Fatalf("admitted is %v, expected rejection %q", isAdmitted, test.reason)
+			}
+
+			rejected := s.RejectedConnections()
+			for reason, count := range rejected {
+
+				expected := uint64(0)
+				if reason == test.reason {
+					expected = 1
+				}
+
+				if count != expected {
+					t.Fatalf("rejected connections are %v", rejected)
+				}
+			}
+
+			// Rejected connection is closed before anything is read from it
+			if !isAdmitted {
+				if _, err := c.Write([]byte("{}\n")); err == nil {
+					t.Fatal("rejected connection is open")
+				}
+			}
+		})
+	}
+}
+
+// Burst of connections is admitted, then they are admitted by accept rate
+func TestAdmitAcceptRate(t *testing.T) {
+
+	limitsConfig(t, 0, 0, 20, 3)
+
+	s := &Server{}
+
+	admitted := 0
+	for i := 0; i < 5; i++ {
+		if s.Admit(minerConn(t, "10.0.0.1")) {
+			admitted++
+		}
+	}
+
+	if admitted != 3 || s.RejectedConnections()[REJECT_ACCEPT_RATE] != 2 {
+		t.Fatalf("%d connections of burst 3 admitted, rejected %v", admitted, s.RejectedConnections())
+	}
+
+	// Bucket refills a token every 50ms
+	time.Sleep(60 * time.Millisecond)
+
+	if !s.Admit(minerConn(t, "10.0.0.1")) {
+		t.Fatal("connection isn't admitted after bucket refilled")
+	}
+}
@@ -19,8 +19,10 @@
 package stratumserver
 
 import (
+	"btcminerproxy/acl"
 	"btcminerproxy/config"
 	"btcminerproxy/mutex"
+	"btcminerproxy/stats"
 	"btcminerproxy/venuslog"
 	"crypto/ed25519"
 	"crypto/rand"
@@ -32,7 +34,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
-	"fmt"
+	"errors"
 	"math/big"
 	"net"
 	"os"
@@ -44,16 +46,54 @@ type Server struct {
 	Connections    []*Connection
 	ConnsMut       mutex.Mutex
 	NewConnections chan *Connection
+
+	// accept rate of connections, and connections rejected by limits by reason
+	acceptBucket tokenBucket
+	rejected     map[string]uint64
+	rejectedMut  mutex.Mutex
 }
 
 type Connection struct {
-	Conn     net.Conn
-	Id       uint64
-	Upstream uint64
-	PoolId   uint64
-	WorkerID string
+	Conn       net.Conn
+	Id         uint64
+	Bind       string
+	Upstream   uint64
+	PoolId     uint64
+	WorkerID   string
+	Authorized bool
+
+	// routing rule which chose pool of miner, and whether miner came back after it was rerouted
+	Route    string
+	Rerouted bool
+
+	// subscription handed to miner
+	ExtraNonce1          string
+	ExtraNonce2Size      int
+	ExtraNoncePrefix     string
+	ExtranonceSubscribed bool
+
+	// miner which can't change extranonce keeps its extranonce1 after failover: its jobs
+	// carry extranonce1 of pool at the end of coinb1, or it is held without work
+	JobExtraNonce1 string
+	HeldSince      time.Time
+
+	// version rolling mask asked by miner, and the one it got from proxy
+	RequestedVersionMask uint32
+	VersionMask          uint32
+
+	// difficulty which miner works on, and hashrate of its accepted shares
+	Difficulty float64
+	Hashrate   *stats.Meter
+
+	// proxy side vardiff, difficulty chosen for miner and its shares since the last retarget
+	Vardiff struct {
+		Target float64
+		Shares uint64
+		Since  time.Time
+	}
 
 	//added for report
+	//shares are counted as miner found them, submits as they were sent to pool
 	Shares struct {
 		Accepted uint64
 		Stale    uint64
@@ -64,6 +104,14 @@ type Connection struct {
 		Stale    uint64
 		Invalid  uint64
 	}
+
+	// rejected shares by reason, and the latest error given by pool
+	Rejects   map[string]uint64
+	LastError struct {
+		Code   int
+		Reason string
+		Time   time.Time
+	}
 }
 
 func (c *Connection) Send(a any) error {
@@ -152,67 +200,105 @@ func GenCertificate() ([]byte, []byte, error) {
 	return certPem, keyPem, os.WriteFile("./certificate.pem", certPem, 0o666)
 }
 
-// Start listening connection request from miners
-func (s *Server) Start(port uint16, bind string, isTls bool) {
+// Open listener for connections from miners
+func (s *Server) Listen(port uint16, bind string, isTls bool) (net.Listener, error) {
 	if s.NewConnections == nil {
 		s.NewConnections = make(chan *Connection, 1)
 	}
 
-	var listener net.Listener
-	var err error
-	if isTls {
-		cert, err := tls.LoadX509KeyPair("./certificate.pem", "key.pem")
+	addr := net.JoinHostPort(bind, strconv.FormatUint(uint64(port), 10))
 
-		if err != nil {
-			venuslog.Info("Failed to load TLS certificate from file, generating a new one.")
-			venuslog.Warn(err)
-
-			certPem, keyPem, err := GenCertificate()
-			if err != nil {
-				venuslog.Fatal(err)
-			}
-
-			cert, err = tls.X509KeyPair(certPem, keyPem)
-			if err != nil {
-				venuslog.Fatal(err)
-			}
-		}
+	if !isTls {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := LoadCertificate()
+	if err != nil {
+		return nil, err
+	}
 
-		fingerprint := sha256.Sum256(cert.Certificate[0])
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+}
 
-		venuslog.Info("TLS fingerprint (SHA-256):", hex.EncodeToString(fingerprint[:]))
+// TLS certificate of proxy from certificate.pem and key.pem, a new one is made when they can't be loaded
+func LoadCertificate() (tls.Certificate, error) {
+
+	cert, err := tls.LoadX509KeyPair("./certificate.pem", "key.pem")
 
-		listener, err = tls.Listen("tcp", bind+":"+strconv.FormatUint(uint64(port), 10), &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
-	} else {
-		listener, err = net.Listen("tcp", bind+":"+strconv.FormatUint(uint64(port), 10))
-	}
 	if err != nil {
-		venuslog.Fatal(err)
+		venuslog.Info("Failed to load TLS certificate from file, generating a new one.")
+		venuslog.Warn(err)
+
+		certPem, keyPem, err := GenCertificate()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		cert, err = tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
 	}
 
-	venuslog.Info("Stratum server listening on", fmt.Sprintf("%s:%d", bind, port))
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	venuslog.Info("TLS fingerprint (SHA-256):", hex.EncodeToString(fingerprint[:]))
+
+	return cert, nil
+}
+
+// Accept connections from miners until listener is closed
+func (s *Server) Serve(listener net.Listener, list *acl.List) {
+
+	venuslog.Info("Stratum server listening on", listener.Addr().String())
 
 	for {
 		c, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			venuslog.Info("Stratum server stopped listening on", listener.Addr().String())
+			return
+		}
 		if err != nil {
-			fmt.Println(err)
+			venuslog.Warn("Accepting connection on", listener.Addr().String(), "failed:", err)
 			continue
 		}
 
-		venuslog.Info("New incoming connection:", c.RemoteAddr().String())
-		venuslog.Info("pool index:", config.CFG.PoolIndex)
+		// Address is known before TLS handshake, denied miners don't get it
+		if !list.AllowsAddr(c.RemoteAddr().String()) {
+			venuslog.Info("Connection denied by acl:", c.RemoteAddr().String())
+			c.Close()
+			continue
+		}
 
-		conn := &Connection{
-			Conn:   c,
-			Id:     randomUint64(),
-			PoolId: config.CFG.PoolIndex,
+		if !s.Admit(c) {
+			continue
 		}
-		go s.handleConnection(conn)
+
+		venuslog.Info("New incoming connection:", c.RemoteAddr().String())
+		venuslog.Info("pool index:", config.Get().PoolIndex)
+
+		s.NewConnection(c, listener.Addr().String())
 	}
 }
 
+// Register stratum session of miner accepted by bind, it is handled as connections accepted by Start
+func (s *Server) NewConnection(c net.Conn, bind string) *Connection {
+	conn := &Connection{
+		Conn:       c,
+		Id:         randomUint64(),
+		Bind:       bind,
+		PoolId:     config.Get().PoolIndex,
+		Rejects:    make(map[string]uint64),
+		Difficulty: config.DEFAULT_DIFFICULTY,
+		Hashrate:   stats.NewMeter(),
+	}
+	go s.handleConnection(conn)
+
+	return conn
+}
+
 // Append miner socket(server socket in miner's side)
 func (srv *Server) handleConnection(conn *Connection) {
 	srv.ConnsMut.Lock()
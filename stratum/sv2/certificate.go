@@ -0,0 +1,148 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Size of certificate sent in the handshake: version, validity and signature
+const CERTIFICATE_SIZE = 2 + 4 + 4 + schnorr.SignatureSize
+
+// Certificate of server static key, signed by authority key of pool
+type Certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     [schnorr.SignatureSize]byte
+}
+
+// Hash which authority signs, it binds validity of certificate to the static key
+func (c *Certificate) hash(static *btcec.PublicKey) []byte {
+	data := make([]byte, 10)
+	binary.LittleEndian.PutUint16(data[0:], c.Version)
+	binary.LittleEndian.PutUint32(data[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(data[6:], c.NotValidAfter)
+
+	hash := sha256.Sum256(append(data, schnorr.SerializePubKey(static)...))
+
+	return hash[:]
+}
+
+// Sign static key of server by authority key for the given validity
+func NewCertificate(authority *btcec.PrivateKey, static *btcec.PublicKey, validity time.Duration) (*Certificate, error) {
+
+	now := time.Now()
+
+	cert := &Certificate{
+		ValidFrom:     uint32(now.Unix()),
+		NotValidAfter: uint32(now.Add(validity).Unix()),
+	}
+
+	signature, err := schnorr.Sign(authority, cert.hash(static))
+	if err != nil {
+		return nil, err
+	}
+
+	copy(cert.Signature[:], signature.Serialize())
+
+	return cert, nil
+}
+
+func (c *Certificate) Serialize() []byte {
+	data := make([]byte, 10, CERTIFICATE_SIZE)
+	binary.LittleEndian.PutUint16(data[0:], c.Version)
+	binary.LittleEndian.PutUint32(data[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(data[6:], c.NotValidAfter)
+
+	return append(data, c.Signature[:]...)
+}
+
+func ParseCertificate(data []byte) (*Certificate, error) {
+
+	if len(data) != CERTIFICATE_SIZE {
+		return nil, errors.New("invalid certificate size")
+	}
+
+	cert := &Certificate{
+		Version:       binary.LittleEndian.Uint16(data[0:]),
+		ValidFrom:     binary.LittleEndian.Uint32(data[2:]),
+		NotValidAfter: binary.LittleEndian.Uint32(data[6:]),
+	}
+	copy(cert.Signature[:], data[10:])
+
+	return cert, nil
+}
+
+// Check that certificate of static key is signed by authority and valid now
+func (c *Certificate) Verify(authority *btcec.PublicKey, static *btcec.PublicKey) error {
+
+	now := uint32(time.Now().Unix())
+
+	if now < c.ValidFrom || now > c.NotValidAfter {
+		return errors.New("certificate of server is expired")
+	}
+
+	signature, err := schnorr.ParseSignature(c.Signature[:])
+	if err != nil {
+		return err
+	}
+
+	if !signature.Verify(c.hash(static), authority) {
+		return errors.New("certificate of server isn't signed by authority")
+	}
+
+	return nil
+}
+
+// Parse hex of 32 bytes secret key
+func ParsePrivateKey(str string) (*btcec.PrivateKey, error) {
+
+	data, err := hex.DecodeString(str)
+	if err != nil || len(data) != 32 {
+		return nil, errors.New("invalid secret key (should be 32 bytes hex)")
+	}
+
+	key, _ := btcec.PrivKeyFromBytes(data)
+
+	return key, nil
+}
+
+// Parse hex of 32 bytes x-only public key
+func ParsePublicKey(str string) (*btcec.PublicKey, error) {
+
+	data, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	return schnorr.ParsePubKey(data)
+}
+
+// Hex of x-only public key, as it is given to miners and proxies
+func SerializePublicKey(key *btcec.PublicKey) string {
+	return hex.EncodeToString(schnorr.SerializePubKey(key))
+}
@@ -0,0 +1,220 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Binary data types of Stratum V2, every integer is little endian
+
+// Size of frame header: extension type, message type and payload length
+const HEADER_SIZE = 6
+
+// Highest bit of extension type tells the message belongs to a channel
+const CHANNEL_MSG_BIT = 0x8000
+
+var errShortMessage = errors.New("message is too short")
+
+type writer struct {
+	data []byte
+}
+
+func (w *writer) u8(v uint8) {
+	w.data = append(w.data, v)
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *writer) u16(v uint16) {
+	w.data = binary.LittleEndian.AppendUint16(w.data, v)
+}
+
+func (w *writer) u24(v uint32) {
+	w.data = append(w.data, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func (w *writer) u32(v uint32) {
+	w.data = binary.LittleEndian.AppendUint32(w.data, v)
+}
+
+func (w *writer) u64(v uint64) {
+	w.data = binary.LittleEndian.AppendUint64(w.data, v)
+}
+
+func (w *writer) f32(v float32) {
+	w.u32(math.Float32bits(v))
+}
+
+func (w *writer) u256(v [32]byte) {
+	w.data = append(w.data, v[:]...)
+}
+
+// STR0_255 and B0_255
+func (w *writer) str(v string) {
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	w.u8(uint8(len(v)))
+	w.data = append(w.data, v...)
+}
+
+// B0_32
+func (w *writer) b32(v []byte) {
+	w.u8(uint8(len(v)))
+	w.data = append(w.data, v...)
+}
+
+// B0_64K
+func (w *writer) b64k(v []byte) {
+	w.u16(uint16(len(v)))
+	w.data = append(w.data, v...)
+}
+
+// SEQ0_255[U256]
+func (w *writer) seqU256(v [][32]byte) {
+	w.u8(uint8(len(v)))
+	for _, item := range v {
+		w.u256(item)
+	}
+}
+
+// OPTION[U32]
+func (w *writer) optionU32(v *uint32) {
+	if v == nil {
+		w.u8(0)
+		return
+	}
+	w.u8(1)
+	w.u32(*v)
+}
+
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = errShortMessage
+		return make([]byte, n)
+	}
+
+	v := r.data[:n]
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *reader) u8() uint8 {
+	return r.take(1)[0]
+}
+
+func (r *reader) bool() bool {
+	return r.u8()&1 != 0
+}
+
+func (r *reader) u16() uint16 {
+	return binary.LittleEndian.Uint16(r.take(2))
+}
+
+func (r *reader) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *reader) u64() uint64 {
+	return binary.LittleEndian.Uint64(r.take(8))
+}
+
+func (r *reader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+func (r *reader) u256() (v [32]byte) {
+	copy(v[:], r.take(32))
+	return v
+}
+
+func (r *reader) str() string {
+	return string(r.take(int(r.u8())))
+}
+
+func (r *reader) b32() []byte {
+	size := int(r.u8())
+	if size > 32 && r.err == nil {
+		r.err = errors.New("B0_32 is too long")
+	}
+	return append([]byte{}, r.take(size)...)
+}
+
+func (r *reader) b64k() []byte {
+	return append([]byte{}, r.take(int(r.u16()))...)
+}
+
+func (r *reader) seqU256() [][32]byte {
+	v := make([][32]byte, r.u8())
+	for idx := range v {
+		v[idx] = r.u256()
+	}
+	return v
+}
+
+func (r *reader) optionU32() *uint32 {
+	if !r.bool() {
+		return nil
+	}
+	v := r.u32()
+	return &v
+}
+
+// Frame of Stratum V2 without its header
+type Frame struct {
+	Extension uint16
+	MsgType   uint8
+	Payload   []byte
+}
+
+func encodeHeader(frame Frame) []byte {
+	w := writer{}
+	w.u16(frame.Extension)
+	w.u8(frame.MsgType)
+	w.u24(uint32(len(frame.Payload)))
+	return w.data
+}
+
+// Returns frame with empty payload and the payload length
+func decodeHeader(header []byte) (Frame, int) {
+	r := reader{data: header}
+
+	frame := Frame{Extension: r.u16(), MsgType: r.u8()}
+	length := int(r.u8()) | int(r.u8())<<8 | int(r.u8())<<16
+
+	return frame, length
+}
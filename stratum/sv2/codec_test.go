@@ -0,0 +1,174 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func u32(v uint32) *uint32 {
+	return &v
+}
+
+func filled(b byte) (v [32]byte) {
+	for idx := range v {
+		v[idx] = b + byte(idx)
+	}
+	return v
+}
+
+var codecMessages = []Message{
+	&SetupConnection{Protocol: PROTOCOL_MINING, MinVersion: 2, MaxVersion: 2, Flags: FLAG_REQUIRES_VERSION_ROLLING,
+		EndpointHost: "pool.example.com", EndpointPort: 34254, Vendor: "Bitmain", HardwareVersion: "S19",
+		Firmware: "braiins-os", DeviceID: "rig-1"},
+	&SetupConnectionSuccess{UsedVersion: 2, Flags: FLAG_REQUIRES_EXTENDED_CHANNELS},
+	&SetupConnectionError{Flags: 6, ErrorCode: "unsupported-feature-flags"},
+	&OpenStandardMiningChannel{RequestID: 1, UserIdentity: "alice.rig1", NominalHashRate: 1.1e14, MaxTarget: filled(1)},
+	&OpenStandardMiningChannelSuccess{RequestID: 1, ChannelID: 7, Target: filled(2), ExtranoncePrefix: []byte{1, 2, 3, 4}, GroupChannelID: 9},
+	&OpenExtendedMiningChannel{RequestID: 2, UserIdentity: "bob", NominalHashRate: 5e12, MaxTarget: filled(3), MinExtranonceSize: 8},
+	&OpenExtendedMiningChannelSuccess{RequestID: 2, ChannelID: 8, Target: filled(4), ExtranonceSize: 8, ExtranoncePrefix: []byte{9, 9}},
+	&OpenMiningChannelError{RequestID: 3, ErrorCode: "unknown-user"},
+	&NewMiningJob{ChannelID: 7, JobID: 11, MinNTime: u32(1700000000), Version: 0x20000000, MerkleRoot: bytes.Repeat([]byte{5}, 32)},
+	&NewMiningJob{ChannelID: 7, JobID: 12, Version: 0x20000000, MerkleRoot: bytes.Repeat([]byte{6}, 32)},
+	&NewExtendedMiningJob{ChannelID: 8, JobID: 13, MinNTime: u32(1700000001), Version: 0x20000000, VersionRollingAllowed: true,
+		MerklePath: [][32]byte{filled(5), filled(6)}, CoinbasePrefix: []byte{1, 0, 0, 0}, CoinbaseSuffix: []byte{0xff, 0xff, 0xff, 0xff}},
+	&SetNewPrevHash{ChannelID: 7, JobID: 11, PrevHash: filled(7), MinNTime: 1700000000, NBits: 0x1703a30c},
+	&SetTarget{ChannelID: 7, MaximumTarget: filled(8)},
+	&UpdateChannel{ChannelID: 7, NominalHashRate: 2.5e14, MaximumTarget: filled(9)},
+	&UpdateChannelError{ChannelID: 7, ErrorCode: "max-target-out-of-range"},
+	&CloseChannel{ChannelID: 7, ReasonCode: "shutdown"},
+	&SetExtranoncePrefix{ChannelID: 7, ExtranoncePrefix: []byte{4, 3, 2, 1}},
+	&SubmitSharesStandard{ChannelID: 7, SequenceNumber: 1, JobID: 11, Nonce: 0xdeadbeef, NTime: 1700000002, Version: 0x20002000},
+	&SubmitSharesExtended{SubmitSharesStandard: SubmitSharesStandard{ChannelID: 8, SequenceNumber: 2, JobID: 13, Nonce: 1, NTime: 2, Version: 3},
+		Extranonce: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	&SubmitSharesSuccess{ChannelID: 7, LastSequenceNumber: 1, NewSubmitsAcceptedCount: 1, NewSharesSum: 1 << 40},
+	&SubmitSharesError{ChannelID: 7, SequenceNumber: 2, ErrorCode: "stale-share"},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, msg := range codecMessages {
+
+		frame := Encode(msg)
+
+		if isChannelMsg(msg.MsgType()) != (frame.Extension == CHANNEL_MSG_BIT) {
+			t.Errorf("%T has extension %04x", msg, frame.Extension)
+		}
+
+		decoded, err := Decode(frame)
+		if err != nil {
+			t.Errorf("Decode %T: %v", msg, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("%T decoded as %+v, want %+v", msg, decoded, msg)
+		}
+
+		// Every field is needed
+		if len(frame.Payload) > 0 {
+			frame.Payload = frame.Payload[:len(frame.Payload)-1]
+			if _, err := Decode(frame); err == nil {
+				t.Errorf("Decode %T accepted truncated payload", msg)
+			}
+		}
+	}
+}
+
+func TestCodecEveryMessageType(t *testing.T) {
+
+	covered := make(map[uint8]bool)
+	for _, msg := range codecMessages {
+		covered[msg.MsgType()] = true
+	}
+
+	for msgType := 0; msgType < 256; msgType++ {
+		_, err := Decode(Frame{MsgType: uint8(msgType)})
+		if err != nil && err.Error() == errShortMessage.Error() && !covered[uint8(msgType)] {
+			t.Errorf("message type %02x has no round trip", msgType)
+		}
+	}
+}
+
+// Bytes as they are sent, integers are little endian
+func TestCodecWireFormat(t *testing.T) {
+
+	tests := []struct {
+		msg    Message
+		header string
+		hex    string
+	}{
+		{
+			&SetupConnection{Protocol: PROTOCOL_MINING, MinVersion: 2, MaxVersion: 2, Flags: 1, EndpointHost: "h", EndpointPort: 3333, Vendor: "v"},
+			"000000120000",
+			"00" + "0200" + "0200" + "01000000" + "0168" + "050d" + "0176" + "00" + "00" + "00",
+		},
+		{
+			&SubmitSharesStandard{ChannelID: 1, SequenceNumber: 2, JobID: 3, Nonce: 0x04030201, NTime: 5, Version: 0x20000000},
+			"00801a180000",
+			"01000000" + "02000000" + "03000000" + "01020304" + "05000000" + "00000020",
+		},
+		{
+			&NewMiningJob{ChannelID: 1, JobID: 2, MinNTime: u32(3), Version: 4, MerkleRoot: []byte{0xaa}},
+			"008015130000",
+			"01000000" + "02000000" + "0103000000" + "04000000" + "01aa",
+		},
+	}
+
+	for _, test := range tests {
+		frame := Encode(test.msg)
+
+		if got := hex.EncodeToString(encodeHeader(frame)); got != test.header {
+			t.Errorf("header of %T is %s, want %s", test.msg, got, test.header)
+		}
+
+		if got := hex.EncodeToString(frame.Payload); got != test.hex {
+			t.Errorf("payload of %T is %s, want %s", test.msg, got, test.hex)
+		}
+
+		header, _ := hex.DecodeString(test.header)
+		decodedFrame, size := decodeHeader(header)
+		if decodedFrame.MsgType != frame.MsgType || decodedFrame.Extension != frame.Extension || size != len(frame.Payload) {
+			t.Errorf("header %s decoded as %+v of %d bytes", test.header, decodedFrame, size)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+
+	valid := Encode(&CloseChannel{ChannelID: 1, ReasonCode: "x"})
+
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"unknown type", Frame{MsgType: 0x7f}},
+		{"unknown extension", Frame{Extension: 1, MsgType: valid.MsgType, Payload: valid.Payload}},
+		{"trailing bytes", Frame{Extension: valid.Extension, MsgType: valid.MsgType, Payload: append(append([]byte{}, valid.Payload...), 0)}},
+		{"long B0_32", Frame{MsgType: MSG_SET_EXTRANONCE_PREFIX, Payload: append([]byte{1, 0, 0, 0, 33}, make([]byte, 33)...)}},
+	}
+
+	for _, test := range tests {
+		if _, err := Decode(test.frame); err == nil {
+			t.Errorf("%s: Decode accepted frame", test.name)
+		}
+	}
+}
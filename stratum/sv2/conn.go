@@ -0,0 +1,205 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package sv2 implements encrypted connection and messages of Stratum V2 mining protocol
+package sv2
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Largest plaintext which is encrypted at once, payload is split into such chunks
+const MAX_CHUNK_SIZE = 65535 - MAC_SIZE
+
+// Largest payload of frame which is accepted
+const MAX_PAYLOAD_SIZE = 1 << 20
+
+// Connection after the noise handshake
+type Conn struct {
+	Conn     net.Conn
+	send     *cipherState
+	recv     *cipherState
+	writeMut mutex.Mutex
+}
+
+// Do handshake as server with static key certified by authority
+func Accept(conn net.Conn, static *btcec.PrivateKey, cert *Certificate) (*Conn, error) {
+
+	conn.SetDeadline(time.Now().Add(config.WRITE_TIMEOUT_SECONDS * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newHandshakeState()
+
+	act1 := make([]byte, ELLSWIFT_SIZE)
+	if _, err := io.ReadFull(conn, act1); err != nil {
+		return nil, err
+	}
+
+	act2, err := responderAct2(hs, act1, static, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(act2); err != nil {
+		return nil, err
+	}
+
+	recv, send, err := hs.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// Do handshake as client, server must have certificate signed by authority
+func Connect(conn net.Conn, authority *btcec.PublicKey) (*Conn, error) {
+
+	conn.SetDeadline(time.Now().Add(config.WRITE_TIMEOUT_SECONDS * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newHandshakeState()
+
+	e, encoded, err := initiatorAct1(hs)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(encoded); err != nil {
+		return nil, err
+	}
+
+	act2 := make([]byte, ACT2_SIZE)
+	if _, err = io.ReadFull(conn, act2); err != nil {
+		return nil, err
+	}
+
+	static, cert, err := initiatorAct2(hs, act2, e, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cert.Verify(authority, static); err != nil {
+		return nil, err
+	}
+
+	send, recv, err := hs.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// Size of encrypted payload with MAC of every chunk
+func encryptedSize(size int) int {
+	chunks := (size + MAX_CHUNK_SIZE - 1) / MAX_CHUNK_SIZE
+	return size + chunks*MAC_SIZE
+}
+
+// Read the next frame
+func (c *Conn) ReadFrame() (Frame, error) {
+
+	header := make([]byte, HEADER_SIZE+MAC_SIZE)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return Frame{}, err
+	}
+
+	header, err := c.recv.decrypt(nil, header)
+	if err != nil {
+		return Frame{}, errors.New("failed to decrypt frame header")
+	}
+
+	frame, size := decodeHeader(header)
+
+	if size > MAX_PAYLOAD_SIZE {
+		return Frame{}, errors.New("frame is too large")
+	}
+
+	encrypted := make([]byte, encryptedSize(size))
+	if _, err := io.ReadFull(c.Conn, encrypted); err != nil {
+		return Frame{}, err
+	}
+
+	for len(encrypted) > 0 {
+		chunk := encrypted
+		if len(chunk) > MAX_CHUNK_SIZE+MAC_SIZE {
+			chunk = chunk[:MAX_CHUNK_SIZE+MAC_SIZE]
+		}
+		encrypted = encrypted[len(chunk):]
+
+		plaintext, err := c.recv.decrypt(nil, chunk)
+		if err != nil {
+			return Frame{}, errors.New("failed to decrypt frame")
+		}
+
+		frame.Payload = append(frame.Payload, plaintext...)
+	}
+
+	return frame, nil
+}
+
+// Write frame, frames of concurrent writers never interleave
+func (c *Conn) WriteFrame(frame Frame) error {
+
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+
+	data := c.send.encrypt(nil, encodeHeader(frame))
+
+	payload := frame.Payload
+	for len(payload) > 0 {
+		chunk := payload
+		if len(chunk) > MAX_CHUNK_SIZE {
+			chunk = chunk[:MAX_CHUNK_SIZE]
+		}
+		payload = payload[len(chunk):]
+
+		data = append(data, c.send.encrypt(nil, chunk)...)
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(config.WRITE_TIMEOUT_SECONDS * time.Second))
+	_, err := c.Conn.Write(data)
+
+	return err
+}
+
+// Read the next message
+func (c *Conn) ReadMessage() (Message, error) {
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(frame)
+}
+
+func (c *Conn) WriteMessage(msg Message) error {
+	return c.WriteFrame(Encode(msg))
+}
+
+func (c *Conn) Close() {
+	c.Conn.Close()
+}
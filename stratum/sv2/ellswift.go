@@ -0,0 +1,232 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// ElligatorSwift encoding of secp256k1 public keys (BIP324), Stratum V2 sends
+// every public key of the handshake in this 64 bytes encoding
+
+const ELLSWIFT_SIZE = 64
+
+var fieldP = btcec.S256().P
+
+// sqrt(-3) as chosen by BIP324
+var minus3Sqrt = new(big.Int).Exp(new(big.Int).Sub(fieldP, big.NewInt(3)), new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2), fieldP)
+
+func feAdd(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Add(a, b), fieldP) }
+func feSub(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Sub(a, b), fieldP) }
+func feMul(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Mul(a, b), fieldP) }
+func feNeg(a *big.Int) *big.Int    { return new(big.Int).Mod(new(big.Int).Neg(a), fieldP) }
+func feInv(a *big.Int) *big.Int    { return new(big.Int).ModInverse(a, fieldP) }
+func feDiv(a, b *big.Int) *big.Int { return feMul(a, feInv(b)) }
+
+// Square root in the field, nil when there is none
+func feSqrt(a *big.Int) *big.Int {
+	root := new(big.Int).Exp(a, new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2), fieldP)
+
+	if feMul(root, root).Cmp(new(big.Int).Mod(a, fieldP)) != 0 {
+		return nil
+	}
+
+	return root
+}
+
+// x^3 + 7
+func curveRhs(x *big.Int) *big.Int {
+	return feAdd(feMul(feMul(x, x), x), big.NewInt(7))
+}
+
+func isValidX(x *big.Int) bool {
+	return feSqrt(curveRhs(x)) != nil
+}
+
+// Decode (u, t) into X coordinate on the curve
+func xSwiftEC(u, t *big.Int) *big.Int {
+
+	u = new(big.Int).Mod(u, fieldP)
+	t = new(big.Int).Mod(t, fieldP)
+
+	if u.Sign() == 0 {
+		u = big.NewInt(1)
+	}
+	if t.Sign() == 0 {
+		t = big.NewInt(1)
+	}
+	if feAdd(curveRhs(u), feMul(t, t)).Sign() == 0 {
+		t = feAdd(t, t)
+	}
+
+	x := feDiv(feSub(curveRhs(u), feMul(t, t)), feAdd(t, t))
+	y := feDiv(feAdd(x, t), feMul(minus3Sqrt, u))
+
+	candidates := []*big.Int{
+		feAdd(u, feMul(big.NewInt(4), feMul(y, y))),
+		feDiv(feSub(feNeg(feDiv(x, y)), u), big.NewInt(2)),
+		feDiv(feSub(feDiv(x, y), u), big.NewInt(2)),
+	}
+
+	for _, candidate := range candidates {
+		if isValidX(candidate) {
+			return candidate
+		}
+	}
+
+	return nil
+}
+
+// Find t so that xSwiftEC(u, t) is x, nil when this case doesn't work
+func xSwiftECInv(x, u *big.Int, c int) *big.Int {
+
+	var v, s *big.Int
+
+	if c&2 == 0 {
+		if isValidX(feSub(feNeg(x), u)) {
+			return nil
+		}
+
+		v = x
+		s = feNeg(feDiv(curveRhs(u), feAdd(feAdd(feMul(u, u), feMul(u, v)), feMul(v, v))))
+	} else {
+		s = feSub(x, u)
+
+		if s.Sign() == 0 {
+			return nil
+		}
+
+		r := feSqrt(feNeg(feMul(s, feAdd(feMul(big.NewInt(4), curveRhs(u)), feMul(feMul(big.NewInt(3), s), feMul(u, u))))))
+
+		if r == nil || (c&1 != 0 && r.Sign() == 0) {
+			return nil
+		}
+
+		v = feDiv(feSub(feDiv(r, s), u), big.NewInt(2))
+	}
+
+	w := feSqrt(s)
+
+	if w == nil {
+		return nil
+	}
+
+	half := feInv(big.NewInt(2))
+	minus := feMul(feMul(u, feSub(big.NewInt(1), minus3Sqrt)), half)
+	plus := feMul(feMul(u, feAdd(big.NewInt(1), minus3Sqrt)), half)
+
+	switch c & 5 {
+	case 0:
+		return feNeg(feMul(w, feAdd(minus, v)))
+	case 1:
+		return feMul(w, feAdd(plus, v))
+	case 4:
+		return feMul(w, feAdd(minus, v))
+	default:
+		return feNeg(feMul(w, feAdd(plus, v)))
+	}
+}
+
+func fieldBytes(v *big.Int) []byte {
+	out := make([]byte, 32)
+	v.FillBytes(out)
+	return out
+}
+
+// Encode public key with random ElligatorSwift encoding
+func EllswiftEncode(pub *btcec.PublicKey) ([]byte, error) {
+
+	x := new(big.Int).SetBytes(pub.SerializeCompressed()[1:])
+	random := make([]byte, 33)
+
+	for tries := 0; tries < 1000; tries++ {
+
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		u := new(big.Int).Mod(new(big.Int).SetBytes(random[:32]), fieldP)
+		if u.Sign() == 0 {
+			continue
+		}
+
+		t := xSwiftECInv(x, u, int(random[32]&7))
+
+		// Encoding is checked against decoding, which is what the peer does
+		if t == nil || xSwiftEC(u, t).Cmp(x) != 0 {
+			continue
+		}
+
+		return append(fieldBytes(u), fieldBytes(t)...), nil
+	}
+
+	return nil, errors.New("failed to encode public key")
+}
+
+// Decode ElligatorSwift encoding into public key with even Y
+func EllswiftDecode(encoded []byte) (*btcec.PublicKey, error) {
+
+	if len(encoded) != ELLSWIFT_SIZE {
+		return nil, errors.New("invalid ellswift encoding size")
+	}
+
+	x := xSwiftEC(new(big.Int).SetBytes(encoded[:32]), new(big.Int).SetBytes(encoded[32:]))
+
+	if x == nil {
+		return nil, errors.New("invalid ellswift encoding")
+	}
+
+	return btcec.ParsePubKey(append([]byte{0x02}, fieldBytes(x)...))
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// ECDH of BIP324 between ElligatorSwift encoded keys of initiator and responder
+func EllswiftECDH(priv *btcec.PrivateKey, initiator []byte, responder []byte, isInitiator bool) ([]byte, error) {
+
+	theirs := initiator
+	if isInitiator {
+		theirs = responder
+	}
+
+	pub, err := EllswiftDecode(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	x := btcec.GenerateSharedSecret(priv, pub)
+
+	return taggedHash("bip324_ellswift_xonly_ecdh", initiator, responder, x), nil
+}
@@ -0,0 +1,601 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Messages of common and mining protocol of Stratum V2
+
+const (
+	MSG_SETUP_CONNECTION                = 0x00
+	MSG_SETUP_CONNECTION_SUCCESS        = 0x01
+	MSG_SETUP_CONNECTION_ERROR          = 0x02
+	MSG_OPEN_STANDARD_MINING_CHANNEL    = 0x10
+	MSG_OPEN_STANDARD_MINING_CHANNEL_OK = 0x11
+	MSG_OPEN_MINING_CHANNEL_ERROR       = 0x12
+	MSG_OPEN_EXTENDED_MINING_CHANNEL    = 0x13
+	MSG_OPEN_EXTENDED_MINING_CHANNEL_OK = 0x14
+	MSG_NEW_MINING_JOB                  = 0x15
+	MSG_UPDATE_CHANNEL                  = 0x16
+	MSG_UPDATE_CHANNEL_ERROR            = 0x17
+	MSG_CLOSE_CHANNEL                   = 0x18
+	MSG_SET_EXTRANONCE_PREFIX           = 0x19
+	MSG_SUBMIT_SHARES_STANDARD          = 0x1a
+	MSG_SUBMIT_SHARES_EXTENDED          = 0x1b
+	MSG_SUBMIT_SHARES_SUCCESS           = 0x1c
+	MSG_SUBMIT_SHARES_ERROR             = 0x1d
+	MSG_NEW_EXTENDED_MINING_JOB         = 0x1f
+	MSG_SET_NEW_PREV_HASH               = 0x20
+	MSG_SET_TARGET                      = 0x21
+)
+
+// Mining protocol in SetupConnection
+const PROTOCOL_MINING = 0
+
+// Flags of SetupConnection for mining protocol
+const (
+	FLAG_REQUIRES_STANDARD_JOBS   = 1 << 0
+	FLAG_REQUIRES_WORK_SELECTION  = 1 << 1
+	FLAG_REQUIRES_VERSION_ROLLING = 1 << 2
+)
+
+// Flags of SetupConnection.Success for mining protocol
+const (
+	FLAG_REQUIRES_FIXED_VERSION     = 1 << 0
+	FLAG_REQUIRES_EXTENDED_CHANNELS = 1 << 1
+)
+
+type Message interface {
+	MsgType() uint8
+	encode(w *writer)
+	decode(r *reader)
+}
+
+type SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceID        string
+}
+
+type SetupConnectionSuccess struct {
+	UsedVersion uint16
+	Flags       uint32
+}
+
+type SetupConnectionError struct {
+	Flags     uint32
+	ErrorCode string
+}
+
+type OpenStandardMiningChannel struct {
+	RequestID       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       [32]byte
+}
+
+type OpenStandardMiningChannelSuccess struct {
+	RequestID        uint32
+	ChannelID        uint32
+	Target           [32]byte
+	ExtranoncePrefix []byte
+	GroupChannelID   uint32
+}
+
+type OpenExtendedMiningChannel struct {
+	RequestID         uint32
+	UserIdentity      string
+	NominalHashRate   float32
+	MaxTarget         [32]byte
+	MinExtranonceSize uint16
+}
+
+type OpenExtendedMiningChannelSuccess struct {
+	RequestID        uint32
+	ChannelID        uint32
+	Target           [32]byte
+	ExtranonceSize   uint16
+	ExtranoncePrefix []byte
+}
+
+type OpenMiningChannelError struct {
+	RequestID uint32
+	ErrorCode string
+}
+
+type NewMiningJob struct {
+	ChannelID  uint32
+	JobID      uint32
+	MinNTime   *uint32
+	Version    uint32
+	MerkleRoot []byte
+}
+
+type NewExtendedMiningJob struct {
+	ChannelID             uint32
+	JobID                 uint32
+	MinNTime              *uint32
+	Version               uint32
+	VersionRollingAllowed bool
+	MerklePath            [][32]byte
+	CoinbasePrefix        []byte
+	CoinbaseSuffix        []byte
+}
+
+type SetNewPrevHash struct {
+	ChannelID uint32
+	JobID     uint32
+	PrevHash  [32]byte
+	MinNTime  uint32
+	NBits     uint32
+}
+
+type SetTarget struct {
+	ChannelID     uint32
+	MaximumTarget [32]byte
+}
+
+type UpdateChannel struct {
+	ChannelID       uint32
+	NominalHashRate float32
+	MaximumTarget   [32]byte
+}
+
+type UpdateChannelError struct {
+	ChannelID uint32
+	ErrorCode string
+}
+
+type CloseChannel struct {
+	ChannelID  uint32
+	ReasonCode string
+}
+
+type SetExtranoncePrefix struct {
+	ChannelID        uint32
+	ExtranoncePrefix []byte
+}
+
+type SubmitSharesStandard struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+}
+
+type SubmitSharesExtended struct {
+	SubmitSharesStandard
+	Extranonce []byte
+}
+
+type SubmitSharesSuccess struct {
+	ChannelID               uint32
+	LastSequenceNumber      uint32
+	NewSubmitsAcceptedCount uint32
+	NewSharesSum            uint64
+}
+
+type SubmitSharesError struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	ErrorCode      string
+}
+
+func (*SetupConnection) MsgType() uint8                  { return MSG_SETUP_CONNECTION }
+func (*SetupConnectionSuccess) MsgType() uint8           { return MSG_SETUP_CONNECTION_SUCCESS }
+func (*SetupConnectionError) MsgType() uint8             { return MSG_SETUP_CONNECTION_ERROR }
+func (*OpenStandardMiningChannel) MsgType() uint8        { return MSG_OPEN_STANDARD_MINING_CHANNEL }
+func (*OpenStandardMiningChannelSuccess) MsgType() uint8 { return MSG_OPEN_STANDARD_MINING_CHANNEL_OK }
+func (*OpenExtendedMiningChannel) MsgType() uint8        { return MSG_OPEN_EXTENDED_MINING_CHANNEL }
+func (*OpenExtendedMiningChannelSuccess) MsgType() uint8 { return MSG_OPEN_EXTENDED_MINING_CHANNEL_OK }
+func (*OpenMiningChannelError) MsgType() uint8           { return MSG_OPEN_MINING_CHANNEL_ERROR }
+func (*NewMiningJob) MsgType() uint8                     { return MSG_NEW_MINING_JOB }
+func (*NewExtendedMiningJob) MsgType() uint8             { return MSG_NEW_EXTENDED_MINING_JOB }
+func (*SetNewPrevHash) MsgType() uint8                   { return MSG_SET_NEW_PREV_HASH }
+func (*SetTarget) MsgType() uint8                        { return MSG_SET_TARGET }
+func (*UpdateChannel) MsgType() uint8                    { return MSG_UPDATE_CHANNEL }
+func (*UpdateChannelError) MsgType() uint8               { return MSG_UPDATE_CHANNEL_ERROR }
+func (*CloseChannel) MsgType() uint8                     { return MSG_CLOSE_CHANNEL }
+func (*SetExtranoncePrefix) MsgType() uint8              { return MSG_SET_EXTRANONCE_PREFIX }
+func (*SubmitSharesStandard) MsgType() uint8             { return MSG_SUBMIT_SHARES_STANDARD }
+func (*SubmitSharesExtended) MsgType() uint8             { return MSG_SUBMIT_SHARES_EXTENDED }
+func (*SubmitSharesSuccess) MsgType() uint8              { return MSG_SUBMIT_SHARES_SUCCESS }
+func (*SubmitSharesError) MsgType() uint8                { return MSG_SUBMIT_SHARES_ERROR }
+
+func (m *SetupConnection) encode(w *writer) {
+	w.u8(m.Protocol)
+	w.u16(m.MinVersion)
+	w.u16(m.MaxVersion)
+	w.u32(m.Flags)
+	w.str(m.EndpointHost)
+	w.u16(m.EndpointPort)
+	w.str(m.Vendor)
+	w.str(m.HardwareVersion)
+	w.str(m.Firmware)
+	w.str(m.DeviceID)
+}
+
+func (m *SetupConnection) decode(r *reader) {
+	m.Protocol = r.u8()
+	m.MinVersion = r.u16()
+	m.MaxVersion = r.u16()
+	m.Flags = r.u32()
+	m.EndpointHost = r.str()
+	m.EndpointPort = r.u16()
+	m.Vendor = r.str()
+	m.HardwareVersion = r.str()
+	m.Firmware = r.str()
+	m.DeviceID = r.str()
+}
+
+func (m *SetupConnectionSuccess) encode(w *writer) {
+	w.u16(m.UsedVersion)
+	w.u32(m.Flags)
+}
+
+func (m *SetupConnectionSuccess) decode(r *reader) {
+	m.UsedVersion = r.u16()
+	m.Flags = r.u32()
+}
+
+func (m *SetupConnectionError) encode(w *writer) {
+	w.u32(m.Flags)
+	w.str(m.ErrorCode)
+}
+
+func (m *SetupConnectionError) decode(r *reader) {
+	m.Flags = r.u32()
+	m.ErrorCode = r.str()
+}
+
+func (m *OpenStandardMiningChannel) encode(w *writer) {
+	w.u32(m.RequestID)
+	w.str(m.UserIdentity)
+	w.f32(m.NominalHashRate)
+	w.u256(m.MaxTarget)
+}
+
+func (m *OpenStandardMiningChannel) decode(r *reader) {
+	m.RequestID = r.u32()
+	m.UserIdentity = r.str()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+}
+
+func (m *OpenStandardMiningChannelSuccess) encode(w *writer) {
+	w.u32(m.RequestID)
+	w.u32(m.ChannelID)
+	w.u256(m.Target)
+	w.b32(m.ExtranoncePrefix)
+	w.u32(m.GroupChannelID)
+}
+
+func (m *OpenStandardMiningChannelSuccess) decode(r *reader) {
+	m.RequestID = r.u32()
+	m.ChannelID = r.u32()
+	m.Target = r.u256()
+	m.ExtranoncePrefix = r.b32()
+	m.GroupChannelID = r.u32()
+}
+
+func (m *OpenExtendedMiningChannel) encode(w *writer) {
+	w.u32(m.RequestID)
+	w.str(m.UserIdentity)
+	w.f32(m.NominalHashRate)
+	w.u256(m.MaxTarget)
+	w.u16(m.MinExtranonceSize)
+}
+
+func (m *OpenExtendedMiningChannel) decode(r *reader) {
+	m.RequestID = r.u32()
+	m.UserIdentity = r.str()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	m.MinExtranonceSize = r.u16()
+}
+
+func (m *OpenExtendedMiningChannelSuccess) encode(w *writer) {
+	w.u32(m.RequestID)
+	w.u32(m.ChannelID)
+	w.u256(m.Target)
+	w.u16(m.ExtranonceSize)
+	w.b32(m.ExtranoncePrefix)
+}
+
+func (m *OpenExtendedMiningChannelSuccess) decode(r *reader) {
+	m.RequestID = r.u32()
+	m.ChannelID = r.u32()
+	m.Target = r.u256()
+	m.ExtranonceSize = r.u16()
+	m.ExtranoncePrefix = r.b32()
+}
+
+func (m *OpenMiningChannelError) encode(w *writer) {
+	w.u32(m.RequestID)
+	w.str(m.ErrorCode)
+}
+
+func (m *OpenMiningChannelError) decode(r *reader) {
+	m.RequestID = r.u32()
+	m.ErrorCode = r.str()
+}
+
+func (m *NewMiningJob) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.JobID)
+	w.optionU32(m.MinNTime)
+	w.u32(m.Version)
+	w.b32(m.MerkleRoot)
+}
+
+func (m *NewMiningJob) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.JobID = r.u32()
+	m.MinNTime = r.optionU32()
+	m.Version = r.u32()
+	m.MerkleRoot = r.b32()
+}
+
+func (m *NewExtendedMiningJob) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.JobID)
+	w.optionU32(m.MinNTime)
+	w.u32(m.Version)
+	w.bool(m.VersionRollingAllowed)
+	w.seqU256(m.MerklePath)
+	w.b64k(m.CoinbasePrefix)
+	w.b64k(m.CoinbaseSuffix)
+}
+
+func (m *NewExtendedMiningJob) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.JobID = r.u32()
+	m.MinNTime = r.optionU32()
+	m.Version = r.u32()
+	m.VersionRollingAllowed = r.bool()
+	m.MerklePath = r.seqU256()
+	m.CoinbasePrefix = r.b64k()
+	m.CoinbaseSuffix = r.b64k()
+}
+
+func (m *SetNewPrevHash) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.JobID)
+	w.u256(m.PrevHash)
+	w.u32(m.MinNTime)
+	w.u32(m.NBits)
+}
+
+func (m *SetNewPrevHash) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.JobID = r.u32()
+	m.PrevHash = r.u256()
+	m.MinNTime = r.u32()
+	m.NBits = r.u32()
+}
+
+func (m *SetTarget) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u256(m.MaximumTarget)
+}
+
+func (m *SetTarget) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.MaximumTarget = r.u256()
+}
+
+func (m *UpdateChannel) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.f32(m.NominalHashRate)
+	w.u256(m.MaximumTarget)
+}
+
+func (m *UpdateChannel) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.NominalHashRate = r.f32()
+	m.MaximumTarget = r.u256()
+}
+
+func (m *UpdateChannelError) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.str(m.ErrorCode)
+}
+
+func (m *UpdateChannelError) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.ErrorCode = r.str()
+}
+
+func (m *CloseChannel) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.str(m.ReasonCode)
+}
+
+func (m *CloseChannel) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.ReasonCode = r.str()
+}
+
+func (m *SetExtranoncePrefix) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.b32(m.ExtranoncePrefix)
+}
+
+func (m *SetExtranoncePrefix) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.ExtranoncePrefix = r.b32()
+}
+
+func (m *SubmitSharesStandard) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.SequenceNumber)
+	w.u32(m.JobID)
+	w.u32(m.Nonce)
+	w.u32(m.NTime)
+	w.u32(m.Version)
+}
+
+func (m *SubmitSharesStandard) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.SequenceNumber = r.u32()
+	m.JobID = r.u32()
+	m.Nonce = r.u32()
+	m.NTime = r.u32()
+	m.Version = r.u32()
+}
+
+func (m *SubmitSharesExtended) encode(w *writer) {
+	m.SubmitSharesStandard.encode(w)
+	w.b32(m.Extranonce)
+}
+
+func (m *SubmitSharesExtended) decode(r *reader) {
+	m.SubmitSharesStandard.decode(r)
+	m.Extranonce = r.b32()
+}
+
+func (m *SubmitSharesSuccess) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.LastSequenceNumber)
+	w.u32(m.NewSubmitsAcceptedCount)
+	w.u64(m.NewSharesSum)
+}
+
+func (m *SubmitSharesSuccess) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.LastSequenceNumber = r.u32()
+	m.NewSubmitsAcceptedCount = r.u32()
+	m.NewSharesSum = r.u64()
+}
+
+func (m *SubmitSharesError) encode(w *writer) {
+	w.u32(m.ChannelID)
+	w.u32(m.SequenceNumber)
+	w.str(m.ErrorCode)
+}
+
+func (m *SubmitSharesError) decode(r *reader) {
+	m.ChannelID = r.u32()
+	m.SequenceNumber = r.u32()
+	m.ErrorCode = r.str()
+}
+
+// Messages which belong to a channel have the channel bit in their frame
+func isChannelMsg(msgType uint8) bool {
+	switch msgType {
+	case MSG_NEW_MINING_JOB, MSG_UPDATE_CHANNEL, MSG_UPDATE_CHANNEL_ERROR, MSG_CLOSE_CHANNEL,
+		MSG_SET_EXTRANONCE_PREFIX, MSG_SUBMIT_SHARES_STANDARD, MSG_SUBMIT_SHARES_EXTENDED,
+		MSG_SUBMIT_SHARES_SUCCESS, MSG_SUBMIT_SHARES_ERROR, MSG_NEW_EXTENDED_MINING_JOB,
+		MSG_SET_NEW_PREV_HASH, MSG_SET_TARGET:
+		return true
+	}
+	return false
+}
+
+// Frame of message
+func Encode(msg Message) Frame {
+	w := writer{}
+	msg.encode(&w)
+
+	frame := Frame{MsgType: msg.MsgType(), Payload: w.data}
+	if isChannelMsg(frame.MsgType) {
+		frame.Extension = CHANNEL_MSG_BIT
+	}
+
+	return frame
+}
+
+// Message of frame, frames of extensions aren't supported
+func Decode(frame Frame) (Message, error) {
+
+	if frame.Extension&^CHANNEL_MSG_BIT != 0 {
+		return nil, fmt.Errorf("unsupported extension %04x", frame.Extension)
+	}
+
+	var msg Message
+
+	switch frame.MsgType {
+	case MSG_SETUP_CONNECTION:
+		msg = &SetupConnection{}
+	case MSG_SETUP_CONNECTION_SUCCESS:
+		msg = &SetupConnectionSuccess{}
+	case MSG_SETUP_CONNECTION_ERROR:
+		msg = &SetupConnectionError{}
+	case MSG_OPEN_STANDARD_MINING_CHANNEL:
+		msg = &OpenStandardMiningChannel{}
+	case MSG_OPEN_STANDARD_MINING_CHANNEL_OK:
+		msg = &OpenStandardMiningChannelSuccess{}
+	case MSG_OPEN_EXTENDED_MINING_CHANNEL:
+		msg = &OpenExtendedMiningChannel{}
+	case MSG_OPEN_EXTENDED_MINING_CHANNEL_OK:
+		msg = &OpenExtendedMiningChannelSuccess{}
+	case MSG_OPEN_MINING_CHANNEL_ERROR:
+		msg = &OpenMiningChannelError{}
+	case MSG_NEW_MINING_JOB:
+		msg = &NewMiningJob{}
+	case MSG_NEW_EXTENDED_MINING_JOB:
+		msg = &NewExtendedMiningJob{}
+	case MSG_SET_NEW_PREV_HASH:
+		msg = &SetNewPrevHash{}
+	case MSG_SET_TARGET:
+		msg = &SetTarget{}
+	case MSG_UPDATE_CHANNEL:
+		msg = &UpdateChannel{}
+	case MSG_UPDATE_CHANNEL_ERROR:
+		msg = &UpdateChannelError{}
+	case MSG_CLOSE_CHANNEL:
+		msg = &CloseChannel{}
+	case MSG_SET_EXTRANONCE_PREFIX:
+		msg = &SetExtranoncePrefix{}
+	case MSG_SUBMIT_SHARES_STANDARD:
+		msg = &SubmitSharesStandard{}
+	case MSG_SUBMIT_SHARES_EXTENDED:
+		msg = &SubmitSharesExtended{}
+	case MSG_SUBMIT_SHARES_SUCCESS:
+		msg = &SubmitSharesSuccess{}
+	case MSG_SUBMIT_SHARES_ERROR:
+		msg = &SubmitSharesError{}
+	default:
+		return nil, fmt.Errorf("unsupported message type %02x", frame.MsgType)
+	}
+
+	r := reader{data: frame.Payload}
+	msg.decode(&r)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, errors.New("message is too long")
+	}
+
+	return msg, nil
+}
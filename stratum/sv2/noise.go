@@ -0,0 +1,287 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise NX handshake of Stratum V2, miner (initiator) learns static key of
+// server (responder) during the handshake and checks it by the certificate
+// signed with authority key of pool
+
+const PROTOCOL_NAME = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+const MAC_SIZE = 16
+
+// Size of the second act: ephemeral key, encrypted static key and encrypted certificate
+const ACT2_SIZE = ELLSWIFT_SIZE + ELLSWIFT_SIZE + MAC_SIZE + CERTIFICATE_SIZE + MAC_SIZE
+
+// Encrypting key with its nonce
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cipherState{aead: aead}, nil
+}
+
+func (c *cipherState) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *cipherState) encrypt(ad []byte, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), plaintext, ad)
+}
+
+func (c *cipherState) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nextNonce(), ciphertext, ad)
+}
+
+// Chaining key, handshake hash and key of handshake in progress
+type handshakeState struct {
+	ck     []byte
+	h      []byte
+	cipher *cipherState
+}
+
+func newHandshakeState() *handshakeState {
+	name := sha256.Sum256([]byte(PROTOCOL_NAME))
+
+	hs := &handshakeState{ck: name[:], h: name[:]}
+
+	// Empty prologue
+	hs.mixHash(nil)
+
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	h := sha256.Sum256(append(append([]byte{}, hs.h...), data...))
+	hs.h = h[:]
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// HKDF of noise with two outputs
+func hkdf(ck []byte, ikm []byte) ([]byte, []byte) {
+	temp := hmacSha256(ck, ikm)
+	out1 := hmacSha256(temp, []byte{0x01})
+	out2 := hmacSha256(temp, out1, []byte{0x02})
+	return out1, out2
+}
+
+func (hs *handshakeState) mixKey(ikm []byte) error {
+	var key []byte
+	hs.ck, key = hkdf(hs.ck, ikm)
+
+	var err error
+	hs.cipher, err = newCipherState(key)
+
+	return err
+}
+
+func (hs *handshakeState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := plaintext
+	if hs.cipher != nil {
+		ciphertext = hs.cipher.encrypt(hs.h, plaintext)
+	}
+
+	hs.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if hs.cipher != nil {
+		var err error
+		if plaintext, err = hs.cipher.decrypt(hs.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+
+	hs.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// Keys for transport, the first one encrypts messages of initiator
+func (hs *handshakeState) split() (*cipherState, *cipherState, error) {
+	k1, k2 := hkdf(hs.ck, nil)
+
+	c1, err := newCipherState(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c2, err := newCipherState(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c1, c2, nil
+}
+
+// Ephemeral key with its encoding
+func newEphemeral() (*btcec.PrivateKey, []byte, error) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoded, err := EllswiftEncode(key.PubKey())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, encoded, nil
+}
+
+// First act of initiator, ephemeral key in clear
+func initiatorAct1(hs *handshakeState) (*btcec.PrivateKey, []byte, error) {
+
+	e, encoded, err := newEphemeral()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hs.mixHash(encoded)
+	hs.encryptAndHash(nil)
+
+	return e, encoded, nil
+}
+
+// Second act of responder, answering ephemeral key of initiator with its own,
+// its static key and certificate of the static key
+func responderAct2(hs *handshakeState, act1 []byte, static *btcec.PrivateKey, cert *Certificate) ([]byte, error) {
+
+	if len(act1) != ELLSWIFT_SIZE {
+		return nil, errors.New("invalid handshake message size")
+	}
+
+	hs.mixHash(act1)
+	hs.decryptAndHash(nil)
+
+	e, encoded, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+
+	hs.mixHash(encoded)
+
+	secret, err := EllswiftECDH(e, act1, encoded, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = hs.mixKey(secret); err != nil {
+		return nil, err
+	}
+
+	staticEncoded, err := EllswiftEncode(static.PubKey())
+	if err != nil {
+		return nil, err
+	}
+
+	act2 := append([]byte{}, encoded...)
+	act2 = append(act2, hs.encryptAndHash(staticEncoded)...)
+
+	secret, err = EllswiftECDH(static, act1, staticEncoded, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = hs.mixKey(secret); err != nil {
+		return nil, err
+	}
+
+	act2 = append(act2, hs.encryptAndHash(cert.Serialize())...)
+
+	return act2, nil
+}
+
+// Initiator reads the second act, returns static key of responder with its certificate
+func initiatorAct2(hs *handshakeState, act2 []byte, e *btcec.PrivateKey, encoded []byte) (*btcec.PublicKey, *Certificate, error) {
+
+	if len(act2) != ACT2_SIZE {
+		return nil, nil, errors.New("invalid handshake message size")
+	}
+
+	re := act2[:ELLSWIFT_SIZE]
+	hs.mixHash(re)
+
+	secret, err := EllswiftECDH(e, encoded, re, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = hs.mixKey(secret); err != nil {
+		return nil, nil, err
+	}
+
+	rs, err := hs.decryptAndHash(act2[ELLSWIFT_SIZE : 2*ELLSWIFT_SIZE+MAC_SIZE])
+	if err != nil {
+		return nil, nil, errors.New("failed to decrypt static key of server")
+	}
+
+	secret, err = EllswiftECDH(e, encoded, rs, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = hs.mixKey(secret); err != nil {
+		return nil, nil, err
+	}
+
+	certData, err := hs.decryptAndHash(act2[2*ELLSWIFT_SIZE+MAC_SIZE:])
+	if err != nil {
+		return nil, nil, errors.New("failed to decrypt certificate of server")
+	}
+
+	static, err := EllswiftDecode(rs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := ParseCertificate(certData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return static, cert, nil
+}
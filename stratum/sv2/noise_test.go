@@ -0,0 +1,148 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+type handshakeResult struct {
+	conn *Conn
+	err  error
+}
+
+// Server certified by signer does handshake with client which trusts authority
+func handshake(t *testing.T, signer *btcec.PrivateKey, authority *btcec.PublicKey, validity time.Duration) (*Conn, *Conn, error) {
+
+	static, _ := btcec.NewPrivateKey()
+
+	cert, err := NewCertificate(signer, static.PubKey(), validity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		serverSide.Close()
+		clientSide.Close()
+	})
+
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := Accept(serverSide, static, cert)
+		accepted <- handshakeResult{conn, err}
+	}()
+
+	client, err := Connect(clientSide, authority)
+
+	server := <-accepted
+	if server.err != nil {
+		t.Fatalf("Accept: %v", server.err)
+	}
+
+	return server.conn, client, err
+}
+
+func TestHandshake(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+
+	server, client, err := handshake(t, authority, authority.PubKey(), time.Hour)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	// Frames larger than a chunk are split and joined again
+	frames := []Frame{
+		{MsgType: MSG_SETUP_CONNECTION, Payload: []byte("setup")},
+		{Extension: CHANNEL_MSG_BIT, MsgType: MSG_NEW_MINING_JOB, Payload: bytes.Repeat([]byte{7}, MAX_CHUNK_SIZE+100)},
+		{MsgType: MSG_SETUP_CONNECTION_SUCCESS},
+	}
+
+	for _, frame := range frames {
+		go client.WriteFrame(frame)
+
+		got, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+
+		if got.Extension != frame.Extension || got.MsgType != frame.MsgType || !bytes.Equal(got.Payload, frame.Payload) {
+			t.Fatalf("server got frame %x %x of %d bytes, sent %x %x of %d bytes",
+				got.Extension, got.MsgType, len(got.Payload), frame.Extension, frame.MsgType, len(frame.Payload))
+		}
+
+		go server.WriteFrame(frame)
+
+		got, err = client.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+
+		if !bytes.Equal(got.Payload, frame.Payload) {
+			t.Fatal("client got another payload")
+		}
+	}
+}
+
+func TestHandshakeCertificateMismatch(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+	other, _ := btcec.NewPrivateKey()
+
+	_, _, err := handshake(t, other, authority.PubKey(), time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "isn't signed by authority") {
+		t.Fatalf("Connect accepted certificate of another authority: %v", err)
+	}
+}
+
+func TestHandshakeExpiredCertificate(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+
+	_, _, err := handshake(t, authority, authority.PubKey(), -time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Connect accepted expired certificate: %v", err)
+	}
+}
+
+func TestTamperedFrame(t *testing.T) {
+
+	authority, _ := btcec.NewPrivateKey()
+
+	server, client, err := handshake(t, authority, authority.PubKey(), time.Hour)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	data := client.send.encrypt(nil, encodeHeader(Frame{MsgType: MSG_SETUP_CONNECTION}))
+	data[0] ^= 1
+
+	go client.Conn.Write(data)
+
+	if _, err := server.ReadFrame(); err == nil {
+		t.Fatal("server decrypted tampered frame")
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sv2
+
+import (
+	"math/big"
+)
+
+// Stratum V2 sends targets instead of difficulty, as little endian U256
+
+// Target of difficulty 1 share, 0x00000000ffff0000...
+var diff1Target = new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(0xffff), 208))
+
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Target of shares at difficulty
+func TargetFromDifficulty(difficulty float64) (target [32]byte) {
+
+	value := maxTarget
+
+	if difficulty > 0 {
+		value, _ = new(big.Float).Quo(diff1Target, big.NewFloat(difficulty)).Int(nil)
+
+		if value.Cmp(maxTarget) > 0 {
+			value = maxTarget
+		}
+	}
+
+	be := value.FillBytes(make([]byte, 32))
+	for idx := range be {
+		target[idx] = be[31-idx]
+	}
+
+	return target
+}
+
+// Difficulty of shares at target
+func DifficultyFromTarget(target [32]byte) float64 {
+
+	be := make([]byte, 32)
+	for idx := range be {
+		be[idx] = target[31-idx]
+	}
+
+	value := new(big.Int).SetBytes(be)
+
+	if value.Sign() == 0 {
+		return 0
+	}
+
+	difficulty, _ := new(big.Float).Quo(diff1Target, new(big.Float).SetInt(value)).Float64()
+
+	return difficulty
+}
@@ -22,6 +22,8 @@ import (
 	"btcminerproxy/config"
 	"btcminerproxy/venuslog"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 )
@@ -64,7 +66,21 @@ type authorizeParams struct {
 type StratumMsgResponse struct {
 	ID     uint64 `json:"id"`
 	Result any    `json:"result"`
-	Error  string `json:"error"`
+	Error  any    `json:"error"`
+}
+
+// Request sent by proxy itself
+type StratumRequest struct {
+	ID     uint64 `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+// Notification sent by proxy itself, id is always null
+type StratumNotification struct {
+	ID     any    `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
 }
 
 type StratumSeverMsg struct {
@@ -72,6 +88,97 @@ type StratumSeverMsg struct {
 	Method string `json:"method"`
 }
 
+// Error of stratum response, [code, reason, traceback]
+func NewError(code int, reason string) []any {
+	return []any{code, reason, nil}
+}
+
+// Parse error of stratum response, pools send [code, reason, traceback],
+// {"code": code, "message": reason} or just a reason
+func ParseError(stratumErr any) (int, string) {
+
+	switch e := stratumErr.(type) {
+	case []any:
+		code, reason := 0, ""
+		if len(e) > 0 {
+			if c, ok := e[0].(float64); ok {
+				code = int(c)
+			}
+		}
+		if len(e) > 1 {
+			reason, _ = e[1].(string)
+		}
+		return code, reason
+
+	case map[string]any:
+		code, _ := e["code"].(float64)
+		reason, _ := e["message"].(string)
+		return int(code), reason
+
+	case string:
+		return 0, e
+	}
+
+	return 0, ""
+}
+
+// Replace id of stratum msg, other fields are kept as they are
+func ReplaceID(msg []byte, id uint64) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, err
+	}
+
+	newId, _ := json.Marshal(id)
+	fields["id"] = newId
+
+	return json.Marshal(fields)
+}
+
+// Set clean jobs flag of mining.notify, other fields are kept as they are
+func CleanJobs(msg []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, err
+	}
+
+	params := make([]json.RawMessage, 0, 9)
+
+	if err := json.Unmarshal(fields["params"], &params); err != nil || len(params) < 9 {
+		return nil, errors.New("invalid mining.notify")
+	}
+
+	params[8] = json.RawMessage("true")
+
+	newParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	fields["params"] = newParams
+
+	return json.Marshal(fields)
+}
+
+// Parse result of mining.subscribe, returns extranonce1 and extranonce2 size
+func ParseSubscribeResult(result any) (string, int, error) {
+	params, ok := result.([]any)
+
+	if !ok || len(params) < 3 {
+		return "", 0, errors.New("invalid subscribe result")
+	}
+
+	extraNonce1, ok1 := params[1].(string)
+	extraNonce2Size, ok2 := params[2].(float64)
+
+	if !ok1 || !ok2 {
+		return "", 0, errors.New("invalid subscribe result")
+	}
+
+	return extraNonce1, int(extraNonce2Size), nil
+}
+
 // Read one stratum msg from Socket, because protocol is tcp, we need buffering
 func ReadLineFromSocket(conn net.Conn, buf []byte, bufLen int) (line []byte, lineLen int, readLen int, err error) {
 
@@ -88,7 +195,7 @@ func ReadLineFromSocket(conn net.Conn, buf []byte, bufLen int) (line []byte, lin
 	readBytes, err := conn.Read(readBuf)
 
 	if err != nil {
-		if err != io.EOF {
+		if err != io.EOF || readBytes == 0 {
 			return nil, 0, 0, err
 		}
 	}
@@ -0,0 +1,110 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stats"
+	"btcminerproxy/stratum/template"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Shares are counted by the answer of pool to their submits, miner gets the answer with its own id
+func TestCountSubmit(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		response string
+		accepted uint64
+		stale    uint64
+		rejected uint64
+		reason   string
+	}{
+		{"accepted", `"result":true,"error":null`, 1, 0, 0, ""},
+		{"low difficulty", `"result":null,"error":[23,"Low difficulty share",null]`, 0, 0, 1, "Low difficulty share"},
+		{"job not found", `"result":null,"error":[21,"Job not found",null]`, 0, 1, 0, "Job not found"},
+		{"stale by message", `"result":null,"error":{"code":20,"message":"Stale share"}`, 0, 1, 0, "Stale share"},
+		{"false without error", `"result":false,"error":null`, 0, 0, 1, "Rejected"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, pool, miner := shareUpstream(t, false)
+			conn.Hashrate = stats.NewMeter()
+			config.Update(func(cfg *config.Config) {
+				cfg.ValidateShares = false
+			})
+
+			forwarded, code := submitShare(t, us, conn, pool, miner, []string{"rig1", "1f", "01020304", "504e86b9", "00000000"})
+			if code != 0 {
+				t.Fatalf("share wasn't forwarded, error %d", code)
+			}
+
+			submit := template.StratumMsg{}
+			json.Unmarshal([]byte(forwarded), &submit)
+
+			us.handleResponse(submit.ID, []byte(fmt.Sprintf(`{"id":%d,%s}`, submit.ID, test.response)))
+
+			select {
+			case line := <-miner:
+				answer := template.StratumMsgResponse{}
+				if err := json.Unmarshal([]byte(line), &answer); err != nil || answer.ID != 7 {
+					t.Fatalf("miner got %s", line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("miner didn't get answer of pool")
+			}
+
+			us.mutex.Lock()
+			defer us.mutex.Unlock()
+
+			if us.Submits.Accepted != test.accepted || us.Submits.Stale != test.stale || us.Submits.Rejected != test.rejected {
+				t.Fatalf("upstream counted %+v", us.Submits)
+			}
+			if conn.Submits.Accepted != test.accepted || conn.Submits.Stale != test.stale || conn.Submits.Invalid != test.rejected {
+				t.Fatalf("miner counted %+v", conn.Submits)
+			}
+			if test.reason != "" && (conn.Rejects[test.reason] != 1 || conn.LastError.Reason != test.reason) {
+				t.Fatalf("miner has rejects %v, last error %+v", conn.Rejects, conn.LastError)
+			}
+		})
+	}
+}
+
+// Answer of pool which doesn't match a submit is dropped
+func TestUnknownResponse(t *testing.T) {
+
+	us, conn, _, miner := shareUpstream(t, false)
+
+	us.handleResponse(99, []byte(`{"id":99,"result":true,"error":null}`))
+
+	select {
+	case line := <-miner:
+		t.Fatalf("miner got %s", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if us.Submits.Accepted != 0 || conn.Submits.Accepted != 0 {
+		t.Fatal("unknown response was counted")
+	}
+}
@@ -0,0 +1,816 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/acl"
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/sv2"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Stratum V2 miners are served by translating every channel into a stratum V1
+// session of proxy, so V2 channels share upstreams, failover, vardiff and share
+// checks with V1 miners. Session of channel is a pipe which is handled as any
+// other V1 connection.
+
+// Version of mining protocol which proxy speaks
+const SV2_VERSION = 2
+
+// Ids of requests which open V1 session of channel
+const (
+	SV2_CONFIGURE_ID = iota + 1
+	SV2_SUBSCRIBE_ID
+	SV2_EXTRANONCE_SUBSCRIBE_ID
+	SV2_AUTHORIZE_ID
+	SV2_FIRST_SUBMIT_ID
+)
+
+var sv2Authority *btcec.PrivateKey
+var sv2Static *btcec.PrivateKey
+
+// Load authority key which signs certificates of proxy, a new one is made when not configured
+func initSv2() {
+
+	var err error
+
+	if config.Get().Sv2.AuthoritySecretKey != "" {
+		sv2Authority, err = sv2.ParsePrivateKey(config.Get().Sv2.AuthoritySecretKey)
+	} else {
+		sv2Authority, err = btcec.NewPrivateKey()
+		venuslog.Warn("No sv2 authority secret key configured, miners must use the new authority key after every restart")
+	}
+
+	if err != nil {
+		venuslog.Fatal(err)
+	}
+
+	if sv2Static, err = btcec.NewPrivateKey(); err != nil {
+		venuslog.Fatal(err)
+	}
+
+	venuslog.Info("Stratum V2 authority public key:", sv2.SerializePublicKey(sv2Authority.PubKey()))
+}
+
+// Accept stratum V2 miners until listener is closed
+func ServeSv2(listener net.Listener, list *acl.List) {
+
+	venuslog.Info("Stratum V2 server listening on", listener.Addr().String())
+
+	for {
+		c, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			venuslog.Info("Stratum V2 server stopped listening on", listener.Addr().String())
+			return
+		}
+		if err != nil {
+			venuslog.Warn("Failed to accept stratum V2 connection:", err)
+			continue
+		}
+
+		if !list.AllowsAddr(c.RemoteAddr().String()) {
+			venuslog.Info("Connection denied by acl:", c.RemoteAddr().String())
+			c.Close()
+			continue
+		}
+
+		// Handshake costs CPU, blocked and banned miners don't get that far
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+
+		if checkBlackList(ip) {
+			venuslog.Info("This address is in blocklist", ip)
+			c.Close()
+			continue
+		}
+
+		if isBanned(ip) {
+			venuslog.Info("This address is banned", ip)
+			c.Close()
+			continue
+		}
+
+		if !srv.Admit(c) {
+			continue
+		}
+
+		venuslog.Info("New incoming stratum V2 connection:", c.RemoteAddr().String())
+
+		go handleSv2Connection(c, listener.Addr().String())
+	}
+}
+
+// Connection of V2 miner with its channels
+type sv2Session struct {
+	conn          *sv2.Conn
+	bind          string
+	mutex         mutex.Mutex
+	channels      map[uint32]*sv2Channel
+	nextChannelId uint32
+	isSetup       bool
+	standardJobs  bool
+}
+
+// Job of channel and the V1 job it was made of
+type sv2Job struct {
+	v1Id string
+	job  *job.Job
+}
+
+// Submit of channel waiting for answer of V1 session
+type sv2Submit struct {
+	sequenceNumber uint32
+	difficulty     float64
+}
+
+// Channel of V2 miner, it is translated into V1 session
+type sv2Channel struct {
+	id        uint32
+	session   *sv2Session
+	requestId uint32
+	user      string
+	extended  bool
+	minSize   int
+
+	// V1 side of pipe, written only by reader of V2 connection
+	pipe   net.Conn
+	isOpen bool
+
+	mutex           mutex.Mutex
+	extraNonce1     string
+	extraNonce2Size int
+	versionMask     uint32
+	difficulty      float64
+	lastNotify      []any
+	jobs            map[uint32]*sv2Job
+	nextJobId       uint32
+	prevHash        []byte
+	nextSubmitId    uint64
+	submits         map[uint64]sv2Submit
+}
+
+// Pipe end which tells the addresses of V2 miner, bans, reports and routing see the miner
+type sv2PipeConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *sv2PipeConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *sv2PipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Handshake with V2 miner and handle its messages
+func handleSv2Connection(c net.Conn, bind string) {
+
+	validity := time.Duration(config.Get().Sv2.CertificateValidity) * time.Second
+
+	cert, err := sv2.NewCertificate(sv2Authority, sv2Static.PubKey(), validity)
+	if err != nil {
+		venuslog.Warn("Failed to sign certificate:", err)
+		c.Close()
+		return
+	}
+
+	conn, err := sv2.Accept(c, sv2Static, cert)
+	if err != nil {
+		venuslog.Warn("Stratum V2 handshake failed with", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	session := &sv2Session{
+		conn:          conn,
+		bind:          bind,
+		channels:      make(map[uint32]*sv2Channel),
+		nextChannelId: 1,
+	}
+
+	defer session.close()
+
+	for {
+		conn.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
+
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			venuslog.Warn("Read Data failed in proxy from V2 miner:", err)
+			return
+		}
+
+		msg, err := sv2.Decode(frame)
+		if err != nil {
+			venuslog.Warn("V2 miner sent message which proxy can't handle:", err)
+			continue
+		}
+
+		if !session.handleMessage(msg) {
+			return
+		}
+	}
+}
+
+// Close V2 connection with V1 sessions of its channels
+func (s *sv2Session) close() {
+
+	s.mutex.Lock()
+	channels := s.channels
+	s.channels = make(map[uint32]*sv2Channel)
+	s.mutex.Unlock()
+
+	for _, ch := range channels {
+		ch.pipe.Close()
+	}
+
+	s.conn.Close()
+}
+
+func (s *sv2Session) send(msg sv2.Message) {
+	if err := s.conn.WriteMessage(msg); err != nil {
+		venuslog.Warn("err on write ", err)
+		s.conn.Close()
+	}
+}
+
+func (s *sv2Session) getChannel(id uint32) *sv2Channel {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.channels[id]
+}
+
+// Handle message of V2 miner, returns false when connection must be closed
+func (s *sv2Session) handleMessage(msg sv2.Message) bool {
+
+	if _, ok := msg.(*sv2.SetupConnection); !ok && !s.isSetup {
+		venuslog.Warn("V2 miner didn't setup connection")
+		return false
+	}
+
+	switch m := msg.(type) {
+	case *sv2.SetupConnection:
+		return s.setup(m)
+
+	case *sv2.OpenStandardMiningChannel:
+		s.openChannel(m.RequestID, m.UserIdentity, false, 0)
+
+	case *sv2.OpenExtendedMiningChannel:
+		if s.standardJobs {
+			s.send(&sv2.OpenMiningChannelError{RequestID: m.RequestID, ErrorCode: "unsupported-feature-flags"})
+			break
+		}
+		s.openChannel(m.RequestID, m.UserIdentity, true, int(m.MinExtranonceSize))
+
+	case *sv2.SubmitSharesStandard:
+		s.submit(m, nil)
+
+	case *sv2.SubmitSharesExtended:
+		s.submit(&m.SubmitSharesStandard, m.Extranonce)
+
+	case *sv2.UpdateChannel:
+		// Difficulty of channel is chosen by pool or vardiff of proxy
+
+	case *sv2.CloseChannel:
+		s.mutex.Lock()
+		ch := s.channels[m.ChannelID]
+		delete(s.channels, m.ChannelID)
+		s.mutex.Unlock()
+
+		if ch != nil {
+			venuslog.Info("V2 miner closed channel", m.ChannelID, m.ReasonCode)
+			ch.pipe.Close()
+		}
+
+	default:
+		venuslog.Warn("V2 miner sent unexpected message", fmt.Sprintf("%02x", msg.MsgType()))
+	}
+
+	return true
+}
+
+// Answer SetupConnection, only mining protocol without work selection is supported
+func (s *sv2Session) setup(m *sv2.SetupConnection) bool {
+
+	var errorCode string
+	var flags uint32
+
+	switch {
+	case s.isSetup:
+		errorCode = "connection-already-setup"
+	case m.Protocol != sv2.PROTOCOL_MINING:
+		errorCode = "unsupported-protocol"
+	case m.MinVersion > SV2_VERSION || m.MaxVersion < SV2_VERSION:
+		errorCode = "protocol-version-mismatch"
+	case m.Flags&sv2.FLAG_REQUIRES_WORK_SELECTION != 0:
+		errorCode = "unsupported-feature-flags"
+		flags = sv2.FLAG_REQUIRES_WORK_SELECTION
+	}
+
+	if errorCode != "" {
+		venuslog.Warn("Refused setup of V2 miner:", errorCode)
+		s.send(&sv2.SetupConnectionError{Flags: flags, ErrorCode: errorCode})
+		return false
+	}
+
+	venuslog.Info("V2 miner", m.Vendor, m.HardwareVersion, m.Firmware, m.DeviceID, "connected")
+
+	s.isSetup = true
+	s.standardJobs = m.Flags&sv2.FLAG_REQUIRES_STANDARD_JOBS != 0
+
+	s.send(&sv2.SetupConnectionSuccess{UsedVersion: SV2_VERSION})
+
+	return true
+}
+
+// Open channel as V1 session, channel is answered when the session is authorized.
+// User identity is worker name and password separated by colon, the password
+// is carried by the encrypted session and never leaves it.
+func (s *sv2Session) openChannel(requestId uint32, identity string, extended bool, minSize int) {
+
+	user, password, _ := strings.Cut(identity, ":")
+
+	local, remote := net.Pipe()
+
+	s.mutex.Lock()
+	ch := &sv2Channel{
+		id:           s.nextChannelId,
+		session:      s,
+		requestId:    requestId,
+		user:         user,
+		extended:     extended,
+		minSize:      minSize,
+		pipe:         local,
+		jobs:         make(map[uint32]*sv2Job),
+		nextJobId:    1,
+		nextSubmitId: SV2_FIRST_SUBMIT_ID,
+		submits:      make(map[uint64]sv2Submit),
+		difficulty:   config.DEFAULT_DIFFICULTY,
+	}
+	s.channels[ch.id] = ch
+	s.nextChannelId++
+	s.mutex.Unlock()
+
+	conn := srv.NewConnection(&sv2PipeConn{Conn: remote, localAddr: s.conn.Conn.LocalAddr(), remoteAddr: s.conn.Conn.RemoteAddr()}, s.bind)
+
+	venuslog.Info("V2 miner opened channel", ch.id, "for", user, "as connection", conn.Id)
+
+	go ch.readSession()
+
+	time.AfterFunc(config.UPSTREAM_READY_TIMEOUT_SECONDS*time.Second, func() {
+		ch.mutex.Lock()
+		isOpen := ch.isOpen
+		ch.mutex.Unlock()
+
+		if !isOpen {
+			ch.openFailed("pool-unavailable")
+		}
+	})
+
+	ch.request(SV2_CONFIGURE_ID, "mining.configure", []any{
+		[]string{"version-rolling"},
+		map[string]any{
+			"version-rolling.mask":          fmt.Sprintf("%08x", job.BIP320_VERSION_MASK),
+			"version-rolling.min-bit-count": 2,
+		},
+	})
+	ch.request(SV2_SUBSCRIBE_ID, "mining.subscribe", []any{config.USERAGENT})
+	ch.request(SV2_EXTRANONCE_SUBSCRIBE_ID, "mining.extranonce.subscribe", []any{})
+	ch.request(SV2_AUTHORIZE_ID, "mining.authorize", []string{user, password})
+}
+
+// Send request to V1 session of channel
+func (ch *sv2Channel) request(id uint64, method string, params any) {
+
+	data, err := json.Marshal(template.StratumRequest{
+		ID:     id,
+		Method: method,
+		Params: params,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ch.pipe.SetWriteDeadline(time.Now().Add(config.WRITE_TIMEOUT_SECONDS * time.Second))
+
+	if _, err = ch.pipe.Write(append(data, '\n')); err != nil {
+		venuslog.Warn("Failed to write to session of V2 channel", ch.id, err)
+	}
+}
+
+// Tell miner that channel couldn't be opened
+func (ch *sv2Channel) openFailed(errorCode string) {
+
+	ch.mutex.Lock()
+	if ch.isOpen {
+		ch.mutex.Unlock()
+		return
+	}
+	// Channel is never opened after failure
+	ch.isOpen = true
+	ch.mutex.Unlock()
+
+	venuslog.Warn("Failed to open channel of V2 miner:", errorCode)
+
+	ch.session.mutex.Lock()
+	delete(ch.session.channels, ch.id)
+	ch.session.mutex.Unlock()
+
+	ch.session.send(&sv2.OpenMiningChannelError{RequestID: ch.requestId, ErrorCode: errorCode})
+	ch.pipe.Close()
+}
+
+// Read msgs of V1 session and translate them for V2 miner,
+// V2 connection is closed together with the session
+func (ch *sv2Channel) readSession() {
+
+	reader := bufio.NewReaderSize(ch.pipe, config.MAX_REQUEST_SIZE)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		req := template.NotifyMsg{}
+		if err = json.Unmarshal(line, &req); err != nil {
+			venuslog.Warn("ReadJSON failed in proxy from V1 session:", err)
+			continue
+		}
+
+		if req.Method == "" {
+			resp := template.StratumMsgResponse{}
+			json.Unmarshal(line, &resp)
+			ch.handleResponse(resp)
+			continue
+		}
+
+		ch.handleNotification(req.Method, req.Params)
+	}
+
+	ch.session.mutex.Lock()
+	_, isActive := ch.session.channels[ch.id]
+	ch.session.mutex.Unlock()
+
+	// Session was closed by proxy, miner reconnects
+	if isActive {
+		venuslog.Warn("Session of V2 channel", ch.id, "is closed")
+		ch.session.conn.Close()
+	}
+}
+
+// Handle response of V1 session to request of channel
+func (ch *sv2Channel) handleResponse(resp template.StratumMsgResponse) {
+
+	switch resp.ID {
+	case SV2_CONFIGURE_ID:
+		result, _ := resp.Result.(map[string]any)
+		maskStr, _ := result["version-rolling.mask"].(string)
+		mask, _ := job.ParseUint32(maskStr)
+
+		ch.mutex.Lock()
+		ch.versionMask = mask
+		ch.mutex.Unlock()
+
+	case SV2_SUBSCRIBE_ID:
+		extraNonce1, extraNonce2Size, err := template.ParseSubscribeResult(resp.Result)
+		if err != nil || resp.Error != nil {
+			ch.openFailed("pool-unavailable")
+			return
+		}
+
+		if extraNonce2Size < ch.minSize {
+			ch.openFailed("unsupported-min-extranonce-size")
+			return
+		}
+
+		ch.mutex.Lock()
+		ch.extraNonce1 = extraNonce1
+		ch.extraNonce2Size = extraNonce2Size
+		ch.mutex.Unlock()
+
+	case SV2_EXTRANONCE_SUBSCRIBE_ID:
+
+	case SV2_AUTHORIZE_ID:
+		if authorized, _ := resp.Result.(bool); !authorized || resp.Error != nil {
+			ch.openFailed("unknown-user")
+			return
+		}
+
+		ch.open()
+
+	default:
+		ch.mutex.Lock()
+		submit, ok := ch.submits[resp.ID]
+		delete(ch.submits, resp.ID)
+		ch.mutex.Unlock()
+
+		if !ok {
+			return
+		}
+
+		if accepted, _ := resp.Result.(bool); accepted && resp.Error == nil {
+			ch.session.send(&sv2.SubmitSharesSuccess{
+				ChannelID:               ch.id,
+				LastSequenceNumber:      submit.sequenceNumber,
+				NewSubmitsAcceptedCount: 1,
+				NewSharesSum:            uint64(submit.difficulty),
+			})
+			return
+		}
+
+		code, _ := template.ParseError(resp.Error)
+
+		ch.session.send(&sv2.SubmitSharesError{
+			ChannelID:      ch.id,
+			SequenceNumber: submit.sequenceNumber,
+			ErrorCode:      sv2ShareError(code),
+		})
+	}
+}
+
+// Error code of V2 for error code of rejected V1 share
+func sv2ShareError(code int) string {
+	switch code {
+	case 21:
+		return "stale-share"
+	case 22:
+		return "duplicate-share"
+	case 23:
+		return "difficulty-too-low"
+	default:
+		return "invalid-share"
+	}
+}
+
+// Answer miner that channel is open, with the latest work of pool
+func (ch *sv2Channel) open() {
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	if ch.isOpen {
+		return
+	}
+	ch.isOpen = true
+
+	extraNonce1, _ := hex.DecodeString(ch.extraNonce1)
+	target := sv2.TargetFromDifficulty(ch.difficulty)
+
+	if ch.extended {
+		ch.session.send(&sv2.OpenExtendedMiningChannelSuccess{
+			RequestID:        ch.requestId,
+			ChannelID:        ch.id,
+			Target:           target,
+			ExtranonceSize:   uint16(ch.extraNonce2Size),
+			ExtranoncePrefix: extraNonce1,
+		})
+	} else {
+		ch.session.send(&sv2.OpenStandardMiningChannelSuccess{
+			RequestID:        ch.requestId,
+			ChannelID:        ch.id,
+			Target:           target,
+			ExtranoncePrefix: extraNonce1,
+		})
+	}
+
+	if ch.lastNotify != nil {
+		ch.sendJob(ch.lastNotify)
+	}
+}
+
+// Translate msg which V1 session sent on its own
+func (ch *sv2Channel) handleNotification(method string, params []any) {
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	switch method {
+	case "mining.notify":
+		ch.lastNotify = params
+		if ch.isOpen {
+			ch.sendJob(params)
+		}
+
+	case "mining.set_difficulty":
+		if len(params) == 0 {
+			return
+		}
+
+		difficulty, ok := params[0].(float64)
+		if !ok || difficulty <= 0 {
+			return
+		}
+
+		ch.difficulty = difficulty
+		if ch.isOpen {
+			ch.session.send(&sv2.SetTarget{ChannelID: ch.id, MaximumTarget: sv2.TargetFromDifficulty(difficulty)})
+		}
+
+	case "mining.set_version_mask":
+		if len(params) == 0 {
+			return
+		}
+
+		maskStr, _ := params[0].(string)
+		if mask, err := job.ParseUint32(maskStr); err == nil {
+			ch.versionMask = mask
+		}
+
+	case "mining.set_extranonce":
+		if len(params) < 2 {
+			return
+		}
+
+		extraNonce1, ok1 := params[0].(string)
+		extraNonce2Size, ok2 := params[1].(float64)
+
+		if !ok1 || !ok2 {
+			return
+		}
+
+		// Miner can't change size of extranonce it rolls
+		if int(extraNonce2Size) != ch.extraNonce2Size {
+			venuslog.Warn("Extranonce size of V2 channel", ch.id, "changed, closing connection")
+			ch.session.conn.Close()
+			return
+		}
+
+		ch.extraNonce1 = extraNonce1
+
+		// Merkle root of jobs of standard channel has the prefix already
+		if ch.extended && ch.isOpen {
+			prefix, _ := hex.DecodeString(extraNonce1)
+			ch.session.send(&sv2.SetExtranoncePrefix{ChannelID: ch.id, ExtranoncePrefix: prefix})
+		}
+
+	case "client.reconnect":
+		venuslog.Warn("Pool asked reconnecting, closing V2 connection")
+		ch.session.conn.Close()
+	}
+}
+
+// Send job of pool to channel, new block is sent as future job with SetNewPrevHash
+// channel must be locked
+func (ch *sv2Channel) sendJob(params []any) {
+
+	j, err := job.Parse(params)
+	if err != nil {
+		venuslog.Warn("Job of pool can't be sent to V2 miner:", err)
+		return
+	}
+
+	jobId := ch.nextJobId
+	ch.nextJobId++
+
+	isNewBlock := j.CleanJobs || !bytes.Equal(j.PrevHash, ch.prevHash)
+
+	if isNewBlock {
+		ch.jobs = make(map[uint32]*sv2Job)
+		ch.prevHash = j.PrevHash
+	}
+
+	ch.jobs[jobId] = &sv2Job{v1Id: j.ID, job: j}
+	delete(ch.jobs, jobId-config.MAX_JOBS)
+
+	var minNTime *uint32
+	if !isNewBlock {
+		minNTime = &j.NTime
+	}
+
+	if ch.extended {
+		merklePath := make([][32]byte, len(j.MerkleBranch))
+		for idx, branch := range j.MerkleBranch {
+			copy(merklePath[idx][:], branch)
+		}
+
+		ch.session.send(&sv2.NewExtendedMiningJob{
+			ChannelID:             ch.id,
+			JobID:                 jobId,
+			MinNTime:              minNTime,
+			Version:               j.Version,
+			VersionRollingAllowed: ch.versionMask != 0,
+			MerklePath:            merklePath,
+			CoinbasePrefix:        j.Coinbase1,
+			CoinbaseSuffix:        j.Coinbase2,
+		})
+	} else {
+		// Standard channel mines header only, extranonce2 is left at zero
+		header, err := j.Header(ch.extraNonce1, strings.Repeat("00", ch.extraNonce2Size), j.NTime, 0, j.Version)
+		if err != nil {
+			venuslog.Warn("Job of pool can't be sent to V2 miner:", err)
+			return
+		}
+
+		ch.session.send(&sv2.NewMiningJob{
+			ChannelID:  ch.id,
+			JobID:      jobId,
+			MinNTime:   minNTime,
+			Version:    j.Version,
+			MerkleRoot: header[36:68],
+		})
+	}
+
+	if isNewBlock {
+		var prevHash [32]byte
+		copy(prevHash[:], j.PrevHash)
+
+		ch.session.send(&sv2.SetNewPrevHash{
+			ChannelID: ch.id,
+			JobID:     jobId,
+			PrevHash:  prevHash,
+			MinNTime:  j.NTime,
+			NBits:     j.NBits,
+		})
+	}
+}
+
+// Translate share of V2 miner into mining.submit of V1 session
+func (s *sv2Session) submit(m *sv2.SubmitSharesStandard, extraNonce []byte) {
+
+	ch := s.getChannel(m.ChannelID)
+
+	if ch == nil {
+		s.send(&sv2.SubmitSharesError{ChannelID: m.ChannelID, SequenceNumber: m.SequenceNumber, ErrorCode: "invalid-channel-id"})
+		return
+	}
+
+	ch.mutex.Lock()
+
+	shareError := ""
+	j := ch.jobs[m.JobID]
+	extraNonce2 := strings.Repeat("00", ch.extraNonce2Size)
+
+	switch {
+	case !ch.isOpen:
+		shareError = "invalid-channel-id"
+	case j == nil:
+		shareError = "invalid-job-id"
+	case ch.extended != (extraNonce != nil):
+		shareError = "invalid-share"
+	case ch.extended && len(extraNonce) != ch.extraNonce2Size:
+		shareError = "invalid-extranonce-size"
+	case (m.Version^j.job.Version)&^ch.versionMask != 0:
+		shareError = "invalid-version"
+	}
+
+	if shareError != "" {
+		ch.mutex.Unlock()
+		venuslog.Warn("Proxy rejected share of V2 channel", m.ChannelID, shareError)
+		s.send(&sv2.SubmitSharesError{ChannelID: m.ChannelID, SequenceNumber: m.SequenceNumber, ErrorCode: shareError})
+		return
+	}
+
+	if ch.extended {
+		extraNonce2 = hex.EncodeToString(extraNonce)
+	}
+
+	params := []string{
+		ch.user,
+		j.v1Id,
+		extraNonce2,
+		fmt.Sprintf("%08x", m.NTime),
+		fmt.Sprintf("%08x", m.Nonce),
+	}
+	if ch.versionMask != 0 {
+		params = append(params, fmt.Sprintf("%08x", m.Version&ch.versionMask))
+	}
+
+	id := ch.nextSubmitId
+	ch.nextSubmitId++
+	ch.submits[id] = sv2Submit{sequenceNumber: m.SequenceNumber, difficulty: ch.difficulty}
+
+	ch.mutex.Unlock()
+
+	ch.request(id, "mining.submit", params)
+}
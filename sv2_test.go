@@ -0,0 +1,209 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/auth"
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/sv2"
+	"btcminerproxy/stratum/template"
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// V2 miner connected to proxy over pipe, after setup of connection.
+// Connection is closed after test and proxy is done with it.
+func connectSv2(t *testing.T) *sv2.Conn {
+
+	if sv2Authority == nil {
+		initSv2()
+	}
+
+	miner, proxy := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		handleSv2Connection(proxy, "127.0.0.1:3336")
+		close(done)
+	}()
+
+	conn, err := sv2.Connect(miner, sv2Authority.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+
+	err = conn.WriteMessage(&sv2.SetupConnection{Protocol: sv2.PROTOCOL_MINING, MinVersion: SV2_VERSION, MaxVersion: SV2_VERSION})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := readSv2(t, conn); msg.MsgType() != sv2.MSG_SETUP_CONNECTION_SUCCESS {
+		t.Fatalf("setup answered with %+v", msg)
+	}
+
+	return conn
+}
+
+func readSv2(t *testing.T, conn *sv2.Conn) sv2.Message {
+
+	conn.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// Answer V1 session of channel, authorization is checked as proxy does
+// and the other requests are answered as pool would
+func serveChannelSession(t *testing.T, conn *stratumserver.Connection) {
+
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		conn.Conn.Close()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		serveSession(conn)
+	}()
+}
+
+func serveSession(conn *stratumserver.Connection) {
+
+	reader := bufio.NewReader(conn.Conn)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		req := template.StratumMsg{}
+		json.Unmarshal(line, &req)
+
+		var result any = true
+
+		switch req.Method {
+		case "mining.configure":
+			result = map[string]any{"version-rolling": true, "version-rolling.mask": "1fffe000"}
+
+		case "mining.subscribe":
+			result = []any{[]any{}, "08000002", 4}
+
+		case "mining.authorize":
+			authorizemsg := template.AuthorizeMsg{}
+			json.Unmarshal(line, &authorizemsg)
+
+			conn.WorkerID = authorizemsg.Params[0]
+
+			if err := checkAuthorize(conn, conn.WorkerID, authorizemsg.Params[1]); err != nil {
+				refuseAuthorize(conn, authorizemsg.ID, conn.WorkerID, err)
+				continue
+			}
+		}
+
+		conn.Send(template.StratumMsgResponse{ID: req.ID, Result: result})
+	}
+}
+
+func TestSv2Authorize(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		identity string
+		isOpen   bool
+	}{
+		{"right password", true, "alice.rig1:secret", true},
+		{"wrong password", true, "alice.rig1:wrong", false},
+		{"no password", true, "alice.rig1", false},
+		{"unknown user", true, "bob.rig1:secret", false},
+		{"auth disabled", false, "bob.rig1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := config.Get()
+			t.Cleanup(func() { config.Set(cfg) })
+
+			next := &config.Config{}
+			next.Sv2.CertificateValidity = 3600
+			next.Auth.Enabled = test.enabled
+			next.Auth.Users = []auth.User{{Name: "alice", PasswordHash: string(hash)}}
+			config.Set(next)
+
+			conn := connectSv2(t)
+
+			err := conn.WriteMessage(&sv2.OpenStandardMiningChannel{RequestID: 7, UserIdentity: test.identity})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session := <-srv.NewConnections
+			serveChannelSession(t, session)
+
+			switch msg := readSv2(t, conn).(type) {
+			case *sv2.OpenStandardMiningChannelSuccess:
+				if !test.isOpen {
+					t.Fatalf("channel of %s opened", test.identity)
+				}
+				if msg.RequestID != 7 {
+					t.Fatalf("channel opened for request %d", msg.RequestID)
+				}
+
+			case *sv2.OpenMiningChannelError:
+				if test.isOpen {
+					t.Fatalf("channel of %s failed with %s", test.identity, msg.ErrorCode)
+				}
+				if msg.ErrorCode != "unknown-user" {
+					t.Fatalf("channel failed with %s, expected unknown-user", msg.ErrorCode)
+				}
+
+			default:
+				t.Fatalf("channel answered with %+v", msg)
+			}
+
+			// Password stays in V2 session, proxy knows the miner by its worker
+			if worker, _, _ := strings.Cut(test.identity, ":"); session.WorkerID != worker {
+				t.Fatalf("worker of session is %q, expected %q", session.WorkerID, worker)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/mutex"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Switching moves miner to another pool while it keeps mining. Upstream of the new
+// pool is subscribed and authorized in background, then miner gets its extranonce,
+// difficulty and a clean job from it. The old upstream is closed once pool answered
+// its in-flight submits. Miners which didn't subscribe to extranonce changes are
+// asked to reconnect instead.
+
+// Miners being switched, keyed by connection id
+var switchingMiners = make(map[uint64]bool)
+var switchingMut mutex.Mutex
+
+// Move miner to pool in background, miner reconnects when it can't be switched
+func moveMiner(conn *stratumserver.Connection, poolIndex uint64) {
+	go func() {
+		err := switchMiner(conn, poolIndex)
+
+		if err != nil {
+			venuslog.Warn("Failed to switch miner", conn.Conn.RemoteAddr(), "to", config.Get().Pool(poolIndex).Url, err)
+			reconnectMiner(conn)
+		}
+	}()
+}
+
+// Move every miner from IP to pool, except miners routed by rules
+func moveMinersFromIp(minerIp string, poolIndex uint64) {
+
+	srv.ConnsMut.Lock()
+	conns := make([]*stratumserver.Connection, 0)
+	for _, conn := range srv.Connections {
+		ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+		if ip == minerIp && conn.Route == "" {
+			conns = append(conns, conn)
+		}
+	}
+	srv.ConnsMut.Unlock()
+
+	for _, conn := range conns {
+		moveMiner(conn, poolIndex)
+	}
+}
+
+// Ask miner to connect again, it gets the pool assigned to it
+func reconnectMiner(conn *stratumserver.Connection) {
+	conn.Send(template.StratumNotification{
+		Method: "client.reconnect",
+		Params: []any{},
+	})
+	conn.Close()
+}
+
+// Move miner to upstream of pool without closing its connection
+func switchMiner(conn *stratumserver.Connection, poolIndex uint64) error {
+
+	switchingMut.Lock()
+	if switchingMiners[conn.Id] {
+		switchingMut.Unlock()
+		return errors.New("miner is switching already")
+	}
+	switchingMiners[conn.Id] = true
+	switchingMut.Unlock()
+
+	defer func() {
+		switchingMut.Lock()
+		delete(switchingMiners, conn.Id)
+		switchingMut.Unlock()
+	}()
+
+	old := getUpstream(conn.Upstream)
+
+	// Miner gets the pool when it subscribes
+	if old == nil {
+		return nil
+	}
+
+	old.mutex.Lock()
+	isSamePool := old.Primary == poolIndex
+	old.mutex.Unlock()
+
+	if isSamePool {
+		return nil
+	}
+
+	// User of miner keeps it on its pools
+	if !allowedPool(conn, poolIndex) {
+		venuslog.Info("Miner", conn.WorkerID, "is not allowed on", config.Get().Pool(poolIndex).Url)
+		return nil
+	}
+
+	if !conn.Authorized || !conn.ExtranonceSubscribed {
+		reconnectMiner(conn)
+		return nil
+	}
+
+	var us *Upstream
+	var err error
+
+	if old.Aggregated {
+		us, err = readySharedUpstream(poolIndex)
+	} else {
+		us, err = newDedicatedUpstream(old, conn, poolIndex)
+	}
+
+	if err == nil {
+		err = us.waitJob()
+	}
+
+	if err != nil {
+		if us != nil && !us.Aggregated {
+			CloseUpstream(us.ID)
+		}
+		return err
+	}
+
+	// Miner gets no more work from the old pool, its submits are still answered
+	isEmpty := old.remove(conn)
+
+	us.mutex.Lock()
+	isAttached := true
+	if us.Aggregated {
+		isAttached = us.attachLocked(conn)
+	} else {
+		us.servers[conn.Id] = conn
+		conn.ExtraNonce1 = us.ExtraNonce1
+		conn.ExtraNonce2Size = us.ExtraNonce2Size
+		conn.Upstream = us.ID
+		conn.PoolId = us.PoolId
+	}
+	var msgs [][]byte
+	if isAttached {
+		msgs = us.handOver(conn)
+	}
+	us.mutex.Unlock()
+
+	if isEmpty {
+		go old.drain()
+	}
+
+	if !isAttached {
+		return errors.New("shared upstream is full")
+	}
+
+	for _, msg := range msgs {
+		if err = conn.SendBytes(msg); err != nil {
+			break
+		}
+	}
+
+	if us.Aggregated {
+		us.authorizeWorker(conn)
+	}
+
+	if err != nil {
+		UpstreamsMut.Lock()
+		us.detach(conn)
+		UpstreamsMut.Unlock()
+		return err
+	}
+
+	venuslog.Info("Miner", conn.Conn.RemoteAddr(), "switched to", config.Get().Pool(us.PoolId).Url, "upstream", us.ID)
+	makeReport()
+
+	return nil
+}
+
+// Open upstream for miner of dedicated upstream, proxy subscribes and authorizes for it
+func newDedicatedUpstream(old *Upstream, conn *stratumserver.Connection, poolIndex uint64) (*Upstream, error) {
+
+	old.mutex.Lock()
+	params := old.subscribeParams
+	old.mutex.Unlock()
+
+	if params == nil {
+		return nil, errors.New("miner didn't subscribe")
+	}
+
+	us, err := newUpstream(poolIndex, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	us.mutex.Lock()
+	us.subscribeParams = params
+	pool := config.Get().Pool(us.PoolId)
+	user := poolWorker(us.PoolId, conn)
+	us.mutex.Unlock()
+
+	err = us.sendRequest("mining.subscribe", params)
+
+	if err == nil {
+		err = us.sendRequest("mining.extranonce.subscribe", []any{})
+	}
+
+	if err == nil {
+		err = us.sendRequest("mining.authorize", []string{user, pool.Pass})
+	}
+
+	if err != nil {
+		CloseUpstream(us.ID)
+		return nil, err
+	}
+
+	return us, nil
+}
+
+// Wait until upstream is configured, authorized and pool sent the first job
+func (us *Upstream) waitJob() error {
+
+	timeout := time.After(config.UPSTREAM_READY_TIMEOUT_SECONDS * time.Second)
+
+	select {
+	case <-us.configured:
+	case <-time.After(config.CONFIGURE_TIMEOUT_SECONDS * time.Second):
+	}
+
+	select {
+	case <-us.ready:
+	case <-timeout:
+		return errors.New("timeout while waiting upstream")
+	}
+
+	if us.readyErr != nil {
+		return us.readyErr
+	}
+
+	for {
+		us.mutex.Lock()
+		hasJob := us.lastNotify != nil
+		us.mutex.Unlock()
+
+		if hasJob {
+			return nil
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			return errors.New("timeout while waiting job of upstream")
+		}
+	}
+}
+
+// Msgs which give miner extranonce, version mask, difficulty and clean job of upstream,
+// they are sent after upstream is unlocked. upstream must be locked
+func (us *Upstream) handOver(conn *stratumserver.Connection) [][]byte {
+
+	msgs := [][]byte{marshalMsg(template.StratumNotification{
+		Method: "mining.set_extranonce",
+		Params: []any{conn.ExtraNonce1, conn.ExtraNonce2Size},
+	})}
+
+	if mask := conn.RequestedVersionMask & us.VersionMask; conn.RequestedVersionMask != 0 && mask != conn.VersionMask {
+		conn.VersionMask = mask
+
+		msgs = append(msgs, marshalMsg(template.StratumNotification{
+			Method: "mining.set_version_mask",
+			Params: []any{fmt.Sprintf("%08x", mask)},
+		}))
+	}
+
+	difficulty := us.Difficulty
+	if config.Get().Vardiff.Enabled {
+		difficulty = us.minerDifficulty(conn)
+	}
+
+	conn.Difficulty = difficulty
+
+	msgs = append(msgs, marshalMsg(template.StratumNotification{
+		Method: "mining.set_difficulty",
+		Params: []any{difficulty},
+	}))
+
+	notify, err := template.CleanJobs(us.lastNotify)
+
+	if err != nil {
+		notify = us.lastNotify
+	}
+
+	return append(msgs, notify)
+}
+
+// Msg as it is written to socket
+func marshalMsg(msg any) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Close upstream which lost its miners once pool answered its submits
+func (us *Upstream) drain() {
+
+	deadline := time.Now().Add(config.DRAIN_TIMEOUT_SECONDS * time.Second)
+
+	for time.Now().Before(deadline) && us.hasPendingSubmits() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	// Closed already, or another miner joined it meanwhile
+	if Upstreams[us.ID] != us {
+		return
+	}
+
+	us.mutex.Lock()
+	isEmpty := len(us.servers) == 0
+	us.mutex.Unlock()
+
+	if isEmpty {
+		us.Close()
+	}
+}
+
+// Submits of upstream which pool didn't answer yet
+func (us *Upstream) hasPendingSubmits() bool {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	for _, req := range us.pending {
+		if req.method == "mining.submit" {
+			return true
+		}
+	}
+
+	return false
+}
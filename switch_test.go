@@ -0,0 +1,215 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stats"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stratum pool which accepts everything, it sends difficulty and job once miner is authorized
+func stubPool(t *testing.T) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	answer := func(c net.Conn, msg any) {
+		c.Write(append(marshalMsg(msg), '\n'))
+	}
+
+	serve := func(c net.Conn) {
+		defer c.Close()
+
+		reader := bufio.NewReader(c)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			req := template.StratumMsg{}
+			json.Unmarshal([]byte(line), &req)
+
+			switch req.Method {
+			case "mining.configure":
+				answer(c, template.StratumMsgResponse{ID: req.ID, Result: map[string]any{"version-rolling": true, "version-rolling.mask": "1fffe000"}})
+			case "mining.subscribe":
+				answer(c, template.StratumMsgResponse{ID: req.ID, Result: []any{[]any{[]any{"mining.notify", "1"}}, "11223344", 4}})
+			case "mining.authorize":
+				answer(c, template.StratumMsgResponse{ID: req.ID, Result: true})
+				answer(c, template.StratumNotification{Method: "mining.set_difficulty", Params: []any{512}})
+				answer(c, template.StratumNotification{Method: "mining.notify", Params: testNotify})
+			default:
+				answer(c, template.StratumMsgResponse{ID: req.ID, Result: true})
+			}
+		}
+	}
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// Miner of shareUpstream on pool-a, registered so it can be switched to the stub pool
+func switchingMiner(t *testing.T) (*Upstream, *stratumserver.Connection, chan string) {
+
+	useTestRedis(t)
+	us, conn, _, miner := shareUpstream(t, false)
+
+	poolUrl := stubPool(t)
+	config.Update(func(cfg *config.Config) {
+		cfg.Pools = append(cfg.Pools, config.PoolInfo{Url: poolUrl, User: "pooluser"})
+	})
+
+	us.ID = 1000
+	us.ready = make(chan struct{})
+	us.configured = make(chan struct{})
+	us.subscribeParams = []any{"miner/1.0"}
+	conn.Upstream = us.ID
+	conn.Authorized = true
+	conn.Hashrate = stats.NewMeter()
+
+	UpstreamsMut.Lock()
+	Upstreams[us.ID] = us
+	UpstreamsMut.Unlock()
+
+	t.Cleanup(func() {
+		UpstreamsMut.Lock()
+		upstreams := make([]*Upstream, 0, len(Upstreams))
+		for _, upstream := range Upstreams {
+			upstreams = append(upstreams, upstream)
+		}
+		UpstreamsMut.Unlock()
+
+		for _, upstream := range upstreams {
+			CloseUpstream(upstream.ID)
+		}
+	})
+
+	return us, conn, miner
+}
+
+// Miner subscribed to extranonce keeps its connection and gets the session of the new pool
+func TestSwitchMiner(t *testing.T) {
+
+	old, conn, miner := switchingMiner(t)
+	conn.ExtranonceSubscribed = true
+
+	done := make(chan error)
+	go func() {
+		done <- switchMiner(conn, 1)
+	}()
+
+	expected := []string{
+		`"mining.set_extranonce","params":["11223344",4]`,
+		`"mining.set_difficulty","params":[512]`,
+		`"mining.notify","params":["1f"`,
+	}
+
+	for _, msg := range expected {
+		select {
+		case line := <-miner:
+			if !strings.Contains(line, msg) {
+				t.Fatalf("miner got %s, expected %s", line, msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("miner didn't get %s", msg)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	us := getUpstream(conn.Upstream)
+	if us == nil || us == old || us.PoolId != 1 || conn.ExtraNonce1 != "11223344" || conn.Difficulty != 512 {
+		t.Fatalf("miner is on upstream %d with extranonce1 %s and difficulty %v", conn.Upstream, conn.ExtraNonce1, conn.Difficulty)
+	}
+
+	old.mutex.Lock()
+	_, isOld := old.servers[conn.Id]
+	old.mutex.Unlock()
+
+	if isOld {
+		t.Fatal("miner is still on old upstream")
+	}
+}
+
+// Miner which can't change extranonce connects again and gets the pool then
+func TestSwitchMinerReconnect(t *testing.T) {
+
+	old, conn, miner := switchingMiner(t)
+
+	if err := switchMiner(conn, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-miner:
+		if !strings.Contains(line, `"client.reconnect"`) {
+			t.Fatalf("miner got %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner wasn't asked to reconnect")
+	}
+
+	if conn.Upstream != old.ID {
+		t.Fatalf("miner moved to upstream %d", conn.Upstream)
+	}
+}
+
+// Miner which is on the pool already stays on its upstream
+func TestSwitchMinerSamePool(t *testing.T) {
+
+	old, conn, miner := switchingMiner(t)
+	conn.ExtranonceSubscribed = true
+
+	if err := switchMiner(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-miner:
+		t.Fatalf("miner got %s", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if conn.Upstream != old.ID {
+		t.Fatalf("miner moved to upstream %d", conn.Upstream)
+	}
+}
@@ -22,51 +22,129 @@ import (
 	"btcminerproxy/config"
 	"btcminerproxy/mutex"
 	stratumclient "btcminerproxy/stratum/client"
+	"btcminerproxy/stratum/job"
 	"btcminerproxy/stratum/rpc"
 	stratumserver "btcminerproxy/stratum/server"
 	"btcminerproxy/stratum/template"
 	"btcminerproxy/venuslog"
-	"io"
+	"encoding/json"
+	"errors"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 )
 
-type Job struct {
-	Difficulty uint64
-	Status     uint64
+// Request forwarded to pool and waiting for its response
+type pendingRequest struct {
+	// nil when the request was made by proxy itself
+	conn   *stratumserver.Connection
+	id     uint64
+	method string
+	sent   time.Time
+
+	// job of submitted share, difficulty of miner and pool when it was submitted
+	jobId          string
+	difficulty     float64
+	poolDifficulty float64
+
+	// worker name which proxy authorizes for miners of shared upstream
+	worker string
 }
 
 type Upstream struct {
 	ID     uint64
+	PoolId uint64
 	client *stratumclient.Client
-	server *stratumserver.Connection
+	mutex  mutex.Mutex
+
+	// pool chosen for miners, PoolId differs from it while failed over
+	Primary uint64
+
+	// params of mining.subscribe of miner, sent again after failover
+	subscribeParams []interface{}
+	timeouts        int
+	switching       bool
+	closed          bool
+	lastRetry       time.Time
+
+	// pool client which broke while upstream was switching pools
+	failedClient *stratumclient.Client
+
+	// miners served through this upstream, keyed by connection id
+	servers map[uint64]*stratumserver.Connection
+
+	// shared upstream, extranonce2 of pool is split between miners,
+	// requests of pool wait for the first miner which answers
+	Aggregated   bool
+	slots        map[uint64]uint64
+	poolRequests map[uint64]bool
+	ready        chan struct{}
+	isReady      bool
+	readyErr     error
+
+	// subscription from pool
+	ExtraNonce1     string
+	ExtraNonce2Size int
+
+	// version rolling mask negotiated with pool, zero when pool doesn't support it
+	VersionMask  uint32
+	configured   chan struct{}
+	isConfigured bool
+
+	// difficulty set by pool, and its jobs for checking shares,
+	// the latest job can't be checked when pool sent something proxy doesn't understand
+	Difficulty  float64
+	jobs        map[string]*job.Job
+	isUnchecked bool
+
+	// latest difficulty and job from pool, sent to miners joining a shared upstream
+	lastDifficulty []byte
+	lastNotify     []byte
+
+	// requests waiting response from pool, keyed by id sent to pool
+	nextRequestId uint64
+	pending       map[uint64]*pendingRequest
+
+	// worker names of miners authorized on pool of shared upstream, false until pool accepts them
+	workers map[string]bool
 
 	// added for report
+	// shares are counted as miners found them, submits as they were sent to pool
 	Shares struct {
 		Accepted uint64
 		Rejected uint64
+		Stale    uint64
 	}
 	Submits struct {
 		Accepted uint64
 		Rejected uint64
+		Stale    uint64
 	}
-
-	// checking jobs
-	Jobs map[uint64]*Job
 }
 
 var Upstreams = make(map[uint64]*Upstream, 100)
 var UpstreamsMut mutex.Mutex
 var LatestUpstream uint64
 
+// Pools of miners by IP, config.Get().Miners is changed by dashboard and balancing
+var minersMut mutex.Mutex
+
+func getUpstream(upstreamId uint64) *Upstream {
+	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
+
+	return Upstreams[upstreamId]
+}
+
 func findPoolUrl(minerIp string) (string, uint64) {
 
+	minersMut.Lock()
+	defer minersMut.Unlock()
+
 	var poolIndex uint64 = 0
 	poolUrl := ""
 
-	for _, miner := range config.CFG.Miners {
+	for _, miner := range config.Get().Miners {
 
 		if miner.IP != minerIp {
 			continue
@@ -78,22 +156,32 @@ func findPoolUrl(minerIp string) (string, uint64) {
 	}
 
 	if poolUrl == "" {
-		poolUrl = config.CFG.Pools[config.CFG.PoolIndex].Url
-		poolIndex = config.CFG.PoolIndex
+		poolIndex = config.Get().PoolIndex
+		if config.Get().Balance.Enabled {
+			poolIndex = balancedPool()
+		}
+		poolUrl = config.Get().Pool(poolIndex).Url
+
+		// Miner goes back to the chosen pool after its schedule ends
+		if scheduledUrl, ok := scheduledPool(minerIp, nil, time.Now()); ok {
+			scheduledMiners[minerIp] = poolUrl
+			poolUrl = scheduledUrl
+		}
 
 		newMiner := config.MinerInfo{}
 		newMiner.IP = minerIp
 		newMiner.PoolUrl = poolUrl
 
-		config.CFG.Miners = append(config.CFG.Miners, newMiner)
-
-	} else {
+		config.Update(func(cfg *config.Config) {
+			cfg.Miners = append(cfg.Miners, newMiner)
+		})
+		configChanged("assigned miner " + minerIp + " to " + poolUrl)
+	}
 
-		for idx, pool := range config.CFG.Pools {
-			if pool.Url == poolUrl {
-				poolIndex = uint64(idx)
-				break
-			}
+	for idx, pool := range config.Get().Pools {
+		if pool.Url == poolUrl {
+			poolIndex = uint64(idx)
+			break
 		}
 	}
 
@@ -101,56 +189,97 @@ func findPoolUrl(minerIp string) (string, uint64) {
 
 }
 
+// Connect to pool and register new upstream, miners are attached by caller
+func newUpstream(poolIndex uint64, aggregated bool) (*Upstream, error) {
+
+	UpstreamsMut.Lock()
+	LatestUpstream++
+	newId := LatestUpstream
+	UpstreamsMut.Unlock()
+
+	venuslog.Warn("Trying to Upstream ID", newId)
+
+	client, connectedPool, err := dialPool(poolIndex, newId)
+
+	if err != nil {
+		venuslog.Warn("Error while sending connecting to pool")
+		return nil, err
+	}
+
+	us := &Upstream{
+		ID:           newId,
+		PoolId:       connectedPool,
+		Primary:      poolIndex,
+		client:       client,
+		servers:      make(map[uint64]*stratumserver.Connection, 1),
+		Aggregated:   aggregated,
+		slots:        make(map[uint64]uint64),
+		poolRequests: make(map[uint64]bool),
+		ready:        make(chan struct{}),
+		configured:   make(chan struct{}),
+		pending:      make(map[uint64]*pendingRequest, 10),
+		workers:      make(map[string]bool),
+		Difficulty:   config.DEFAULT_DIFFICULTY,
+		jobs:         make(map[string]*job.Job, config.MAX_JOBS),
+	}
+
+	UpstreamsMut.Lock()
+	Upstreams[newId] = us
+	UpstreamsMut.Unlock()
+
+	go handleDownstream(us, client)
+
+	err = us.configure()
+
+	if err != nil {
+		venuslog.Warn("Error while sending configure to pool", err)
+		us.setConfigured()
+	}
+
+	venuslog.Warn("New upstream id ", newId, config.Get().Pool(connectedPool).Url)
+
+	return us, nil
+}
+
 // Create new upstream for incomming connection from miner
 func CreateNewUpstream(conn *stratumserver.Connection) error {
 
 	venuslog.Warn("Trying to create new upstream")
 
-	newId := LatestUpstream + 1
-	client := &stratumclient.Client{}
-
-	venuslog.Warn("Trying to Upstream ID", newId)
-
-	minerIp := strings.Split(conn.Conn.RemoteAddr().String(), ":")[0]
+	minerIp, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
 
 	venuslog.Warn("Trying to Upstream ID", minerIp)
 
-	poolUrl, poolIndex := findPoolUrl(minerIp)
+	poolIndex := minerPool(conn)
 
-	conn.PoolId = poolIndex
-
-	err := client.Connect(poolUrl, newId)
+	us, err := newUpstream(poolIndex, false)
 
 	if err != nil {
-		venuslog.Warn("Error while sending connecting to pool")
 		conn.Close()
 		return err
 	}
 
-	UpstreamsMut.Lock()
+	conn.PoolId = us.PoolId
 
-	Upstreams[newId] = &Upstream{
-		ID:     newId,
-		client: client,
-		server: conn,
-	}
-	Upstreams[newId].Jobs = make(map[uint64]*Job, 100)
-	conn.Upstream = newId
+	us.mutex.Lock()
+	us.servers[conn.Id] = conn
+	us.mutex.Unlock()
 
-	UpstreamsMut.Unlock()
+	conn.Upstream = us.ID
 
 	makeReport()
 
-	go handleDownstream(newId)
-
-	venuslog.Warn("New upstream id ", newId, config.CFG.Pools[conn.PoolId].Url)
-
 	return nil
 }
 
 // Sending mining.subscribe msg of stratum to mining pool
 func SendSubscribe(conn *stratumserver.Connection, data []byte) {
 
+	if config.Get().Aggregate.Enabled {
+		SubscribeAggregated(conn, data)
+		return
+	}
+
 	if conn.Upstream == 0 {
 		err := CreateNewUpstream(conn)
 
@@ -162,91 +291,212 @@ func SendSubscribe(conn *stratumserver.Connection, data []byte) {
 
 	venuslog.Warn("Trying to send")
 
-	err := Upstreams[conn.Upstream].client.SendData(data)
+	err := getUpstream(conn.Upstream).forward(conn, data)
 
 	if err != nil {
 		venuslog.Warn("Error while sending subscribe to pool")
 	}
 }
 
-// Sending mining.configure msg of stratum to mining pool
-func SendConfigure(conn *stratumserver.Connection, data []byte) {
+// Sending data of stratum to mining pool
+func SendData(conn *stratumserver.Connection, data []byte) {
 
-	if conn.Upstream == 0 {
-		err := CreateNewUpstream(conn)
+	us := getUpstream(conn.Upstream)
 
-		if err != nil {
-			venuslog.Warn("Error while sending configure to pool")
+	if us == nil {
+		venuslog.Warn("Connection broken")
+		Kick(conn.Id)
+		return
+	}
+
+	err := us.forward(conn, data)
+
+	if err != nil {
+		// Reading side of upstream moves it to another pool
+		if config.Get().Failover.Enabled {
+			venuslog.Warn("Failed to forward data to pool:", err)
 			return
 		}
+
+		venuslog.Warn("Connection broken")
+		Kick(conn.Id)
 	}
+}
+
+// Forward msg of miner to pool, id of requests is replaced so that
+// response can be routed back to the miner
+func (us *Upstream) forward(conn *stratumserver.Connection, data []byte) error {
 
-	err := Upstreams[conn.Upstream].client.SendData(data)
+	req := template.StratumMsg{}
+	errJson := rpc.ReadJSON(&req, data)
 
+	if errJson != nil {
+		return errJson
+	}
+
+	// Response of miner to request of pool
+	if req.Method == "" {
+		if us.Aggregated {
+			return forwardAggregatedResponse(us, req, data)
+		}
+		return us.poolClient().SendData(data)
+	}
+
+	if req.Method == "mining.submit" {
+		return us.submit(conn, req, data)
+	}
+
+	if us.Aggregated {
+		return forwardAggregated(us, conn, req, data)
+	}
+
+	switch req.Method {
+	case "mining.subscribe":
+		subscribemsg := template.NotifyMsg{}
+		if rpc.ReadJSON(&subscribemsg, data) == nil {
+			us.subscribeParams = subscribemsg.Params
+		}
+
+	case "mining.extranonce.subscribe":
+		conn.ExtranonceSubscribed = true
+	}
+
+	poolReqId := us.addPending(&pendingRequest{
+		conn:   conn,
+		id:     req.ID,
+		method: req.Method,
+	})
+
+	newmsg, err := template.ReplaceID(data, poolReqId)
 	if err != nil {
-		venuslog.Warn("Error while sending configure to pool")
+		return err
 	}
+
+	return us.poolClient().SendData(newmsg)
 }
 
-// Sending data of stratum to mining pool
-func SendData(conn *stratumserver.Connection, data []byte) {
+// Client connected to the pool currently used by upstream
+func (us *Upstream) poolClient() *stratumclient.Client {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
 
-	if conn.Upstream == 0 {
-		venuslog.Warn("Connection broken")
-		Kick(conn.Id)
+	return us.client
+}
+
+// Register request waiting response from pool, returns id to be sent to pool
+func (us *Upstream) addPending(req *pendingRequest) uint64 {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	req.sent = time.Now()
+
+	us.nextRequestId++
+	us.pending[us.nextRequestId] = req
+
+	return us.nextRequestId
+}
+
+// Send request of proxy itself to pool
+func (us *Upstream) sendRequest(method string, params any) error {
+	return us.sendPending(&pendingRequest{method: method}, params)
+}
+
+// Send request of proxy itself to pool, its response is handled by req
+func (us *Upstream) sendPending(req *pendingRequest, params any) error {
+
+	poolReqId := us.addPending(req)
+
+	data, err := json.Marshal(template.StratumRequest{
+		ID:     poolReqId,
+		Method: req.method,
+		Params: params,
+	})
+	if err != nil {
+		return err
+	}
+
+	return us.poolClient().SendData(data)
+}
+
+// Mark upstream as ready to serve miners, or failed
+func (us *Upstream) setReady(err error) {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	if us.isReady {
 		return
 	}
 
-	err := Upstreams[conn.Upstream].client.SendData(data)
+	us.isReady = true
+	us.readyErr = err
+	close(us.ready)
+}
 
-	if err != nil {
-		venuslog.Warn("Connection broken")
-		Kick(conn.Id)
+// Send data to every miner served by upstream, miners of shared upstream
+// get work only after they are authorized. Miners held after failover get nothing,
+// miners which kept their extranonce1 get jobs with extranonce1 of pool in coinb1.
+func (us *Upstream) broadcast(data []byte) {
+
+	for _, conn := range us.miners() {
+
+		us.mutex.Lock()
+		isHeld := !conn.HeldSince.IsZero()
+		jobExtraNonce1 := conn.JobExtraNonce1
+		us.mutex.Unlock()
+
+		if (us.Aggregated && !conn.Authorized) || isHeld {
+			continue
+		}
+
+		msg := data
+		if jobExtraNonce1 != "" {
+			msg = withJobExtraNonce1(data, jobExtraNonce1)
+		}
+
+		err := conn.SendBytes(msg)
+
+		if err != nil {
+			venuslog.Warn("err on write ", err)
+		}
 	}
 }
 
 func CloseUpstream(upstreamId uint64) {
 
 	UpstreamsMut.Lock()
+	defer UpstreamsMut.Unlock()
 
 	if Upstreams[upstreamId] == nil {
 		return
 	}
 
 	Upstreams[upstreamId].Close()
-	UpstreamsMut.Unlock()
 }
 
 // Handling downstreaming data from mining pool to miner
-func handleDownstream(upstreamId uint64) {
-
-	cl := Upstreams[upstreamId].client
-
-	if cl == nil {
-		venuslog.Warn("Read failed in proxy from pool socket, it was removed already")
-		CloseUpstream(upstreamId)
-		return
-	}
+func handleDownstream(us *Upstream, cl *stratumclient.Client) {
 
 	totalBuf := make([]byte, config.MAX_REQUEST_SIZE)
 	bufLen := 0
-	errDeadline := cl.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
-
-	if errDeadline != nil {
-		venuslog.Warn("Read failed in proxy from pool socket:", errDeadline)
-		CloseUpstream(upstreamId)
-		return
-	}
 
 	for {
+		errDeadline := cl.Conn.SetReadDeadline(time.Now().Add(config.READ_TIMEOUT_SECONDS * time.Second))
+
+		if errDeadline != nil {
+			venuslog.Warn("Read failed in proxy from pool socket:", errDeadline)
+			us.lostPool(cl, errDeadline)
+			return
+		}
+
 		msg, msgLen, readLen, err := template.ReadLineFromSocket(cl.Conn, totalBuf, bufLen)
 
 		if err != nil || msgLen == 0 {
-			if err == io.EOF || msgLen == 0 {
+			if err == nil {
 				continue
 			}
 			venuslog.Warn("Read failed in proxy from pool socket:", err)
-			CloseUpstream(upstreamId)
+			us.lostPool(cl, err)
 			return
 		}
 
@@ -263,69 +513,506 @@ func handleDownstream(upstreamId uint64) {
 
 		if errJson != nil {
 			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
-			CloseUpstream(upstreamId)
+			us.lostPool(cl, errJson)
 			return
 		}
 
-		msg = append(msg, '\n')
-		_, nerr := Upstreams[upstreamId].server.Conn.Write(msg)
+		if req.Method == "" {
+			us.handleResponse(req.ID, msg)
+		} else {
+			us.handleNotification(req, msg)
+		}
+
+		copy(totalBuf, totalBuf[msgLen+1:])
+		venuslog.Warn("Total Buf Len from upstream", len(totalBuf))
+
+	}
+}
+
+// Route response of pool back to the miner which made the request
+func (us *Upstream) handleResponse(poolReqId uint64, msg []byte) {
+
+	us.mutex.Lock()
+	req := us.pending[poolReqId]
+	delete(us.pending, poolReqId)
+	us.timeouts = 0
+	us.mutex.Unlock()
+
+	if req == nil {
+		venuslog.Warn("Received response for unknown request from pool:", poolReqId)
+		return
+	}
+
+	resp := template.StratumMsgResponse{}
+	errJson := rpc.ReadJSON(&resp, msg)
+
+	if errJson != nil {
+		venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+		return
+	}
+
+	// Request made by proxy itself
+	if req.conn == nil {
+		us.handleOwnResponse(req, resp)
+		return
+	}
+
+	switch req.method {
+	case "mining.subscribe":
+		extraNonce1, extraNonce2Size, err := template.ParseSubscribeResult(resp.Result)
+
+		if err == nil {
+			us.mutex.Lock()
+			us.ExtraNonce1 = extraNonce1
+			us.ExtraNonce2Size = extraNonce2Size
+			req.conn.JobExtraNonce1 = ""
+			req.conn.ExtraNoncePrefix = ""
+			req.conn.HeldSince = time.Time{}
+			us.mutex.Unlock()
+
+			req.conn.ExtraNonce1 = extraNonce1
+			req.conn.ExtraNonce2Size = extraNonce2Size
+		}
+
+	case "mining.authorize":
+		req.conn.Authorized, _ = resp.Result.(bool)
+
+	case "mining.submit":
+		us.countSubmit(req, resp)
+	}
+
+	newmsg, err := template.ReplaceID(msg, req.id)
+	if err != nil {
+		venuslog.Warn("Failed to replace id of response from pool:", err)
+		return
+	}
+
+	err = req.conn.SendBytes(newmsg)
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+	}
+
+	// Miner gets its own difficulty once it is subscribed
+	if req.method == "mining.subscribe" && config.Get().Vardiff.Enabled {
+		us.mutex.Lock()
+		difficulty := us.startVardiff(req.conn)
+		us.mutex.Unlock()
+
+		if difficulty > 0 {
+			sendDifficulty(req.conn, difficulty)
+		}
+	}
+
+	// Worker name is known now, rules may route miner to another pool
+	if req.method == "mining.authorize" {
+		rerouteMiner(req.conn)
+	}
+}
 
-		if nerr != nil {
-			venuslog.Warn("err on write ", nerr)
-			CloseUpstream(upstreamId)
+// Count share by the answer of pool to its submit
+func (us *Upstream) countSubmit(req *pendingRequest, resp template.StratumMsgResponse) {
+
+	conn := req.conn
+	isAccepted, _ := resp.Result.(bool)
+	latency := time.Since(req.sent)
+
+	if isAccepted && resp.Error == nil {
+		us.mutex.Lock()
+		us.Submits.Accepted++
+		us.Shares.Accepted++
+		conn.Submits.Accepted++
+		conn.Shares.Accepted++
+		countPoolSubmit(us.PoolId, "accepted", latency)
+		countPoolShare(us.PoolId, conn, "accepted", "")
+		poolUrl := config.Get().Pool(us.PoolId).Url
+		us.mutex.Unlock()
+
+		recordShare(poolUrl, conn, req.difficulty, req.poolDifficulty)
+		return
+	}
+
+	code, reason := template.ParseError(resp.Error)
+
+	if reason == "" {
+		reason = "Rejected"
+	}
+
+	venuslog.Warn("Pool rejected share of", conn.WorkerID, code, reason)
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	// Stratum error 21 is "Job not found", pools use it for stale shares
+	if code == 21 || strings.Contains(strings.ToLower(reason), "stale") {
+		us.Submits.Stale++
+		us.Shares.Stale++
+		conn.Submits.Stale++
+		conn.Shares.Stale++
+		countPoolSubmit(us.PoolId, "stale", latency)
+		countPoolShare(us.PoolId, conn, "stale", reason)
+	} else {
+		us.Submits.Rejected++
+		us.Shares.Rejected++
+		conn.Submits.Invalid++
+		conn.Shares.Invalid++
+		countPoolSubmit(us.PoolId, "rejected", latency)
+		countPoolShare(us.PoolId, conn, "rejected", reason)
+	}
+
+	recordReject(conn, code, reason)
+}
+
+// Handle response for request which proxy made by itself
+func (us *Upstream) handleOwnResponse(req *pendingRequest, resp template.StratumMsgResponse) {
+
+	switch req.method {
+	case "mining.subscribe":
+
+		extraNonce1, extraNonce2Size, err := template.ParseSubscribeResult(resp.Result)
+
+		if err == nil {
+			err = us.updateExtranonce(extraNonce1, extraNonce2Size)
+		}
+
+		if err != nil {
+			venuslog.Warn("Pool refused subscription:", resp.Error, err)
+			us.setReady(err)
+			CloseUpstream(us.ID)
 			return
 		}
 
-		switch req.Method {
-		case "mining.notify":
+	case "mining.configure":
 
-			venuslog.Warn("Stratum proxy received job from pool :")
+		us.handleConfigureResponse(resp)
 
-			notifymsg := template.NotifyMsg{}
-			errJson := rpc.ReadJSON(&notifymsg, msg)
+	case "mining.authorize":
 
-			if errJson != nil {
-				venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
-				return
-			}
+		if req.worker != "" {
+			us.workerAuthorized(req.worker, resp)
+			return
+		}
 
-			jobId, errUintJob := strconv.ParseUint(notifymsg.Params[0].(string), 16, 64)
+		if authorized, _ := resp.Result.(bool); !authorized {
+			venuslog.Warn("Pool refused authorization:", resp.Error)
+			us.setReady(errors.New("authorization refused by pool"))
+			CloseUpstream(us.ID)
+			return
+		}
+
+		us.setReady(nil)
+	}
+}
+
+// Handle msg which pool sent on its own and pass it to miners
+func (us *Upstream) handleNotification(req template.StratumMsg, msg []byte) {
+
+	switch req.Method {
+	case "mining.notify":
+
+		venuslog.Warn("Stratum proxy received job from pool :")
+
+		notifymsg := template.NotifyMsg{}
+		errJson := rpc.ReadJSON(&notifymsg, msg)
+
+		if errJson != nil {
+			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+			break
+		}
+
+		j, err := job.Parse(notifymsg.Params)
 
-			if errUintJob != nil {
-				venuslog.Warn("ReadJSON failed in proxy from pool:", notifymsg.Params[0].(string), errUintJob)
-				return
+		if err != nil {
+			venuslog.Warn("Pool sent job which proxy can't check:", err)
+
+			if len(notifymsg.Params) == 0 {
+				break
 			}
 
-			difficulty, errUintDiff := strconv.ParseUint(notifymsg.Params[6].(string), 16, 64)
+			// Shares of the job are left to pool
+			jobId, _ := notifymsg.Params[0].(string)
+			cleanJobs := len(notifymsg.Params) > 8 && notifymsg.Params[8] == true
+			j = job.Unchecked(jobId, cleanJobs)
+		}
 
-			venuslog.Warn("ReadJSON Job ID:", difficulty)
+		us.mutex.Lock()
+		us.lastNotify = append([]byte{}, msg...)
 
-			if errUintDiff != nil {
-				venuslog.Warn("ReadJSON failed in proxy from pool:", notifymsg.Params[6].(string), errUintDiff)
-				return
+		// Miners with vardiff are moved to difficulty of pool before job which can't be checked
+		changes := make([]difficultyChange, 0)
+		if us.isUnchecked != !j.IsChecked() {
+			us.isUnchecked = !j.IsChecked()
+			if config.Get().Vardiff.Enabled {
+				changes = us.updateVardiff()
 			}
+		}
 
-			Upstreams[upstreamId].Jobs[jobId] = &Job{}
+		j.Difficulty = us.Difficulty
+		for _, conn := range us.servers {
+			j.SetMinerDifficulty(conn.Id, conn.Difficulty)
+		}
+		us.addJob(j)
+		us.mutex.Unlock()
 
-			Upstreams[upstreamId].Jobs[jobId].Difficulty = difficulty
-			Upstreams[upstreamId].Jobs[jobId].Status = 1
+		sendDifficulties(changes)
 
-			Upstreams[upstreamId].Shares.Accepted++
-			Upstreams[upstreamId].server.Shares.Accepted++
+	case "mining.set_difficulty":
 
+		difficultymsg := template.NotifyMsg{}
+		errJson := rpc.ReadJSON(&difficultymsg, msg)
+
+		if errJson != nil || len(difficultymsg.Params) == 0 {
+			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+			break
 		}
 
-		copy(totalBuf, totalBuf[msgLen+1:])
-		venuslog.Warn("Total Buf Len from upstream", len(totalBuf))
+		difficulty, ok := difficultymsg.Params[0].(float64)
+
+		if !ok || difficulty <= 0 {
+			venuslog.Warn("Pool sent invalid difficulty:", difficultymsg.Params[0])
+			break
+		}
+
+		venuslog.Warn("Stratum proxy received difficulty from pool:", difficulty)
+
+		us.mutex.Lock()
+		us.Difficulty = difficulty
+		us.lastDifficulty = append([]byte{}, msg...)
+
+		// Miners have their own difficulty with vardiff
+		if config.Get().Vardiff.Enabled {
+			changes := us.updateVardiff()
+			us.mutex.Unlock()
+
+			sendDifficulties(changes)
+			return
+		}
+
+		for _, conn := range us.servers {
+			conn.Difficulty = difficulty
+		}
+		us.mutex.Unlock()
+
+	case "mining.set_version_mask":
+
+		// Miners get the mask negotiated by proxy
+		maskmsg := template.NotifyMsg{}
+		errJson := rpc.ReadJSON(&maskmsg, msg)
 
+		if errJson != nil || len(maskmsg.Params) == 0 {
+			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+			return
+		}
+
+		maskStr, _ := maskmsg.Params[0].(string)
+		mask, err := job.ParseUint32(maskStr)
+
+		if err != nil {
+			venuslog.Warn("Pool sent invalid version mask:", maskStr)
+			return
+		}
+
+		us.setVersionMask(mask)
+		return
+
+	case "mining.set_extranonce":
+
+		if us.Aggregated {
+			handleAggregatedNotification(us, req, msg)
+			return
+		}
+
+		// Miner gets the new extranonce as it is, proxy needs it for checking shares
+		extranoncemsg := template.NotifyMsg{}
+		errJson := rpc.ReadJSON(&extranoncemsg, msg)
+
+		if errJson != nil || len(extranoncemsg.Params) < 2 {
+			venuslog.Warn("ReadJSON failed in proxy from pool:", errJson)
+			break
+		}
+
+		extraNonce1, ok1 := extranoncemsg.Params[0].(string)
+		extraNonce2Size, ok2 := extranoncemsg.Params[1].(float64)
+
+		if !ok1 || !ok2 {
+			break
+		}
+
+		us.mutex.Lock()
+		us.ExtraNonce1 = extraNonce1
+		us.ExtraNonce2Size = int(extraNonce2Size)
+		for _, conn := range us.servers {
+			conn.ExtraNonce1 = extraNonce1
+			conn.ExtraNonce2Size = int(extraNonce2Size)
+		}
+		us.mutex.Unlock()
+
+	default:
+		if us.Aggregated {
+			handleAggregatedNotification(us, req, msg)
+			return
+		}
 	}
+
+	us.broadcast(msg)
+}
+
+// Set extranonce of pool and pass the new one to miners which are already mining.
+// Miners which can't change extranonce keep their session, see keepExtranonce.
+func (us *Upstream) updateExtranonce(extraNonce1 string, extraNonce2Size int) error {
+
+	prefixSize := 0
+	if us.Aggregated {
+		prefixSize = config.Get().Aggregate.ExtraNonceSize
+	}
+
+	if extraNonce2Size-prefixSize < config.MIN_EXTRANONCE2_SIZE && us.Aggregated {
+		return errors.New("extranonce2 of pool is too small to be shared")
+	}
+
+	us.mutex.Lock()
+	us.ExtraNonce1 = extraNonce1
+	us.ExtraNonce2Size = extraNonce2Size
+	us.mutex.Unlock()
+
+	for _, conn := range us.miners() {
+
+		// Miner didn't subscribe yet
+		if conn.ExtraNonce1 == "" {
+			continue
+		}
+
+		if !conn.ExtranonceSubscribed {
+			us.keepExtranonce(conn)
+			continue
+		}
+
+		newExtraNonce1 := extraNonce1 + conn.ExtraNoncePrefix
+		newExtraNonce2Size := extraNonce2Size - prefixSize
+
+		if conn.ExtraNonce1 == newExtraNonce1 && conn.ExtraNonce2Size == newExtraNonce2Size {
+			continue
+		}
+
+		conn.ExtraNonce1 = newExtraNonce1
+		conn.ExtraNonce2Size = newExtraNonce2Size
+
+		conn.Send(template.StratumNotification{
+			Method: "mining.set_extranonce",
+			Params: []any{conn.ExtraNonce1, conn.ExtraNonce2Size},
+		})
+	}
+
+	return nil
+}
+
+// Miner which can't change extranonce keeps its extranonce1 on the new pool session.
+// Miner of dedicated upstream mines on when extranonce2 of pool has room for it: its
+// jobs carry extranonce1 of pool and padding at the end of coinb1, its submits get
+// padding and its extranonce1 in front of extranonce2, so the coinbase is the one
+// pool expects. Other miners are held without work until pool gives their extranonce1
+// again, after failback. Miner which is held for EXTRANONCE_HOLD_SECONDS is asked to
+// reconnect as the last resort, see checkHeld.
+func (us *Upstream) keepExtranonce(conn *stratumserver.Connection) {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	extraNonce1 := us.ExtraNonce1
+	prefix := ""
+	padding := us.ExtraNonce2Size - len(conn.ExtraNonce1)/2 - conn.ExtraNonce2Size
+
+	switch {
+	case us.Aggregated && conn.ExtraNonce1 == us.ExtraNonce1+conn.ExtraNoncePrefix &&
+		conn.ExtraNonce2Size == us.ExtraNonce2Size-len(conn.ExtraNoncePrefix)/2:
+		extraNonce1 = ""
+		prefix = conn.ExtraNoncePrefix
+
+	case us.Aggregated:
+		us.holdMiner(conn)
+		return
+
+	case conn.ExtraNonce1 == us.ExtraNonce1 && conn.ExtraNonce2Size == us.ExtraNonce2Size:
+		extraNonce1 = ""
+
+	case padding >= 0:
+		extraNonce1 += strings.Repeat("00", padding)
+		prefix = strings.Repeat("00", padding) + conn.ExtraNonce1
+
+	default:
+		us.holdMiner(conn)
+		return
+	}
+
+	if !conn.HeldSince.IsZero() {
+		venuslog.Info("Miner", conn.WorkerID, "mines again with its extranonce1 on upstream", us.ID)
+	} else if extraNonce1 != "" {
+		venuslog.Info("Miner", conn.WorkerID, "keeps its extranonce1 on upstream", us.ID)
+	}
+
+	conn.JobExtraNonce1 = extraNonce1
+	conn.ExtraNoncePrefix = prefix
+	conn.HeldSince = time.Time{}
+}
+
+// Miner gets no work until pool gives its extranonce1 again, upstream must be locked
+func (us *Upstream) holdMiner(conn *stratumserver.Connection) {
+
+	if conn.HeldSince.IsZero() {
+		venuslog.Warn("Miner", conn.WorkerID, "can't change extranonce, it waits for pool with its extranonce1 on upstream", us.ID)
+		conn.HeldSince = time.Now()
+	}
+}
+
+// Ask miners which were held for too long to reconnect, they get a new extranonce then
+func (us *Upstream) checkHeld() {
+
+	held := make([]*stratumserver.Connection, 0)
+
+	us.mutex.Lock()
+	for _, conn := range us.servers {
+		if !conn.HeldSince.IsZero() && time.Since(conn.HeldSince) >= config.EXTRANONCE_HOLD_SECONDS*time.Second {
+			held = append(held, conn)
+		}
+	}
+	us.mutex.Unlock()
+
+	for _, conn := range held {
+		venuslog.Warn("Miner", conn.WorkerID, "waited too long for its extranonce1, asking it to reconnect")
+		reconnectMiner(conn)
+	}
+}
+
+// Job of pool with extranonce1 of pool at the end of coinb1, other msgs are kept
+func withJobExtraNonce1(data []byte, extraNonce1 string) []byte {
+
+	notifymsg := template.NotifyMsg{}
+	if rpc.ReadJSON(&notifymsg, data) != nil || notifymsg.Method != "mining.notify" || len(notifymsg.Params) < 3 {
+		return data
+	}
+
+	coinbase1, ok := notifymsg.Params[2].(string)
+	if !ok {
+		return data
+	}
+
+	notifymsg.Params[2] = coinbase1 + extraNonce1
+
+	return marshalMsg(notifymsg)
 }
 
 // upstream must be locked before closing
 func (us *Upstream) Close() {
 
-	us.client.Close()
-	us.server.Close()
+	us.poolClient().Close()
+
+	us.mutex.Lock()
+	us.closed = true
+	for _, conn := range us.servers {
+		conn.Close()
+	}
+	us.mutex.Unlock()
+
+	us.setReady(errors.New("upstream closed"))
 
 	Upstreams[us.ID] = nil
 
@@ -339,6 +1026,45 @@ func (us *Upstream) Close() {
 	delete(Upstreams, us.ID)
 }
 
+// Remove miner from upstream, returns true when nobody uses upstream any more
+func (us *Upstream) remove(conn *stratumserver.Connection) bool {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	delete(us.servers, conn.Id)
+	for slot, connId := range us.slots {
+		if connId == conn.Id {
+			delete(us.slots, slot)
+		}
+	}
+
+	return len(us.servers) == 0
+}
+
+// Remove miner from upstream, upstream is closed when nobody uses it
+// upstream must be locked before detaching
+func (us *Upstream) detach(conn *stratumserver.Connection) {
+
+	if us.remove(conn) {
+		us.Close()
+	}
+}
+
+// Miners served by upstream
+func (us *Upstream) miners() []*stratumserver.Connection {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	servers := make([]*stratumserver.Connection, 0, len(us.servers))
+	for _, conn := range us.servers {
+		servers = append(servers, conn)
+	}
+
+	return servers
+}
+
 // disconnect miner
 func disconnectMiner(remoteAddr string) (err error) {
 
@@ -347,17 +1073,19 @@ func disconnectMiner(remoteAddr string) (err error) {
 	UpstreamsMut.Lock()
 	for _, upstream := range Upstreams {
 
-		venuslog.Warn("Deleted miner", upstream.server.Conn.RemoteAddr().String())
-		host, _, _ := net.SplitHostPort(upstream.server.Conn.RemoteAddr().String())
+		for _, conn := range upstream.miners() {
 
-		if host != remoteAddr {
-			continue
-		}
+			host, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
 
-		upstream.Close()
+			if host != remoteAddr {
+				continue
+			}
 
-		venuslog.Warn("Deleted miner", remoteAddr)
+			conn.Close()
+			upstream.detach(conn)
 
+			venuslog.Warn("Deleted miner", remoteAddr)
+		}
 	}
 
 	UpstreamsMut.Unlock()
@@ -385,13 +1113,17 @@ func closeAllUpstreamFromMiner(minerIpStr string) {
 
 	for _, us := range Upstreams {
 
-		minerIpOfUpstream := strings.Split(us.server.Conn.RemoteAddr().String(), ":")[0]
+		for _, conn := range us.miners() {
 
-		if minerIpOfUpstream != minerIpStr {
-			continue
-		}
+			minerIpOfUpstream, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
 
-		us.Close()
+			if minerIpOfUpstream != minerIpStr {
+				continue
+			}
+
+			conn.Close()
+			us.detach(conn)
+		}
 	}
 
 	UpstreamsMut.Unlock()
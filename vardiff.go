@@ -0,0 +1,213 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"time"
+)
+
+// Vardiff gives every miner its own difficulty so that it finds a share about
+// every vardiff.target_time seconds. Difficulty of miner never goes above the
+// difficulty of pool, so the pool still gets every share it asks for. Jobs which
+// proxy can't check are mined at difficulty of pool.
+
+// Difficulty may change at most this many times on one retarget
+const VARDIFF_MAX_CHANGE = 4
+
+// Difficulty which is sent to miner after upstream is unlocked
+type difficultyChange struct {
+	conn       *stratumserver.Connection
+	difficulty float64
+}
+
+// Difficulty for miner, upstream must be locked
+func (us *Upstream) minerDifficulty(conn *stratumserver.Connection) float64 {
+
+	// Shares of job which proxy can't check go to pool, miners mine it at difficulty of pool
+	if us.isUnchecked {
+		return us.Difficulty
+	}
+
+	if conn.Vardiff.Target < us.Difficulty {
+		return conn.Vardiff.Target
+	}
+	return us.Difficulty
+}
+
+// Set new difficulty of miner, returns difficulty which is sent to miner after
+// upstream is unlocked, or zero when it didn't change.
+// upstream must be locked
+func (us *Upstream) setMinerDifficulty(conn *stratumserver.Connection, difficulty float64) float64 {
+
+	if difficulty == conn.Difficulty {
+		return 0
+	}
+
+	conn.Difficulty = difficulty
+
+	return difficulty
+}
+
+func sendDifficulty(conn *stratumserver.Connection, difficulty float64) {
+
+	err := conn.Send(template.StratumNotification{
+		Method: "mining.set_difficulty",
+		Params: []any{difficulty},
+	})
+
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+	}
+}
+
+// Start vardiff of miner which just subscribed, returns difficulty which is sent
+// to miner after upstream is unlocked, or zero when vardiff was started already.
+// upstream must be locked
+func (us *Upstream) startVardiff(conn *stratumserver.Connection) float64 {
+
+	if !conn.Vardiff.Since.IsZero() {
+		return 0
+	}
+
+	conn.Vardiff.Target = config.Get().Vardiff.StartDifficulty
+	conn.Vardiff.Since = time.Now()
+	conn.Vardiff.Shares = 0
+
+	difficulty := us.minerDifficulty(conn)
+	conn.Difficulty = difficulty
+
+	return difficulty
+}
+
+// Count share which met difficulty of miner, difficulty is retargeted when
+// the window passed or miner is sending far too many shares.
+// Returns difficulty which is sent to miner after upstream is unlocked, or zero.
+// upstream must be locked
+func (us *Upstream) vardiffShare(conn *stratumserver.Connection) float64 {
+
+	conn.Vardiff.Shares++
+
+	retargetTime := time.Duration(config.Get().Vardiff.RetargetTime) * time.Second
+	maxShares := VARDIFF_MAX_CHANGE * float64(config.Get().Vardiff.RetargetTime) / config.Get().Vardiff.TargetTime
+
+	if time.Since(conn.Vardiff.Since) >= retargetTime || float64(conn.Vardiff.Shares) >= maxShares {
+		return us.retarget(conn)
+	}
+
+	return 0
+}
+
+// Choose difficulty of miner from its share rate since the last retarget,
+// returns difficulty which is sent to miner after upstream is unlocked, or zero.
+// upstream must be locked
+func (us *Upstream) retarget(conn *stratumserver.Connection) float64 {
+
+	cfg := config.Get().Vardiff
+
+	shares := conn.Vardiff.Shares
+	elapsed := time.Since(conn.Vardiff.Since).Seconds()
+
+	conn.Vardiff.Shares = 0
+	conn.Vardiff.Since = time.Now()
+
+	// Miner without shares is treated as it would find one right now
+	if shares == 0 {
+		shares = 1
+	}
+
+	shareTime := elapsed / float64(shares)
+	variance := cfg.TargetTime * cfg.VariancePercent / 100
+
+	if shareTime >= cfg.TargetTime-variance && shareTime <= cfg.TargetTime+variance {
+		return 0
+	}
+
+	target := conn.Difficulty * cfg.TargetTime / shareTime
+
+	if target > conn.Difficulty*VARDIFF_MAX_CHANGE {
+		target = conn.Difficulty * VARDIFF_MAX_CHANGE
+	}
+	if target < conn.Difficulty/VARDIFF_MAX_CHANGE {
+		target = conn.Difficulty / VARDIFF_MAX_CHANGE
+	}
+	if target < cfg.MinDifficulty {
+		target = cfg.MinDifficulty
+	}
+	if target > cfg.MaxDifficulty {
+		target = cfg.MaxDifficulty
+	}
+
+	conn.Vardiff.Target = target
+
+	difficulty := us.setMinerDifficulty(conn, us.minerDifficulty(conn))
+
+	venuslog.Info("Vardiff of", conn.WorkerID, "retargeted to", conn.Difficulty)
+
+	return difficulty
+}
+
+// Retarget miners which didn't send shares for the whole window
+func (us *Upstream) checkVardiff() {
+
+	retargetTime := time.Duration(config.Get().Vardiff.RetargetTime) * time.Second
+
+	changes := make([]difficultyChange, 0)
+
+	us.mutex.Lock()
+	for _, conn := range us.servers {
+		if !conn.Vardiff.Since.IsZero() && time.Since(conn.Vardiff.Since) >= retargetTime {
+			if difficulty := us.retarget(conn); difficulty > 0 {
+				changes = append(changes, difficultyChange{conn, difficulty})
+			}
+		}
+	}
+	us.mutex.Unlock()
+
+	sendDifficulties(changes)
+}
+
+// Pool changed its difficulty, miners follow it up to their own target.
+// Returns difficulties which are sent to miners after upstream is unlocked.
+// upstream must be locked
+func (us *Upstream) updateVardiff() []difficultyChange {
+
+	changes := make([]difficultyChange, 0)
+
+	for _, conn := range us.servers {
+		if conn.Vardiff.Since.IsZero() {
+			continue
+		}
+
+		if difficulty := us.setMinerDifficulty(conn, us.minerDifficulty(conn)); difficulty > 0 {
+			changes = append(changes, difficultyChange{conn, difficulty})
+		}
+	}
+
+	return changes
+}
+
+func sendDifficulties(changes []difficultyChange) {
+	for _, change := range changes {
+		sendDifficulty(change.conn, change.difficulty)
+	}
+}
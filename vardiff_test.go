@@ -0,0 +1,217 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Upstream with vardiff on, its miner started vardiff at the given target
+func vardiffUpstream(t *testing.T, target float64, poolDifficulty float64) (*Upstream, *stratumserver.Connection, chan string, chan string) {
+
+	us, conn, pool, miner := shareUpstream(t, true)
+
+	config.Update(func(cfg *config.Config) {
+		cfg.Vardiff.StartDifficulty = target
+		cfg.Vardiff.MinDifficulty = 1
+		cfg.Vardiff.MaxDifficulty = 1 << 20
+		cfg.Vardiff.TargetTime = 10
+		cfg.Vardiff.RetargetTime = 60
+		cfg.Vardiff.VariancePercent = 30
+	})
+
+	us.Difficulty = poolDifficulty
+	us.startVardiff(conn)
+
+	return us, conn, pool, miner
+}
+
+// Upstream isn't locked while miner reads the message
+func readUnlocked(t *testing.T, us *Upstream, reader *bufio.Reader) string {
+
+	locked := make(chan bool)
+	go func() {
+		us.mutex.Lock()
+		us.mutex.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream is locked while message is written to miner")
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return line
+}
+
+// Miner end of pipe which nobody reads until test does
+func blockingMiner(t *testing.T, conn *stratumserver.Connection) *bufio.Reader {
+
+	miner, minerEnd := net.Pipe()
+	t.Cleanup(func() { miner.Close() })
+
+	conn.Conn = &sv2PipeConn{Conn: miner, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}}
+
+	return bufio.NewReader(minerEnd)
+}
+
+func TestCheckVardiff(t *testing.T) {
+
+	us, conn, _, _ := vardiffUpstream(t, 64, 1024)
+	reader := blockingMiner(t, conn)
+
+	// Miner didn't find a share for the whole window
+	us.mutex.Lock()
+	conn.Vardiff.Since = time.Now().Add(-2 * time.Minute)
+	us.mutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		us.checkVardiff()
+		close(done)
+	}()
+
+	line := readUnlocked(t, us, reader)
+	<-done
+
+	if !strings.Contains(line, `"mining.set_difficulty"`) || !strings.Contains(line, "[16]") {
+		t.Fatalf("miner got %s, expected difficulty lowered to 16", line)
+	}
+}
+
+func TestSetVersionMask(t *testing.T) {
+
+	us, conn, _, _ := shareUpstream(t, false)
+	reader := blockingMiner(t, conn)
+
+	conn.RequestedVersionMask = 0x1fffe000
+	conn.VersionMask = 0x1fffe000
+
+	done := make(chan bool)
+	go func() {
+		us.setVersionMask(0x00ffe000)
+		close(done)
+	}()
+
+	line := readUnlocked(t, us, reader)
+	<-done
+
+	if !strings.Contains(line, `"mining.set_version_mask"`) || !strings.Contains(line, `"00ffe000"`) {
+		t.Fatalf("miner got %s, expected version mask 00ffe000", line)
+	}
+}
+
+// Miner difficulty follows the pool while the pool sends jobs which proxy can't check
+func TestVardiffUncheckedJob(t *testing.T) {
+
+	us, conn, pool, miner := vardiffUpstream(t, 64, 1024)
+
+	notify := func(params []any) []string {
+
+		msg, _ := json.Marshal(template.StratumNotification{Method: "mining.notify", Params: params})
+		us.handleNotification(template.StratumMsg{Method: "mining.notify"}, msg)
+
+		// Difficulty and job
+		lines := make([]string, 0)
+		for len(lines) < 2 {
+			select {
+			case line := <-miner:
+				lines = append(lines, line)
+			case <-time.After(time.Second):
+				return lines
+			}
+		}
+		return lines
+	}
+
+	// Job with a malformed previous hash
+	unchecked := append([]any{"2a", "zz"}, testNotify[2:]...)
+
+	lines := notify(unchecked)
+	if len(lines) != 2 || !strings.Contains(lines[0], "[1024]") || !strings.Contains(lines[1], `"2a"`) {
+		t.Fatalf("miner got %q, expected difficulty of pool before the job", lines)
+	}
+
+	// Share at difficulty of pool goes to pool, which checks it
+	params := []string{"rig1", "2a", "00000000", "504e86b9", "00000000"}
+
+	if submit, code := submitShare(t, us, conn, pool, miner, params); code != 0 || submit == "" {
+		t.Fatalf("share of unchecked job answered with error %d", code)
+	}
+
+	// Job which proxy checks brings vardiff back
+	lines = notify(testNotify)
+	if len(lines) != 2 || !strings.Contains(lines[0], "[64]") || !strings.Contains(lines[1], `"1f"`) {
+		t.Fatalf("miner got %q, expected its own difficulty before the job", lines)
+	}
+}
+
+// Share of unchecked job which miner got at a lower difficulty is not sent to pool
+func TestSubmitUncheckedJob(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		vardiff bool
+		miner   float64
+		code    int
+	}{
+		{"difficulty of pool", true, 1024, 0},
+		{"lower difficulty", true, 64, 21},
+		{"validating only", false, 1024, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, pool, miner := shareUpstream(t, test.vardiff)
+
+			msg, _ := json.Marshal(template.StratumNotification{Method: "mining.notify", Params: append([]any{"2a", "zz"}, testNotify[2:]...)})
+
+			us.Difficulty = 1024
+			conn.Difficulty = test.miner
+			us.handleNotification(template.StratumMsg{Method: "mining.notify"}, msg)
+			<-miner
+
+			params := []string{"rig1", "2a", "00000000", "504e86b9", "00000000"}
+
+			submit, code := submitShare(t, us, conn, pool, miner, params)
+
+			if code != test.code {
+				t.Fatalf("share answered with error %d, expected %d", code, test.code)
+			}
+			if test.code == 0 && !strings.Contains(submit, `"pooluser"`) {
+				t.Fatalf("pool got %s", submit)
+			}
+		})
+	}
+}
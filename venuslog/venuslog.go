@@ -76,7 +76,7 @@ func disableColors() {
 }
 
 func StartLogger() {
-	if config.CFG.Colors {
+	if config.Get().Colors {
 		debug = COLOR_BG_MAGENTA + BOLD + debug + COLOR_RESET + FAINT + " "
 		info = COLOR_BG_BLUE + BOLD + info + COLOR_RESET + " "
 		warn = COLOR_BG_YELLOW + BOLD + warn + COLOR_RESET + " "
@@ -106,7 +106,7 @@ func getCaller() string {
 }
 
 func getPrefix() (out string) {
-	if config.CFG.Verbose {
+	if config.Get().Verbose {
 		out = getCaller()
 	}
 
@@ -114,7 +114,7 @@ func getPrefix() (out string) {
 }
 
 func Debug(a ...any) {
-	if !config.CFG.Verbose {
+	if !config.Get().Verbose {
 		return
 	}
 
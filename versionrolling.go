@@ -0,0 +1,225 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stratum/job"
+	"btcminerproxy/stratum/rpc"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"fmt"
+	"time"
+)
+
+// Version rolling (BIP310) is negotiated by proxy with the pool whenever upstream
+// connects, miners get the part of the pool's mask which they asked for.
+// Miners keep their mask over failover, and get mining.set_version_mask when it changes.
+
+// Sending mining.configure of proxy itself to pool
+func (us *Upstream) configure() error {
+	return us.sendRequest("mining.configure", []any{
+		[]string{"version-rolling"},
+		map[string]any{
+			"version-rolling.mask":          fmt.Sprintf("%08x", job.BIP320_VERSION_MASK),
+			"version-rolling.min-bit-count": 2,
+		},
+	})
+}
+
+// Mark upstream as configured, miners waiting for the mask are answered
+func (us *Upstream) setConfigured() {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	if us.isConfigured {
+		return
+	}
+
+	us.isConfigured = true
+	close(us.configured)
+}
+
+// Handle answer of pool to mining.configure of proxy
+func (us *Upstream) handleConfigureResponse(resp template.StratumMsgResponse) {
+
+	defer us.setConfigured()
+
+	var mask uint32
+
+	result, _ := resp.Result.(map[string]any)
+
+	if rolling, _ := result["version-rolling"].(bool); rolling {
+		maskStr, _ := result["version-rolling.mask"].(string)
+
+		var err error
+		mask, err = job.ParseUint32(maskStr)
+
+		if err != nil {
+			venuslog.Warn("Pool sent invalid version mask:", maskStr)
+			mask = 0
+		}
+	}
+
+	venuslog.Info("Version rolling mask of pool", config.Get().Pool(us.PoolId).Url, fmt.Sprintf("%08x", mask))
+
+	us.setVersionMask(mask)
+}
+
+// Set version mask of pool and pass it to miners which roll version,
+// masks are sent after upstream is unlocked
+func (us *Upstream) setVersionMask(mask uint32) {
+
+	changed := make(map[*stratumserver.Connection]uint32)
+
+	us.mutex.Lock()
+	us.VersionMask = mask
+
+	for _, conn := range us.servers {
+
+		newMask := conn.RequestedVersionMask & mask
+
+		if conn.RequestedVersionMask == 0 || conn.VersionMask == newMask {
+			continue
+		}
+
+		conn.VersionMask = newMask
+		changed[conn] = newMask
+	}
+	us.mutex.Unlock()
+
+	for conn, newMask := range changed {
+
+		err := conn.Send(template.StratumNotification{
+			Method: "mining.set_version_mask",
+			Params: []any{fmt.Sprintf("%08x", newMask)},
+		})
+
+		if err != nil {
+			venuslog.Warn("err on write ", err)
+		}
+	}
+}
+
+// Answering mining.configure of miner with the mask negotiated by proxy,
+// other extensions are not supported
+func SendConfigure(conn *stratumserver.Connection, data []byte) {
+
+	configuremsg := template.NotifyMsg{}
+	errJson := rpc.ReadJSON(&configuremsg, data)
+
+	if errJson != nil {
+		venuslog.Warn("ReadJSON failed in proxy from miner:", errJson)
+		return
+	}
+
+	if conn.Upstream == 0 {
+		var err error
+
+		if config.Get().Aggregate.Enabled {
+			err = attachAggregated(conn)
+		} else {
+			err = CreateNewUpstream(conn)
+		}
+
+		if err != nil {
+			venuslog.Warn("Error while sending configure to pool", err)
+			conn.Send(template.StratumMsgResponse{
+				ID:    configuremsg.ID,
+				Error: template.NewError(20, "Pool is not available"),
+			})
+			conn.Close()
+			return
+		}
+	}
+
+	us := getUpstream(conn.Upstream)
+
+	if us == nil {
+		venuslog.Warn("Connection broken")
+		Kick(conn.Id)
+		return
+	}
+
+	select {
+	case <-us.configured:
+	case <-time.After(config.CONFIGURE_TIMEOUT_SECONDS * time.Second):
+		venuslog.Warn("Pool didn't answer configure of upstream", us.ID)
+	}
+
+	result := make(map[string]any)
+
+	var extensions []any
+	var params map[string]any
+
+	if len(configuremsg.Params) > 0 {
+		extensions, _ = configuremsg.Params[0].([]any)
+	}
+	if len(configuremsg.Params) > 1 {
+		params, _ = configuremsg.Params[1].(map[string]any)
+	}
+
+	for _, extension := range extensions {
+
+		name, ok := extension.(string)
+
+		if !ok {
+			continue
+		}
+
+		if name != "version-rolling" {
+			result[name] = false
+			continue
+		}
+
+		// Miner which doesn't tell its mask can roll any bit
+		requested := uint32(0xffffffff)
+
+		if maskStr, ok := params["version-rolling.mask"].(string); ok {
+			mask, err := job.ParseUint32(fmt.Sprintf("%08s", maskStr))
+
+			if err == nil {
+				requested = mask
+			}
+		}
+
+		us.mutex.Lock()
+		mask := requested & us.VersionMask
+		if mask != 0 {
+			conn.RequestedVersionMask = requested
+			conn.VersionMask = mask
+		}
+		us.mutex.Unlock()
+
+		result["version-rolling"] = mask != 0
+		if mask != 0 {
+			result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+		}
+	}
+
+	err := conn.Send(template.StratumMsgResponse{
+		ID:     configuremsg.ID,
+		Result: result,
+	})
+
+	if err != nil {
+		venuslog.Warn("err on write ", err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	"btcminerproxy/stratum/template"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Upstream of shareUpstream registered, so that configure of miner finds it
+func configuredUpstream(t *testing.T, mask uint32) (*Upstream, chan string) {
+
+	us, conn, _, miner := shareUpstream(t, false)
+
+	us.ID = 1000
+	us.VersionMask = mask
+	us.configured = make(chan struct{})
+	us.setConfigured()
+	conn.Upstream = us.ID
+
+	UpstreamsMut.Lock()
+	Upstreams[us.ID] = us
+	UpstreamsMut.Unlock()
+
+	t.Cleanup(func() {
+		UpstreamsMut.Lock()
+		delete(Upstreams, us.ID)
+		UpstreamsMut.Unlock()
+	})
+
+	return us, miner
+}
+
+func TestHandleConfigureResponse(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		result any
+		mask   uint32
+	}{
+		{"version rolling", map[string]any{"version-rolling": true, "version-rolling.mask": "1fffe000"}, 0x1fffe000},
+		{"no version rolling", map[string]any{"version-rolling": false}, 0},
+		{"invalid mask", map[string]any{"version-rolling": true, "version-rolling.mask": "mask"}, 0},
+		{"configure not supported", nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, _, _, _ := shareUpstream(t, false)
+			us.configured = make(chan struct{})
+			us.VersionMask = 0xffffffff
+
+			us.handleConfigureResponse(template.StratumMsgResponse{Result: test.result})
+
+			select {
+			case <-us.configured:
+			default:
+				t.Fatal("miners waiting for mask weren't released")
+			}
+
+			if us.VersionMask != test.mask {
+				t.Fatalf("mask of pool is %08x, expected %08x", us.VersionMask, test.mask)
+			}
+		})
+	}
+}
+
+// Miners get the part of the mask of pool which they asked for
+func TestSendConfigure(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		poolMask   uint32
+		params     []any
+		result     map[string]any
+		minerMask  uint32
+		isRequired bool
+	}{
+		{"whole mask", 0x1fffe000, []any{[]any{"version-rolling"}, map[string]any{"version-rolling.mask": "1fffe000"}},
+			map[string]any{"version-rolling": true, "version-rolling.mask": "1fffe000"}, 0x1fffe000, true},
+		{"part of mask", 0x1fffe000, []any{[]any{"version-rolling"}, map[string]any{"version-rolling.mask": "00ffffff"}},
+			map[string]any{"version-rolling": true, "version-rolling.mask": "00ffe000"}, 0x00ffe000, true},
+		{"short mask", 0x1fffe000, []any{[]any{"version-rolling"}, map[string]any{"version-rolling.mask": "e000"}},
+			map[string]any{"version-rolling": true, "version-rolling.mask": "0000e000"}, 0x0000e000, true},
+		{"mask not given", 0x1fffe000, []any{[]any{"version-rolling"}},
+			map[string]any{"version-rolling": true, "version-rolling.mask": "1fffe000"}, 0x1fffe000, true},
+		{"pool without version rolling", 0, []any{[]any{"version-rolling"}, map[string]any{"version-rolling.mask": "1fffe000"}},
+			map[string]any{"version-rolling": false}, 0, true},
+		{"masks don't overlap", 0x1fffe000, []any{[]any{"version-rolling"}, map[string]any{"version-rolling.mask": "00001fff"}},
+			map[string]any{"version-rolling": false}, 0, true},
+		{"other extension", 0x1fffe000, []any{[]any{"minimum-difficulty"}, map[string]any{"minimum-difficulty.value": 2048}},
+			map[string]any{"minimum-difficulty": false}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, miner := configuredUpstream(t, test.poolMask)
+			conn := us.servers[1]
+
+			data, _ := json.Marshal(template.NotifyMsg{ID: 3, Method: "mining.configure", Params: test.params})
+			go SendConfigure(conn, data)
+
+			var line string
+			select {
+			case line = <-miner:
+			case <-time.After(5 * time.Second):
+				t.Fatal("miner didn't get answer to configure")
+			}
+
+			resp := template.StratumMsgResponse{}
+			json.Unmarshal([]byte(line), &resp)
+
+			result, _ := resp.Result.(map[string]any)
+			if resp.ID != 3 || len(result) != len(test.result) {
+				t.Fatalf("miner got %s", line)
+			}
+			for key, value := range test.result {
+				if result[key] != value {
+					t.Fatalf("miner got %s, expected %s %v", line, key, value)
+				}
+			}
+
+			us.mutex.Lock()
+			defer us.mutex.Unlock()
+
+			if conn.VersionMask != test.minerMask {
+				t.Fatalf("miner may roll %08x, expected %08x", conn.VersionMask, test.minerMask)
+			}
+		})
+	}
+}
+
+// Shares with version bits outside of mask of miner are refused by proxy
+func TestSubmitVersionBits(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		versionBits string
+		code        int
+	}{
+		{"bits in mask", "00002000", 0},
+		{"no bits", "00000000", 0},
+		{"bits outside mask", "40000000", 20},
+		{"malformed bits", "bits", 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, pool, miner := shareUpstream(t, false)
+			config.Update(func(cfg *config.Config) {
+				cfg.ValidateShares = false
+			})
+			conn.VersionMask = 0x1fffe000
+
+			_, code := submitShare(t, us, conn, pool, miner, []string{"rig1", "1f", "01020304", "504e86b9", "00000000", test.versionBits})
+			if code != test.code {
+				t.Fatalf("share got error %d, expected %d", code, test.code)
+			}
+		})
+	}
+}
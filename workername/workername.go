@@ -0,0 +1,99 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// package workername builds the worker name which miner gets on pool
+package workername
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Placeholders of template
+const (
+	POOL_USER     = "{pool_user}"
+	MINER_WORKER  = "{miner_worker}"
+	MINER_RIG     = "{miner_rig}"
+	IP            = "{ip}"
+	IP_LAST_OCTET = "{ip_last_octet}"
+)
+
+var placeholders = []string{POOL_USER, MINER_WORKER, MINER_RIG, IP, IP_LAST_OCTET}
+
+// What template can use about miner
+type Miner struct {
+	PoolUser string
+	Worker   string
+	IP       net.IP
+}
+
+// Template may use only known placeholders
+func Validate(template string) error {
+
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return errors.New("unclosed placeholder in worker template " + template)
+		}
+
+		placeholder := rest[start : start+end+1]
+		isKnown := false
+		for _, known := range placeholders {
+			isKnown = isKnown || placeholder == known
+		}
+
+		if !isKnown {
+			return errors.New("unknown placeholder " + placeholder + " in worker template " + template)
+		}
+
+		rest = rest[start+end+1:]
+	}
+
+	return nil
+}
+
+// Worker name by template, rig is the part of miner worker after its last dot
+func Name(template string, miner Miner) string {
+
+	rig := miner.Worker[strings.LastIndexByte(miner.Worker, '.')+1:]
+
+	ip, lastOctet := "", ""
+	if miner.IP != nil {
+		ip = miner.IP.String()
+
+		if ip4 := miner.IP.To4(); ip4 != nil {
+			lastOctet = strconv.Itoa(int(ip4[3]))
+		}
+	}
+
+	return strings.NewReplacer(
+		POOL_USER, miner.PoolUser,
+		MINER_WORKER, miner.Worker,
+		MINER_RIG, rig,
+		IP, ip,
+		IP_LAST_OCTET, lastOctet,
+	).Replace(template)
+}
@@ -0,0 +1,114 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/venuslog"
+	"btcminerproxy/workername"
+	"net"
+)
+
+// Miners get their own worker name on pool by mapping or template of the pool,
+// so pool shows every device. Dedicated upstream authorizes it instead of the
+// worker of miner, shared upstream authorizes it besides user of pool and miner
+// submits under user of pool until pool accepted it.
+
+// Worker name of miner on pool, mapping by worker name of miner goes before mapping by its IP
+func poolWorker(poolIndex uint64, conn *stratumserver.Connection) string {
+
+	pool := config.Get().Pool(poolIndex)
+	ip, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+
+	name, ok := pool.Workers[conn.WorkerID]
+	if !ok {
+		name, ok = pool.Workers[ip]
+	}
+	if !ok {
+		name = pool.WorkerTemplate
+	}
+
+	if name == "" {
+		return pool.User
+	}
+
+	return workername.Name(name, workername.Miner{
+		PoolUser: pool.User,
+		Worker:   conn.WorkerID,
+		IP:       net.ParseIP(ip),
+	})
+}
+
+// Worker name which submit of miner is sent with
+func (us *Upstream) submitWorker(conn *stratumserver.Connection) string {
+
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	name := poolWorker(us.PoolId, conn)
+
+	if us.Aggregated && !us.workers[name] {
+		return config.Get().Pool(us.PoolId).User
+	}
+
+	return name
+}
+
+// Authorize worker name of miner on shared upstream, once for every name
+func (us *Upstream) authorizeWorker(conn *stratumserver.Connection) {
+
+	us.mutex.Lock()
+	poolIndex := us.PoolId
+	name := poolWorker(poolIndex, conn)
+	_, isKnown := us.workers[name]
+	isNeeded := !isKnown && name != config.Get().Pool(poolIndex).User
+	if isNeeded {
+		us.workers[name] = false
+	}
+	us.mutex.Unlock()
+
+	if !isNeeded {
+		return
+	}
+
+	err := us.sendPending(&pendingRequest{
+		method: "mining.authorize",
+		worker: name,
+	}, []string{name, config.Get().Pool(poolIndex).Pass})
+
+	if err != nil {
+		venuslog.Warn("Failed to authorize worker", name, "on upstream", us.ID, err)
+	}
+}
+
+// Pool answered authorization of worker name, refused name stays unused
+func (us *Upstream) workerAuthorized(name string, resp template.StratumMsgResponse) {
+
+	authorized, _ := resp.Result.(bool)
+
+	us.mutex.Lock()
+	us.workers[name] = authorized && resp.Error == nil
+	us.mutex.Unlock()
+
+	if !authorized {
+		venuslog.Warn("Pool refused worker", name, "of upstream", us.ID, resp.Error)
+	}
+}
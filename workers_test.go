@@ -0,0 +1,149 @@
+/*
+ * BtcMinerProxy is a high-performance Cryptonote Stratum mining proxy.
+ * Copyright (C) 2023 Venusgalstar
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"btcminerproxy/config"
+	stratumserver "btcminerproxy/stratum/server"
+	"btcminerproxy/stratum/template"
+	"btcminerproxy/workername"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolWorker(t *testing.T) {
+
+	cfg := config.Get()
+	t.Cleanup(func() { config.Set(cfg) })
+
+	tests := []struct {
+		name     string
+		workers  map[string]string
+		template string
+		worker   string
+		ip       string
+		expected string
+	}{
+		{"mapped by worker", map[string]string{"farm.rig1": "pooluser.s19a", "10.0.0.1": "pooluser.byip"}, "{pool_user}.x", "farm.rig1", "10.0.0.1", "pooluser.s19a"},
+		{"mapped by ip", map[string]string{"farm.rig1": "pooluser.s19a", "10.0.0.1": "pooluser.byip"}, "{pool_user}.x", "farm.rig2", "10.0.0.1", "pooluser.byip"},
+		{"mapping with placeholders", map[string]string{"10.0.0.1": "{pool_user}.{ip_last_octet}"}, "", "farm.rig1", "10.0.0.1", "pooluser.1"},
+		{"template", map[string]string{"10.0.0.1": "pooluser.byip"}, "{pool_user}.{miner_rig}-{ip_last_octet}", "farm.rig1", "10.0.0.2", "pooluser.rig1-2"},
+		{"template of whole worker", nil, "{pool_user}.{miner_worker}", "farm.rig1", "10.0.0.2", "pooluser.farm.rig1"},
+		{"worker without dot", nil, "{pool_user}.{miner_rig}", "rig1", "10.0.0.2", "pooluser.rig1"},
+		{"ipv6", nil, "{pool_user}.{ip}{ip_last_octet}", "rig1", "2001:db8::1", "pooluser.2001:db8::1"},
+		{"neither mapping nor template", nil, "", "farm.rig1", "10.0.0.2", "pooluser"},
+	}
+
+	for _, test := range tests {
+
+		config.Set(&config.Config{Pools: []config.PoolInfo{{Url: "pool-a:3333", User: "pooluser", Workers: test.workers, WorkerTemplate: test.template}}})
+
+		conn := &stratumserver.Connection{
+			Conn:     &sv2PipeConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 4000}},
+			WorkerID: test.worker,
+		}
+
+		if name := poolWorker(0, conn); name != test.expected {
+			t.Errorf("%s: worker name is %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
+
+func TestWorkerTemplateValidate(t *testing.T) {
+	tests := []struct {
+		template string
+		isValid  bool
+	}{
+		{"", true},
+		{"pooluser.rig", true},
+		{"{pool_user}.{miner_worker}", true},
+		{"{pool_user}.{miner_rig}-{ip}-{ip_last_octet}", true},
+		{"{pool_user}.{worker}", false},
+		{"{pool_user}.{miner_rig", false},
+	}
+
+	for _, test := range tests {
+		if err := workername.Validate(test.template); (err == nil) != test.isValid {
+			t.Errorf("template %q: validate returned %v", test.template, err)
+		}
+	}
+}
+
+// Shared upstream authorizes worker name of miner once, miner submits under
+// user of pool until pool accepted the name
+func TestSharedUpstreamWorker(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		authorized bool
+		expected   string
+	}{
+		{"accepted", true, "pooluser.rig1"},
+		{"refused", false, "pooluser"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			us, conn, pool, _ := aggregatedUpstream(t, 2)
+			config.Update(func(cfg *config.Config) {
+				cfg.Pools[0].WorkerTemplate = "{pool_user}.{miner_rig}"
+			})
+			conn.WorkerID = "farm.rig1"
+
+			go us.authorizeWorker(conn)
+
+			var line string
+			select {
+			case line = <-pool:
+			case <-time.After(5 * time.Second):
+				t.Fatal("pool didn't get authorization of worker")
+			}
+
+			req := template.AuthorizeMsg{}
+			json.Unmarshal([]byte(line), &req)
+
+			if req.Method != "mining.authorize" || len(req.Params) != 2 || req.Params[0] != "pooluser.rig1" {
+				t.Fatalf("pool got %s", line)
+			}
+
+			if name := us.submitWorker(conn); name != "pooluser" {
+				t.Fatalf("miner submits as %s before pool answered", name)
+			}
+
+			us.handleResponse(req.ID, []byte(fmt.Sprintf(`{"id":%d,"result":%v,"error":null}`, req.ID, test.authorized)))
+
+			if name := us.submitWorker(conn); name != test.expected {
+				t.Fatalf("miner submits as %s, expected %s", name, test.expected)
+			}
+
+			// Name is authorized once for all miners of upstream
+			go us.authorizeWorker(conn)
+
+			select {
+			case line := <-pool:
+				t.Fatalf("pool got %s again", line)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}